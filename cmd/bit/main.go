@@ -1,156 +1,2368 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"bit/internal/core"
 	"bit/internal/util"
 )
 
+// jsonOutput is set by the global --json flag and switches list, log and
+// status to machine-readable output
+var jsonOutput bool
+
+// progressJSON, set by the global --progress-json flag, makes commands that
+// report progress write it to stderr as JSON events instead of drawing it
+var progressJSON bool
+
 func main() {
 	// Always enable compression for all deltas
 	util.CompressionConfig.Enabled = true
 	util.CompressionConfig.MinSizeForCompression = 1     // Compress all deltas regardless of size
 	util.CompressionConfig.CompressNewFileContent = true // Also compress full file content
 
-	if len(os.Args) < 2 {
-		printUsage()
-		os.Exit(1)
+	// Select the engine used for new deltas, e.g. "binary" for binary-heavy projects
+	if engine := os.Getenv("BIT_DELTA_ENGINE"); engine != "" {
+		if _, err := util.GetDeltaEngine(engine); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		util.DeltaEngineConfig.Engine = engine
+	}
+
+	os.Exit(run(streams{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}, os.Args[1:]))
+}
+
+// streams are the standard streams a command reads from and writes to, so
+// that tests can run commands against buffers
+type streams struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// run runs the command named by the first of args with the remaining
+// arguments and returns its exit code. Global flags may appear anywhere
+// before a "--" argument.
+func run(s streams, args []string) int {
+	// Global flags of an earlier run must not carry over
+	jsonOutput, progressJSON = false, false
+	args = stripGlobalFlags(args)
+	if len(args) < 1 {
+		printUsage(s.stdout)
+		return 1
 	}
 
-	command := os.Args[1]
+	command := args[0]
 
 	switch command {
 	case "init":
-		handleInit()
+		return handleInit(s, args[1:])
 	case "save":
-		handleSave()
+		return handleSave(s, args[1:])
+	case "snapshot":
+		return handleSnapshot(s, args[1:])
 	case "list":
-		handleList()
+		return handleList(s, args[1:])
+	case "log":
+		return handleLog(s, args[1:])
+	case "status":
+		return handleStatus(s, args[1:])
+	case "history":
+		return handleHistory(s, args[1:])
+	case "diff":
+		return handleDiff(s, args[1:])
+	case "diffstat":
+		return handleDiffStat(s, args[1:])
+	case "diff-saves":
+		return handleDiffSaves(s, args[1:])
+	case "grep":
+		return handleGrep(s, args[1:])
+	case "cat":
+		return handleCat(s, args[1:])
+	case "blame":
+		return handleBlame(s, args[1:])
 	case "checkout":
-		handleCheckout()
+		return handleCheckout(s, args[1:])
+	case "undo":
+		return handleUndo(s, args[1:])
+	case "stash":
+		return handleStash(s, args[1:])
+	case "reflog":
+		return handleReflog(s, args[1:])
 	case "now":
-		handleNow()
-	case "debug":
-		handleDebug()
+		return handleNow(s, args[1:])
+	case "tag":
+		return handleTag(s, args[1:])
+	case "tags":
+		return handleTags(s, args[1:])
+	case "branch":
+		return handleBranch(s, args[1:])
+	case "switch":
+		return handleSwitch(s, args[1:])
+	case "merge":
+		return handleMerge(s, args[1:])
+	case "export":
+		return handleExport(s, args[1:])
+	case "import":
+		return handleImport(s, args[1:])
+	case "bundle":
+		return handleBundle(s, args[1:])
+	case "unbundle":
+		return handleUnbundle(s, args[1:])
+	case "squash":
+		return handleSquash(s, args[1:])
+	case "size":
+		return handleSize(s, args[1:])
+	case "stats":
+		return handleStats(s, args[1:])
+	case "compact":
+		return handleCompact(s, args[1:])
+	case "repack":
+		return handleRepack(s, args[1:])
+	case "mv":
+		return handleMv(s, args[1:])
+	case "rm":
+		return handleRm(s, args[1:])
+	case "clean":
+		return handleClean(s, args[1:])
+	case "fsck":
+		return handleFsck(s, args[1:])
+	case "objects":
+		return handleObjects(s, args[1:])
+	case "doctor":
+		return handleDoctor(s, args[1:])
+	case "config":
+		return handleConfig(s, args[1:])
 	default:
-		fmt.Printf("Unknown command: %s\n", command)
-		printUsage()
-		os.Exit(1)
+		fmt.Fprintf(s.stdout, "Unknown command: %s\n", command)
+		printUsage(s.stdout)
+		return 1
+	}
+}
+
+// requireRepository prints the same message for every command when the
+// working directory is not inside a repository, and reports whether it is
+func requireRepository(s streams) bool {
+	if err := core.EnsureRepository(); err != nil {
+		fmt.Fprintf(s.stderr, "fatal: %v\n", err)
+		return false
+	}
+	return true
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: bit [--json] [--progress-json] <command> [options]")
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintln(w, "  init                Initialize a .bit repository (--dir <path> to keep its data elsewhere, --with-ignore for a starter .bitignore)")
+	fmt.Fprintln(w, "  save <name>         Save the current state with the given name (--verbose to show how files are stored, --allow-large to skip size limits, --no-compress to store content uncompressed, --include/--exclude <glob> to override .bitignore once, --name-from-file/--name-from-stdin to read the name, --amend-file <path> to store one file in the latest save)")
+	fmt.Fprintln(w, "  snapshot [suffix]   Save the current state named after the current time, e.g. snapshot-2024-06-01T14-30-00")
+	fmt.Fprintln(w, "  list                List all saved states (--branch <name> for the saves of a branch, --grep <text>, --reverse, --skip/--limit <n> to page, --files <hash> [--null] for the files of a save)")
+	fmt.Fprintln(w, "  log                 List saves with timestamps (--since/--until <time>, --branch <name>, --graph to draw history)")
+	fmt.Fprintln(w, "  status              Show files added, modified or deleted since the checked out save")
+	fmt.Fprintln(w, "  history <file>      List the saves in which a file changed")
+	fmt.Fprintln(w, "  diff [from] [to]    Show changes as a patch for git apply (working tree by default, --context <lines>, --name-only/--name-status to only list changed files)")
+	fmt.Fprintln(w, "  diffstat [a] [b]    Count the lines inserted and deleted in each changed file, like diff --stat")
+	fmt.Fprintln(w, "  diff-saves <a> <b>  List files added, removed or modified between two saves")
+	fmt.Fprintln(w, "  grep <pattern> [h]  Search file contents at a save, or the working tree (--ignore-case)")
+	fmt.Fprintln(w, "  cat <hash> <file>   Print a file as it was at a save (--binary to print binary content to a terminal)")
+	fmt.Fprintln(w, "  blame <file> [hash] Show the save that last changed each line of a file")
+	fmt.Fprintln(w, "  checkout <hash|tag> Restore files to the state of the given hash or tag (--paths <glob> to restore only matching files, --keep <glob> to leave untracked files in place, --into <dir> to write them elsewhere, --merge to keep unsaved changes)")
+	fmt.Fprintln(w, "  undo                Delete the latest save and check out the save before it (--force to discard unsaved changes)")
+	fmt.Fprintln(w, "  stash [list]        List the backups of unsaved changes taken before checkouts (pop [name] to restore one)")
+	fmt.Fprintln(w, "  reflog              List every save and checkout, including saves no longer checked out")
+	fmt.Fprintln(w, "  now                 Restore files to the latest saved state")
+	fmt.Fprintln(w, "  tag <hash> <name>   Tag the given save with a name (-d <name> to delete)")
+	fmt.Fprintln(w, "  tags                List all tags")
+	fmt.Fprintln(w, "  branch [name]       List branches, or start one at the checked out save")
+	fmt.Fprintln(w, "  switch <branch>     Check out a branch so that new saves extend it")
+	fmt.Fprintln(w, "  merge <hash|branch> Merge the changes of another save or branch into the checked out save")
+	fmt.Fprintln(w, "  export <hash>       Export a save as a tar archive (--output <file>, default stdout)")
+	fmt.Fprintln(w, "  import <tar> <name> Create a save from a tar archive")
+	fmt.Fprintln(w, "  bundle              Write the whole repository as one file (--output <file>, default stdout)")
+	fmt.Fprintln(w, "  unbundle <file>     Create a repository in the current directory from a bundle")
+	fmt.Fprintln(w, "  squash <from> <to>  Collapse a range of saves into one (--name <name>)")
+	fmt.Fprintln(w, "  size                Show the storage used by the repository and the largest saves (--top <n>)")
+	fmt.Fprintln(w, "  stats [hash|tag]    Show how many deltas rebuild each file of a save, deepest first (--top <n>)")
+	fmt.Fprintln(w, "  compact             Store files with long delta chains in full (--max-chain <n>)")
+	fmt.Fprintln(w, "  repack <file>       Rewrite the deltas of a file so that no version needs more than one")
+	fmt.Fprintln(w, "  mv <old> <new>      Rename a tracked file, recorded as a rename on the next save")
+	fmt.Fprintln(w, "  rm <file>           Stop tracking a file (--save <name> to save the removal)")
+	fmt.Fprintln(w, "  clean               Remove untracked files (requires --dry-run or --force)")
+	fmt.Fprintln(w, "  objects             List every stored object with its type, save, path and size, for debugging storage")
+	fmt.Fprintln(w, "  doctor              Check the health of the repository and show the ignore patterns in effect")
+	fmt.Fprintln(w, "  config [key] [val]  List the settings in effect (--list), show one, or change one after checking its value (--unset <key> to restore its default)")
+	fmt.Fprintln(w, "  fsck                Check that the repository metadata is readable (--rebuild to recover it, --orphans to list unreferenced objects, --verify to check every save)")
+}
+
+// stripGlobalFlags removes flags that apply to every command from args,
+// wherever they appear before a "--" argument. Arguments from "--" on are
+// left to the command, so that they can name a save --json, for instance.
+func stripGlobalFlags(args []string) []string {
+	stripped := make([]string, 0, len(args))
+	for i, arg := range args {
+		if arg == "--" {
+			return append(stripped, args[i:]...)
+		}
+		if arg == "--json" || arg == "-json" {
+			jsonOutput = true
+			continue
+		}
+		if arg == "--progress-json" || arg == "-progress-json" {
+			progressJSON = true
+			continue
+		}
+		stripped = append(stripped, arg)
 	}
+	return stripped
 }
 
-func printUsage() {
-	fmt.Println("Usage: bit <command> [options]")
-	fmt.Println("Commands:")
-	fmt.Println("  init                Initialize a .bit repository")
-	fmt.Println("  save <name>         Save the current state with the given name")
-	fmt.Println("  list                List all saved states")
-	fmt.Println("  checkout <hash>     Restore files to the state of the given hash")
-	fmt.Println("  now                 Restore files to the latest saved state")
+// saveJSON is the stable JSON representation of a save
+type saveJSON struct {
+	Hash      string   `json:"hash"`
+	Name      string   `json:"name"`
+	Timestamp string   `json:"timestamp"`
+	Files     []string `json:"files"`
+	Author    string   `json:"author,omitempty"`
+	Host      string   `json:"host,omitempty"`
 }
 
-func handleInit() {
-	err := core.InitRepository()
+// writeSavesJSON writes saves as a JSON array with RFC3339 timestamps
+func writeSavesJSON(w io.Writer, saves []core.Save) error {
+	out := make([]saveJSON, 0, len(saves))
+	for _, save := range saves {
+		files := save.Files
+		if files == nil {
+			files = []string{}
+		}
+		out = append(out, saveJSON{
+			Hash:      save.Hash,
+			Name:      save.Name,
+			Timestamp: save.Timestamp.Format(time.RFC3339),
+			Files:     files,
+			Author:    save.Author,
+			Host:      save.Host,
+		})
+	}
+	return json.NewEncoder(w).Encode(out)
+}
+
+func handleInit(s streams, args []string) int {
+	flags := newFlagSet(s, "init")
+	dir := flags.String("dir", "", "keep the repository data in this directory instead of .bit/")
+	withIgnore := flags.Bool("with-ignore", false, "write a starter .bitignore with common patterns")
+	if _, err := parseFlags(flags, args); err != nil {
+		return flagError(err)
+	}
+
+	location := ".bit/"
+	if *dir != "" {
+		if err := core.InitRepositoryAt(*dir); err != nil {
+			fmt.Fprintf(s.stdout, "Error initializing repository: %v\n", err)
+			return 1
+		}
+		location = *dir
+	} else if err := core.InitRepository(); err != nil {
+		fmt.Fprintf(s.stdout, "Error initializing repository: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(s.stdout, "Initialized empty bit repository in %s\n", location)
+
+	if *withIgnore {
+		written, err := core.WriteStarterIgnore()
+		if err != nil {
+			fmt.Fprintf(s.stdout, "Error: %v\n", err)
+			return 1
+		}
+		if written {
+			fmt.Fprintln(s.stdout, "Created .bitignore with common patterns")
+		} else {
+			fmt.Fprintln(s.stdout, "Kept the existing .bitignore")
+		}
+	}
+	return 0
+}
+
+func handleSave(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "save")
+	verbose := flags.Bool("verbose", false, "print how each file was stored")
+	allowLarge := flags.Bool("allow-large", false, "save files over the configured size limits")
+	allowEmpty := flags.Bool("allow-empty", false, "save even if nothing changed since the latest save")
+	allowCaseCollisions := flags.Bool("allow-case-collisions", false, "save paths that differ only in case")
+	noCompress := flags.Bool("no-compress", false, "store new file content uncompressed")
+	var include, exclude stringList
+	flags.Var(&include, "include", "save files matching the pattern even if ignored (repeatable)")
+	flags.Var(&exclude, "exclude", "leave files matching the pattern out of this save (repeatable)")
+	nameFile := flags.String("name-from-file", "", "read the save name from a file")
+	nameStdin := flags.Bool("name-from-stdin", false, "read the save name from standard input")
+	amendFile := flags.String("amend-file", "", "add or update a single file in the latest save instead of saving")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return flagError(err)
+	}
+
+	if *amendFile != "" {
+		if len(args) > 0 || *nameFile != "" || *nameStdin {
+			fmt.Fprintln(s.stdout, "Error: --amend-file keeps the name of the latest save")
+			return 1
+		}
+		save, err := core.AmendFile(*amendFile, *allowLarge)
+		if err != nil {
+			fmt.Fprintf(s.stdout, "Error amending save: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(s.stdout, "Amended save '%s' (%s) with %s\n", save.Name, save.Hash, *amendFile)
+		return 0
+	}
+
+	var name string
+	switch {
+	case (*nameFile != "" || *nameStdin) && (len(args) > 0 || *nameFile != "" && *nameStdin):
+		fmt.Fprintln(s.stdout, "Error: Give the save name only once, as arguments, with --name-from-file or with --name-from-stdin")
+		return 1
+	case *nameFile != "":
+		file, err := os.Open(*nameFile)
+		if err != nil {
+			fmt.Fprintf(s.stdout, "Error reading save name: %v\n", err)
+			return 1
+		}
+		name, err = readSaveName(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprintf(s.stdout, "Error reading save name: %v\n", err)
+			return 1
+		}
+	case *nameStdin:
+		var err error
+		if name, err = readSaveName(s.stdin); err != nil {
+			fmt.Fprintf(s.stdout, "Error reading save name: %v\n", err)
+			return 1
+		}
+	default:
+		name = strings.Join(args, " ")
+	}
+
+	if name == "" {
+		fmt.Fprintln(s.stdout, "Error: Save name required")
+		fmt.Fprintln(s.stdout, "Usage: bit save [--verbose] [--allow-large] [--allow-empty] [--no-compress] [--allow-case-collisions] [--include <glob>] [--exclude <glob>] <name> | --name-from-file <file> | --name-from-stdin | --amend-file <path>")
+		return 1
+	}
+
+	// Only this save is stored uncompressed, not those of later runs
+	if *noCompress {
+		enabled := util.CompressionConfig.Enabled
+		util.CompressionConfig.Enabled = false
+		defer func() { util.CompressionConfig.Enabled = enabled }()
+	}
+
+	progress, finish := commandProgress(s, "save")
+	opts := core.SaveOptions{
+		AllowLarge:          *allowLarge,
+		AllowEmpty:          *allowEmpty,
+		AllowCaseCollisions: *allowCaseCollisions,
+		Include:             include,
+		Exclude:             exclude,
+		Progress:            progress,
+	}
+	if *verbose {
+		opts.Report = func(file core.FileReport) {
+			printFileReport(s.stdout, file)
+		}
+	}
+	hash, err := core.SaveStateWithOptions(name, opts)
+	if errors.Is(err, core.ErrNothingToSave) {
+		finish(nil)
+		fmt.Fprintln(s.stdout, "Nothing changed since the latest save, not saving (use --allow-empty to save anyway)")
+		return 0
+	}
+	finish(err)
+	if err != nil && hash == "" {
+		fmt.Fprintf(s.stdout, "Error saving state: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(s.stdout, "Saved state '%s' with hash %s\n", name, hash)
 	if err != nil {
-		fmt.Printf("Error initializing repository: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(s.stdout, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// snapshotTimeFormat names snapshots after the time they were taken, without
+// characters that are awkward in file names
+const snapshotTimeFormat = "2006-01-02T15-04-05"
+
+// snapshotName returns the name of a snapshot taken at t, ending in suffix
+// when it is not empty
+func snapshotName(t time.Time, suffix string) string {
+	name := "snapshot-" + t.Format(snapshotTimeFormat)
+	if suffix != "" {
+		name += "-" + suffix
 	}
-	fmt.Println("Initialized empty bit repository in .bit/")
+	return name
 }
 
-func handleSave() {
-	if len(os.Args) < 3 {
-		fmt.Println("Error: Save name required")
-		fmt.Println("Usage: bit save <name>")
-		os.Exit(1)
+func handleSnapshot(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "snapshot")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return flagError(err)
+	}
+	if len(args) > 1 {
+		fmt.Fprintln(s.stdout, "Usage: bit snapshot [suffix]")
+		return 1
+	}
+
+	var suffix string
+	if len(args) == 1 {
+		suffix = args[0]
+	}
+	name := snapshotName(time.Now(), suffix)
+	progress, finish := commandProgress(s, "snapshot")
+	hash, err := core.SaveStateWithOptions(name, core.SaveOptions{Progress: progress})
+	if errors.Is(err, core.ErrNothingToSave) {
+		finish(nil)
+		fmt.Fprintln(s.stdout, "Nothing changed since the latest save, not saving")
+		return 0
 	}
-	name := strings.Join(os.Args[2:], " ")
-	hash, err := core.SaveState(name)
+	finish(err)
+	if err != nil && hash == "" {
+		fmt.Fprintf(s.stdout, "Error saving state: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(s.stdout, "Saved state '%s' with hash %s\n", name, hash)
 	if err != nil {
-		fmt.Printf("Error saving state: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(s.stdout, "Error: %v\n", err)
+		return 1
 	}
-	fmt.Printf("Saved state '%s' with hash %s\n", name, hash)
+	return 0
 }
 
-func handleList() {
-	saves, err := core.ListSaves()
+// readSaveName reads a save name, like git commit -F reads a message, keeping
+// everything but a single trailing newline
+func readSaveName(r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSuffix(string(data), "\n")
+	return strings.TrimSuffix(name, "\r"), nil
+}
+
+// progressInterval is the least time between two progress updates
+const progressInterval = 100 * time.Millisecond
+
+// terminalProgress returns a progress callback drawing on stderr, or nil when
+// stderr is not a terminal so that logs and pipes stay clean
+func terminalProgress(stderr io.Writer) core.ProgressFunc {
+	if !isTerminal(stderr) {
+		return nil
+	}
+	return progressPrinter(stderr, progressInterval)
+}
+
+// isTerminal reports whether w is a terminal rather than a file, pipe or buffer
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressPrinter returns a progress callback that redraws a "[n/total] path"
+// line on w at most once per interval. The last file is always drawn, followed
+// by a newline.
+func progressPrinter(w io.Writer, interval time.Duration) core.ProgressFunc {
+	var last time.Time
+	return func(done, total int, path string) {
+		now := time.Now()
+		if done < total && now.Sub(last) < interval {
+			return
+		}
+		last = now
+
+		fmt.Fprintf(w, "\r\033[K[%d/%d] %s", done, total, path)
+		if done == total {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// progressEvent is one line of the --progress-json stream. Every command
+// writes a start event, a file event as each file is processed and a done or
+// error event once it has finished.
+type progressEvent struct {
+	Type    string `json:"type"` // start, file, done or error
+	Command string `json:"command"`
+	Done    int    `json:"done,omitempty"`  // Files processed so far
+	Total   int    `json:"total,omitempty"` // Files the command processes
+	Path    string `json:"path,omitempty"`  // File just processed
+	Error   string `json:"error,omitempty"`
+}
+
+// commandProgress returns the progress callback of command and a function to
+// call with the outcome of the command once it has finished. With
+// --progress-json the events of command are written to stderr; otherwise
+// progress is drawn on a terminal and finish does nothing.
+func commandProgress(s streams, command string) (progress core.ProgressFunc, finish func(err error)) {
+	if !progressJSON {
+		return terminalProgress(s.stderr), func(error) {}
+	}
+
+	encoder := json.NewEncoder(s.stderr)
+	encoder.Encode(progressEvent{Type: "start", Command: command})
+	progress = func(done, total int, path string) {
+		encoder.Encode(progressEvent{Type: "file", Command: command, Done: done, Total: total, Path: path})
+	}
+	finish = func(err error) {
+		if err != nil {
+			encoder.Encode(progressEvent{Type: "error", Command: command, Error: err.Error()})
+			return
+		}
+		encoder.Encode(progressEvent{Type: "done", Command: command})
+	}
+	return progress, finish
+}
+
+// printFileReport prints one line describing how a file was stored
+func printFileReport(w io.Writer, file core.FileReport) {
+	fmt.Fprintf(w, "%-9s %-5s chain %-3d %10d bytes %10d stored  %s\n",
+		file.Change, file.Stored, file.ChainDepth, file.Size, file.StoredSize, file.Path)
+}
+
+func handleList(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "list")
+	branch := flags.String("branch", "", "only list the saves of this branch")
+	limit := flags.Int("limit", 0, "list at most this many saves")
+	skip := flags.Int("skip", 0, "skip this many saves before listing")
+	grep := flags.String("grep", "", "only list saves whose name contains this text")
+	reverse := flags.Bool("reverse", false, "list the newest save first")
+	files := flags.String("files", "", "only print the files tracked by this save, one per line")
+	null := flags.Bool("null", false, "with --files, end each path with a NUL byte instead of a newline")
+	if _, err := parseFlags(flags, args); err != nil {
+		return flagError(err)
+	}
+
+	if *files != "" {
+		return listFiles(s, *files, *null)
+	}
+	if *null {
+		fmt.Fprintln(s.stdout, "Error: --null only applies to --files")
+		return 1
+	}
+
+	saves, err := core.ListSavesFiltered(core.ListOptions{
+		Branch:  *branch,
+		Name:    *grep,
+		Reverse: *reverse,
+		Offset:  *skip,
+		Limit:   *limit,
+	})
 	if err != nil {
-		fmt.Printf("Error listing saves: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(s.stdout, "Error listing saves: %v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		if err := writeSavesJSON(s.stdout, saves); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
 	}
 
 	if len(saves) == 0 {
-		fmt.Println("No saves found")
-		return
+		fmt.Fprintln(s.stdout, "No saves found")
+		return 0
 	}
 
-	fmt.Println("Saves:")
+	fmt.Fprintln(s.stdout, "Saves:")
 	for _, save := range saves {
-		fmt.Printf("  %s  %s\n", save.Hash, save.Name)
+		fmt.Fprintf(s.stdout, "  %s  %s\n", save.Hash, save.Name)
 	}
+	return 0
 }
 
-func handleCheckout() {
-	if len(os.Args) < 3 {
-		fmt.Println("Error: Save hash required")
-		fmt.Println("Usage: bit checkout <hash>")
-		os.Exit(1)
+// listFiles prints the paths tracked by the save referenced by hash, as is so
+// they can be piped into other tools
+func listFiles(s streams, hash string, null bool) int {
+	files, err := core.SaveFiles(hash)
+	if err != nil {
+		fmt.Fprintf(s.stderr, "Error listing files: %v\n", err)
+		return 1
 	}
 
-	hash := os.Args[2]
-	err := core.Checkout(hash)
-	if err != nil {
-		fmt.Printf("Error checking out save: %v\n", err)
-		os.Exit(1)
+	if jsonOutput {
+		if files == nil {
+			files = []string{}
+		}
+		if err := json.NewEncoder(s.stdout).Encode(files); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	terminator := "\n"
+	if null {
+		terminator = "\x00"
+	}
+	for _, file := range files {
+		fmt.Fprint(s.stdout, file+terminator)
 	}
-	fmt.Printf("Successfully checked out save with hash %s\n", hash)
+	return 0
 }
 
-func handleNow() {
-	saves, err := core.ListSaves()
+func handleLog(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "log")
+	sinceFlag := flags.String("since", "", "only show saves at or after this time")
+	untilFlag := flags.String("until", "", "only show saves at or before this time")
+	branch := flags.String("branch", "", "only show the saves of this branch")
+	graph := flags.Bool("graph", false, "draw how saves descend from each other, newest first")
+	if _, err := parseFlags(flags, args); err != nil {
+		return flagError(err)
+	}
+
+	var since, until time.Time
+	var err error
+	if *sinceFlag != "" {
+		if since, err = parseTime(*sinceFlag, false); err != nil {
+			fmt.Fprintf(s.stdout, "Error: %v\n", err)
+			return 1
+		}
+	}
+	if *untilFlag != "" {
+		if until, err = parseTime(*untilFlag, true); err != nil {
+			fmt.Fprintf(s.stdout, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	saves, err := core.LogBranch(*branch, since, until)
 	if err != nil {
-		fmt.Printf("Error listing saves: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(s.stdout, "Error listing saves: %v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		if err := writeSavesJSON(s.stdout, saves); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
 	}
 
 	if len(saves) == 0 {
-		fmt.Println("No saves found")
-		return
+		fmt.Fprintln(s.stdout, "No saves found")
+		return 0
 	}
 
-	// Get the latest save (last in the list)
-	latestSave := saves[len(saves)-1]
-	err = core.Checkout(latestSave.Hash)
+	if *graph {
+		writeGraph(s.stdout, saves)
+		return 0
+	}
+	for _, save := range saves {
+		line := fmt.Sprintf("  %s  %s  %s", save.Hash, save.Timestamp.Local().Format("2006-01-02 15:04:05"), save.Name)
+		if by := madeBy(save); by != "" {
+			line += "  (" + by + ")"
+		}
+		fmt.Fprintln(s.stdout, line)
+	}
+	return 0
+}
+
+// madeBy describes who made a save and where as author@host, or as much of
+// it as was recorded
+func madeBy(save core.Save) string {
+	switch {
+	case save.Author != "" && save.Host != "":
+		return save.Author + "@" + save.Host
+	case save.Author != "":
+		return save.Author
+	default:
+		return save.Host
+	}
+}
+
+// writeGraph draws saves, given oldest first, newest first with one column of
+// "|" per line of history, as git log --graph does. A "*" marks the column of
+// each save, "\" where a merge brings in another line and "/" where lines
+// branched from the same save join up again. Parents not among saves end
+// their line.
+func writeGraph(w io.Writer, saves []core.Save) {
+	listed := make(map[string]bool, len(saves))
+	for _, save := range saves {
+		listed[save.Hash] = true
+	}
+
+	// columns holds the hash of the save expected next in each line. Column i
+	// is drawn at position 2i, and lines moving between columns in between.
+	var columns []string
+	connector := func(draw func(line []byte)) {
+		line := []byte(strings.Repeat(" ", 2*len(columns)))
+		draw(line)
+		fmt.Fprintln(w, strings.TrimRight(string(line), " "))
+	}
+	// remove drops column i, joined to the one on its left when join is set,
+	// and moves the columns after it left
+	remove := func(i int, join bool) {
+		if join || i < len(columns)-1 {
+			connector(func(line []byte) {
+				for j := range columns {
+					switch {
+					case j < i:
+						line[2*j] = '|'
+					case j > i || join:
+						line[2*j-1] = '/'
+					}
+				}
+			})
+		}
+		columns = append(columns[:i], columns[i+1:]...)
+	}
+
+	for n := len(saves) - 1; n >= 0; n-- {
+		save := saves[n]
+		col := -1
+		for i, hash := range columns {
+			if hash == save.Hash {
+				col = i
+				break
+			}
+		}
+		if col < 0 {
+			col = len(columns)
+			columns = append(columns, save.Hash)
+		}
+
+		marks := make([]string, len(columns))
+		for i := range marks {
+			marks[i] = "|"
+		}
+		marks[col] = "*"
+		line := strings.Join(marks, " ")
+		fmt.Fprintf(w, "%s  %s  %s  %s\n", line, save.Hash, save.Timestamp.Local().Format("2006-01-02 15:04:05"), save.Name)
+
+		var parents []string
+		for _, parent := range save.Parents() {
+			if listed[parent] {
+				parents = append(parents, parent)
+			}
+		}
+		if len(parents) == 0 {
+			remove(col, false)
+			continue
+		}
+
+		// The base continues this line and merged saves start new ones next
+		// to it, unless a line already leads to them
+		columns[col] = parents[0]
+		at := col + 1
+		for _, parent := range parents[1:] {
+			exists := false
+			for _, hash := range columns {
+				exists = exists || hash == parent
+			}
+			if exists {
+				continue
+			}
+			columns = append(columns[:at], append([]string{parent}, columns[at:]...)...)
+			connector(func(line []byte) {
+				for j := range columns {
+					if j < at {
+						line[2*j] = '|'
+					} else {
+						line[2*j-1] = '\\'
+					}
+				}
+			})
+			at++
+		}
+
+		// Lines that now lead to the same save join the leftmost of them
+		for i := 0; i < len(columns); i++ {
+			for j := i + 1; j < len(columns); {
+				if columns[j] == columns[i] {
+					remove(j, true)
+					continue
+				}
+				j++
+			}
+		}
+	}
+}
+
+// timeLayouts are the formats accepted by parseTime, most specific first
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTime parses a time given on the command line in local time unless a
+// zone is included. A date without a time refers to the start of that day,
+// or to its last instant when endOfDay is set so that ranges stay inclusive.
+func parseTime(value string, endOfDay bool) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err != nil {
+			continue
+		}
+		if layout == "2006-01-02" && endOfDay {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC3339 or YYYY-MM-DD", value)
+}
+
+func handleStatus(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	status, err := core.GetStatus()
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error reading status: %v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(status); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if status.Head != "" {
+		fmt.Fprintf(s.stdout, "On save %s\n", status.Head)
+	}
+	if len(status.Added)+len(status.Modified)+len(status.Deleted) == 0 {
+		fmt.Fprintln(s.stdout, "No changes since the checked out save")
+		return 0
+	}
+
+	for _, file := range status.Added {
+		fmt.Fprintf(s.stdout, "  added:    %s\n", file)
+	}
+	for _, file := range status.Modified {
+		fmt.Fprintf(s.stdout, "  modified: %s\n", file)
+	}
+	for _, file := range status.Deleted {
+		fmt.Fprintf(s.stdout, "  deleted:  %s\n", file)
+	}
+	return 0
+}
+
+func handleHistory(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	if len(args) < 1 {
+		fmt.Fprintln(s.stdout, "Error: File path required")
+		fmt.Fprintln(s.stdout, "Usage: bit history <file>")
+		return 1
+	}
+
+	history, err := core.FileHistory(args[0])
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error reading file history: %v\n", err)
+		return 1
+	}
+
+	if len(history) == 0 {
+		fmt.Fprintf(s.stdout, "No saves contain %s\n", args[0])
+		return 0
+	}
+
+	for _, change := range history {
+		fmt.Fprintf(s.stdout, "  %s  %-8s  %s\n", change.Save.Hash, change.Change, change.Save.Name)
+	}
+	return 0
+}
+
+func handleDiff(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "diff")
+	context := flags.Int("context", util.DefaultContextLines, "number of unchanged lines shown around each change")
+	nameOnly := flags.Bool("name-only", false, "only list the paths of changed files")
+	nameStatus := flags.Bool("name-status", false, "only list changed files with A, M or D for added, modified or deleted")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return flagError(err)
+	}
+
+	if len(args) > 2 {
+		fmt.Fprintln(s.stdout, "Error: At most two saves can be compared")
+		fmt.Fprintln(s.stdout, "Usage: bit diff [--context <lines> | --name-only | --name-status] [<from> [<to>]]")
+		return 1
+	}
+	var from, to string
+	if len(args) > 0 {
+		from = args[0]
+	}
+	if len(args) > 1 {
+		to = args[1]
+	}
+
+	if *nameOnly || *nameStatus {
+		if *nameOnly && *nameStatus {
+			fmt.Fprintln(s.stdout, "Error: --name-only and --name-status cannot be combined")
+			return 1
+		}
+		changes, err := core.ChangedFiles(from, to)
+		if err != nil {
+			fmt.Fprintf(s.stderr, "Error computing diff: %v\n", err)
+			return 1
+		}
+		if jsonOutput {
+			if err := json.NewEncoder(s.stdout).Encode(changes); err != nil {
+				fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+				return 1
+			}
+			return 0
+		}
+		writeNameStatus(s.stdout, changes, *nameStatus)
+		return 0
+	}
+
+	patch, err := core.Diff(from, to, *context)
 	if err != nil {
-		fmt.Printf("Error checking out latest save: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(s.stderr, "Error computing diff: %v\n", err)
+		return 1
+	}
+	fmt.Fprint(s.stdout, patch)
+	return 0
+}
+
+// writeNameStatus lists the files of changes in path order, one per line,
+// preceded by A, M or D and a tab when withStatus is set, as git diff
+// --name-status does
+func writeNameStatus(w io.Writer, changes *core.ChangeSet, withStatus bool) {
+	status := make(map[string]string)
+	for letter, files := range map[string][]string{"A": changes.Added, "M": changes.Modified, "D": changes.Removed} {
+		for _, file := range files {
+			status[file] = letter
+		}
+	}
+	files := make([]string, 0, len(status))
+	for file := range status {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		if withStatus {
+			fmt.Fprintf(w, "%s\t%s\n", status[file], file)
+		} else {
+			fmt.Fprintln(w, file)
+		}
 	}
-	fmt.Printf("Successfully checked out latest save '%s' with hash %s\n", latestSave.Name, latestSave.Hash)
 }
 
-func handleDebug() {
-	// Test ignore patterns
-	patterns, err := util.GetIgnorePatterns(".bitignore")
+func handleDiffStat(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	if len(args) > 2 {
+		fmt.Fprintln(s.stdout, "Error: At most two saves can be compared")
+		fmt.Fprintln(s.stdout, "Usage: bit diffstat [<from> [<to>]]")
+		return 1
+	}
+	var from, to string
+	if len(args) > 0 {
+		from = args[0]
+	}
+	if len(args) > 1 {
+		to = args[1]
+	}
+
+	stats, err := core.DiffStat(from, to)
 	if err != nil {
-		fmt.Printf("Error loading ignore patterns: %v\n", err)
+		fmt.Fprintf(s.stdout, "Error computing diffstat: %v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(stats); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	writeDiffStat(s.stdout, stats)
+	return 0
+}
+
+// diffStatWidth is the most characters the +/- bar of a file takes in diffstat
+const diffStatWidth = 40
+
+// writeDiffStat prints one line per file with its number of changed lines and
+// a bar of "+" and "-", scaled down when the largest change does not fit in
+// diffStatWidth, followed by the totals, like git diff --stat
+func writeDiffStat(w io.Writer, stats []core.FileStat) {
+	if len(stats) == 0 {
 		return
 	}
 
-	// Test a few paths
-	paths := []string{
-		"test.log",
-		"subfolder/test.log",
-		"random.txt",
-		".bitignore",
+	nameWidth, most, insertions, deletions := 0, 0, 0, 0
+	binary := false
+	for _, stat := range stats {
+		nameWidth = max(nameWidth, len(stat.Path))
+		most = max(most, stat.Insertions+stat.Deletions)
+		insertions += stat.Insertions
+		deletions += stat.Deletions
+		binary = binary || stat.Binary
+	}
+	countWidth := len(fmt.Sprint(most))
+	if binary {
+		countWidth = max(countWidth, len("Bin"))
+	}
+
+	// scale shrinks a count to its share of the bar, keeping at least one
+	// character for any change
+	scale := func(n int) int {
+		if most <= diffStatWidth || n == 0 {
+			return n
+		}
+		return max(1, n*diffStatWidth/most)
+	}
+
+	for _, stat := range stats {
+		if stat.Binary {
+			fmt.Fprintf(w, " %-*s | %*s\n", nameWidth, stat.Path, countWidth, "Bin")
+			continue
+		}
+		bar := strings.Repeat("+", scale(stat.Insertions)) + strings.Repeat("-", scale(stat.Deletions))
+		fmt.Fprintf(w, " %-*s | %*d %s\n", nameWidth, stat.Path, countWidth, stat.Insertions+stat.Deletions, bar)
+	}
+
+	plural := func(n int, word string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, word)
+		}
+		return fmt.Sprintf("%d %ss", n, word)
+	}
+	summary := " " + plural(len(stats), "file") + " changed"
+	if insertions > 0 {
+		summary += ", " + plural(insertions, "insertion") + "(+)"
+	}
+	if deletions > 0 {
+		summary += ", " + plural(deletions, "deletion") + "(-)"
+	}
+	fmt.Fprintln(w, summary)
+}
+
+func handleDiffSaves(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	if len(args) < 2 {
+		fmt.Fprintln(s.stdout, "Error: Two saves required")
+		fmt.Fprintln(s.stdout, "Usage: bit diff-saves <hashA> <hashB>")
+		return 1
+	}
+
+	changes, err := core.CompareSaves(args[0], args[1])
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error comparing saves: %v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(changes); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(s.stdout, "%s..%s: %d added, %d removed, %d modified\n",
+		changes.From, changes.To, len(changes.Added), len(changes.Removed), len(changes.Modified))
+	for _, file := range changes.Added {
+		fmt.Fprintf(s.stdout, "  added:    %s\n", file)
+	}
+	for _, file := range changes.Removed {
+		fmt.Fprintf(s.stdout, "  removed:  %s\n", file)
+	}
+	for _, file := range changes.Modified {
+		fmt.Fprintf(s.stdout, "  modified: %s\n", file)
+	}
+	return 0
+}
+
+func handleGrep(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "grep")
+	ignoreCase := flags.Bool("ignore-case", false, "match without regard to case")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return flagError(err)
+	}
+
+	if len(args) < 1 {
+		fmt.Fprintln(s.stdout, "Error: Pattern required")
+		fmt.Fprintln(s.stdout, "Usage: bit grep [--ignore-case] <pattern> [hash|tag]")
+		return 1
+	}
+
+	pattern := args[0]
+	if *ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	var hash string
+	if len(args) > 1 {
+		hash = args[1]
+	}
+
+	matches, err := core.Grep(pattern, hash)
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error searching files: %v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(matches); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	for _, match := range matches {
+		fmt.Fprintf(s.stdout, "%s:%d:%s\n", match.Path, match.Line, match.Text)
+	}
+	if len(matches) == 0 {
+		return 1
+	}
+	return 0
+}
+
+func handleCat(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "cat")
+	binary := flags.Bool("binary", false, "print binary content even when stdout is a terminal")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return flagError(err)
+	}
+
+	// Errors go to stderr so they never mix with the file content
+	if len(args) < 2 {
+		fmt.Fprintln(s.stderr, "Error: Save hash and file path required")
+		fmt.Fprintln(s.stderr, "Usage: bit cat [--binary] <hash|tag> <file>")
+		return 1
+	}
+
+	content, err := core.CatFile(args[0], args[1])
+	if err != nil {
+		fmt.Fprintf(s.stderr, "Error reading file: %v\n", err)
+		return 1
+	}
+
+	if !*binary && core.IsBinary(content) && isTerminal(s.stdout) {
+		fmt.Fprintf(s.stderr, "Error: %s is binary, redirect the output or pass --binary to print it\n", args[1])
+		return 1
+	}
+
+	if _, err := s.stdout.Write(content); err != nil {
+		fmt.Fprintf(s.stderr, "Error writing file: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func handleBlame(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
 	}
 
-	fmt.Println("Testing ignore patterns:")
-	for _, path := range paths {
-		ignored := util.IsIgnored(path, patterns)
-		fmt.Printf("  %s: %v\n", path, ignored)
+	if len(args) < 1 {
+		fmt.Fprintln(s.stdout, "Error: File path required")
+		fmt.Fprintln(s.stdout, "Usage: bit blame <file> [hash|tag]")
+		return 1
+	}
+	hash := ""
+	if len(args) > 1 {
+		hash = args[1]
+	}
+
+	lines, err := core.Annotate(args[0], hash)
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error annotating file: %v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(lines); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	width := len(fmt.Sprint(len(lines)))
+	for _, line := range lines {
+		fmt.Fprintf(s.stdout, "%s  %*d  %s\n", line.Hash[:min(8, len(line.Hash))], width, line.Number, line.Line)
+	}
+	return 0
+}
+
+func handleCheckout(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "checkout")
+	paths := flags.String("paths", "", "only restore files matching this glob, e.g. 'src/**'")
+	into := flags.String("into", "", "write the save's files under this directory instead of the working tree")
+	merge := flags.Bool("merge", false, "carry unsaved changes over to the save, merging them into its files")
+	var keep stringList
+	flags.Var(&keep, "keep", "leave files matching the pattern in place although they are not in the save (repeatable)")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return flagError(err)
+	}
+
+	if len(args) < 1 {
+		fmt.Fprintln(s.stdout, "Error: Save hash required")
+		fmt.Fprintln(s.stdout, "Usage: bit checkout [--paths <glob>] [--keep <glob>] [--into <dir>] [--merge] <hash|tag>")
+		return 1
+	}
+
+	if *merge && (*paths != "" || len(keep) > 0 || *into != "") {
+		fmt.Fprintln(s.stdout, "Error: --merge cannot be combined with --paths, --keep or --into")
+		return 1
+	}
+	if *into != "" && (*paths != "" || len(keep) > 0) {
+		fmt.Fprintln(s.stdout, "Error: --paths and --keep cannot be combined with --into")
+		return 1
+	}
+
+	hash := args[0]
+	if *into != "" {
+		if err := core.CheckoutInto(hash, *into); err != nil {
+			fmt.Fprintf(s.stdout, "Error checking out save: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(s.stdout, "Successfully wrote save with hash %s to %s\n", hash, *into)
+		return 0
+	}
+	if *merge {
+		progress, finish := commandProgress(s, "checkout")
+		conflicts, err := core.CheckoutMerge(hash, progress)
+		finish(err)
+		if err != nil {
+			fmt.Fprintf(s.stdout, "Error checking out save: %v\n", err)
+			return 1
+		}
+		if len(conflicts) == 0 {
+			fmt.Fprintf(s.stdout, "Successfully checked out save with hash %s, keeping unsaved changes\n", hash)
+			return 0
+		}
+		fmt.Fprintf(s.stdout, "Checked out save with hash %s, but unsaved changes conflict in:\n", hash)
+		for _, file := range conflicts {
+			fmt.Fprintf(s.stdout, "  %s\n", file)
+		}
+		fmt.Fprintln(s.stdout, "Resolve them before saving; 'bit stash list' shows the backup of the changes as they were")
+		return 1
+	}
+	progress, finish := commandProgress(s, "checkout")
+	err = core.CheckoutPaths(hash, *paths, keep, progress)
+	finish(err)
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error checking out save: %v\n", err)
+		return 1
+	}
+	if *paths != "" {
+		fmt.Fprintf(s.stdout, "Successfully restored %s from save with hash %s\n", *paths, hash)
+		return 0
+	}
+	fmt.Fprintf(s.stdout, "Successfully checked out save with hash %s\n", hash)
+	return 0
+}
+
+func handleUndo(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "undo")
+	force := flags.Bool("force", false, "discard unsaved changes")
+	if _, err := parseFlags(flags, args); err != nil {
+		return flagError(err)
+	}
+
+	undone, err := core.Undo(*force)
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error undoing save: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(s.stdout, "Deleted save '%s' (%s) and checked out %s\n", undone.Name, undone.Hash, undone.BaseSaveHash)
+	return 0
+}
+
+func handleStash(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	if len(args) > 0 && args[0] == "pop" {
+		var name string
+		if len(args) > 1 {
+			name = args[1]
+		}
+		stash, err := core.PopStash(name)
+		if err != nil {
+			fmt.Fprintf(s.stdout, "Error popping stash: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(s.stdout, "Restored stash %s taken before %s\n", stash.Name, stash.Command)
+		return 0
+	}
+	if len(args) > 0 && args[0] != "list" {
+		fmt.Fprintf(s.stdout, "Unknown stash command: %s\n", args[0])
+		fmt.Fprintln(s.stdout, "Usage: bit stash [list | pop [name]]")
+		return 1
+	}
+
+	stashes, err := core.Stashes()
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error listing stashes: %v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(stashes); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if len(stashes) == 0 {
+		fmt.Fprintln(s.stdout, "No stashes found")
+		return 0
+	}
+
+	fmt.Fprintln(s.stdout, "Stashes:")
+	for _, stash := range stashes {
+		head := stash.Head
+		if head == "" {
+			head = "no save"
+		}
+		fmt.Fprintf(s.stdout, "  %s  before %s, on %s (%d files)\n", stash.Name, stash.Command, head, len(stash.Save.Files))
+	}
+	return 0
+}
+
+func handleReflog(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	entries, err := core.Reflog()
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error reading reflog: %v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(entries); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if len(entries) == 0 {
+		fmt.Fprintln(s.stdout, "No reflog entries found")
+		return 0
+	}
+
+	for _, entry := range entries {
+		from := entry.From
+		if from == "" {
+			from = "(none)"
+		}
+		fmt.Fprintf(s.stdout, "  %s  %-8s  %s -> %s\n", entry.Timestamp.Local().Format("2006-01-02 15:04:05"), entry.Command, from, entry.To)
+	}
+	return 0
+}
+
+func handleNow(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	saves, err := core.ListSaves()
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error listing saves: %v\n", err)
+		return 1
+	}
+
+	if len(saves) == 0 {
+		fmt.Fprintln(s.stdout, "No saves found")
+		return 0
+	}
+
+	head, err := core.Head()
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error reading checked out save: %v\n", err)
+		return 1
+	}
+
+	// Get the latest save (last in the list)
+	latestSave := saves[len(saves)-1]
+	err = core.Checkout(latestSave.Hash)
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error checking out latest save: %v\n", err)
+		return 1
+	}
+	if head != latestSave.Hash {
+		fmt.Fprintf(s.stdout, "Moved from save %s to the latest save\n", head)
+	}
+	fmt.Fprintf(s.stdout, "Successfully checked out latest save '%s' with hash %s\n", latestSave.Name, latestSave.Hash)
+	return 0
+}
+
+func handleTag(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	if len(args) == 2 && args[0] == "-d" {
+		if err := core.RemoveTag(args[1]); err != nil {
+			fmt.Fprintf(s.stdout, "Error removing tag: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(s.stdout, "Removed tag '%s'\n", args[1])
+		return 0
+	}
+
+	if len(args) < 2 {
+		fmt.Fprintln(s.stdout, "Error: Save hash and tag name required")
+		fmt.Fprintln(s.stdout, "Usage: bit tag <hash> <name>")
+		fmt.Fprintln(s.stdout, "       bit tag -d <name>")
+		return 1
+	}
+
+	hash, name := args[0], args[1]
+	if err := core.AddTag(hash, name); err != nil {
+		fmt.Fprintf(s.stdout, "Error adding tag: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(s.stdout, "Tagged save %s as '%s'\n", hash, name)
+	return 0
+}
+
+func handleTags(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	tags, err := core.ListTags()
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error listing tags: %v\n", err)
+		return 1
+	}
+
+	if len(tags) == 0 {
+		fmt.Fprintln(s.stdout, "No tags found")
+		return 0
+	}
+
+	fmt.Fprintln(s.stdout, "Tags:")
+	for _, tag := range tags {
+		fmt.Fprintf(s.stdout, "  %s  %s\n", tag.Hash, tag.Name)
+	}
+	return 0
+}
+
+func handleBranch(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	if len(args) > 0 {
+		name := args[0]
+		if err := core.CreateBranch(name); err != nil {
+			fmt.Fprintf(s.stdout, "Error creating branch: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(s.stdout, "Created branch %s\n", name)
+		return 0
+	}
+
+	branches, err := core.ListBranches()
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error listing branches: %v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(branches); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if len(branches) == 0 {
+		fmt.Fprintln(s.stdout, "No branches found")
+		return 0
+	}
+
+	for _, branch := range branches {
+		marker := " "
+		if branch.Current {
+			marker = "*"
+		}
+		fmt.Fprintf(s.stdout, "%s %s  %s\n", marker, branch.Hash, branch.Name)
+	}
+	return 0
+}
+
+func handleSwitch(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	if len(args) < 1 {
+		fmt.Fprintln(s.stdout, "Error: Branch name required")
+		fmt.Fprintln(s.stdout, "Usage: bit switch <branch>")
+		return 1
+	}
+
+	name := args[0]
+	progress, finish := commandProgress(s, "switch")
+	err := core.Switch(name, progress)
+	finish(err)
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error switching branch: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(s.stdout, "Switched to branch %s\n", name)
+	return 0
+}
+
+func handleMerge(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	if len(args) < 1 {
+		fmt.Fprintln(s.stdout, "Error: Save to merge required")
+		fmt.Fprintln(s.stdout, "Usage: bit merge <hash|tag|branch>")
+		return 1
+	}
+
+	other := args[0]
+	result, err := core.Merge(other)
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error merging save: %v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(result); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+	} else if result.UpToDate {
+		fmt.Fprintf(s.stdout, "Already up to date with %s\n", other)
+	} else if len(result.Conflicts) > 0 {
+		fmt.Fprintf(s.stdout, "Merge of %s has conflicts in:\n", other)
+		for _, file := range result.Conflicts {
+			fmt.Fprintf(s.stdout, "  %s\n", file)
+		}
+		fmt.Fprintln(s.stdout, "Resolve them and run 'bit save <name>' to conclude the merge")
+	} else {
+		fmt.Fprintf(s.stdout, "Merged %s into save %s\n", other, result.Hash)
+	}
+
+	if len(result.Conflicts) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func handleExport(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "export")
+	output := flags.String("output", "", "file to write the tar archive to (default stdout)")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return flagError(err)
+	}
+
+	if len(args) < 1 {
+		fmt.Fprintln(s.stdout, "Error: Save hash required")
+		fmt.Fprintln(s.stdout, "Usage: bit export <hash> [--output <file>]")
+		return 1
+	}
+
+	export := func(w io.Writer) error { return core.ExportTar(args[0], w) }
+	if *output == "" {
+		err = export(s.stdout)
+	} else {
+		err = writeOutputFile(*output, export)
+	}
+	if err != nil {
+		fmt.Fprintf(s.stderr, "Error exporting save: %v\n", err)
+		return 1
+	}
+
+	if *output != "" {
+		fmt.Fprintf(s.stdout, "Exported save %s to %s\n", args[0], *output)
+	}
+	return 0
+}
+
+// writeOutputFile writes to a temporary file next to name and renames it over
+// name once write succeeds, so a failed write leaves no partial file behind
+// and an existing file untouched
+func writeOutputFile(name string, write func(io.Writer) error) error {
+	file, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	if err := os.Rename(file.Name(), name); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	return nil
+}
+
+func handleImport(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	if len(args) < 2 {
+		fmt.Fprintln(s.stdout, "Error: Archive path and save name required")
+		fmt.Fprintln(s.stdout, "Usage: bit import <archive.tar> <name>")
+		return 1
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error opening archive: %v\n", err)
+		return 1
+	}
+	defer file.Close()
+
+	name := strings.Join(args[1:], " ")
+	hash, err := core.ImportTar(name, file)
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error importing archive: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(s.stdout, "Imported '%s' with hash %s\n", name, hash)
+	return 0
+}
+
+func handleBundle(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "bundle")
+	output := flags.String("output", "", "file to write the bundle to (default stdout)")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return flagError(err)
+	}
+	if len(args) > 0 {
+		fmt.Fprintln(s.stdout, "Usage: bit bundle [--output <file>]")
+		return 1
+	}
+
+	var w io.Writer = s.stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(s.stdout, "Error creating output file: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if err := core.Bundle(w); err != nil {
+		fmt.Fprintf(s.stderr, "Error bundling repository: %v\n", err)
+		return 1
+	}
+
+	if *output != "" {
+		fmt.Fprintf(s.stdout, "Bundled repository to %s\n", *output)
+	}
+	return 0
+}
+
+func handleUnbundle(s streams, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(s.stdout, "Error: Bundle path required")
+		fmt.Fprintln(s.stdout, "Usage: bit unbundle <file>")
+		return 1
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error opening bundle: %v\n", err)
+		return 1
+	}
+	defer file.Close()
+
+	if err := core.Unbundle(file); err != nil {
+		fmt.Fprintf(s.stdout, "Error unbundling repository: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(s.stdout, "Repository created; run 'bit checkout <hash>' to fill the working tree")
+	return 0
+}
+
+// stringList is a flag value collecting every occurrence of a repeated flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// newFlagSet returns a flag set for a command that reports invalid flags on
+// the command's standard error instead of exiting
+func newFlagSet(s streams, name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(s.stderr)
+	return flags
+}
+
+// parseFlags parses flags that may appear anywhere among args and returns the
+// remaining positional arguments in order. Every argument after "--" is
+// positional.
+func parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := flags.Args()
+		if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+			// Everything after "--" is positional, even if it looks like a flag
+			return append(positional, rest...), nil
+		}
+		args = rest
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// flagError returns the exit code for a flag parsing error, which the flag set
+// has already reported: 0 when help was asked for and 2 otherwise, as with
+// flag.ExitOnError
+func flagError(err error) int {
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	return 2
+}
+
+func handleSquash(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "squash")
+	name := flags.String("name", "", "name of the squashed save (default: name of <to>)")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return flagError(err)
+	}
+
+	if len(args) < 2 {
+		fmt.Fprintln(s.stdout, "Error: First and last save of the range required")
+		fmt.Fprintln(s.stdout, "Usage: bit squash <from> <to> [--name <name>]")
+		return 1
+	}
+
+	hash, err := core.Squash(args[0], args[1], *name)
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error squashing saves: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(s.stdout, "Squashed %s..%s into %s\n", args[0], args[1], hash)
+	return 0
+}
+
+func handleSize(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "size")
+	top := flags.Int("top", 10, "number of largest saves to list")
+	if _, err := parseFlags(flags, args); err != nil {
+		return flagError(err)
+	}
+
+	report, err := core.Size()
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error measuring repository: %v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(report); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(s.stdout, "Total: %s in %d objects\n", formatSize(report.TotalBytes), report.Objects)
+	if report.UnreferencedBytes > 0 {
+		fmt.Fprintf(s.stdout, "Unreferenced: %s\n", formatSize(report.UnreferencedBytes))
+	}
+
+	saves := report.Saves
+	if *top >= 0 && len(saves) > *top {
+		saves = saves[:*top]
+	}
+	if len(saves) == 0 {
+		return 0
+	}
+	fmt.Fprintln(s.stdout, "Largest saves:")
+	for _, save := range saves {
+		fmt.Fprintf(s.stdout, "  %s  %10s  %s\n", save.Hash, formatSize(save.Bytes), save.Name)
+	}
+	return 0
+}
+
+// formatSize renders a byte count with a binary unit
+func formatSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+func handleStats(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "stats")
+	top := flags.Int("top", 0, "list only this many of the deepest files")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return flagError(err)
+	}
+
+	var hash string
+	if len(args) > 0 {
+		hash = args[0]
+	}
+	report, err := core.DeltaDepths(hash)
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error reading delta depths: %v\n", err)
+		return 1
+	}
+	if *top > 0 && len(report.Files) > *top {
+		report.Files = report.Files[:*top]
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(report); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(s.stdout, "Delta depths at %s (changed files are stored in full at %d):\n", report.Hash, report.Limit)
+	for _, file := range report.Files {
+		fmt.Fprintf(s.stdout, "  %3d  %s\n", file.Depth, file.Path)
+	}
+	return 0
+}
+
+func handleCompact(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "compact")
+	maxChain := flags.Int("max-chain", 0, "longest delta chain to keep (default: the limit used when saving)")
+	if _, err := parseFlags(flags, args); err != nil {
+		return flagError(err)
+	}
+
+	shortened, err := core.Compact(*maxChain)
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error compacting repository: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(s.stdout, "Shortened %d delta chains\n", shortened)
+	return 0
+}
+
+func handleRepack(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	if len(args) < 1 {
+		fmt.Fprintln(s.stdout, "Error: File path required")
+		fmt.Fprintln(s.stdout, "Usage: bit repack <file>")
+		return 1
+	}
+
+	rewritten, err := core.RepackDeltas(args[0])
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error repacking %s: %v\n", args[0], err)
+		return 1
+	}
+	fmt.Fprintf(s.stdout, "Rewrote the deltas of %s in %d saves\n", args[0], rewritten)
+	return 0
+}
+
+func handleMv(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	if len(args) < 2 {
+		fmt.Fprintln(s.stdout, "Error: Source and destination paths required")
+		fmt.Fprintln(s.stdout, "Usage: bit mv <old> <new>")
+		return 1
+	}
+
+	if err := core.Move(args[0], args[1]); err != nil {
+		fmt.Fprintf(s.stdout, "Error moving file: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(s.stdout, "Moved %s to %s\n", args[0], args[1])
+	return 0
+}
+
+func handleRm(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "rm")
+	saveName := flags.String("save", "", "immediately create a save recording only the removal")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return flagError(err)
+	}
+
+	if len(args) < 1 {
+		fmt.Fprintln(s.stdout, "Error: File path required")
+		fmt.Fprintln(s.stdout, "Usage: bit rm [--save <name>] <file>")
+		return 1
+	}
+
+	if *saveName == "" {
+		if err := core.Remove(args[0]); err != nil {
+			fmt.Fprintf(s.stdout, "Error removing file: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(s.stdout, "Removed %s\n", args[0])
+		return 0
+	}
+
+	hash, err := core.RemoveAndSave(args[0], *saveName)
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error removing file: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(s.stdout, "Removed %s and saved '%s' with hash %s\n", args[0], *saveName, hash)
+	return 0
+}
+
+func handleClean(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "clean")
+	dryRun := flags.Bool("dry-run", false, "only list the files that would be removed")
+	force := flags.Bool("force", false, "remove the files")
+	if _, err := parseFlags(flags, args); err != nil {
+		return flagError(err)
+	}
+
+	if *dryRun == *force {
+		fmt.Fprintln(s.stdout, "Error: Exactly one of --dry-run or --force is required")
+		fmt.Fprintln(s.stdout, "Usage: bit clean --dry-run | --force")
+		return 1
+	}
+
+	files, err := core.Clean(*dryRun)
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error cleaning working directory: %v\n", err)
+		return 1
+	}
+
+	if len(files) == 0 {
+		fmt.Fprintln(s.stdout, "Nothing to clean")
+		return 0
+	}
+
+	action := "Removed"
+	if *dryRun {
+		action = "Would remove"
+	}
+	for _, file := range files {
+		fmt.Fprintf(s.stdout, "%s %s\n", action, file)
+	}
+	return 0
+}
+
+func handleFsck(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "fsck")
+	rebuild := flags.Bool("rebuild", false, "recover the save list from stored objects if the metadata is corrupt")
+	orphans := flags.Bool("orphans", false, "list stored objects that no save refers to, without deleting them")
+	verify := flags.Bool("verify", false, "check the content of every save and, with a signing key configured, its signature")
+	if _, err := parseFlags(flags, args); err != nil {
+		return flagError(err)
+	}
+
+	if *orphans {
+		files, err := core.FindOrphans()
+		if err != nil {
+			fmt.Fprintf(s.stdout, "Error finding orphaned objects: %v\n", err)
+			return 1
+		}
+		if jsonOutput {
+			if err := json.NewEncoder(s.stdout).Encode(files); err != nil {
+				fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+				return 1
+			}
+			return 0
+		}
+		if len(files) == 0 {
+			fmt.Fprintln(s.stdout, "No orphaned objects")
+			return 0
+		}
+		for _, file := range files {
+			fmt.Fprintf(s.stdout, "  %s\n", file)
+		}
+		fmt.Fprintf(s.stdout, "%d orphaned objects\n", len(files))
+		return 0
+	}
+
+	if *verify {
+		issues, err := core.VerifyIntegrity()
+		if err != nil {
+			fmt.Fprintf(s.stdout, "Error verifying saves: %v\n", err)
+			return 1
+		}
+		if jsonOutput {
+			if err := json.NewEncoder(s.stdout).Encode(issues); err != nil {
+				fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+				return 1
+			}
+		} else if len(issues) == 0 {
+			fmt.Fprintln(s.stdout, "All saves verified")
+		} else {
+			for _, issue := range issues {
+				fmt.Fprintf(s.stdout, "  %s: %s\n", issue.Hash, issue.Problem)
+			}
+			fmt.Fprintf(s.stdout, "%d problems found\n", len(issues))
+		}
+		if len(issues) > 0 {
+			return 1
+		}
+		return 0
+	}
+
+	if *rebuild {
+		recovered, err := core.RebuildMetadata()
+		if err != nil {
+			fmt.Fprintf(s.stdout, "Error rebuilding metadata: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(s.stdout, "Recovered %d saves; their names and all tags were lost\n", recovered)
+		return 0
+	}
+
+	saves, err := core.ListSaves()
+	if errors.Is(err, core.ErrCorruptMetadata) {
+		fmt.Fprintf(s.stdout, "Error: %v\n", err)
+		fmt.Fprintln(s.stdout, "Run 'bit fsck --rebuild' to recover the save list")
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(s.stdout, "Error checking repository: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(s.stdout, "Metadata is readable, %d saves\n", len(saves))
+	return 0
+}
+
+func handleObjects(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	objects, err := core.Objects()
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error listing objects: %v\n", err)
+		return 1
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(objects); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if len(objects) == 0 {
+		fmt.Fprintln(s.stdout, "No objects stored")
+		return 0
+	}
+	for _, object := range objects {
+		printObject(s.stdout, object)
+	}
+	return 0
+}
+
+// printObject prints one line describing a stored object: its type, owning
+// save, size, header and name, followed by the file it stores if known
+func printObject(w io.Writer, object core.ObjectInfo) {
+	save := object.Save
+	if save == "" {
+		save = "-"
+	}
+
+	header := "-"
+	switch {
+	case object.Error != "":
+		header = "error: " + object.Error
+	case object.Header != nil:
+		header = fmt.Sprintf("v%d", object.Header.Version)
+		if object.Header.Compressed {
+			header += " gzip"
+		}
+	}
+
+	fmt.Fprintf(w, "%-7s %-16s %10d  %-10s %s", object.Type, save, object.Size, header, object.Name)
+	if object.Path != "" {
+		fmt.Fprintf(w, " -> %s", object.Path)
+	}
+	fmt.Fprintln(w)
+}
+
+// handleDoctor prints the repository health report and exits with status 1
+// when it finds a problem. It runs outside a repository too, to report that.
+func handleDoctor(s streams, args []string) int {
+	report := core.Doctor()
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(report); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+	} else {
+		printDoctorReport(s.stdout, report)
+	}
+
+	if !report.Healthy() {
+		return 1
+	}
+	return 0
+}
+
+// printDoctorReport prints the checks of a health report, one section each
+func printDoctorReport(w io.Writer, report core.DoctorReport) {
+	if !report.Initialized {
+		fmt.Fprintf(w, "Repository: missing, no %s directory (run 'bit init')\n", report.Dir)
+	} else {
+		fmt.Fprintf(w, "Repository: %s\n", report.Dir)
+		if report.MetadataError != "" {
+			fmt.Fprintf(w, "Metadata: %s (run 'bit fsck --rebuild')\n", report.MetadataError)
+		} else {
+			fmt.Fprintf(w, "Metadata: ok, %d saves\n", report.Saves)
+			fmt.Fprintf(w, "Objects: %d, %s\n", report.Objects, formatSize(report.TotalBytes))
+			fmt.Fprintf(w, "Orphaned objects: %d\n", len(report.Orphans))
+			if len(report.Issues) == 0 {
+				fmt.Fprintf(w, "Integrity: ok, latest %d saves verified\n", report.Verified)
+			} else {
+				fmt.Fprintf(w, "Integrity: %d problems in the latest %d saves\n", len(report.Issues), report.Verified)
+				for _, issue := range report.Issues {
+					fmt.Fprintf(w, "  %s: %s\n", issue.Hash, issue.Problem)
+				}
+			}
+		}
+	}
+	for _, err := range report.Errors {
+		fmt.Fprintf(w, "Error: %s\n", err)
+	}
+
+	fmt.Fprintln(w, "Ignore patterns:")
+	if report.IgnoreError != "" {
+		fmt.Fprintf(w, "  error: %s\n", report.IgnoreError)
+	}
+	if len(report.IgnorePatterns) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, pattern := range report.IgnorePatterns {
+		fmt.Fprintf(w, "  %s\n", pattern)
+	}
+}
+
+// handleConfig lists, reads and changes the repository settings. Settings
+// are checked before config.json is written, so an invalid value cannot
+// break later commands.
+func handleConfig(s streams, args []string) int {
+	if !requireRepository(s) {
+		return 1
+	}
+
+	flags := newFlagSet(s, "config")
+	list := flags.Bool("list", false, "list every setting in effect")
+	unset := flags.String("unset", "", "remove a setting from config.json so that its default applies")
+	args, err := parseFlags(flags, args)
+	if err != nil {
+		return flagError(err)
+	}
+
+	switch {
+	case *unset != "" && (*list || len(args) > 0):
+		fmt.Fprintln(s.stdout, "Error: --unset takes no other arguments")
+		return 1
+	case *unset != "":
+		if err := core.UnsetConfig(*unset); err != nil {
+			fmt.Fprintf(s.stdout, "Error changing config: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(s.stdout, "Unset %s\n", *unset)
+		return 0
+	case len(args) == 2 && !*list:
+		if err := core.SetConfig(args[0], args[1]); err != nil {
+			fmt.Fprintf(s.stdout, "Error changing config: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(s.stdout, "Set %s to %s\n", args[0], args[1])
+		return 0
+	case len(args) > 2 || len(args) > 0 && *list:
+		fmt.Fprintln(s.stdout, "Usage: bit config [--list | <key> [value] | --unset <key>]")
+		return 1
+	}
+
+	values, err := core.ConfigValues()
+	if err != nil {
+		fmt.Fprintf(s.stdout, "Error reading config: %v\n", err)
+		return 1
+	}
+	if len(args) == 1 {
+		for _, value := range values {
+			if value.Key == args[0] {
+				values = []core.ConfigValue{value}
+				break
+			}
+		}
+		if len(values) != 1 || values[0].Key != args[0] {
+			fmt.Fprintf(s.stdout, "Error: unknown setting %q; bit config --list shows every setting\n", args[0])
+			return 1
+		}
+	}
+
+	if jsonOutput {
+		if err := json.NewEncoder(s.stdout).Encode(values); err != nil {
+			fmt.Fprintf(s.stderr, "Error writing JSON: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	if len(args) == 1 {
+		fmt.Fprintln(s.stdout, values[0].Value)
+		return 0
+	}
+	for _, value := range values {
+		fmt.Fprintf(s.stdout, "%s=%s", value.Key, value.Value)
+		if !value.Set {
+			fmt.Fprint(s.stdout, "  (default)")
+		}
+		fmt.Fprintln(s.stdout)
 	}
+	return 0
 }
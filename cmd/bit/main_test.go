@@ -2,11 +2,17 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
+
+	"bit/internal/core"
+	"bit/internal/util"
 )
 
 // TestCommandLineInterface tests the command line interface
@@ -186,6 +192,42 @@ func TestCommandLineInterface(t *testing.T) {
 		t.Errorf("Expected another.txt to exist after 'bit now'")
 	}
 
+	// Test JSON output of 'bit list'
+	cmd = exec.Command(bitCmd, "--json", "list")
+	output, err = cmd.Output()
+	if err != nil {
+		t.Errorf("Failed to run 'bit --json list': %v\nOutput: %s", err, output)
+	}
+	var saves []saveJSON
+	if err := json.Unmarshal(output, &saves); err != nil {
+		t.Fatalf("Failed to parse 'bit --json list' output: %v\nOutput: %s", err, output)
+	}
+	if len(saves) != 2 || saves[0].Name != "Initial save" || saves[0].Hash != hash {
+		t.Errorf("Unexpected saves in JSON output: %+v", saves)
+	}
+
+	// Test JSON output of 'bit status' after a modification
+	err = os.WriteFile("another.txt", []byte("Changed again"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to modify another test file: %v", err)
+	}
+	cmd = exec.Command(bitCmd, "status", "--json")
+	output, err = cmd.Output()
+	if err != nil {
+		t.Errorf("Failed to run 'bit status --json': %v\nOutput: %s", err, output)
+	}
+	var status struct {
+		Added    []string `json:"added"`
+		Modified []string `json:"modified"`
+		Deleted  []string `json:"deleted"`
+	}
+	if err := json.Unmarshal(output, &status); err != nil {
+		t.Fatalf("Failed to parse 'bit status --json' output: %v\nOutput: %s", err, output)
+	}
+	if len(status.Modified) != 1 || status.Modified[0] != "another.txt" || len(status.Added) != 0 || len(status.Deleted) != 0 {
+		t.Errorf("Unexpected status in JSON output: %+v", status)
+	}
+
 	// Test unknown command
 	cmd = exec.Command(bitCmd, "unknown")
 	output, err = cmd.CombinedOutput()
@@ -196,10 +238,806 @@ func TestCommandLineInterface(t *testing.T) {
 		t.Errorf("Expected 'Unknown command' message")
 	}
 
-	// Test 'bit debug' (just make sure it runs without error)
-	cmd = exec.Command(bitCmd, "debug")
-	_, err = cmd.CombinedOutput()
+	// Test 'bit doctor' on the healthy repository
+	cmd = exec.Command(bitCmd, "doctor")
+	output, err = cmd.CombinedOutput()
+	if err != nil {
+		t.Errorf("Failed to run 'bit doctor': %v\n%s", err, output)
+	}
+	if !bytes.Contains(output, []byte("Metadata: ok")) {
+		t.Errorf("Expected doctor to report readable metadata, got:\n%s", output)
+	}
+}
+
+func TestWriteSavesJSON(t *testing.T) {
+	timestamp := time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)
+	saves := []core.Save{
+		{Hash: "abc123", Name: "First", Timestamp: timestamp, Files: []string{"a.txt", "b.txt"}},
+		{Hash: "def456", Name: "Empty", Timestamp: timestamp},
+	}
+
+	var buf bytes.Buffer
+	if err := writeSavesJSON(&buf, saves); err != nil {
+		t.Fatalf("writeSavesJSON failed: %v", err)
+	}
+
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to parse JSON: %v", err)
+	}
+	if len(decoded) != 2 {
+		t.Fatalf("Expected 2 saves, got %d", len(decoded))
+	}
+	if decoded[0]["hash"] != "abc123" || decoded[0]["name"] != "First" {
+		t.Errorf("Unexpected save fields: %v", decoded[0])
+	}
+	if decoded[0]["timestamp"] != "2024-01-02T10:30:00Z" {
+		t.Errorf("Expected RFC3339 timestamp, got %v", decoded[0]["timestamp"])
+	}
+	if files, ok := decoded[0]["files"].([]interface{}); !ok || len(files) != 2 {
+		t.Errorf("Unexpected files: %v", decoded[0]["files"])
+	}
+
+	// Saves without files still produce an array
+	if files, ok := decoded[1]["files"].([]interface{}); !ok || len(files) != 0 {
+		t.Errorf("Expected empty files array, got %v", decoded[1]["files"])
+	}
+}
+
+func TestWriteGraph(t *testing.T) {
+	timestamp := time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)
+	// a is the root, b continues it, c branches off a, m merges c into b and
+	// d is based on a save that is not listed
+	saves := []core.Save{
+		{Hash: "a", Name: "root", Timestamp: timestamp},
+		{Hash: "b", Name: "main", Timestamp: timestamp, BaseSaveHash: "a"},
+		{Hash: "c", Name: "feature", Timestamp: timestamp, BaseSaveHash: "a"},
+		{Hash: "m", Name: "merge", Timestamp: timestamp, BaseSaveHash: "b", MergeParents: []string{"b", "c"}},
+		{Hash: "d", Name: "orphan", Timestamp: timestamp, BaseSaveHash: "gone"},
+	}
+
+	var buf bytes.Buffer
+	writeGraph(&buf, saves)
+
+	when := timestamp.Local().Format("2006-01-02 15:04:05")
+	expected := strings.Join([]string{
+		"*  d  " + when + "  orphan",
+		"*  m  " + when + "  merge",
+		"|\\",
+		"| *  c  " + when + "  feature",
+		"* |  b  " + when + "  main",
+		"|/",
+		"*  a  " + when + "  root",
+	}, "\n") + "\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected graph:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestWriteDiffStat(t *testing.T) {
+	var buf bytes.Buffer
+	writeDiffStat(&buf, []core.FileStat{
+		{Path: "logo.png", Binary: true},
+		{Path: "src/main.go", Insertions: 2, Deletions: 1},
+		{Path: "generated.go", Insertions: 80, Deletions: 20},
+	})
+
+	expected := "" +
+		" logo.png     | Bin\n" +
+		" src/main.go  |   3 +-\n" +
+		" generated.go | 100 ++++++++++++++++++++++++++++++++--------\n" +
+		" 3 files changed, 82 insertions(+), 21 deletions(-)\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected diffstat:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	buf.Reset()
+	writeDiffStat(&buf, []core.FileStat{{Path: "a.txt", Deletions: 1}})
+	if buf.String() != " a.txt | 1 -\n 1 file changed, 1 deletion(-)\n" {
+		t.Errorf("Unexpected diffstat for a single deletion: %q", buf.String())
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	start, err := parseTime("2024-01-02", false)
+	if err != nil {
+		t.Fatalf("Failed to parse date: %v", err)
+	}
+	if !start.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("Unexpected start of day: %v", start)
+	}
+
+	end, err := parseTime("2024-01-02", true)
+	if err != nil {
+		t.Fatalf("Failed to parse date: %v", err)
+	}
+	if !end.Equal(time.Date(2024, 1, 3, 0, 0, 0, 0, time.Local).Add(-time.Nanosecond)) {
+		t.Errorf("Unexpected end of day: %v", end)
+	}
+
+	exact, err := parseTime("2024-01-02T10:30:00Z", true)
+	if err != nil {
+		t.Fatalf("Failed to parse RFC3339 time: %v", err)
+	}
+	if !exact.Equal(time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected RFC3339 time: %v", exact)
+	}
+
+	if _, err := parseTime("yesterday", false); err == nil {
+		t.Error("Expected error for invalid time")
+	}
+}
+
+func TestReadSaveName(t *testing.T) {
+	tests := map[string]string{
+		"Fix \"quoted\" $name & more\n":   "Fix \"quoted\" $name & more",
+		"Windows line ending\r\n":         "Windows line ending",
+		"Summary\n\nLonger description\n": "Summary\n\nLonger description",
+		"No newline":                      "No newline",
+	}
+	for input, want := range tests {
+		got, err := readSaveName(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("Failed to read save name: %v", err)
+		}
+		if got != want {
+			t.Errorf("readSaveName(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := map[int64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		1024:            "1.0 KiB",
+		1536:            "1.5 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+	}
+	for bytes, want := range tests {
+		if got := formatSize(bytes); got != want {
+			t.Errorf("formatSize(%d) = %q, want %q", bytes, got, want)
+		}
+	}
+}
+
+func TestProgressPrinter(t *testing.T) {
+	var out bytes.Buffer
+	progress := progressPrinter(&out, time.Hour)
+	for i := 1; i <= 5; i++ {
+		progress(i, 5, "file"+strings.Repeat("x", i))
+	}
+
+	// Only the first update and the final one fit in the interval
+	want := "\r\033[K[1/5] filex\r\033[K[5/5] filexxxxx\n"
+	if out.String() != want {
+		t.Errorf("progress output = %q, want %q", out.String(), want)
+	}
+}
+
+// runCommand runs a bit command against buffers and returns its exit code and
+// what it wrote to stdout and stderr
+func runCommand(handler func(streams, []string) int, stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := handler(streams{stdin: strings.NewReader(stdin), stdout: &stdout, stderr: &stderr}, args)
+	return code, stdout.String(), stderr.String()
+}
+
+// inTempRepository changes into a new repository for the duration of a test
+func inTempRepository(t *testing.T) string {
+	dir := t.TempDir()
+	origDir, err := os.Getwd()
 	if err != nil {
-		t.Errorf("Failed to run 'bit debug': %v", err)
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(origDir) })
+
+	if code, out, errOut := runCommand(handleInit, ""); code != 0 {
+		t.Fatalf("bit init failed with %d: %s%s", code, out, errOut)
+	}
+	return dir
+}
+
+func TestHandleSaveAndList(t *testing.T) {
+	dir := inTempRepository(t)
+
+	if code, out, _ := runCommand(handleList, ""); code != 0 || out != "No saves found\n" {
+		t.Errorf("Expected no saves, got %d: %q", code, out)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("content\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	code, out, _ := runCommand(handleSave, "", "First", "save")
+	if code != 0 || !strings.HasPrefix(out, "Saved state 'First save' with hash ") {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+	hash := strings.TrimSpace(strings.TrimPrefix(out, "Saved state 'First save' with hash "))
+
+	code, out, _ = runCommand(handleSave, "Second save\n", "--name-from-stdin", "--allow-empty")
+	if code != 0 || !strings.HasPrefix(out, "Saved state 'Second save'") {
+		t.Fatalf("Expected the save named from stdin to succeed, got %d: %q", code, out)
+	}
+
+	code, out, _ = runCommand(handleList, "", "--limit", "1")
+	if code != 0 || out != "Saves:\n  "+hash+"  First save\n" {
+		t.Errorf("Unexpected list output, got %d: %q", code, out)
+	}
+
+	// Errors are reported through the exit code instead of exiting
+	if code, out, _ := runCommand(handleSave, ""); code != 1 || !strings.Contains(out, "Save name required") {
+		t.Errorf("Expected a missing name to fail, got %d: %q", code, out)
+	}
+	if code, _, errOut := runCommand(handleList, "", "--no-such-flag"); code != 2 || !strings.Contains(errOut, "no-such-flag") {
+		t.Errorf("Expected an unknown flag to fail with 2, got %d: %q", code, errOut)
+	}
+}
+
+func TestHandleListFiles(t *testing.T) {
+	dir := inTempRepository(t)
+
+	for _, file := range []string{"b.txt", "a.txt", "docs/with space.md"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(file), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	code, out, _ := runCommand(handleSave, "", "First")
+	if code != 0 {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+	hash := strings.TrimSpace(strings.TrimPrefix(out, "Saved state 'First' with hash "))
+	if err := os.WriteFile(filepath.Join(dir, "c.txt"), []byte("c"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if code, out, _ := runCommand(handleSave, "", "Second"); code != 0 {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+
+	if code, out, _ := runCommand(handleList, "", "--files", hash); code != 0 || out != "a.txt\nb.txt\ndocs/with space.md\n" {
+		t.Errorf("Expected the files of the first save, got %d: %q", code, out)
+	}
+	if code, out, _ := runCommand(handleList, "", "--files", hash, "--null"); code != 0 || out != "a.txt\x00b.txt\x00docs/with space.md\x00" {
+		t.Errorf("Expected NUL separated paths, got %d: %q", code, out)
+	}
+	if code, _, errOut := runCommand(handleList, "", "--files", "ffffffffffff"); code != 1 || !strings.Contains(errOut, "ffffffffffff") {
+		t.Errorf("Expected an unknown save to fail, got %d: %q", code, errOut)
+	}
+	if code, out, _ := runCommand(handleList, "", "--null"); code != 1 || !strings.Contains(out, "--files") {
+		t.Errorf("Expected --null without --files to fail, got %d: %q", code, out)
+	}
+}
+
+func TestHandleStash(t *testing.T) {
+	dir := inTempRepository(t)
+
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("saved\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	code, out, _ := runCommand(handleSave, "", "First")
+	if code != 0 {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+	hash := strings.TrimSpace(strings.TrimPrefix(out, "Saved state 'First' with hash "))
+
+	if code, out, _ := runCommand(handleStash, ""); code != 0 || out != "No stashes found\n" {
+		t.Errorf("Expected no stashes, got %d: %q", code, out)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("unsaved\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if code, out, _ := runCommand(handleCheckout, "", hash); code != 0 {
+		t.Fatalf("Expected the checkout to succeed, got %d: %q", code, out)
+	}
+	if code, out, _ := runCommand(handleStash, "", "list"); code != 0 || !strings.Contains(out, "before checkout, on "+hash+" (1 files)") {
+		t.Errorf("Expected the stash listed, got %d: %q", code, out)
+	}
+
+	if code, out, _ := runCommand(handleStash, "", "pop"); code != 0 || !strings.HasPrefix(out, "Restored stash ") {
+		t.Fatalf("Expected the stash to be popped, got %d: %q", code, out)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "file.txt")); string(content) != "unsaved\n" {
+		t.Errorf("Expected the unsaved content restored, got %q", content)
+	}
+	if code, out, _ := runCommand(handleStash, "", "drop"); code != 1 || !strings.Contains(out, "Unknown stash command") {
+		t.Errorf("Expected an unknown subcommand to fail, got %d: %q", code, out)
+	}
+}
+
+func TestHandleDiffNameStatus(t *testing.T) {
+	dir := inTempRepository(t)
+
+	write := func(file, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	write("same.txt", "unchanged\n")
+	write("changed.txt", "before\n")
+	write("old.txt", "deleted later\n")
+	code, out, _ := runCommand(handleSave, "", "First")
+	if code != 0 {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+	first := strings.TrimSpace(strings.TrimPrefix(out, "Saved state 'First' with hash "))
+
+	write("changed.txt", "after\n")
+	write("new.txt", "added\n")
+	if err := os.Remove(filepath.Join(dir, "old.txt")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+
+	// The working tree against the checked out save
+	want := "M\tchanged.txt\nA\tnew.txt\nD\told.txt\n"
+	if code, out, errOut := runCommand(handleDiff, "", "--name-status"); code != 0 || out != want {
+		t.Errorf("Expected %q, got %d: %q%s", want, code, out, errOut)
+	}
+	if code, out, _ := runCommand(handleDiff, "", "--name-only"); code != 0 || out != "changed.txt\nnew.txt\nold.txt\n" {
+		t.Errorf("Expected the changed paths only, got %d: %q", code, out)
+	}
+
+	// Two saves, in both directions
+	code, out, _ = runCommand(handleSave, "", "Second")
+	if code != 0 {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+	second := strings.TrimSpace(strings.TrimPrefix(out, "Saved state 'Second' with hash "))
+	if code, out, _ := runCommand(handleDiff, "", "--name-status", first, second); code != 0 || out != want {
+		t.Errorf("Expected %q between the saves, got %d: %q", want, code, out)
+	}
+	if code, out, _ := runCommand(handleDiff, "", "--name-status", second, first); code != 0 || out != "M\tchanged.txt\nD\tnew.txt\nA\told.txt\n" {
+		t.Errorf("Expected added and deleted swapped, got %d: %q", code, out)
+	}
+	if code, out, _ := runCommand(handleDiff, "", "--name-only"); code != 0 || out != "" {
+		t.Errorf("Expected no changes in a clean working tree, got %d: %q", code, out)
+	}
+
+	if code, out, _ := runCommand(handleDiff, "", "--name-only", "--name-status"); code != 1 || !strings.Contains(out, "cannot be combined") {
+		t.Errorf("Expected both modes together to fail, got %d: %q", code, out)
+	}
+}
+
+func TestSnapshotName(t *testing.T) {
+	taken := time.Date(2024, 6, 1, 14, 30, 0, 0, time.UTC)
+	if name := snapshotName(taken, ""); name != "snapshot-2024-06-01T14-30-00" {
+		t.Errorf("snapshotName() = %q", name)
+	}
+	if name := snapshotName(taken, "before-refactor"); name != "snapshot-2024-06-01T14-30-00-before-refactor" {
+		t.Errorf("snapshotName() with suffix = %q", name)
+	}
+}
+
+func TestHandleSnapshot(t *testing.T) {
+	dir := inTempRepository(t)
+
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("content\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	code, out, _ := runCommand(handleSnapshot, "", "wip")
+	if code != 0 || !regexp.MustCompile(`^Saved state 'snapshot-\d{4}-\d{2}-\d{2}T\d{2}-\d{2}-\d{2}-wip' with hash \w+\n$`).MatchString(out) {
+		t.Fatalf("Expected a snapshot to be saved, got %d: %q", code, out)
+	}
+	name := strings.Split(out, "'")[1]
+
+	if code, out, _ := runCommand(handleList, ""); code != 0 || !strings.Contains(out, name) {
+		t.Errorf("Expected %s in the save list, got %d: %q", name, code, out)
+	}
+
+	// Like save, a snapshot of an unchanged tree is skipped
+	if code, out, _ := runCommand(handleSnapshot, ""); code != 0 || !strings.HasPrefix(out, "Nothing changed") {
+		t.Errorf("Expected an unchanged snapshot to be skipped, got %d: %q", code, out)
+	}
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	var stdout bytes.Buffer
+	code := run(streams{stdin: strings.NewReader(""), stdout: &stdout, stderr: &stdout}, []string{"unknown"})
+	if code != 1 || !strings.Contains(stdout.String(), "Unknown command: unknown") || !strings.Contains(stdout.String(), "Usage:") {
+		t.Errorf("Expected usage for an unknown command, got %d: %q", code, stdout.String())
+	}
+}
+
+func TestRunGlobalFlags(t *testing.T) {
+	dir := inTempRepository(t)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	runArgs := func(args ...string) (int, string) {
+		var stdout bytes.Buffer
+		code := run(streams{stdin: strings.NewReader(""), stdout: &stdout, stderr: &stdout}, args)
+		return code, stdout.String()
+	}
+
+	// After "--" a global flag is an argument of the command
+	if code, out := runArgs("save", "--", "--json"); code != 0 || !strings.Contains(out, "'--json'") {
+		t.Fatalf("Expected a save named --json, got %d: %q", code, out)
+	}
+	if code, out := runArgs("list", "--json"); code != 0 || !strings.HasPrefix(out, "[") || !strings.Contains(out, `"name":"--json"`) {
+		t.Errorf("Expected the saves as JSON, got %d: %q", code, out)
+	}
+
+	// Global flags do not carry over to the next run
+	if code, out := runArgs("list"); code != 0 || strings.HasPrefix(out, "[") {
+		t.Errorf("Expected the saves as text after a --json run, got %d: %q", code, out)
+	}
+	if jsonOutput || progressJSON {
+		t.Errorf("Expected global flags to be reset, got jsonOutput=%v progressJSON=%v", jsonOutput, progressJSON)
+	}
+
+	// Neither does disabling compression for one save
+	original := util.CompressionConfig.Enabled
+	defer func() { util.CompressionConfig.Enabled = original }()
+	util.CompressionConfig.Enabled = true
+	if code, out := runArgs("save", "--no-compress", "--allow-empty", "Uncompressed"); code != 0 {
+		t.Fatalf("Expected the uncompressed save to succeed, got %d: %q", code, out)
+	}
+	if !util.CompressionConfig.Enabled {
+		t.Errorf("Expected compression enabled again after a --no-compress save")
+	}
+}
+
+func TestHandleInitWithIgnore(t *testing.T) {
+	// Without the flag no .bitignore is written
+	dir := inTempRepository(t)
+	if _, err := os.Stat(filepath.Join(dir, ".bitignore")); !os.IsNotExist(err) {
+		t.Errorf("Expected no .bitignore without --with-ignore, got %v", err)
+	}
+
+	dir = t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	code, out, _ := runCommand(handleInit, "", "--with-ignore")
+	if code != 0 || !strings.Contains(out, "Created .bitignore") {
+		t.Fatalf("Expected init to write a .bitignore, got %d: %q", code, out)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, ".bitignore"))
+	if err != nil {
+		t.Fatalf("Failed to read .bitignore: %v", err)
+	}
+	for _, pattern := range []string{"*.swp", "*~", ".DS_Store", "node_modules/", "build/"} {
+		if !strings.Contains(string(content), "\n"+pattern+"\n") {
+			t.Errorf("Expected %s in the starter .bitignore, got %q", pattern, content)
+		}
+	}
+
+	// The patterns apply at any depth, and directories ignore their contents
+	for _, file := range []string{"main.go", ".DS_Store", "notes.txt~", "src/.main.go.swp", "node_modules/pkg/index.js", "web/build/app.js"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(file), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	code, out, _ = runCommand(handleSave, "", "First")
+	if code != 0 {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+	hash := strings.TrimSpace(strings.TrimPrefix(out, "Saved state 'First' with hash "))
+	if code, out, _ := runCommand(handleList, "", "--files", hash); code != 0 || out != ".bitignore\nmain.go\n" {
+		t.Errorf("Expected only .bitignore and main.go saved, got %d: %q", code, out)
+	}
+
+	// An existing .bitignore is kept
+	dir = t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".bitignore"), []byte("*.log\n"), 0644); err != nil {
+		t.Fatalf("Failed to write .bitignore: %v", err)
+	}
+	if code, out, _ := runCommand(handleInit, "", "--with-ignore"); code != 0 || !strings.Contains(out, "Kept the existing .bitignore") {
+		t.Errorf("Expected the existing .bitignore to be kept, got %d: %q", code, out)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, ".bitignore")); string(content) != "*.log\n" {
+		t.Errorf("Expected .bitignore unchanged, got %q", content)
+	}
+}
+
+func TestRepositoryDirFromEnvironment(t *testing.T) {
+	bitDir := filepath.Join(t.TempDir(), "repo")
+	t.Setenv(core.DirEnv, bitDir)
+	work := t.TempDir()
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(work); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(origDir) })
+
+	if code, out, errOut := runCommand(handleInit, ""); code != 0 {
+		t.Fatalf("bit init failed with %d: %s%s", code, out, errOut)
+	}
+	if _, err := os.Stat(filepath.Join(bitDir, "metadata.json")); err != nil {
+		t.Errorf("Expected the repository in $%s: %v", core.DirEnv, err)
+	}
+	if _, err := os.Stat(filepath.Join(work, ".bit")); !os.IsNotExist(err) {
+		t.Errorf("Expected no .bit in the working tree, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(work, "file.txt"), []byte("content\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if code, out, _ := runCommand(handleSave, "", "First"); code != 0 {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+	if code, out, _ := runCommand(handleList, ""); code != 0 || !strings.Contains(out, "First") {
+		t.Errorf("Expected the save listed from $%s, got %d: %q", core.DirEnv, code, out)
+	}
+}
+
+func TestHandleConfig(t *testing.T) {
+	inTempRepository(t)
+
+	code, out, _ := runCommand(handleConfig, "", "--list")
+	if code != 0 || !strings.Contains(out, "hashLength=12  (default)\n") || !strings.Contains(out, "maxStashes=10  (default)\n") {
+		t.Errorf("Expected the defaults listed, got %d: %q", code, out)
+	}
+
+	if code, out, _ := runCommand(handleConfig, "", "maxStashes", "3"); code != 0 || out != "Set maxStashes to 3\n" {
+		t.Errorf("Expected maxStashes to be set, got %d: %q", code, out)
+	}
+	if code, out, _ := runCommand(handleConfig, "", "maxStashes"); code != 0 || out != "3\n" {
+		t.Errorf("Expected maxStashes to read 3, got %d: %q", code, out)
+	}
+
+	code, out, _ = runCommand(handleConfig, "", "hashLength", "100")
+	if code != 1 || !strings.Contains(out, "must be between 4 and 64") {
+		t.Errorf("Expected an out of range hashLength to be refused, got %d: %q", code, out)
+	}
+	if code, out, _ := runCommand(handleConfig, "", "hashLength"); code != 0 || out != "12\n" {
+		t.Errorf("Expected hashLength to keep its default, got %d: %q", code, out)
+	}
+	if code, out, _ := runCommand(handleConfig, "", "nope"); code != 1 || !strings.Contains(out, "unknown setting") {
+		t.Errorf("Expected an unknown setting to be refused, got %d: %q", code, out)
+	}
+}
+
+func TestProgressJSON(t *testing.T) {
+	dir := inTempRepository(t)
+	if args := stripGlobalFlags([]string{"--progress-json", "save", "First"}); !progressJSON || len(args) != 2 {
+		t.Fatalf("Expected --progress-json to be taken as a global flag, got %v", args)
+	}
+	t.Cleanup(func() { progressJSON = false })
+
+	files := []string{"a.txt", "b.txt", "c.txt"}
+	for _, file := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(file), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	code, out, errOut := runCommand(handleSave, "", "First")
+	if code != 0 {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+
+	// Every line of stderr is one event, from start through each file to done
+	var events []progressEvent
+	decoder := json.NewDecoder(strings.NewReader(errOut))
+	for decoder.More() {
+		var event progressEvent
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatalf("Failed to parse events %q: %v", errOut, err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != len(files)+2 || events[0].Type != "start" || events[len(events)-1].Type != "done" {
+		t.Fatalf("Expected start, %d file events and done, got %+v", len(files), events)
+	}
+	seen := make(map[string]bool)
+	for i, event := range events[1 : len(events)-1] {
+		if event.Type != "file" || event.Command != "save" || event.Done != i+1 || event.Total != len(files) {
+			t.Errorf("Unexpected file event %+v", event)
+		}
+		seen[event.Path] = true
+	}
+	for _, file := range files {
+		if !seen[file] {
+			t.Errorf("Expected an event for %s, got %+v", file, events)
+		}
+	}
+
+	// A failing command ends its stream with the error
+	code, _, errOut = runCommand(handleCheckout, "", "ffffffffffff")
+	lines := strings.Split(strings.TrimSpace(errOut), "\n")
+	var last progressEvent
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); code != 1 || err != nil || last.Type != "error" || last.Command != "checkout" || last.Error == "" {
+		t.Errorf("Expected the checkout to end with an error event, got %d: %q", code, errOut)
+	}
+}
+
+func TestSpecialFileNamesRoundTrip(t *testing.T) {
+	dir := inTempRepository(t)
+
+	files := []string{"my file (1).txt", "naïve café ☕.txt", "dir with space/🎉 emoji.md", ".hidden dir/.dotfile"}
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, file)), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(file+"\n"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	code, out, _ := runCommand(handleSave, "", "First")
+	if code != 0 {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+	hash := strings.TrimSpace(strings.TrimPrefix(out, "Saved state 'First' with hash "))
+
+	for _, file := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte("changed\n"), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	if code, out, _ := runCommand(handleDiff, "", "--name-only"); code != 0 || out != ".hidden dir/.dotfile\ndir with space/🎉 emoji.md\nmy file (1).txt\nnaïve café ☕.txt\n" {
+		t.Errorf("Expected every file listed as changed, got %d: %q", code, out)
+	}
+
+	if code, out, _ := runCommand(handleCheckout, "", hash); code != 0 {
+		t.Fatalf("Expected the checkout to succeed, got %d: %q", code, out)
+	}
+	for _, file := range files {
+		if content, err := os.ReadFile(filepath.Join(dir, file)); err != nil || string(content) != file+"\n" {
+			t.Errorf("Expected %q restored, got %q, %v", file, content, err)
+		}
+	}
+	if code, out, _ := runCommand(handleCat, "", hash, "naïve café ☕.txt"); code != 0 || out != "naïve café ☕.txt\n" {
+		t.Errorf("Expected cat to print the unicode file, got %d: %q", code, out)
+	}
+}
+
+func TestHandleCheckoutMerge(t *testing.T) {
+	dir := inTempRepository(t)
+
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	write("1\n2\n3\n4\n5\n")
+	code, out, _ := runCommand(handleSave, "", "First")
+	if code != 0 {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+	first := strings.TrimSpace(strings.TrimPrefix(out, "Saved state 'First' with hash "))
+	write("1\n2\n3\n4\nfive\n")
+	if code, out, _ := runCommand(handleSave, "", "Second"); code != 0 {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+
+	write("one\n2\n3\n4\nfive\n")
+	if code, out, _ := runCommand(handleCheckout, "", "--merge", first); code != 0 || !strings.Contains(out, "keeping unsaved changes") {
+		t.Fatalf("Expected a clean merge, got %d: %q", code, out)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "file.txt")); string(content) != "one\n2\n3\n4\n5\n" {
+		t.Errorf("Expected the edit carried over to the first save, got %q", content)
+	}
+
+	write("one\n2\n3\n4\nFIVE\n")
+	code, out, _ = runCommand(handleCheckout, "", "--merge", "--paths", "*.txt", first)
+	if code != 1 || !strings.Contains(out, "cannot be combined") {
+		t.Errorf("Expected --merge with --paths to be refused, got %d: %q", code, out)
+	}
+	into := filepath.Join(t.TempDir(), "into")
+	code, out, _ = runCommand(handleCheckout, "", "--merge", "--into", into, first)
+	if code != 1 || !strings.Contains(out, "cannot be combined") {
+		t.Errorf("Expected --merge with --into to be refused, got %d: %q", code, out)
+	}
+	if _, err := os.Stat(into); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing written to %s, got: %v", into, err)
+	}
+	runCommand(handleSave, "", "Third")
+	write("one\n2\n3\n4\nfunf\n")
+	if code, out, _ := runCommand(handleCheckout, "", "--merge", first); code != 1 || !strings.Contains(out, "conflict in:\n  file.txt\n") {
+		t.Errorf("Expected a conflict in file.txt, got %d: %q", code, out)
+	}
+}
+
+func TestHandleExportOutput(t *testing.T) {
+	dir := inTempRepository(t)
+
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("content\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	code, out, _ := runCommand(handleSave, "", "First")
+	if code != 0 {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+	hash := strings.TrimSpace(strings.TrimPrefix(out, "Saved state 'First' with hash "))
+
+	// A failed export neither creates nor truncates the output file
+	outDir := t.TempDir()
+	missing := filepath.Join(outDir, "missing.tar")
+	if code, _, errOut := runCommand(handleExport, "", "--output", missing, "unknown"); code != 1 || errOut == "" {
+		t.Errorf("Expected exporting an unknown save to fail, got %d: %q", code, errOut)
+	}
+	existing := filepath.Join(outDir, "existing.tar")
+	if err := os.WriteFile(existing, []byte("keep"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if code, _, errOut := runCommand(handleExport, "", "--output", existing, "unknown"); code != 1 || errOut == "" {
+		t.Errorf("Expected exporting an unknown save to fail, got %d: %q", code, errOut)
+	}
+	if content, err := os.ReadFile(existing); err != nil || string(content) != "keep" {
+		t.Errorf("Expected the existing file untouched, got %q, %v", content, err)
+	}
+	if entries, _ := os.ReadDir(outDir); len(entries) != 1 {
+		t.Errorf("Expected only the existing file in the output directory, got %v", entries)
+	}
+
+	if code, out, _ := runCommand(handleExport, "", "--output", existing, hash); code != 0 {
+		t.Fatalf("Expected the export to succeed, got %d: %q", code, out)
+	}
+	if content, err := os.ReadFile(existing); err != nil || !bytes.Contains(content, []byte("content\n")) {
+		t.Errorf("Expected the archive to replace the existing file, got %q, %v", content, err)
+	}
+	if entries, _ := os.ReadDir(outDir); len(entries) != 1 {
+		t.Errorf("Expected no temporary file left behind, got %v", entries)
+	}
+}
+
+func TestHandleCheckoutPatterns(t *testing.T) {
+	dir := inTempRepository(t)
+
+	write := func(file, content string) {
+		t.Helper()
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	read := func(file string) string {
+		content, _ := os.ReadFile(filepath.Join(dir, file))
+		return string(content)
+	}
+	write("src/main.go", "saved\n")
+	write("src/sub/util.go", "saved\n")
+	code, out, _ := runCommand(handleSave, "", "First")
+	if code != 0 {
+		t.Fatalf("Expected the save to succeed, got %d: %q", code, out)
+	}
+	hash := strings.TrimSpace(strings.TrimPrefix(out, "Saved state 'First' with hash "))
+
+	// A single star does not cross directories
+	write("src/main.go", "edited\n")
+	write("src/sub/util.go", "edited\n")
+	if code, out, _ := runCommand(handleCheckout, "", "--paths", "src/*", hash); code != 0 {
+		t.Fatalf("Expected the checkout to succeed, got %d: %q", code, out)
+	}
+	if read("src/main.go") != "saved\n" || read("src/sub/util.go") != "edited\n" {
+		t.Errorf("Expected only src/main.go restored, got %q and %q", read("src/main.go"), read("src/sub/util.go"))
+	}
+	if code, out, _ := runCommand(handleCheckout, "", "--paths", "src/**", hash); code != 0 {
+		t.Fatalf("Expected the checkout to succeed, got %d: %q", code, out)
+	}
+	if read("src/sub/util.go") != "saved\n" {
+		t.Errorf("Expected src/sub/util.go restored, got %q", read("src/sub/util.go"))
+	}
+
+	// Nor does it when keeping files
+	write("debug.log", "log\n")
+	write("src/debug.log", "log\n")
+	if code, out, _ := runCommand(handleCheckout, "", "--keep", "*.log", hash); code != 0 {
+		t.Fatalf("Expected the checkout to succeed, got %d: %q", code, out)
+	}
+	if read("debug.log") != "log\n" {
+		t.Errorf("Expected debug.log kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "src/debug.log")); !os.IsNotExist(err) {
+		t.Errorf("Expected src/debug.log removed, got: %v", err)
 	}
 }
@@ -4,4 +4,4 @@ go 1.21
 
 require github.com/gobwas/glob v0.2.3
 
-require github.com/sergi/go-diff v1.3.1 // indirect
+require github.com/sergi/go-diff v1.3.1
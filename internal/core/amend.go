@@ -0,0 +1,166 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"bit/internal/util"
+)
+
+// AmendFile stores the working tree version of file, relative to the
+// repository root, in the latest save instead of making a new save. A file
+// the save is missing is added to it and one it already has is updated; no
+// other file is read. The latest save must be checked out, and ignored files
+// are refused. Unless allowLarge is set, a file over the maxFileSize limit is
+// refused as well. The amended save keeps its hash and is returned.
+func (r *Repository) AmendFile(file string, allowLarge bool) (Save, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return Save{}, err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return Save{}, err
+	}
+	defer unlock()
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return Save{}, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	if len(metadata.Saves) == 0 {
+		return Save{}, fmt.Errorf("no save to amend")
+	}
+	save := &metadata.Saves[len(metadata.Saves)-1]
+
+	// Saves made later would be based on the content before the amendment
+	head, err := r.Head()
+	if err != nil {
+		return Save{}, err
+	}
+	if head != save.Hash {
+		return Save{}, fmt.Errorf("can only amend the latest save %s, but %s is checked out", save.Hash, head)
+	}
+	if !r.fs.Exists(util.DeltaSetPath(save.Hash, r.objectsDir)) {
+		return Save{}, fmt.Errorf("cannot amend save %s: it stores full files", save.Hash)
+	}
+
+	if util.IsBitDirectory(file) {
+		return Save{}, fmt.Errorf("%s is part of the repository directory", file)
+	}
+	patterns, err := r.loadIgnorePatterns()
+	if err != nil {
+		return Save{}, fmt.Errorf("failed to load ignore patterns: %w", err)
+	}
+	if file != ignoreFile && util.IsIgnored(file, patterns) {
+		return Save{}, fmt.Errorf("%s is ignored", file)
+	}
+
+	info, err := r.fs.Lstat(r.path(file))
+	if err != nil {
+		return Save{}, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	if info.IsDir() {
+		return Save{}, fmt.Errorf("%s is a directory", file)
+	}
+	snap := snapshot{files: []string{file}, symlinks: make(map[string]bool), sizes: map[string]int64{file: info.Size()}, modes: make(map[string]os.FileMode), modTimes: make(map[string]time.Time)}
+	if info.Mode()&os.ModeSymlink != 0 {
+		snap.symlinks[file] = true
+	} else {
+		snap.modes[file] = info.Mode().Perm()
+		snap.modTimes[file] = info.ModTime()
+	}
+	config, err := r.loadConfig()
+	if err != nil {
+		return Save{}, err
+	}
+	if !allowLarge {
+		if err := checkSaveSize(snap, config); err != nil {
+			return Save{}, err
+		}
+	}
+	if snap.lineEndings, err = r.lineEndingsFor(config); err != nil {
+		return Save{}, err
+	}
+
+	// The file is stored as a new save of it alone would store it
+	var baseSave *Save
+	chainLength := 0
+	if i := saveIndex(metadata, save.BaseSaveHash); i >= 0 {
+		baseSave = &metadata.Saves[i]
+		saveMap := make(map[string]int, len(metadata.Saves))
+		for i, s := range metadata.Saves {
+			saveMap[s.Hash] = i
+		}
+		chainLength = r.deltaChainLength(metadata, saveMap, file, baseSave.Hash, make(map[string]map[string]util.DeltaInfo))
+	}
+	attributes, err := r.loadAttributes()
+	if err != nil {
+		return Save{}, err
+	}
+
+	op := r.newOperation()
+	delta, _, err := r.saveFileAsDelta(op, file, file, r.workingTreeSource(snap), baseSave, baseSave != nil && containsFile(baseSave.Files, file), chainLength, attributes.StoragePolicy(file))
+	if err != nil {
+		op.rollback()
+		return Save{}, err
+	}
+	delta.IsSymlink = snap.symlinks[file]
+	delta.Mode = snap.modes[file]
+	delta.ModTime = unixNano(snap.modTimes[file])
+	delta.Normalized = snap.lineEndings.normalized(file)
+
+	if delta, err = util.CompressDelta(delta); err != nil {
+		op.rollback()
+		return Save{}, err
+	}
+	contentHashes := make(map[string]string, len(save.Files)+1)
+	err = r.editDeltaSet(save.Hash, func(deltaSet *util.DeltaSet) {
+		replaced := false
+		for i := range deltaSet.Deltas {
+			if deltaSet.Deltas[i].Path == file {
+				deltaSet.Deltas[i] = delta
+				replaced = true
+			}
+		}
+		if !replaced {
+			deltaSet.Deltas = append(deltaSet.Deltas, delta)
+			sort.Slice(deltaSet.Deltas, func(i, j int) bool {
+				return deltaSet.Deltas[i].Path < deltaSet.Deltas[j].Path
+			})
+		}
+		for _, d := range deltaSet.Deltas {
+			if !d.IsDeleted {
+				contentHashes[d.Path] = d.ContentHash
+			}
+		}
+	})
+	if err != nil {
+		op.rollback()
+		return Save{}, err
+	}
+
+	if !containsFile(save.Files, file) {
+		save.Files = append(save.Files, file)
+		sort.Strings(save.Files)
+		save.Dirs = emptyDirs(save.Dirs, save.Files)
+	}
+	if save.TreeHash != "" {
+		save.TreeHash = treeHash(save.Files, contentHashes)
+	}
+	if save.DeltaDepths != nil {
+		save.DeltaDepths[file] = 0
+		if delta.Blob == "" {
+			save.DeltaDepths[file] = chainLength + 1
+		}
+	}
+	if err := r.signSave(save); err != nil {
+		return Save{}, err
+	}
+	if err := r.saveMetadata(metadata); err != nil {
+		return Save{}, fmt.Errorf("failed to save metadata: %w", err)
+	}
+	return *save, nil
+}
@@ -0,0 +1,134 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"bit/internal/util"
+)
+
+// AnnotatedLine is a line of a file together with the save that last changed it
+type AnnotatedLine struct {
+	Hash   string `json:"hash"`
+	Name   string `json:"name"`
+	Number int    `json:"number"`
+	Line   string `json:"line"`
+}
+
+// Annotate returns each line of file as it was at the save referenced by hash,
+// which may be a hash prefix or a tag, or the checked out save when hash is
+// empty, with the save that introduced or last modified it. Lines are traced
+// back through the saves each save was based on until the file did not exist
+// or every line has been attributed.
+func (r *Repository) Annotate(file, hash string) ([]AnnotatedLine, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	if hash == "" {
+		if hash, err = r.Head(); err != nil {
+			return nil, err
+		}
+		if hash == "" {
+			return nil, fmt.Errorf("nothing to annotate before the first save")
+		}
+	}
+	resolved, err := resolveHash(metadata, hash)
+	if err != nil {
+		return nil, err
+	}
+	target := *resolved
+	file = path.Clean(filepath.ToSlash(file))
+
+	// Reconstructed versions are cached by the operation, so each delta along
+	// the chain is applied once
+	op := r.newOperation()
+	contentAt := func(save Save) (string, bool, error) {
+		if !containsFile(save.Files, file) {
+			return "", false, nil
+		}
+		content, err := op.fileContent(file, save.Hash)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to reconstruct %s in save %s: %w", file, save.Hash, err)
+		}
+		return string(content), true, nil
+	}
+
+	current, ok, err := contentAt(target)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("file %s is not in save %s", file, target.Hash)
+	}
+	if IsBinary([]byte(current)) {
+		return nil, fmt.Errorf("file %s is binary", file)
+	}
+
+	lines := util.SplitLines(current)
+	owners := make([]Save, len(lines))
+	// positions holds where each line is found in the version being compared,
+	// or -1 once the save that introduced it is known
+	positions := make([]int, len(lines))
+	for i := range lines {
+		owners[i] = target
+		positions[i] = i
+	}
+
+	for remaining := len(lines); remaining > 0 && target.BaseSaveHash != ""; {
+		i := saveIndex(metadata, target.BaseSaveHash)
+		if i < 0 {
+			break
+		}
+		parent := metadata.Saves[i]
+		older, ok, err := contentAt(parent)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+
+		matches := util.MatchLines(older, current)
+		for line, pos := range positions {
+			if pos < 0 {
+				continue
+			}
+			if matches[pos] < 0 {
+				positions[line] = -1
+				remaining--
+				continue
+			}
+			positions[line] = matches[pos]
+			owners[line] = parent
+		}
+		target, current = parent, older
+	}
+
+	annotated := make([]AnnotatedLine, len(lines))
+	for i, line := range lines {
+		annotated[i] = AnnotatedLine{
+			Hash:   owners[i].Hash,
+			Name:   owners[i].Name,
+			Number: i + 1,
+			Line:   strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"),
+		}
+	}
+	return annotated, nil
+}
+
+// containsFile reports whether file is among the files of a save
+func containsFile(files []string, file string) bool {
+	for _, saved := range files {
+		if saved == file {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+)
+
+// defaultBranch names the line of saves made before the first branch was
+// created
+const defaultBranch = "main"
+
+// Branch is a named line of saves, identified by the save at its tip
+type Branch struct {
+	Name    string `json:"name"`
+	Hash    string `json:"hash"`
+	Current bool   `json:"current"`
+}
+
+// CreateBranch starts a branch with the given name at the checked out save.
+// Saves stay on the current branch until Switch is called. Creating the first
+// branch also names the saves made so far defaultBranch and makes it current,
+// so they keep growing from the latest save as before.
+func (r *Repository) CreateBranch(name string) error {
+	if err := r.ensureInitialized(); err != nil {
+		return err
+	}
+
+	if err := validateRefName("branch", name); err != nil {
+		return err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	if existing, ok := metadata.Branches[name]; ok {
+		return fmt.Errorf("branch %s already exists (points to %s)", name, existing)
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		return err
+	}
+	if head == "" {
+		return fmt.Errorf("cannot create branch %s before the first save", name)
+	}
+
+	headHash, current, err := r.readHeadState()
+	if err != nil {
+		return err
+	}
+
+	if metadata.Branches == nil {
+		metadata.Branches = make(map[string]string)
+	}
+	if len(metadata.Branches) == 0 {
+		metadata.Branches[defaultBranch] = metadata.Saves[len(metadata.Saves)-1].Hash
+		current = defaultBranch
+	}
+	metadata.Branches[name] = head
+
+	if err := r.saveMetadata(metadata); err != nil {
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+	return r.writeHead(headHash, current)
+}
+
+// Switch checks out the tip of the named branch and makes it the current
+// branch, so that the next save extends it. Progress, when set, is called as
+// files are restored.
+func (r *Repository) Switch(name string, progress ProgressFunc) error {
+	if err := r.ensureInitialized(); err != nil {
+		return err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	tip, ok := metadata.Branches[name]
+	if !ok {
+		return fmt.Errorf("branch %s not found", name)
+	}
+
+	if err := r.checkout("switch", tip, CheckoutOptions{Progress: progress}); err != nil {
+		return err
+	}
+	return r.writeHead(tip, name)
+}
+
+// CurrentBranch returns the name of the branch new saves go to, or "" when
+// the repository has no branches
+func (r *Repository) CurrentBranch() (string, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return "", err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return "", fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	_, branch, err := r.readHeadState()
+	if err != nil {
+		return "", err
+	}
+	if _, ok := metadata.Branches[branch]; !ok {
+		return "", nil
+	}
+	return branch, nil
+}
+
+// ListBranches returns all branches sorted by name
+func (r *Repository) ListBranches() ([]Branch, error) {
+	current, err := r.CurrentBranch()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	branches := make([]Branch, 0, len(metadata.Branches))
+	for name, hash := range metadata.Branches {
+		branches = append(branches, Branch{Name: name, Hash: hash, Current: name == current})
+	}
+	sort.Slice(branches, func(i, j int) bool {
+		return branches[i].Name < branches[j].Name
+	})
+
+	return branches, nil
+}
+
+// BranchSaves returns the saves of the named branch, oldest first, found by
+// following the base of each save back from the branch tip
+func (r *Repository) BranchSaves(name string) ([]Save, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	tip, ok := metadata.Branches[name]
+	if !ok {
+		return nil, fmt.Errorf("branch %s not found", name)
+	}
+
+	var saves []Save
+	for hash := tip; hash != ""; {
+		i := saveIndex(metadata, hash)
+		if i < 0 {
+			break
+		}
+		saves = append(saves, metadata.Saves[i])
+		hash = metadata.Saves[i].BaseSaveHash
+	}
+
+	for i, j := 0, len(saves)-1; i < j; i, j = i+1, j-1 {
+		saves[i], saves[j] = saves[j], saves[i]
+	}
+	return saves, nil
+}
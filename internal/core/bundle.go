@@ -0,0 +1,180 @@
+package core
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// bundleMarker is the first entry of every bundle, naming its format version
+const bundleMarker = "bit-bundle-v1"
+
+// Bundle writes the whole repository, its metadata and every object, to w as
+// a single tar archive that Unbundle turns back into a repository. Settings,
+// hooks, stashes and the checked out save are local to a repository and are
+// not included, so neither is a signing key.
+func (r *Repository) Bundle(w io.Writer) error {
+	if err := r.ensureInitialized(); err != nil {
+		return err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The metadata is read through loadMetadata so a corrupt file is not bundled
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	tw := tar.NewWriter(w)
+	modTime := time.Now()
+	write := func(name string, content []byte) error {
+		header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(content)), ModTime: modTime}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write %s to bundle: %w", name, err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			return fmt.Errorf("failed to write %s to bundle: %w", name, err)
+		}
+		return nil
+	}
+
+	if err := write(bundleMarker, nil); err != nil {
+		return err
+	}
+	if err := write(metadataFile, data); err != nil {
+		return err
+	}
+
+	// Objects only stashes refer to stay behind; blobs may be shared with saves
+	saves := make(map[string]bool, len(metadata.Saves))
+	for _, save := range metadata.Saves {
+		saves[save.Hash] = true
+	}
+	stashes := make(map[string]bool)
+	stashSaves := r.stashSaves()
+	for _, save := range stashSaves {
+		stashes[save.Hash] = true
+	}
+	blobOwners := r.blobOwners(metadata)
+	stashBlobs := r.blobOwners(Metadata{Saves: stashSaves})
+
+	err = r.forEachObject("", func(rel string, info os.FileInfo) error {
+		if !saves[objectOwner(rel, blobOwners)] && stashes[objectOwner(rel, stashBlobs)] {
+			return nil
+		}
+		content, err := r.fs.ReadFile(filepath.Join(r.objectsDir, filepath.FromSlash(rel)))
+		if err != nil {
+			return fmt.Errorf("failed to read object %s: %w", rel, err)
+		}
+		return write(path.Join(objectsDir, rel), content)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return tw.Close()
+}
+
+// Unbundle creates the repository from a bundle written by Bundle. The
+// repository must not exist yet. Every save is verified once the bundle is
+// read, and nothing is kept unless all of them are intact. The working tree is
+// not touched; check out a save to fill it.
+func (r *Repository) Unbundle(reader io.Reader) error {
+	if err := r.InitRepository(); err != nil {
+		return err
+	}
+	if err := r.unbundle(reader); err != nil {
+		r.fs.RemoveAll(r.bitDir)
+		if r.bitDir != r.path(bitDir) && !r.dirFromEnv {
+			r.fs.Remove(r.path(bitDir))
+		}
+		return err
+	}
+	return nil
+}
+
+// unbundle fills the newly initialized repository from reader
+func (r *Repository) unbundle(reader io.Reader) error {
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tr := tar.NewReader(reader)
+	header, err := tr.Next()
+	if err != nil || header.Name != bundleMarker {
+		return fmt.Errorf("not a bit bundle")
+	}
+
+	var metadata *Metadata
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read bundle: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(header.Name)
+		switch {
+		case name == metadataFile:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return fmt.Errorf("failed to read bundle entry %s: %w", header.Name, err)
+			}
+			metadata = &Metadata{}
+			if err := json.Unmarshal(data, metadata); err != nil {
+				return fmt.Errorf("%w: %v", ErrCorruptMetadata, err)
+			}
+		case strings.HasPrefix(name, objectsDir+"/") && !strings.Contains(name, ".."):
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				return fmt.Errorf("failed to read bundle entry %s: %w", header.Name, err)
+			}
+			target := filepath.Join(r.bitDir, filepath.FromSlash(name))
+			if err := r.fs.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create directory for %s: %w", name, err)
+			}
+			if err := r.fs.WriteFile(target, content, 0644); err != nil {
+				return fmt.Errorf("failed to write object %s: %w", name, err)
+			}
+		default:
+			return fmt.Errorf("unexpected bundle entry %s", header.Name)
+		}
+	}
+	if metadata == nil {
+		return fmt.Errorf("bundle has no metadata")
+	}
+	if err := r.saveMetadata(*metadata); err != nil {
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	// A new repository has no signing key, so only content is verified
+	issues, err := r.verifySaves(*metadata, DefaultConfig(), len(metadata.Saves))
+	if err != nil {
+		return err
+	}
+	if len(issues) > 0 {
+		return fmt.Errorf("bundle is corrupt: save %s: %s (%d problems found)", issues[0].Hash, issues[0].Problem, len(issues))
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// configFile holds repository settings inside the repository directory, unless
+// $BIT_CONFIG names another file
+const configFile = "config.json"
+
+// Config holds the repository settings read from .bit/config.json. Settings
+// missing from the file keep their defaults.
+type Config struct {
+	// MaxFileSize is the largest file, in bytes, a save accepts. 0 disables the check.
+	MaxFileSize int64 `json:"maxFileSize"`
+	// MaxSaveSize is the largest total size, in bytes, of the files in a save.
+	// 0 disables the check.
+	MaxSaveSize int64 `json:"maxSaveSize"`
+	// HashLength is the number of hex characters new save hashes start with.
+	// A hash is made longer when it would collide with an existing save.
+	HashLength int `json:"hashLength"`
+	// SigningKey, when set, signs every new save so that VerifyIntegrity can
+	// tell whether it was altered on disk. Saves are not encrypted.
+	SigningKey string `json:"signingKey,omitempty"`
+	// LineEndings, when set, stores the \r\n line endings of text files as \n
+	// and selects the endings such files are checked out with: "lf", "crlf",
+	// or "native" for those of the platform
+	LineEndings string `json:"lineEndings,omitempty"`
+	// MaxStashes is the number of working tree backups kept, the oldest being
+	// removed first. 0 disables the backups.
+	MaxStashes int `json:"maxStashes"`
+	// Author and Host, when set, are recorded on new saves instead of the
+	// name of the user and of the machine making them
+	Author string `json:"author,omitempty"`
+	Host   string `json:"host,omitempty"`
+}
+
+// Bounds of HashLength: below the minimum collisions become routine, and a
+// SHA-256 hash has no more hex characters than the maximum
+const (
+	minHashLength = 4
+	maxHashLength = 64
+)
+
+// DefaultConfig returns the settings used when config.json does not set them
+func DefaultConfig() Config {
+	return Config{
+		MaxFileSize: 100 << 20,
+		MaxSaveSize: 1 << 30,
+		HashLength:  12,
+		MaxStashes:  10,
+	}
+}
+
+// identity returns the author and host recorded on new saves: those of the
+// settings, or else the login name of the user, from $USER, $USERNAME or the
+// name of the home directory, and the host name of the machine. Either is
+// empty when it cannot be determined.
+func (c Config) identity() (author, host string) {
+	author, host = c.Author, c.Host
+	for _, env := range []string{"USER", "USERNAME"} {
+		if author == "" {
+			author = os.Getenv(env)
+		}
+	}
+	if home, err := os.UserHomeDir(); author == "" && err == nil && filepath.Base(home) != string(filepath.Separator) {
+		author = filepath.Base(home)
+	}
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	return author, host
+}
+
+// loadConfig reads the repository settings, falling back to the defaults when
+// there is no config file
+func (r *Repository) loadConfig() (Config, error) {
+	config := DefaultConfig()
+
+	data, err := r.fs.ReadFile(r.configPath)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse %s: %w", r.configPath, err)
+	}
+	if err := config.validate(); err != nil {
+		return config, fmt.Errorf("%s: %w", r.configPath, err)
+	}
+	return config, nil
+}
+
+// validate checks that every setting is in range
+func (c Config) validate() error {
+	if c.MaxFileSize < 0 {
+		return fmt.Errorf("invalid maxFileSize %d: must not be negative", c.MaxFileSize)
+	}
+	if c.MaxSaveSize < 0 {
+		return fmt.Errorf("invalid maxSaveSize %d: must not be negative", c.MaxSaveSize)
+	}
+	if c.HashLength < minHashLength || c.HashLength > maxHashLength {
+		return fmt.Errorf("invalid hashLength %d: must be between %d and %d", c.HashLength, minHashLength, maxHashLength)
+	}
+	if c.MaxStashes < 0 {
+		return fmt.Errorf("invalid maxStashes %d: must not be negative", c.MaxStashes)
+	}
+	switch c.LineEndings {
+	case "", LineEndingsLF, LineEndingsCRLF, LineEndingsNative:
+	default:
+		return fmt.Errorf("invalid lineEndings %q: must be %s, %s or %s", c.LineEndings, LineEndingsLF, LineEndingsCRLF, LineEndingsNative)
+	}
+	return nil
+}
+
+// ConfigValue is one setting as it is in effect
+type ConfigValue struct {
+	Key   string `json:"key"` // Name of the setting in config.json
+	Value string `json:"value"`
+	Set   bool   `json:"set"` // Whether config.json sets it, rather than the default applying
+}
+
+// hiddenConfigValue stands in for the signing key when settings are listed
+const hiddenConfigValue = "(hidden)"
+
+// configKey returns the name a field of Config has in config.json
+func configKey(field reflect.StructField) string {
+	key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	return key
+}
+
+// ConfigValues returns every setting as it is in effect, the default merged
+// with config.json, in the order of Config. A signing key is not shown.
+func (r *Repository) ConfigValues() ([]ConfigValue, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+	config, err := r.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	raw, err := r.readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := reflect.TypeOf(config)
+	values := make([]ConfigValue, 0, fields.NumField())
+	for i := 0; i < fields.NumField(); i++ {
+		key := configKey(fields.Field(i))
+		value := fmt.Sprint(reflect.ValueOf(config).Field(i).Interface())
+		if key == "signingKey" && value != "" {
+			value = hiddenConfigValue
+		}
+		_, set := raw[key]
+		values = append(values, ConfigValue{Key: key, Value: value, Set: set})
+	}
+	return values, nil
+}
+
+// SetConfig sets the setting named key in config.json to value, which is
+// parsed as the type of the setting. A value out of range is refused and
+// config.json is left as it was. Other settings in the file are kept.
+func (r *Repository) SetConfig(key, value string) error {
+	var field *reflect.StructField
+	fields := reflect.TypeOf(Config{})
+	for i := 0; i < fields.NumField(); i++ {
+		if f := fields.Field(i); configKey(f) == key {
+			field = &f
+		}
+	}
+	if field == nil {
+		return fmt.Errorf("unknown setting %q; bit config --list shows every setting", key)
+	}
+
+	var parsed any = value
+	switch field.Type.Kind() {
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: must be a whole number", key, value)
+		}
+		parsed = n
+	}
+	return r.editConfig(func(raw map[string]json.RawMessage) error {
+		data, err := json.Marshal(parsed)
+		if err != nil {
+			return err
+		}
+		raw[key] = data
+		return nil
+	})
+}
+
+// UnsetConfig removes the setting named key from config.json, so that its
+// default applies again
+func (r *Repository) UnsetConfig(key string) error {
+	return r.editConfig(func(raw map[string]json.RawMessage) error {
+		if _, ok := raw[key]; !ok {
+			return fmt.Errorf("%s is not set in %s", key, r.configPath)
+		}
+		delete(raw, key)
+		return nil
+	})
+}
+
+// editConfig applies edit to the settings of config.json and writes them
+// back, unless edit fails or the result is not a valid configuration
+func (r *Repository) editConfig(edit func(raw map[string]json.RawMessage) error) error {
+	if err := r.ensureInitialized(); err != nil {
+		return err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	raw, err := r.readConfigFile()
+	if err != nil {
+		return err
+	}
+	if err := edit(raw); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	config := DefaultConfig()
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("invalid setting: %w", err)
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+	if err := r.fs.WriteFile(r.configPath, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	return nil
+}
+
+// readConfigFile returns the settings config.json sets, as written, keyed by
+// name. Without a config file there are none.
+func (r *Repository) readConfigFile() (map[string]json.RawMessage, error) {
+	raw := make(map[string]json.RawMessage)
+	data, err := r.fs.ReadFile(r.configPath)
+	if os.IsNotExist(err) {
+		return raw, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", r.configPath, err)
+	}
+	return raw, nil
+}
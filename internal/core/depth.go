@@ -0,0 +1,106 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+
+	"bit/internal/util"
+)
+
+// FileDepth is the delta depth of a file at a save
+type FileDepth struct {
+	Path  string `json:"path"`
+	Depth int    `json:"depth"` // Deltas applied to rebuild the file, 0 when stored in full
+}
+
+// DepthReport lists the delta depth of every file of a save
+type DepthReport struct {
+	Hash  string      `json:"hash"`
+	Limit int         `json:"limit"` // Depth at which a save stores a changed file in full
+	Files []FileDepth `json:"files"` // Deepest first
+}
+
+// DeltaDepths reports how many deltas each file of the save referenced by
+// hash, a hash prefix or a tag, needs to be rebuilt, or of the checked out
+// save when hash is empty. Files close to the limit are the ones bit compact
+// would store in full. Depths are taken from the metadata and only computed
+// for saves made before they were recorded.
+func (r *Repository) DeltaDepths(hash string) (DepthReport, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return DepthReport{}, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return DepthReport{}, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	if hash == "" {
+		if hash, err = r.Head(); err != nil {
+			return DepthReport{}, err
+		}
+		if hash == "" {
+			return DepthReport{}, fmt.Errorf("no save is checked out")
+		}
+	}
+	save, err := resolveHash(metadata, hash)
+	if err != nil {
+		return DepthReport{}, err
+	}
+
+	depths := save.DeltaDepths
+	if depths == nil {
+		depths = r.computeDeltaDepths(metadata, *save)
+	}
+
+	report := DepthReport{Hash: save.Hash, Limit: maxDeltaChainLength, Files: make([]FileDepth, 0, len(save.Files))}
+	for _, file := range save.Files {
+		report.Files = append(report.Files, FileDepth{Path: file, Depth: depths[file]})
+	}
+	sort.SliceStable(report.Files, func(i, j int) bool {
+		return report.Files[i].Depth > report.Files[j].Depth
+	})
+	return report, nil
+}
+
+// computeDeltaDepths walks the delta chain of every file of save
+func (r *Repository) computeDeltaDepths(metadata Metadata, save Save) map[string]int {
+	saveMap := make(map[string]int, len(metadata.Saves))
+	for i, s := range metadata.Saves {
+		saveMap[s.Hash] = i
+	}
+	return r.chainDepths(metadata, saveMap, save, make(map[string]map[string]util.DeltaInfo))
+}
+
+// chainDepths is computeDeltaDepths with the lookups shared between saves
+func (r *Repository) chainDepths(metadata Metadata, saveMap map[string]int, save Save, deltaSets map[string]map[string]util.DeltaInfo) map[string]int {
+	depths := make(map[string]int, len(save.Files))
+	for _, file := range save.Files {
+		depths[file] = r.deltaChainLength(metadata, saveMap, file, save.Hash, deltaSets)
+	}
+	return depths
+}
+
+// updateDeltaDepths recomputes the recorded delta depths of the saves in
+// metadata from index first on, after their delta chains were rewritten.
+// Signed saves are signed again, as their delta set or entry changed. The
+// metadata is not saved.
+func (r *Repository) updateDeltaDepths(metadata *Metadata, first int) error {
+	saveMap := make(map[string]int, len(metadata.Saves))
+	for i, save := range metadata.Saves {
+		saveMap[save.Hash] = i
+	}
+	deltaSets := make(map[string]map[string]util.DeltaInfo)
+
+	for i := first; i < len(metadata.Saves); i++ {
+		save := &metadata.Saves[i]
+		if save.DeltaDepths != nil {
+			save.DeltaDepths = r.chainDepths(*metadata, saveMap, *save, deltaSets)
+		}
+		if save.Signature != "" {
+			if err := r.signSave(save); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
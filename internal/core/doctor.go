@@ -0,0 +1,114 @@
+package core
+
+import (
+	"bytes"
+	"os"
+
+	"bit/internal/util"
+)
+
+// doctorVerifySaves is the number of latest saves Doctor checks for integrity,
+// keeping it quick on long histories. bit fsck --verify checks every save.
+const doctorVerifySaves = 10
+
+// DoctorReport describes the health of a repository. Checks that depend on a
+// failed one are skipped and left empty.
+type DoctorReport struct {
+	Dir            string           `json:"dir"`                     // Repository directory
+	Initialized    bool             `json:"initialized"`             // Whether the repository directory exists
+	MetadataError  string           `json:"metadataError,omitempty"` // Why the metadata could not be read
+	Saves          int              `json:"saves"`
+	Objects        int              `json:"objects"`
+	TotalBytes     int64            `json:"totalBytes"`
+	Orphans        []string         `json:"orphans"`  // Objects no save refers to
+	Verified       int              `json:"verified"` // Latest saves checked for integrity
+	Issues         []IntegrityIssue `json:"issues"`
+	IgnorePatterns []string         `json:"ignorePatterns"` // Global patterns followed by those of .bitignore
+	IgnoreError    string           `json:"ignoreError,omitempty"`
+	Errors         []string         `json:"errors,omitempty"` // Checks that could not be run
+}
+
+// Healthy reports whether the repository exists and no check found a problem.
+// Orphaned objects waste space but do no harm, so they are not a problem.
+func (d DoctorReport) Healthy() bool {
+	return d.Initialized && d.MetadataError == "" && len(d.Issues) == 0 &&
+		d.IgnoreError == "" && len(d.Errors) == 0
+}
+
+// Doctor runs every health check on the repository and reports what it
+// found. Problems are returned in the report rather than as an error.
+func (r *Repository) Doctor() DoctorReport {
+	report := DoctorReport{Dir: r.bitDir, Orphans: []string{}, Issues: []IntegrityIssue{}, IgnorePatterns: []string{}}
+	fail := func(err error) {
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	report.IgnorePatterns = r.ignorePatternSources()
+	if _, err := r.loadIgnorePatterns(); err != nil {
+		report.IgnoreError = err.Error()
+	}
+
+	if err := r.ensureInitialized(); err != nil {
+		return report
+	}
+	report.Initialized = true
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		report.MetadataError = err.Error()
+		return report
+	}
+	report.Saves = len(metadata.Saves)
+
+	if size, err := r.Size(); err != nil {
+		fail(err)
+	} else {
+		report.Objects = size.Objects
+		report.TotalBytes = size.TotalBytes
+	}
+
+	if orphans, err := r.FindOrphans(); err != nil {
+		fail(err)
+	} else {
+		report.Orphans = orphans
+	}
+
+	config, err := r.loadConfig()
+	if err != nil {
+		fail(err)
+		return report
+	}
+	issues, err := r.verifySaves(metadata, config, doctorVerifySaves)
+	if err != nil {
+		fail(err)
+		return report
+	}
+	report.Verified = min(doctorVerifySaves, len(metadata.Saves))
+	if issues != nil {
+		report.Issues = issues
+	}
+	return report
+}
+
+// ignorePatternSources returns the ignore patterns in effect as written: those
+// of the global ignore file followed by those of .bitignore. Unreadable files
+// contribute nothing; loadIgnorePatterns reports why.
+func (r *Repository) ignorePatternSources() []string {
+	var patterns []util.IgnorePattern
+	if path, err := util.GlobalIgnorePath(); err == nil {
+		if content, err := os.ReadFile(path); err == nil {
+			global, _ := util.ReadIgnorePatterns(bytes.NewReader(content))
+			patterns = append(patterns, global...)
+		}
+	}
+	if content, err := r.fs.ReadFile(r.ignorePath); err == nil {
+		local, _ := util.ReadIgnorePatterns(bytes.NewReader(content))
+		patterns = append(patterns, local...)
+	}
+
+	sources := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		sources = append(sources, pattern.String())
+	}
+	return sources
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+
+	"bit/internal/util"
+)
+
+// Values of Config.LineEndings
+const (
+	LineEndingsLF     = "lf"
+	LineEndingsCRLF   = "crlf"
+	LineEndingsNative = "native" // crlf on Windows, lf elsewhere
+)
+
+var (
+	crlf = []byte("\r\n")
+	lf   = []byte("\n")
+)
+
+// lineEndings converts the \r\n line endings of text files read from the
+// working tree to \n, remembering which files it converted so that their save
+// can record it. Files are text unless they look binary or have the binary
+// storage policy. A nil *lineEndings converts nothing.
+type lineEndings struct {
+	attributes util.Attributes
+
+	mutex     sync.Mutex
+	converted map[string]bool
+}
+
+// lineEndingsFor returns the converter selected by config, or nil when line
+// endings are kept as they are
+func (r *Repository) lineEndingsFor(config Config) (*lineEndings, error) {
+	if config.LineEndings == "" {
+		return nil, nil
+	}
+	attributes, err := r.loadAttributes()
+	if err != nil {
+		return nil, err
+	}
+	return &lineEndings{attributes: attributes, converted: make(map[string]bool)}, nil
+}
+
+// normalize returns content with every \r\n replaced by \n if file is a text
+// file, or content itself
+func (l *lineEndings) normalize(file string, content []byte) []byte {
+	if l == nil || !bytes.Contains(content, crlf) || IsBinary(content) ||
+		l.attributes.StoragePolicy(file) == util.StorageBinary {
+		return content
+	}
+
+	l.mutex.Lock()
+	l.converted[file] = true
+	l.mutex.Unlock()
+	return bytes.ReplaceAll(content, crlf, lf)
+}
+
+// normalized reports whether normalize converted the line endings of file
+func (l *lineEndings) normalized(file string) bool {
+	if l == nil {
+		return false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.converted[file]
+}
+
+// checkoutCRLF reports whether files whose line endings were converted when
+// saved are checked out with \r\n under the given Config.LineEndings
+func checkoutCRLF(setting string) bool {
+	return setting == LineEndingsCRLF || setting == LineEndingsNative && runtime.GOOS == "windows"
+}
+
+// restoreCRLF reverses normalize
+func restoreCRLF(content []byte) []byte {
+	return bytes.ReplaceAll(content, lf, crlf)
+}
+
+// lineEndingsInSave returns a converter that records the files of the given
+// save whose line endings were converted, for a save made from its content.
+// That content is already converted, so it is not passed through normalize.
+func (r *Repository) lineEndingsInSave(saveHash string) *lineEndings {
+	return &lineEndings{converted: r.normalizedInSave(saveHash)}
+}
+
+// normalizedInSave returns the files of the given save whose line endings were
+// converted when it was made
+func (r *Repository) normalizedInSave(saveHash string) map[string]bool {
+	normalized := make(map[string]bool)
+
+	deltaSet, err := r.loadDeltaSet(saveHash)
+	if err != nil {
+		return normalized
+	}
+
+	for _, delta := range deltaSet.Deltas {
+		if delta.Normalized {
+			normalized[delta.Path] = true
+		}
+	}
+	return normalized
+}
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"bit/internal/util"
+)
+
+// Names of the hooks run around saves, looked up in the hooks directory
+const (
+	hooksDir     = "hooks"
+	preSaveHook  = "pre-save"
+	postSaveHook = "post-save"
+)
+
+// runHook runs the named hook from .bit/hooks, if it exists and is
+// executable, in the repository root with args and the given environment
+// variables added to its own. A hook exiting with a non-zero status is
+// returned as an error. Hooks only run on the real filesystem, never against
+// the in-memory one used by tests.
+func (r *Repository) runHook(name string, args []string, env map[string]string) error {
+	if _, ok := r.fs.(*util.OsFileSystem); !ok {
+		return nil
+	}
+
+	hookPath, err := filepath.Abs(r.bitPath(filepath.Join(hooksDir, name)))
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s hook: %w", name, err)
+	}
+	info, err := os.Stat(hookPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to check %s hook: %w", name, err)
+	}
+	if info.IsDir() || info.Mode().Perm()&0111 == 0 {
+		return nil
+	}
+
+	cmd := exec.Command(hookPath, args...)
+	cmd.Dir = r.root
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook failed: %w", name, err)
+	}
+	return nil
+}
+
+// hookEnv returns the environment variables describing the repository to hooks
+func (r *Repository) hookEnv(saveName string) map[string]string {
+	env := map[string]string{"BIT_SAVE_NAME": saveName}
+	if root, err := filepath.Abs(r.root); err == nil {
+		env["BIT_ROOT"] = root
+	}
+	if bitDir, err := filepath.Abs(r.bitDir); err == nil {
+		env["BIT_DIR"] = bitDir
+	}
+	if head, err := r.Head(); err == nil {
+		env["BIT_HEAD"] = head
+	}
+	return env
+}
@@ -0,0 +1,385 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"bit/internal/util"
+)
+
+// MergeResult describes the outcome of Merge
+type MergeResult struct {
+	// Hash is the merge save, empty when conflicts left the merge pending or
+	// there was nothing to merge
+	Hash string `json:"hash,omitempty"`
+	// Base is the common ancestor both sides' changes were taken from, empty
+	// when the saves share no history
+	Base string `json:"base,omitempty"`
+	// Conflicts lists the files both sides changed in incompatible ways
+	Conflicts []string `json:"conflicts"`
+	// UpToDate is set when the other save is already part of the checked out save
+	UpToDate bool `json:"upToDate"`
+}
+
+// fileVersion is the state of a file at one side of a merge
+type fileVersion struct {
+	exists  bool
+	content []byte
+	symlink bool
+}
+
+func (v fileVersion) equal(other fileVersion) bool {
+	if !v.exists || !other.exists {
+		return v.exists == other.exists
+	}
+	return v.symlink == other.symlink && bytes.Equal(v.content, other.content)
+}
+
+// Merge combines the changes made since their common ancestor in the save
+// referenced by other, which may be a hash prefix, a tag or a branch, with
+// those of the checked out save. Changes to different files or lines are
+// combined into the working tree and saved as a merge save. Text files changed
+// on the same lines by both sides are written with conflict markers; other
+// conflicting files keep their checked out version. When there are conflicts
+// no save is made: the next save, once they are resolved, concludes the merge.
+// The working tree must have no unsaved changes.
+func (r *Repository) Merge(other string) (MergeResult, error) {
+	result := MergeResult{Conflicts: []string{}}
+
+	if err := r.ensureInitialized(); err != nil {
+		return result, err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return result, err
+	}
+	defer unlock()
+
+	if pending, err := r.readMergeHead(); err != nil {
+		return result, err
+	} else if pending != "" {
+		return result, fmt.Errorf("a merge of %s is in progress, resolve its conflicts and save first", pending)
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return result, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	ref := other
+	if tip, ok := metadata.Branches[other]; ok {
+		ref = tip
+	}
+	otherSave, err := resolveHash(metadata, ref)
+	if err != nil {
+		return result, err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return result, err
+	}
+	if head == "" {
+		return result, fmt.Errorf("nothing to merge into before the first save")
+	}
+
+	if clean, err := r.IsClean(); err != nil {
+		return result, err
+	} else if !clean {
+		return result, fmt.Errorf("the working tree has unsaved changes, save them before merging")
+	}
+
+	result.Base = commonAncestor(metadata, head, otherSave.Hash)
+	if result.Base == otherSave.Hash {
+		result.UpToDate = true
+		return result, nil
+	}
+
+	op := r.newOperation()
+	baseVersion, baseFiles := r.saveVersions(op, metadata, result.Base)
+	headVersion, headFiles := r.saveVersions(op, metadata, head)
+	otherVersion, otherFiles := r.saveVersions(op, metadata, otherSave.Hash)
+
+	files := make(map[string]bool)
+	for _, list := range [][]string{baseFiles, headFiles, otherFiles} {
+		for _, file := range list {
+			files[file] = true
+		}
+	}
+	sorted := make([]string, 0, len(files))
+	for file := range files {
+		sorted = append(sorted, file)
+	}
+	sort.Strings(sorted)
+
+	for _, file := range sorted {
+		base, err := baseVersion(file)
+		if err != nil {
+			return result, err
+		}
+		ours, err := headVersion(file)
+		if err != nil {
+			return result, err
+		}
+		theirs, err := otherVersion(file)
+		if err != nil {
+			return result, err
+		}
+
+		merged, conflict := mergeVersions(base, ours, theirs, "HEAD", other)
+		if conflict {
+			result.Conflicts = append(result.Conflicts, file)
+		}
+		if merged.equal(ours) {
+			continue
+		}
+
+		if !merged.exists {
+			if err := r.fs.Remove(r.path(file)); err != nil && !os.IsNotExist(err) {
+				return result, fmt.Errorf("failed to remove %s: %w", file, err)
+			}
+			continue
+		}
+		if err := r.writeWorkingFile(file, merged.content, merged.symlink); err != nil {
+			return result, fmt.Errorf("failed to write %s: %w", file, err)
+		}
+	}
+
+	if err := r.fs.WriteFile(r.bitPath(mergeHeadFile), []byte(otherSave.Hash+"\n"), 0644); err != nil {
+		return result, fmt.Errorf("failed to record merge: %w", err)
+	}
+	if len(result.Conflicts) > 0 {
+		return result, nil
+	}
+
+	result.Hash, err = r.saveState(fmt.Sprintf("Merge %s", other), SaveOptions{})
+	return result, err
+}
+
+// saveVersions returns a function reading the version of a file at the save
+// with the given hash, along with the files of that save. A hash that names
+// no save, such as the empty hash, has no files.
+func (r *Repository) saveVersions(op *operation, metadata Metadata, hash string) (func(string) (fileVersion, error), []string) {
+	i := saveIndex(metadata, hash)
+	if i < 0 {
+		return func(string) (fileVersion, error) { return fileVersion{}, nil }, nil
+	}
+	save := metadata.Saves[i]
+	inSave := make(map[string]bool, len(save.Files))
+	for _, file := range save.Files {
+		inSave[file] = true
+	}
+	symlinks := r.symlinksInSave(hash)
+	return func(file string) (fileVersion, error) {
+		if !inSave[file] {
+			return fileVersion{}, nil
+		}
+		content, err := op.fileContent(file, hash)
+		if err != nil {
+			return fileVersion{}, fmt.Errorf("failed to read %s at %s: %w", file, hash, err)
+		}
+		return fileVersion{exists: true, content: content, symlink: symlinks[file]}, nil
+	}, save.Files
+}
+
+// CheckoutMerge checks out the save referenced by hash, which may be a hash
+// prefix or a tag, like Checkout, but carries the unsaved changes of the
+// working tree over instead of discarding them. The changes made to each file
+// since the checked out save are merged into its version at the new save as
+// Merge merges saves: text files changed on the same lines by both are written
+// with conflict markers, and other conflicting files take the version of the
+// new save. The working tree is stashed first, so the changes can still be
+// recovered as they were. CheckoutMerge returns the files with conflicts.
+func (r *Repository) CheckoutMerge(hash string, progress ProgressFunc) ([]string, error) {
+	conflicts := []string{}
+
+	if err := r.ensureInitialized(); err != nil {
+		return conflicts, err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return conflicts, err
+	}
+	defer unlock()
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return conflicts, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	target, err := resolveHash(metadata, hash)
+	if err != nil {
+		return conflicts, err
+	}
+	head, err := r.Head()
+	if err != nil {
+		return conflicts, err
+	}
+	config, err := r.loadConfig()
+	if err != nil {
+		return conflicts, err
+	}
+
+	// Local changes are merged before the working tree is replaced
+	snap, err := r.getFilesToSave()
+	if err != nil {
+		return conflicts, err
+	}
+	op := r.newOperation()
+	headVersion, headFiles := r.saveVersions(op, metadata, head)
+	targetVersion, _ := r.saveVersions(op, metadata, target.Hash)
+	source := r.workingTreeSource(snap)
+	localVersion := func(file string) (fileVersion, error) {
+		if !containsFile(snap.files, file) {
+			return fileVersion{}, nil
+		}
+		content, err := source(file)
+		if err != nil {
+			return fileVersion{}, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		return fileVersion{exists: true, content: content, symlink: snap.symlinks[file]}, nil
+	}
+
+	files := append(append([]string(nil), headFiles...), snap.files...)
+	sort.Strings(files)
+	merged := make(map[string]fileVersion)
+	for i, file := range files {
+		if i > 0 && files[i-1] == file {
+			continue
+		}
+		base, err := headVersion(file)
+		if err != nil {
+			return conflicts, err
+		}
+		local, err := localVersion(file)
+		if err != nil {
+			return conflicts, err
+		}
+		if base.equal(local) {
+			continue
+		}
+		ours, err := targetVersion(file)
+		if err != nil {
+			return conflicts, err
+		}
+
+		version, conflict := mergeVersions(base, ours, local, target.Hash, "working tree")
+		if conflict {
+			conflicts = append(conflicts, file)
+		}
+		merged[file] = version
+	}
+
+	if err := r.checkout("checkout", target.Hash, CheckoutOptions{Progress: progress}); err != nil {
+		return conflicts, err
+	}
+
+	// The merged files replace those just checked out
+	restoreEndings := checkoutCRLF(config.LineEndings)
+	for _, file := range files {
+		version, ok := merged[file]
+		if !ok {
+			continue
+		}
+		if !version.exists {
+			if err := r.fs.Remove(r.path(file)); err != nil && !os.IsNotExist(err) {
+				return conflicts, fmt.Errorf("failed to remove %s: %w", file, err)
+			}
+			continue
+		}
+		content := version.content
+		if restoreEndings && snap.lineEndings.normalized(file) && !version.symlink {
+			content = restoreCRLF(content)
+		}
+		if err := r.writeWorkingFile(file, content, version.symlink); err != nil {
+			return conflicts, fmt.Errorf("failed to write %s: %w", file, err)
+		}
+		if mode, ok := snap.modes[file]; ok && !version.symlink {
+			if err := r.fs.Chmod(r.path(file), mode); err != nil {
+				return conflicts, fmt.Errorf("failed to set mode of %s: %w", file, err)
+			}
+		}
+	}
+	return conflicts, nil
+}
+
+// mergeVersions combines the changes made to a file from base to ours and from
+// base to theirs, reporting whether both sides changed it incompatibly. Text
+// conflicts are marked with oursLabel and theirsLabel.
+func mergeVersions(base, ours, theirs fileVersion, oursLabel, theirsLabel string) (fileVersion, bool) {
+	switch {
+	case ours.equal(theirs), base.equal(theirs):
+		return ours, false
+	case base.equal(ours):
+		return theirs, false
+	}
+
+	// Deleted on one side and changed on the other, or content that cannot
+	// hold conflict markers: keep the checked out version if there is one
+	if !ours.exists || !theirs.exists || ours.symlink || theirs.symlink ||
+		IsBinary(base.content) || IsBinary(ours.content) || IsBinary(theirs.content) {
+		if ours.exists {
+			return ours, true
+		}
+		return theirs, true
+	}
+
+	merged, conflict := util.MergeText(string(base.content), string(ours.content), string(theirs.content), oursLabel, theirsLabel)
+	return fileVersion{exists: true, content: []byte(merged)}, conflict
+}
+
+// commonAncestor returns the nearest save that both a and b descend from,
+// following both the base and the merge parents of each save, or "" if their
+// histories never meet
+func commonAncestor(metadata Metadata, a, b string) string {
+	parents := func(hash string) []string {
+		i := saveIndex(metadata, hash)
+		if i < 0 {
+			return nil
+		}
+		return metadata.Saves[i].Parents()
+	}
+
+	ancestorsOfA := make(map[string]bool)
+	for queue := []string{a}; len(queue) > 0; queue = queue[1:] {
+		if hash := queue[0]; !ancestorsOfA[hash] {
+			ancestorsOfA[hash] = true
+			queue = append(queue, parents(hash)...)
+		}
+	}
+
+	visited := make(map[string]bool)
+	for queue := []string{b}; len(queue) > 0; queue = queue[1:] {
+		hash := queue[0]
+		if ancestorsOfA[hash] {
+			return hash
+		}
+		if !visited[hash] {
+			visited[hash] = true
+			queue = append(queue, parents(hash)...)
+		}
+	}
+	return ""
+}
+
+// readMergeHead returns the hash of the save whose merge is waiting for its
+// conflicts to be resolved, empty if there is none
+func (r *Repository) readMergeHead() (string, error) {
+	data, err := r.fs.ReadFile(r.bitPath(mergeHeadFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", mergeHeadFile, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// clearMergeHead forgets a pending merge
+func (r *Repository) clearMergeHead() error {
+	if err := r.fs.Remove(r.bitPath(mergeHeadFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear pending merge: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"bit/internal/util"
+)
+
+// Object writes that fail are retried objectWriteAttempts times in total,
+// waiting objectWriteBackoff before the first retry and twice as long before
+// each following one, to ride out transient filesystem errors
+var (
+	objectWriteAttempts = 3
+	objectWriteBackoff  = 10 * time.Millisecond
+)
+
+// contentKey identifies the content of a file at a specific save
+type contentKey struct {
+	path     string
+	saveHash string
+}
+
+// storedBlob is a blob stored during an operation. The first file with its
+// content writes it; later files wait for that write and share its outcome.
+type storedBlob struct {
+	once sync.Once
+	err  error
+}
+
+// operation carries state for the duration of a single repository operation such
+// as a save or a checkout. Reconstructed file contents are memoized so that files
+// sharing a long delta chain are not replayed over and over. An operation is safe
+// for concurrent use by the workers of that operation, but is never shared
+// between operations.
+type operation struct {
+	repo *Repository
+
+	mutex    sync.Mutex
+	contents map[contentKey][]byte
+	// reconstructions counts content lookups that were not served from the cache
+	reconstructions int
+	// deltaSets indexes the delta sets read so far by save hash, then by path
+	deltaSets map[string]map[string]util.DeltaInfo
+	// saves indexes the saves by hash once a reconstruction has needed them
+	saves map[string]*Save
+	// blobs indexes the blobs stored by this operation by content hash
+	blobs map[string]*storedBlob
+	// report, when set, is told how each file of a save was stored
+	report func(FileReport)
+	// skipUnchanged makes a save that records no changes fail with ErrNothingToSave
+	skipUnchanged bool
+	// progress, when set, is told each time a file has been processed
+	progress      ProgressFunc
+	progressMutex sync.Mutex
+	filesDone     int
+	// written lists the objects created by this operation, removed by rollback
+	written []string
+	// mergeParents, when set, is recorded as the MergeParents of the save
+	mergeParents []string
+	// unmaps releases the working files mapped into memory by this operation
+	unmaps []func() error
+	// mapped records the size and modification time of each file mapped by
+	// readMapped before it was read, to notice changes made while it was used
+	mapped map[string]os.FileInfo
+}
+
+// errMappedFileChanged is returned by checkMapped when a working file changed
+// while its content was mapped into memory
+var errMappedFileChanged = errors.New("file changed while it was being saved")
+
+// newOperation starts a new operation on the repository
+func (r *Repository) newOperation() *operation {
+	return &operation{
+		repo:      r,
+		contents:  make(map[contentKey][]byte),
+		deltaSets: make(map[string]map[string]util.DeltaInfo),
+		blobs:     make(map[string]*storedBlob),
+	}
+}
+
+// fileContent returns the content of file at the given save, reconstructing it
+// only if it has not already been reconstructed during this operation
+func (op *operation) fileContent(file, saveHash string) ([]byte, error) {
+	key := contentKey{path: file, saveHash: saveHash}
+	if content, ok := op.cached(key); ok {
+		return content, nil
+	}
+
+	content, err := op.repo.reconstructFileContent(op, file, saveHash)
+	if err != nil {
+		return nil, err
+	}
+	op.remember(key, content)
+	return content, nil
+}
+
+// cached returns the content reconstructed for key earlier in the operation,
+// counting the lookups that find none
+func (op *operation) cached(key contentKey) ([]byte, bool) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	content, ok := op.contents[key]
+	if !ok {
+		op.reconstructions++
+	}
+	return content, ok
+}
+
+// remember keeps the content reconstructed for key for the rest of the operation
+func (op *operation) remember(key contentKey, content []byte) {
+	op.mutex.Lock()
+	op.contents[key] = content
+	op.mutex.Unlock()
+}
+
+// deltaSet returns the deltas of the save with the given hash by path. Each
+// delta set is read only once per operation, however many files of the save
+// are reconstructed. Errors are not remembered, as the delta set of a save
+// being written by the operation may not exist yet.
+func (op *operation) deltaSet(saveHash string) (map[string]util.DeltaInfo, error) {
+	op.mutex.Lock()
+	deltas, ok := op.deltaSets[saveHash]
+	op.mutex.Unlock()
+	if ok {
+		return deltas, nil
+	}
+
+	deltaSet, err := op.repo.loadDeltaSet(saveHash)
+	if err != nil {
+		return nil, err
+	}
+	deltas = make(map[string]util.DeltaInfo, len(deltaSet.Deltas))
+	for _, delta := range deltaSet.Deltas {
+		deltas[delta.Path] = delta
+	}
+
+	op.mutex.Lock()
+	op.deltaSets[saveHash] = deltas
+	op.mutex.Unlock()
+	return deltas, nil
+}
+
+// save returns the save with the given hash, or nil when there is none. The
+// metadata is loaded and indexed the first time a save is looked up during
+// the operation.
+func (op *operation) save(hash string) (*Save, error) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	if op.saves == nil {
+		metadata, err := op.repo.loadMetadata()
+		if err != nil {
+			return nil, err
+		}
+		op.saves = make(map[string]*Save, len(metadata.Saves))
+		for i := range metadata.Saves {
+			op.saves[metadata.Saves[i].Hash] = &metadata.Saves[i]
+		}
+	}
+	return op.saves[hash], nil
+}
+
+// fileDone counts one more processed file out of total and reports it to the
+// progress callback. Calls are serialized so that done only ever increases.
+func (op *operation) fileDone(total int, path string) {
+	if op.progress == nil {
+		return
+	}
+
+	op.progressMutex.Lock()
+	defer op.progressMutex.Unlock()
+	op.filesDone++
+	op.progress(op.filesDone, total, path)
+}
+
+// storeBlob stores content in the blob store and returns its content hash,
+// remembering the blob for rollback unless it was already stored. Files with
+// identical content share one blob, written once per operation even when
+// several workers store it at the same time.
+func (op *operation) storeBlob(content []byte) (string, error) {
+	contentHash := util.CalculateFileHash(content)
+	op.mutex.Lock()
+	blob, ok := op.blobs[contentHash]
+	if !ok {
+		blob = &storedBlob{}
+		op.blobs[contentHash] = blob
+	}
+	op.mutex.Unlock()
+
+	blob.once.Do(func() {
+		blobPath := util.BlobPath(contentHash, op.repo.objectsDir)
+		if op.repo.fs.Exists(blobPath) {
+			return
+		}
+		blob.err = retryObjectWrite(func() error {
+			_, err := util.SaveBlob(content, op.repo.objectsDir, op.repo.fs)
+			return err
+		})
+		if blob.err == nil {
+			op.track(blobPath)
+		}
+	})
+	if blob.err != nil {
+		return "", blob.err
+	}
+	return contentHash, nil
+}
+
+// readMapped reads a working file with util.ReadFileMapped, keeping large
+// files mapped until release is called
+func (op *operation) readMapped(path string) ([]byte, error) {
+	info, err := op.repo.fs.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	content, unmap, err := util.ReadFileMapped(op.repo.fs, path)
+	if err != nil {
+		return nil, err
+	}
+	op.mutex.Lock()
+	op.unmaps = append(op.unmaps, unmap)
+	if util.MmapThreshold > 0 && info.Size() >= util.MmapThreshold {
+		if op.mapped == nil {
+			op.mapped = make(map[string]os.FileInfo)
+		}
+		op.mapped[path] = info
+	}
+	op.mutex.Unlock()
+	return content, nil
+}
+
+// checkMapped returns errMappedFileChanged if a file read with readMapped was
+// written since, as its mapped content may then have changed between being
+// hashed and being stored
+func (op *operation) checkMapped() error {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+
+	for path, before := range op.mapped {
+		after, err := op.repo.fs.Stat(path)
+		if err != nil || after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+			return fmt.Errorf("%w: %s", errMappedFileChanged, path)
+		}
+	}
+	return nil
+}
+
+// release unmaps the files read with readMapped. Their content must not be
+// used afterwards.
+func (op *operation) release() {
+	op.mutex.Lock()
+	unmaps := op.unmaps
+	op.unmaps = nil
+	op.mutex.Unlock()
+
+	for _, unmap := range unmaps {
+		unmap()
+	}
+}
+
+// track remembers an object created by this operation for rollback
+func (op *operation) track(path string) {
+	op.mutex.Lock()
+	op.written = append(op.written, path)
+	op.mutex.Unlock()
+}
+
+// rollback removes the objects created by this operation, so that a save that
+// failed partway leaves the repository as it was
+func (op *operation) rollback() {
+	op.mutex.Lock()
+	written := op.written
+	op.written = nil
+	op.mutex.Unlock()
+
+	for _, path := range written {
+		op.repo.fs.Remove(path)
+	}
+}
+
+// retryObjectWrite calls write until it succeeds or objectWriteAttempts are used
+func retryObjectWrite(write func() error) error {
+	backoff := objectWriteBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = write(); err == nil || attempt >= objectWriteAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
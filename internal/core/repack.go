@@ -0,0 +1,139 @@
+package core
+
+import (
+	"fmt"
+
+	"bit/internal/util"
+)
+
+// fileVersionAt is the content of a file at one save, as RepackDeltas sees it
+type fileVersionAt struct {
+	index   int // Index of the save in the metadata
+	save    string
+	content []byte
+	full    bool // Whether the save stores the file in full
+}
+
+// RepackDeltas shortens the delta chains of file, relative to the repository
+// root, without changing its content at any save. The file is stored in full
+// at the latest save that has it, unless it already is, and the delta of every
+// other save storing it is rewritten to apply directly to the nearest earlier
+// save storing it in full, so that no version needs more than one delta.
+// Patches against an older base can be larger, so unlike Compact this trades
+// some space for speed across the whole history of one file. Deltas recording
+// a rename keep their base. RepackDeltas returns the number of delta sets
+// rewritten.
+func (r *Repository) RepackDeltas(file string) (int, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return 0, err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	// Reconstruct every version before any delta set is rewritten
+	op := r.newOperation()
+	deltaSets := make(map[string]map[string]util.DeltaInfo)
+	var versions []fileVersionAt
+	for i, save := range metadata.Saves {
+		if !containsFile(save.Files, file) {
+			continue
+		}
+		content, err := op.fileContent(file, save.Hash)
+		if err != nil {
+			return 0, fmt.Errorf("failed to reconstruct %s in save %s: %w", file, save.Hash, err)
+		}
+		versions = append(versions, fileVersionAt{
+			index:   i,
+			save:    save.Hash,
+			content: content,
+			full:    r.hasFullContent(file, save.Hash, deltaSets),
+		})
+	}
+	if len(versions) == 0 {
+		return 0, fmt.Errorf("%s is not in any save", file)
+	}
+
+	// Work out the new delta of each version before writing anything
+	rewritten := make(map[string]util.DeltaInfo)
+	var base *fileVersionAt
+	for i := range versions {
+		version := &versions[i]
+		delta, ok := deltaSets[version.save][file]
+		if !ok {
+			// Saves without a delta set store every file in full
+			base = version
+			continue
+		}
+
+		if i == len(versions)-1 && !version.full {
+			blob, err := op.storeBlob(version.content)
+			if err != nil {
+				op.rollback()
+				return 0, fmt.Errorf("failed to save full file %s: %w", file, err)
+			}
+			delta.Blob = blob
+			rewritten[version.save] = delta
+			version.full = true
+		}
+		if version.full {
+			base = version
+			continue
+		}
+		if base == nil || delta.RenamedFrom != "" || delta.BaseSaveHash == base.save {
+			continue
+		}
+
+		// Empty content must not be mistaken for a missing file. The patches
+		// are made with the engine of the original delta, and Engine names
+		// the one that made them, which may have fallen back to another.
+		repacked := util.CalculateDeltaWithEngine(util.EmptyIfNil(base.content), util.EmptyIfNil(version.content), file, base.save, delta.Engine)
+		repacked.IsSymlink = delta.IsSymlink
+		repacked.Mode = delta.Mode
+		repacked.Normalized = delta.Normalized
+		repacked.ModTime = delta.ModTime
+		if repacked, err = util.CompressDelta(repacked); err != nil {
+			op.rollback()
+			return 0, err
+		}
+		rewritten[version.save] = repacked
+	}
+
+	if len(rewritten) == 0 {
+		return 0, nil
+	}
+
+	first := len(metadata.Saves)
+	for _, version := range versions {
+		delta, ok := rewritten[version.save]
+		if !ok {
+			continue
+		}
+		err := r.rewriteDeltaSet(version.save, func(d *util.DeltaInfo) {
+			if d.Path == file {
+				*d = delta
+			}
+		})
+		if err != nil {
+			return 0, err
+		}
+		first = min(first, version.index)
+	}
+
+	// Depths and signatures cover the rewritten delta sets
+	if err := r.updateDeltaDepths(&metadata, first); err != nil {
+		return 0, err
+	}
+	if err := r.saveMetadata(metadata); err != nil {
+		return 0, fmt.Errorf("failed to save metadata: %w", err)
+	}
+	return len(rewritten), nil
+}
@@ -1,537 +1,4398 @@
 package core
 
 import (
+	"archive/tar"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"bit/internal/util"
+
+	"github.com/gobwas/glob"
 )
 
 const (
-	bitDir       = ".bit"
-	savesDir     = ".bit/saves"
-	objectsDir   = ".bit/objects"
-	ignoreFile   = ".bitignore"
-	metadataFile = ".bit/metadata.json"
-	deltaMode    = true // Use delta-based storage when true
+	bitDir     = ".bit" // Repository directory, or a pointer to it, in the working tree
+	ignoreFile = ".bitignore"
+	// attributesFile assigns storage policies to files
+	attributesFile = ".bitattributes"
+	// Locations inside the repository directory
+	objectsDir   = "objects"
+	metadataFile = "metadata.json"
+	lockFile     = "lock"
+	renamesFile  = "renames.json"
+	reflogFile   = "reflog"
+	headFile     = "HEAD"
+	// mergeHeadFile holds the hash of the save being merged while conflicts
+	// are resolved
+	mergeHeadFile = "MERGE_HEAD"
+	// stagingDir holds the files written by a checkout until all are ready
+	stagingDir = "staging"
+	// headBranchPrefix starts the HEAD line naming the current branch
+	headBranchPrefix = "branch: "
+	// bitDirPointer starts a .bit file that points to a repository directory
+	// kept outside the working tree
+	bitDirPointer = "bitdir: "
+	deltaMode     = true // Use delta-based storage when true
 	// Maximum number of deltas in a chain before storing a full file
 	// Set to 0 to disable and rely purely on deltas
 	maxDeltaChainLength = 10
 )
 
+// Environment variables overriding where a repository keeps its files. Paths
+// relative to the working directory are allowed.
+const (
+	// DirEnv names the repository directory to use instead of searching for
+	// .bit, with the working directory as the root of the working tree
+	DirEnv = "BIT_DIR"
+	// IgnoreFileEnv names the file read instead of the repository's .bitignore
+	IgnoreFileEnv = "BIT_IGNORE_FILE"
+	// ConfigEnv names the file read instead of the repository's config.json
+	ConfigEnv = "BIT_CONFIG"
+)
+
+// hexPattern matches strings that could be interpreted as (prefixes of) save hashes
+var hexPattern = regexp.MustCompile(`^[0-9a-f]+$`)
+
+// ErrNotRepository is returned by commands run outside a repository
+var ErrNotRepository = util.ErrNotRepository
+
+// ErrNothingToSave is returned when a save would record no changes since the
+// latest save
+var ErrNothingToSave = errors.New("nothing changed since the latest save")
+
+// ErrCorruptMetadata is returned when metadata.json exists but cannot be decoded
+var ErrCorruptMetadata = errors.New("metadata is corrupt")
+
+// ErrCorruptContent is returned when a file reconstructed from a save does not
+// hash to the content hash recorded for it
+var ErrCorruptContent = errors.New("content does not match its stored hash")
+
+// saveWorkers bounds how many files are diffed and stored concurrently during a save
+var saveWorkers = runtime.NumCPU()
+
 type Save struct {
 	Hash      string    `json:"hash"`
 	Name      string    `json:"name"`
 	Timestamp time.Time `json:"timestamp"`
 	Files     []string  `json:"files"`
+	// Directories without any tracked files, recreated on checkout
+	Dirs []string `json:"dirs,omitempty"`
 	// If this is a delta save, this references the base save
 	BaseSaveHash string `json:"baseSaveHash,omitempty"`
+	// MergeParents holds the checked out save and the merged save for saves
+	// made by a merge
+	MergeParents []string `json:"mergeParents,omitempty"`
+	// TreeHash covers the paths and content of all files, see treeHash
+	TreeHash string `json:"treeHash,omitempty"`
+	// Signature authenticates the save when a signing key is configured, see
+	// signature
+	Signature string `json:"signature,omitempty"`
+	// DeltaDepths maps each file to the number of deltas applied to rebuild
+	// it at this save, 0 for files stored in full. Saves made before depths
+	// were recorded have none.
+	DeltaDepths map[string]int `json:"deltaDepths,omitempty"`
+	// Author and Host name who made the save and on which machine. Saves
+	// made before they were recorded have neither.
+	Author string `json:"author,omitempty"`
+	Host   string `json:"host,omitempty"`
+}
+
+// Parents returns the hashes of the saves this save was made from: its base
+// first, then any other save it merged. The first save has none.
+func (s Save) Parents() []string {
+	var parents []string
+	if s.BaseSaveHash != "" {
+		parents = append(parents, s.BaseSaveHash)
+	}
+	for _, parent := range s.MergeParents {
+		if parent != "" && parent != s.BaseSaveHash {
+			parents = append(parents, parent)
+		}
+	}
+	return parents
 }
 
 type Metadata struct {
 	Saves []Save `json:"saves"`
+	// Tags maps a tag name to the hash of the save it points at
+	Tags map[string]string `json:"tags,omitempty"`
+	// Branches maps a branch name to the hash of the save at its tip
+	Branches map[string]string `json:"branches,omitempty"`
+}
+
+// ContentSource supplies the content of a file being saved, identified by its
+// repository-relative path. It lets saves be built from the working tree, an
+// archive or synthetic content alike.
+type ContentSource func(path string) ([]byte, error)
+
+// snapshot describes the entries making up a save, independently of where
+// their content is read from
+type snapshot struct {
+	files []string
+	// dirs are directories that contain no tracked files
+	dirs []string
+	// symlinks marks files that are symbolic links; their content is the link target
+	symlinks map[string]bool
+	// renames maps files to the path they had in the base save, if they were moved
+	renames map[string]string
+	// sizes holds the size of each file as reported when it was listed
+	sizes map[string]int64
+	// modes holds the permission bits of each regular file
+	modes map[string]os.FileMode
+	// modTimes holds the modification time of each regular file
+	modTimes map[string]time.Time
+	// lineEndings converts the line endings of text files as they are read,
+	// nil when they are kept
+	lineEndings *lineEndings
+}
+
+// Tag associates a human-readable name with a save hash
+type Tag struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+}
+
+// FileChange describes how a file changed in a save
+type FileChange struct {
+	Save   Save   `json:"save"`
+	Change string `json:"change"` // "added", "modified" or "deleted"
+}
+
+// ReflogEntry records one operation that moved the checked out state
+type ReflogEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Command   string    `json:"command"`
+	From      string    `json:"from"` // Save checked out before the operation, empty if none
+	To        string    `json:"to"`
+}
+
+// FileReport describes how a single file was stored by a save
+type FileReport struct {
+	Path       string
+	Change     string // "new", "modified", "renamed", "unchanged" or "deleted"
+	Stored     string // "full", "delta" or "none" when nothing new was written
+	ChainDepth int    // Deltas to apply to reconstruct the file at this save
+	Size       int    // Size of the file content in bytes
+	StoredSize int    // Bytes of patch or full content written, before compression
+}
+
+// ChangeSet lists how the files of one save differ from those of another
+type ChangeSet struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Added    []string `json:"added"`    // Files only in To
+	Removed  []string `json:"removed"`  // Files only in From
+	Modified []string `json:"modified"` // Files in both whose content differs
+}
+
+// GrepMatch is a line matching the pattern given to Grep
+type GrepMatch struct {
+	Path string `json:"path"`
+	Line int    `json:"line"` // 1-based line number
+	Text string `json:"text"`
+}
+
+// SizeReport describes the storage used by the objects of a repository
+type SizeReport struct {
+	TotalBytes        int64      `json:"totalBytes"`
+	Objects           int        `json:"objects"`
+	UnreferencedBytes int64      `json:"unreferencedBytes"` // Objects that no save refers to
+	Saves             []SaveSize `json:"saves"`             // Largest first
+}
+
+// SaveSize is the storage attributed to a single save. Blobs shared by several
+// saves count towards the earliest save referring to them.
+type SaveSize struct {
+	Hash  string `json:"hash"`
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+}
+
+// ObjectInfo describes one file in the objects directory
+type ObjectInfo struct {
+	Name   string             `json:"name"`             // Slash-separated path relative to the objects directory
+	Type   string             `json:"type"`             // "blob", "delta", "file" for full copies named after a save, or "unknown"
+	Save   string             `json:"save"`             // Hash of the save the object belongs to, empty if none is known
+	Path   string             `json:"path,omitempty"`   // File stored by a blob or full copy
+	Size   int64              `json:"size"`             // Bytes on disk
+	Header *util.ObjectHeader `json:"header,omitempty"` // Decoded header of blobs and full copies that have one
+	Error  string             `json:"error,omitempty"`  // Why the header could not be decoded
+}
+
+// Status lists how the working tree differs from the checked out save
+type Status struct {
+	Head     string   `json:"head"` // Hash of the save the working tree is compared to, empty if none
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Deleted  []string `json:"deleted"`
 }
 
 // Repository defines methods for interacting with a bit repository
 type Repository struct {
 	fs util.FileSystem
+	// root is the directory containing .bit; all stored paths are relative to it
+	root string
+
+	// Filesystem paths of the repository data, normally inside root/.bit
+	bitDir       string
+	objectsDir   string
+	metadataFile string
+	ignorePath   string // Ignore file read on top of the global one
+	configPath   string
+	// dirFromEnv is set when the repository directory was given by $BIT_DIR,
+	// which then takes the place of a .bit pointer in the working tree
+	dirFromEnv bool
+
+	// searchErr records why OpenRepository found no repository, for
+	// repositories opened in the working directory as a fallback
+	searchErr error
 }
 
-// NewRepository creates a new repository with the provided filesystem
+// NewRepository creates a new repository rooted at the current directory with the provided filesystem
 func NewRepository(fs util.FileSystem) *Repository {
-	return &Repository{fs: fs}
+	return NewRepositoryAt(fs, ".")
 }
 
-// InitRepository initializes a new bit repository
-func (r *Repository) InitRepository() error {
-	// Check if .bit directory already exists
-	if _, err := r.fs.Stat(bitDir); !os.IsNotExist(err) {
-		return fmt.Errorf("repository already initialized")
-	}
+// NewRepositoryAt creates a new repository rooted at the given directory
+func NewRepositoryAt(fs util.FileSystem, root string) *Repository {
+	return NewRepositoryWithDir(fs, root, filepath.Join(root, bitDir))
+}
 
-	// Create directory structure
-	dirs := []string{bitDir, objectsDir}
-	for _, dir := range dirs {
-		if err := r.fs.MkdirAll(dir, 0755); err != nil {
-			return fmt.Errorf("failed to create directory %s: %w", dir, err)
-		}
+// NewRepositoryWithDir creates a new repository rooted at root whose data is
+// kept in dir instead of root/.bit. $BIT_IGNORE_FILE and $BIT_CONFIG, when
+// set, replace the ignore and config files.
+func NewRepositoryWithDir(fs util.FileSystem, root, dir string) *Repository {
+	r := &Repository{
+		fs:           fs,
+		root:         root,
+		bitDir:       dir,
+		objectsDir:   filepath.Join(dir, objectsDir),
+		metadataFile: filepath.Join(dir, metadataFile),
+		ignorePath:   filepath.Join(root, ignoreFile),
+		configPath:   filepath.Join(dir, configFile),
 	}
-
-	// Initialize empty metadata file
-	metadata := Metadata{Saves: []Save{}}
-	return r.saveMetadata(metadata)
+	if path := os.Getenv(IgnoreFileEnv); path != "" {
+		r.ignorePath = path
+	}
+	if path := os.Getenv(ConfigEnv); path != "" {
+		r.configPath = path
+	}
+	return r
 }
 
-// SaveState creates a snapshot of the current state with the given name
-func (r *Repository) SaveState(name string) (string, error) {
-	// Check if repository is initialized
-	if _, err := r.fs.Stat(bitDir); os.IsNotExist(err) {
-		return "", fmt.Errorf("repository not initialized, run 'bit init' first")
+// repositoryFromEnv creates the repository named by $BIT_DIR, rooted at the
+// working directory, or returns nil when the variable is not set
+func repositoryFromEnv(fs util.FileSystem) *Repository {
+	dir := os.Getenv(DirEnv)
+	if dir == "" {
+		return nil
 	}
+	repo := NewRepositoryWithDir(fs, ".", dir)
+	repo.dirFromEnv = true
+	return repo
+}
 
-	// Get list of files to save (already excludes ignored files except .bitignore)
-	files, err := r.getFilesToSave()
+// OpenRepository creates a repository rooted at the nearest directory containing
+// .bit, searching upwards from startDir. A .bit file points to a repository
+// directory kept elsewhere.
+func OpenRepository(fs util.FileSystem, startDir string) (*Repository, error) {
+	root, err := util.FindRepositoryRoot(startDir, fs)
 	if err != nil {
-		return "", fmt.Errorf("failed to get files to save: %w", err)
+		return nil, err
 	}
 
-	if len(files) == 0 {
-		return "", fmt.Errorf("no files to save")
+	pointer := filepath.Join(root, bitDir)
+	if info, err := fs.Stat(pointer); err != nil || info.IsDir() {
+		return NewRepositoryAt(fs, root), nil
 	}
 
-	// Create save hash
-	timestamp := time.Now()
-	hash := createSaveHash(name, timestamp, files)
-
-	// Load existing metadata to find the previous save
-	metadata, err := r.loadMetadata()
+	data, err := fs.ReadFile(pointer)
 	if err != nil {
-		return "", fmt.Errorf("failed to load metadata: %w", err)
+		return nil, fmt.Errorf("failed to read %s: %w", pointer, err)
 	}
-
-	// Initialize delta storage values
-	var baseSaveHash string
-	var baseSave *Save
-
-	// Find the most recent save to use as a base for deltas
-	if deltaMode && len(metadata.Saves) > 0 {
-		baseSave = &metadata.Saves[len(metadata.Saves)-1]
-		baseSaveHash = baseSave.Hash
+	line := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(line, bitDirPointer) {
+		return nil, fmt.Errorf("%s is not a repository pointer", pointer)
 	}
+	dir := strings.TrimPrefix(line, bitDirPointer)
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	return NewRepositoryWithDir(fs, root, dir), nil
+}
 
-	if deltaMode {
-		// Use delta-based storage
-		err = r.saveFilesAsDelta(files, hash, baseSave)
-		if err != nil {
-			return "", fmt.Errorf("failed to save files as delta: %w", err)
+// ensureInitialized returns an error wrapping ErrNotRepository when the
+// repository directory does not exist. For repositories that were searched
+// for, the error tells how far up the search went.
+func (r *Repository) ensureInitialized() error {
+	if _, err := r.fs.Stat(r.bitDir); os.IsNotExist(err) {
+		if r.searchErr != nil {
+			return r.searchErr
 		}
-	} else {
-		// Use traditional full-file storage
-		for _, file := range files {
-			targetPath := filepath.Join(objectsDir, hash+"_"+file)
-			targetDir := filepath.Dir(targetPath)
+		return fmt.Errorf("%w: no %s directory in %s, run 'bit init' first", ErrNotRepository, bitDir, r.root)
+	}
+	return nil
+}
 
-			if err := r.fs.MkdirAll(targetDir, 0755); err != nil {
-				return "", fmt.Errorf("failed to create directory %s: %w", targetDir, err)
-			}
+// path converts a repository-relative path into one usable with the filesystem
+func (r *Repository) path(rel string) string {
+	return filepath.Join(r.root, rel)
+}
 
-			if err := r.copyFile(file, targetPath); err != nil {
-				return "", fmt.Errorf("failed to copy file %s: %w", file, err)
-			}
-		}
-	}
+// bitPath converts a path inside the repository directory into one usable
+// with the filesystem
+func (r *Repository) bitPath(name string) string {
+	return filepath.Join(r.bitDir, name)
+}
 
-	// Update metadata
-	save := Save{
-		Hash:         hash,
-		Name:         name,
-		Timestamp:    timestamp,
-		Files:        files,
-		BaseSaveHash: baseSaveHash,
+// pathFromWorkingDir converts a path given relative to the process working
+// directory into a repository-relative path
+func (r *Repository) pathFromWorkingDir(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", p, err)
 	}
-
-	metadata.Saves = append(metadata.Saves, save)
-	if err := r.saveMetadata(metadata); err != nil {
-		return "", fmt.Errorf("failed to save metadata: %w", err)
+	root, err := filepath.Abs(r.root)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", r.root, err)
 	}
 
-	return hash, nil
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s is outside the repository", p)
+	}
+	return filepath.ToSlash(rel), nil
 }
 
-// saveFilesAsDelta saves files using delta-based storage
-func (r *Repository) saveFilesAsDelta(files []string, saveHash string, baseSave *Save) error {
-	var deltas []util.DeltaInfo
-	var baseFileMap map[string]bool
-	deltaCounts := make(map[string]int) // Track delta chain length for each file
-
-	// Create a map of files in the base save for quick lookup
-	if baseSave != nil {
-		baseFileMap = make(map[string]bool, len(baseSave.Files))
-		for _, file := range baseSave.Files {
-			baseFileMap[file] = true
-		}
-
-		// Calculate delta chain lengths from metadata
-		metadata, err := r.loadMetadata()
-		if err == nil {
-			// Build a map of save hash to index for quick lookup
-			saveMap := make(map[string]int, len(metadata.Saves))
-			for i, save := range metadata.Saves {
-				saveMap[save.Hash] = i
-			}
-
-			// For each file, traverse the delta chain to count its length
-			for _, file := range files {
-				currentHash := baseSave.Hash
-				count := 0
-
-				// Follow delta chain back until we find a save with a full file
-				for currentHash != "" {
-					saveIndex, found := saveMap[currentHash]
-					if !found {
-						break
-					}
-
-					save := metadata.Saves[saveIndex]
-
-					// Check if this save has a full file content stored
-					fullPath := filepath.Join(objectsDir, currentHash+"_"+file)
-					if _, err := r.fs.Stat(fullPath); err == nil {
-						// Full file found, chain ends here
-						break
-					}
-
-					// Move to base save and increment count
-					currentHash = save.BaseSaveHash
-					count++
-				}
+// relPath converts a filesystem path under the root into a repository-relative path
+func (r *Repository) relPath(path string) (string, error) {
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to make %s relative to %s: %w", path, r.root, err)
+	}
+	return filepath.ToSlash(rel), nil
+}
 
-				deltaCounts[file] = count
-			}
-		}
+// InitRepository initializes a new bit repository
+func (r *Repository) InitRepository() error {
+	// Check if .bit directory or a pointer to another one already exists
+	if _, err := r.fs.Stat(r.bitDir); !os.IsNotExist(err) {
+		return fmt.Errorf("repository already initialized")
+	}
+	if _, err := r.fs.Stat(r.path(bitDir)); !os.IsNotExist(err) {
+		return fmt.Errorf("repository already initialized")
 	}
 
-	// Process each file in the current state
-	for _, file := range files {
-		// Read current file content
-		currentContent, err := r.fs.ReadFile(file)
-		if err != nil {
-			return fmt.Errorf("failed to read file %s: %w", file, err)
+	// Create directory structure
+	dirs := []string{r.bitDir, r.objectsDir}
+	for _, dir := range dirs {
+		if err := r.fs.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
 		}
+	}
 
-		// Check if this file exists in the base save
-		if baseSave != nil && baseFileMap[file] {
-			// Try to read base content directly or from delta chain
-			baseContent, err := r.getFileContentFromSave(file, baseSave.Hash)
-			if err != nil {
-				return fmt.Errorf("failed to read base file %s: %w", file, err)
-			}
-
-			// Calculate delta between base and current
-			delta := util.CalculateDelta(baseContent, currentContent, file, baseSave.Hash)
-			deltas = append(deltas, delta)
-
-			// Store full file only if:
-			// 1. The delta chain length exceeds our maximum limit (if configured)
-			// 2. There are actual changes (delta.Patches is not nil/empty)
-			if maxDeltaChainLength > 0 &&
-				delta.Patches != nil &&
-				len(delta.Patches) > 0 &&
-				deltaCounts[file] >= maxDeltaChainLength {
-				// Store full file to avoid excessive delta chain length
-				err = util.SaveFullFile(currentContent, file, saveHash, objectsDir, r.fs)
-				if err != nil {
-					return fmt.Errorf("failed to save full file %s: %w", file, err)
-				}
-			}
-		} else {
-			// This is a new file, store full content
-			delta := util.CalculateDelta(nil, currentContent, file, "")
-			deltas = append(deltas, delta)
-
-			// Always store full content for new files
-			err = util.SaveFullFile(currentContent, file, saveHash, objectsDir, r.fs)
-			if err != nil {
-				return fmt.Errorf("failed to save full file %s: %w", file, err)
-			}
+	// Point the working tree at a repository directory kept elsewhere
+	if r.bitDir != r.path(bitDir) && !r.dirFromEnv {
+		pointer := bitDirPointer + r.bitDir + "\n"
+		if err := r.fs.WriteFile(r.path(bitDir), []byte(pointer), 0644); err != nil {
+			return fmt.Errorf("failed to write repository pointer: %w", err)
 		}
 	}
 
-	// Check for deleted files (files in base save but not in current save)
-	if baseSave != nil {
-		currentFileMap := make(map[string]bool, len(files))
-		for _, file := range files {
-			currentFileMap[file] = true
-		}
+	// Initialize empty metadata file
+	metadata := Metadata{Saves: []Save{}}
+	return r.saveMetadata(metadata)
+}
 
-		for _, file := range baseSave.Files {
-			if !currentFileMap[file] {
-				// Get base content
-				baseContent, err := r.getFileContentFromSave(file, baseSave.Hash)
-				if err != nil {
-					return fmt.Errorf("failed to read base file %s: %w", file, err)
-				}
+// starterIgnore is the .bitignore written by WriteStarterIgnore
+const starterIgnore = `# Editor and operating system files
+*.swp
+*~
+.DS_Store
+Thumbs.db
 
-				// Add a deletion delta
-				delta := util.CalculateDelta(baseContent, nil, file, baseSave.Hash)
-				deltas = append(deltas, delta)
-			}
-		}
-	}
+# Dependencies and build output
+node_modules/
+build/
+dist/
+__pycache__/
+*.o
+*.pyc
+`
 
-	// Save delta set
-	deltaSet := util.DeltaSet{
-		SaveHash: saveHash,
-		Deltas:   deltas,
+// WriteStarterIgnore writes a .bitignore ignoring editor temporary files,
+// operating system clutter, dependencies and build output, so that a new
+// repository does not start by saving them. An existing .bitignore is kept
+// as it is. WriteStarterIgnore reports whether the file was written.
+func (r *Repository) WriteStarterIgnore() (bool, error) {
+	if _, err := r.fs.Stat(r.ignorePath); !os.IsNotExist(err) {
+		return false, nil
 	}
-
-	return util.SaveDeltaSet(deltaSet, objectsDir, r.fs)
+	if err := r.fs.WriteFile(r.ignorePath, []byte(starterIgnore), 0644); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", ignoreFile, err)
+	}
+	return true, nil
 }
 
-// saveDeltaSet saves a delta set to the filesystem
-func (r *Repository) saveDeltaSet(deltaSet util.DeltaSet) error {
-	return util.SaveDeltaSet(deltaSet, objectsDir, r.fs)
+// ProgressFunc is told each time another file of a save or checkout has been
+// processed: done of total files are finished, path being the latest one
+type ProgressFunc func(done, total int, path string)
+
+// SaveOptions adjusts how SaveStateWithOptions creates a save
+type SaveOptions struct {
+	// Report is called once per stored file, in path order, describing how the
+	// file was stored. A nil Report saves silently.
+	Report func(FileReport)
+	// AllowLarge skips the MaxFileSize and MaxSaveSize limits of the config
+	AllowLarge bool
+	// AllowEmpty creates the save even if nothing changed since the latest
+	// save, instead of returning ErrNothingToSave
+	AllowEmpty bool
+	// Include adds files matching these .bitignore style patterns to this
+	// save even if they are ignored
+	Include []string
+	// Exclude leaves files matching these .bitignore style patterns out of
+	// this save. It takes precedence over Include.
+	Exclude []string
+	// AllowCaseCollisions saves paths that differ only in case, which
+	// overwrite each other when checked out on a case-insensitive filesystem
+	AllowCaseCollisions bool
+	// Progress, when set, is called as files are stored
+	Progress ProgressFunc
 }
 
-// loadDeltaSet loads a delta set from the filesystem
-func (r *Repository) loadDeltaSet(saveHash string) (util.DeltaSet, error) {
-	return util.LoadDeltaSet(saveHash, objectsDir, r.fs)
+// SaveState creates a snapshot of the current state with the given name
+func (r *Repository) SaveState(name string) (string, error) {
+	return r.SaveStateWithOptions(name, SaveOptions{})
 }
 
-// saveFullFile saves a full file to the objects directory
-func (r *Repository) saveFullFile(content []byte, path, saveHash string) error {
-	return util.SaveFullFile(content, path, saveHash, objectsDir, r.fs)
+// SaveStateWithReport creates a snapshot like SaveState and calls report once
+// per stored file, in path order, describing how the file was stored. A nil
+// report saves silently.
+func (r *Repository) SaveStateWithReport(name string, report func(FileReport)) (string, error) {
+	return r.SaveStateWithOptions(name, SaveOptions{Report: report})
 }
 
-// getFileContentFromSave retrieves file content from a specific save
-func (r *Repository) getFileContentFromSave(file, saveHash string) ([]byte, error) {
-	if saveHash == "" {
-		return nil, fmt.Errorf("invalid save hash")
+// SaveStateWithOptions creates a snapshot like SaveState, adjusted by opts.
+// Unless opts.AllowLarge is set, files over the configured size limits are
+// refused before any of them is read. The executable .bit/hooks/pre-save and
+// post-save hooks, if present, run before and after the save; a failing
+// pre-save hook aborts it, while a failing post-save hook is returned as an
+// error along with the hash of the save that was kept.
+func (r *Repository) SaveStateWithOptions(name string, opts SaveOptions) (string, error) {
+	// Check if repository is initialized
+	if err := r.ensureInitialized(); err != nil {
+		return "", err
 	}
 
-	// Check if the file exists as full content first
-	content, err := util.GetFileContent(file, saveHash, objectsDir, r.fs)
-	if err == nil {
-		return content, nil
+	unlock, err := r.lock()
+	if err != nil {
+		return "", err
 	}
+	defer unlock()
 
-	// If not found as full content, check for delta
-	metadata, err := r.loadMetadata()
+	// The pre-save hook may change files, so it runs before they are scanned
+	if err := r.runHook(preSaveHook, []string{name}, r.hookEnv(name)); err != nil {
+		return "", fmt.Errorf("save aborted: %w", err)
+	}
+
+	hash, err := r.saveState(name, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load metadata: %w", err)
+		return "", err
 	}
 
-	// Find the save to get its base save
-	var save *Save
-	for i := range metadata.Saves {
-		if metadata.Saves[i].Hash == saveHash {
-			save = &metadata.Saves[i]
-			break
-		}
+	env := r.hookEnv(name)
+	env["BIT_SAVE_HASH"] = hash
+	if err := r.runHook(postSaveHook, []string{name, hash}, env); err != nil {
+		return hash, err
 	}
+	return hash, nil
+}
 
-	if save == nil {
-		return nil, fmt.Errorf("save with hash %s not found", saveHash)
+// saveState saves the working tree for SaveStateWithOptions, concluding a
+// pending merge. Callers hold the repository lock.
+func (r *Repository) saveState(name string, opts SaveOptions) (string, error) {
+	include, err := util.CompilePatterns(opts.Include)
+	if err != nil {
+		return "", fmt.Errorf("invalid include pattern: %w", err)
+	}
+	exclude, err := util.CompilePatterns(opts.Exclude)
+	if err != nil {
+		return "", fmt.Errorf("invalid exclude pattern: %w", err)
 	}
 
-	// Load delta set
-	deltaSet, err := r.loadDeltaSet(saveHash)
+	// Get list of files to save (already excludes ignored files except .bitignore)
+	snap, err := r.getFilesToSaveWith(include, exclude)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load delta set: %w", err)
+		return "", fmt.Errorf("failed to get files to save: %w", err)
 	}
 
-	// Find delta for this file
-	var fileDelta *util.DeltaInfo
-	for i := range deltaSet.Deltas {
-		if deltaSet.Deltas[i].Path == file {
-			fileDelta = &deltaSet.Deltas[i]
-			break
+	if len(snap.files) == 0 {
+		return "", fmt.Errorf("no files to save")
+	}
+
+	if !opts.AllowCaseCollisions {
+		if err := checkCaseCollisions(snap); err != nil {
+			return "", err
 		}
 	}
 
-	if fileDelta == nil {
-		return nil, fmt.Errorf("delta for file %s not found in save %s", file, saveHash)
+	if !opts.AllowLarge {
+		config, err := r.loadConfig()
+		if err != nil {
+			return "", err
+		}
+		if err := checkSaveSize(snap, config); err != nil {
+			return "", err
+		}
 	}
 
-	// Create a wrapper for the method to satisfy the content provider signature
-	contentProvider := func(path, saveHash string) ([]byte, error) {
-		return r.getFileContentFromSave(path, saveHash)
+	// Files moved with Move are stored as renames of their previous path
+	snap.renames, err = r.loadRenames()
+	if err != nil {
+		return "", err
 	}
 
-	// Apply delta using recursive content provider
-	return util.ApplyDelta(*fileDelta, contentProvider)
-}
+	// A merge is recorded even if it kept the checked out content
+	merging, err := r.readMergeHead()
+	if err != nil {
+		return "", err
+	}
+	var mergeParents []string
+	if merging != "" {
+		head, err := r.Head()
+		if err != nil {
+			return "", err
+		}
+		mergeParents = []string{head, merging}
+	}
+	newOperation := func() *operation {
+		op := r.newOperation()
+		op.report = opts.Report
+		op.skipUnchanged = !opts.AllowEmpty && merging == ""
+		op.progress = opts.Progress
+		op.mergeParents = mergeParents
+		return op
+	}
 
-// ListSaves returns a list of all saves
-func (r *Repository) ListSaves() ([]Save, error) {
-	metadata, err := r.loadMetadata()
+	op := newOperation()
+	hash, err := r.createSave(op, name, snap, r.mappedWorkingTreeSource(op, snap))
+	op.release()
+	if errors.Is(err, errMappedFileChanged) {
+		// Save copies of the files instead, which cannot change while in use
+		op = newOperation()
+		hash, err = r.createSave(op, name, snap, r.workingTreeSource(snap))
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to load metadata: %w", err)
+		return "", err
 	}
 
-	return metadata.Saves, nil
+	if err := r.fs.Remove(r.bitPath(renamesFile)); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to clear pending renames: %w", err)
+	}
+	if err := r.clearMergeHead(); err != nil {
+		return "", err
+	}
+	return hash, r.setHead("save", hash)
 }
 
-// Checkout restores the project to the state of the given save hash
-func (r *Repository) Checkout(hash string) error {
-	// Check if repository is initialized
-	if _, err := r.fs.Stat(bitDir); os.IsNotExist(err) {
-		return fmt.Errorf("repository not initialized, run 'bit init' first")
+// checkSaveSize refuses a snapshot holding a file larger than MaxFileSize or
+// files larger than MaxSaveSize in total
+func checkSaveSize(snap snapshot, config Config) error {
+	var total int64
+	for _, file := range snap.files {
+		size := snap.sizes[file]
+		if config.MaxFileSize > 0 && size > config.MaxFileSize {
+			return fmt.Errorf("%s is %d bytes, over the maxFileSize limit of %d bytes; add it to .bitignore or save with --allow-large", file, size, config.MaxFileSize)
+		}
+		total += size
 	}
+	if config.MaxSaveSize > 0 && total > config.MaxSaveSize {
+		return fmt.Errorf("files to save total %d bytes, over the maxSaveSize limit of %d bytes; add large files to .bitignore or save with --allow-large", total, config.MaxSaveSize)
+	}
+	return nil
+}
 
-	// Load metadata
-	metadata, err := r.loadMetadata()
-	if err != nil {
-		return fmt.Errorf("failed to load metadata: %w", err)
+// checkFileDirectoryConflicts refuses a snapshot in which a path is both a
+// file and a directory, such as an archive holding foo and foo/bar, since no
+// checkout could write both. A file replaced by a directory between two saves
+// is fine: the file is deleted and the files inside the directory are added.
+func checkFileDirectoryConflicts(snap snapshot) error {
+	isFile := make(map[string]bool, len(snap.files))
+	for _, file := range snap.files {
+		isFile[file] = true
 	}
 
-	// Find the save with the given hash
-	var save *Save
-	for i := range metadata.Saves {
-		if metadata.Saves[i].Hash == hash {
-			save = &metadata.Saves[i]
-			break
+	for _, p := range append(append([]string(nil), snap.files...), snap.dirs...) {
+		for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if isFile[dir] {
+				return fmt.Errorf("%s is both a file and the directory holding %s", dir, p)
+			}
 		}
 	}
-
-	if save == nil {
-		return fmt.Errorf("save with hash %s not found", hash)
+	for _, dir := range snap.dirs {
+		if isFile[dir] {
+			return fmt.Errorf("%s is both a file and a directory", dir)
+		}
 	}
+	return nil
+}
 
-	// Store all current ignored files before any changes
-	currentIgnoredFiles := make(map[string]string) // map of path -> content
+// checkCaseCollisions refuses a snapshot with paths that differ only in case,
+// such as File.TXT and file.txt, or whose directories do, such as Docs/a and
+// docs/b. Case-insensitive filesystems would store both under the same name.
+func checkCaseCollisions(snap snapshot) error {
+	seen := make(map[string]string)
+	check := func(p string) error {
+		folded := strings.ToLower(p)
+		if other, ok := seen[folded]; ok && other != p {
+			return fmt.Errorf("%s and %s differ only in case and would overwrite each other on case-insensitive filesystems; rename one or save with --allow-case-collisions", other, p)
+		}
+		seen[folded] = p
+		return nil
+	}
 
-	// First, get a list of all current files
-	currentFiles, err := r.listAllFiles()
+	sorted := append(append([]string(nil), snap.files...), snap.dirs...)
+	sort.Strings(sorted)
+	for _, p := range sorted {
+		for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if err := check(dir + "/"); err != nil {
+				return err
+			}
+		}
+		if err := check(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// workingTreeSource returns a content source reading files from the working tree.
+// Symbolic links are read as their target rather than followed.
+func (r *Repository) workingTreeSource(snap snapshot) ContentSource {
+	return func(file string) ([]byte, error) {
+		if snap.symlinks[file] {
+			target, err := r.fs.Readlink(r.path(file))
+			if err != nil {
+				return nil, err
+			}
+			return []byte(target), nil
+		}
+		content, err := r.fs.ReadFile(r.path(file))
+		if err != nil {
+			return nil, err
+		}
+		return snap.lineEndings.normalize(file, content), nil
+	}
+}
+
+// mappedWorkingTreeSource is like workingTreeSource, but maps large files into
+// memory with op instead of copying them. The content must not be used after
+// op.release.
+func (r *Repository) mappedWorkingTreeSource(op *operation, snap snapshot) ContentSource {
+	read := r.workingTreeSource(snap)
+	return func(file string) ([]byte, error) {
+		if snap.symlinks[file] {
+			return read(file)
+		}
+		content, err := op.readMapped(r.path(file))
+		if err != nil {
+			return nil, err
+		}
+		return snap.lineEndings.normalize(file, content), nil
+	}
+}
+
+// ImportTar creates a new save with the given name from the regular files in a
+// tar archive, without touching the working directory. Files keep the
+// permission bits and modification times recorded in the archive.
+func (r *Repository) ImportTar(name string, reader io.Reader) (string, error) {
+	// Check if repository is initialized
+	if err := r.ensureInitialized(); err != nil {
+		return "", err
+	}
+
+	unlock, err := r.lock()
 	if err != nil {
-		return fmt.Errorf("failed to get current files: %w", err)
+		return "", err
 	}
+	defer unlock()
 
-	// First restore the .bitignore file if it exists in the save
-	var hasIgnoreFile bool
-	for _, file := range save.Files {
-		if file == ignoreFile {
-			hasIgnoreFile = true
+	contents := make(map[string][]byte)
+	symlinks := make(map[string]bool)
+	modes := make(map[string]os.FileMode)
+	modTimes := make(map[string]time.Time)
+	var dirs []string
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read archive: %w", err)
+		}
 
-			// Get the content of the .bitignore file from save
-			ignoreContent, err := r.getFileContentFromSave(file, hash)
+		// Only regular files and links carry content; directories are kept only when empty
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeSymlink {
+			continue
+		}
+
+		file := path.Clean(strings.TrimPrefix(filepath.ToSlash(header.Name), "./"))
+		if path.IsAbs(file) || file == ".." || strings.HasPrefix(file, "../") {
+			return "", fmt.Errorf("archive entry %s escapes the repository", header.Name)
+		}
+		if util.IsBitDirectory(file) || file == "." {
+			continue
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, file)
+			continue
+		}
+
+		if header.Typeflag == tar.TypeSymlink {
+			contents[file] = []byte(header.Linkname)
+			symlinks[file] = true
+			continue
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return "", fmt.Errorf("failed to read archive entry %s: %w", header.Name, err)
+		}
+		contents[file] = content
+		if mode := os.FileMode(header.Mode).Perm(); mode != 0 {
+			modes[file] = mode
+		}
+		if !header.ModTime.IsZero() {
+			modTimes[file] = header.ModTime
+		}
+	}
+
+	if len(contents) == 0 {
+		return "", fmt.Errorf("no files to save")
+	}
+
+	files := make([]string, 0, len(contents))
+	for file := range contents {
+		files = append(files, file)
+	}
+
+	source := func(file string) ([]byte, error) {
+		content, ok := contents[file]
+		if !ok {
+			return nil, fmt.Errorf("file %s not found in archive", file)
+		}
+		return content, nil
+	}
+
+	snap := snapshot{files: files, dirs: emptyDirs(dirs, files), symlinks: symlinks, modes: modes, modTimes: modTimes}
+	return r.createSave(r.newOperation(), name, snap, source)
+}
+
+// createSave stores the files of the snapshot, reading their content from source,
+// as a new save on top of the latest save and records it in the metadata
+func (r *Repository) createSave(op *operation, name string, snap snapshot, source ContentSource) (string, error) {
+	if err := checkFileDirectoryConflicts(snap); err != nil {
+		return "", err
+	}
+
+	files := append([]string(nil), snap.files...)
+	sort.Strings(files)
+	dirs := append([]string(nil), snap.dirs...)
+	sort.Strings(dirs)
+
+	timestamp := time.Now()
+
+	// Load existing metadata to find the previous save
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return "", fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	_, branch, err := r.readHeadState()
+	if err != nil {
+		return "", err
+	}
+	_, onBranch := metadata.Branches[branch]
+
+	// Find the most recent save to use as a base for deltas. Saves on a
+	// branch extend its tip instead.
+	var baseSave *Save
+	if deltaMode && len(metadata.Saves) > 0 {
+		baseSave = &metadata.Saves[len(metadata.Saves)-1]
+		if i := saveIndex(metadata, metadata.Branches[branch]); onBranch && i >= 0 {
+			baseSave = &metadata.Saves[i]
+		}
+	}
+
+	// A save that fails partway leaves none of its objects behind
+	save, err := r.writeSave(op, name, timestamp, snapshot{files: files, dirs: dirs, symlinks: snap.symlinks, renames: snap.renames, modes: snap.modes, modTimes: snap.modTimes, lineEndings: snap.lineEndings}, source, baseSave)
+	if err != nil {
+		op.rollback()
+		return "", err
+	}
+	if err := op.checkMapped(); err != nil {
+		op.rollback()
+		return "", err
+	}
+
+	save.MergeParents = op.mergeParents
+	if err := r.signSave(&save); err != nil {
+		op.rollback()
+		return "", err
+	}
+	metadata.Saves = append(metadata.Saves, save)
+	if onBranch {
+		metadata.Branches[branch] = save.Hash
+	}
+	if err := r.saveMetadata(metadata); err != nil {
+		op.rollback()
+		return "", fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	return save.Hash, nil
+}
+
+// writeSave stores the objects for a save of the sorted files in snap on top
+// of baseSave, which may be nil, and returns the save without recording it in
+// the metadata. The save hash covers the content of every file, so it is only
+// known once all files have been read.
+func (r *Repository) writeSave(op *operation, name string, timestamp time.Time, snap snapshot, source ContentSource, baseSave *Save) (Save, error) {
+	config, err := r.loadConfig()
+	if err != nil {
+		return Save{}, err
+	}
+	author, host := config.identity()
+
+	var baseSaveHash string
+	if baseSave != nil {
+		baseSaveHash = baseSave.Hash
+	}
+
+	var hash string
+	var contentHashes map[string]string
+	var depths map[string]int
+	if deltaMode {
+		// Use delta-based storage
+		deltas, fileDepths, err := r.saveFilesAsDelta(op, snap, source, baseSave)
+		if err != nil {
+			return Save{}, fmt.Errorf("failed to save files as delta: %w", err)
+		}
+		if op.skipUnchanged && unchangedSave(deltas, snap, baseSave, r.modesInSave(baseSaveHash)) {
+			return Save{}, ErrNothingToSave
+		}
+		depths = fileDepths
+
+		contentHashes = make(map[string]string, len(snap.files))
+		for _, delta := range deltas {
+			if !delta.IsDeleted {
+				contentHashes[delta.Path] = delta.ContentHash
+			}
+		}
+		hash, err = r.newSaveHash(createSaveHash(name, timestamp, baseSaveHash, snap.files, contentHashes))
+		if err != nil {
+			return Save{}, err
+		}
+
+		deltaSet := util.DeltaSet{
+			SaveHash: hash,
+			Deltas:   deltas,
+		}
+		deltaPath := util.DeltaSetPath(hash, r.objectsDir)
+		existed := r.fs.Exists(deltaPath)
+		err = retryObjectWrite(func() error {
+			return r.saveDeltaSet(deltaSet)
+		})
+		if !existed {
+			op.track(deltaPath)
+		}
+		if err != nil {
+			return Save{}, fmt.Errorf("failed to save delta set: %w", err)
+		}
+	} else {
+		// Use traditional full-file storage
+		contents := make(map[string][]byte, len(snap.files))
+		contentHashes = make(map[string]string, len(snap.files))
+		depths = make(map[string]int, len(snap.files))
+		for _, file := range snap.files {
+			content, err := source(file)
 			if err != nil {
-				return fmt.Errorf("failed to get ignore file content: %w", err)
+				return Save{}, fmt.Errorf("failed to read file %s: %w", file, err)
 			}
+			contents[file] = content
+			contentHashes[file] = util.CalculateFileHash(content)
+			depths[file] = 0
+		}
+		var err error
+		hash, err = r.newSaveHash(createSaveHash(name, timestamp, baseSaveHash, snap.files, contentHashes))
+		if err != nil {
+			return Save{}, err
+		}
 
-			// Write the .bitignore file
-			if err := r.fs.WriteFile(file, ignoreContent, 0644); err != nil {
-				return fmt.Errorf("failed to restore ignore file: %w", err)
+		for _, file := range snap.files {
+			content := contents[file]
+			targetPath := util.FileObjectPath(file, hash, r.objectsDir)
+			op.track(targetPath)
+			if err := util.CopyToFile(content, targetPath, r.fs); err != nil {
+				return Save{}, fmt.Errorf("failed to copy file %s: %w", file, err)
 			}
-			break
 		}
 	}
 
-	// If no .bitignore in save, but one exists now, keep it
-	if !hasIgnoreFile {
-		for _, file := range currentFiles {
-			if file == ignoreFile {
-				hasIgnoreFile = true
-				break
+	return Save{
+		Hash:         hash,
+		Name:         name,
+		Timestamp:    timestamp,
+		Files:        snap.files,
+		Dirs:         snap.dirs,
+		BaseSaveHash: baseSaveHash,
+		TreeHash:     treeHash(snap.files, contentHashes),
+		DeltaDepths:  depths,
+		Author:       author,
+		Host:         host,
+	}, nil
+}
+
+// unchangedSave reports whether deltas, computed against baseSave, record no
+// change: no file was added, deleted, renamed, modified or given other
+// permissions than in baseModes, and the same empty directories exist
+func unchangedSave(deltas []util.DeltaInfo, snap snapshot, baseSave *Save, baseModes map[string]os.FileMode) bool {
+	if baseSave == nil {
+		return false
+	}
+	for _, delta := range deltas {
+		if delta.IsNew || delta.IsDeleted || delta.RenamedFrom != "" || delta.Blob != "" || len(delta.Patches) > 0 {
+			return false
+		}
+		// Saves made before modes were recorded have none to compare
+		if baseMode, ok := baseModes[delta.Path]; ok && baseMode != delta.Mode {
+			return false
+		}
+	}
+	return strings.Join(snap.dirs, "\x00") == strings.Join(baseSave.Dirs, "\x00")
+}
+
+// saveFilesAsDelta stores the content of files that needs storing, reading it
+// from source, and returns the deltas of the save sorted by path along with
+// the delta depth of each file
+func (r *Repository) saveFilesAsDelta(op *operation, snap snapshot, source ContentSource, baseSave *Save) ([]util.DeltaInfo, map[string]int, error) {
+	files := snap.files
+	var deltas []util.DeltaInfo
+	var baseFileMap map[string]bool
+	deltaCounts := make(map[string]int)  // Track delta chain length for each file
+	basePaths := make(map[string]string) // Path of each renamed file in the base save
+
+	attributes, err := r.loadAttributes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create a map of files in the base save for quick lookup
+	if baseSave != nil {
+		baseFileMap = make(map[string]bool, len(baseSave.Files))
+		for _, file := range baseSave.Files {
+			baseFileMap[file] = true
+		}
+
+		// A moved file is based on its previous path, as long as that path
+		// was saved and is not still present itself
+		currentFiles := make(map[string]bool, len(files))
+		for _, file := range files {
+			currentFiles[file] = true
+		}
+		for file, from := range snap.renames {
+			if currentFiles[file] && !baseFileMap[file] && baseFileMap[from] && !currentFiles[from] {
+				basePaths[file] = from
+			}
+		}
+
+		// Calculate delta chain lengths from metadata
+		metadata, err := r.loadMetadata()
+		if err == nil {
+			// Delta sets are shared by every file, so load each one at most once
+			deltaSets := make(map[string]map[string]util.DeltaInfo)
+
+			// Build a map of save hash to index for quick lookup
+			saveMap := make(map[string]int, len(metadata.Saves))
+			for i, save := range metadata.Saves {
+				saveMap[save.Hash] = i
+			}
+
+			// For each file, traverse the delta chain to count its length
+			for _, file := range files {
+				deltaCounts[file] = r.deltaChainLength(metadata, saveMap, basePath(file, basePaths), baseSave.Hash, deltaSets)
+			}
+		}
+	}
+
+	// Process files concurrently; each worker writes into its own slot so the
+	// result order does not depend on scheduling
+	results := make([]util.DeltaInfo, len(files))
+	sizes := make([]int, len(files))
+	errs := make([]error, len(files))
+
+	workers := saveWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(files) {
+		workers = len(files)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				file := files[i]
+				from := basePath(file, basePaths)
+				results[i], sizes[i], errs[i] = r.saveFileAsDelta(op, file, from, source, baseSave, baseFileMap[from], deltaCounts[file], attributes.StoragePolicy(file))
+				results[i].IsSymlink = snap.symlinks[file]
+				results[i].Mode = snap.modes[file]
+				results[i].ModTime = unixNano(snap.modTimes[file])
+				results[i].Normalized = snap.lineEndings.normalized(file)
+				op.fileDone(len(files), file)
+			}
+		}()
+	}
+	for i := range files {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	deltas = append(deltas, results...)
+
+	// A file stored in full is rebuilt without deltas, any other file needs
+	// one more delta than at the base save
+	depths := make(map[string]int, len(files))
+	for i, delta := range results {
+		if delta.Blob == "" {
+			depths[files[i]] = deltaCounts[files[i]] + 1
+		} else {
+			depths[files[i]] = 0
+		}
+	}
+
+	var reports []FileReport
+	if op.report != nil {
+		for i, delta := range results {
+			reports = append(reports, fileReport(delta, sizes[i], deltaCounts[files[i]]))
+		}
+	}
+
+	// Check for deleted files (files in base save but not in current save)
+	if baseSave != nil {
+		currentFileMap := make(map[string]bool, len(files))
+		for _, file := range files {
+			currentFileMap[file] = true
+		}
+
+		for _, file := range baseSave.Files {
+			if !currentFileMap[file] {
+				// Get base content
+				baseContent, err := op.fileContent(file, baseSave.Hash)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to read base file %s: %w", file, err)
+				}
+
+				// Add a deletion delta
+				delta := util.CalculateDelta(util.EmptyIfNil(baseContent), nil, file, baseSave.Hash)
+				deltas = append(deltas, delta)
+				if op.report != nil {
+					reports = append(reports, FileReport{Path: file, Change: "deleted", Stored: "none"})
+				}
 			}
 		}
 	}
 
-	// Load ignore patterns from the restored or existing .bitignore file
-	ignoredPatterns, err := util.GetIgnorePatterns(ignoreFile)
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to load ignore patterns: %w", err)
-	}
+	// Keep the delta set ordering deterministic regardless of worker scheduling
+	sort.Slice(deltas, func(i, j int) bool {
+		return deltas[i].Path < deltas[j].Path
+	})
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Path < reports[j].Path
+	})
+	for _, report := range reports {
+		op.report(report)
+	}
+	return deltas, depths, nil
+}
+
+// fileReport describes how delta stored a file of the given size whose base
+// needed chainLength deltas to reconstruct
+func fileReport(delta util.DeltaInfo, size, chainLength int) FileReport {
+	report := FileReport{Path: delta.Path, Size: size, Stored: "none"}
+
+	switch {
+	case delta.IsNew:
+		report.Change = "new"
+	case delta.RenamedFrom != "":
+		report.Change = "renamed"
+	case len(delta.Patches) > 0 || delta.Blob != "":
+		report.Change = "modified"
+	default:
+		report.Change = "unchanged"
+	}
+
+	switch {
+	case delta.Blob != "":
+		report.Stored = "full"
+		report.StoredSize = size
+	case len(delta.Patches) > 0:
+		report.Stored = "delta"
+		report.ChainDepth = chainLength + 1
+		for _, patch := range delta.Patches {
+			report.StoredSize += len(patch)
+		}
+	default:
+		report.ChainDepth = chainLength
+	}
+	return report
+}
+
+// basePath returns the path file had in the base save
+func basePath(file string, basePaths map[string]string) string {
+	if from, ok := basePaths[file]; ok {
+		return from
+	}
+	return file
+}
+
+// saveFileAsDelta stores file relative to the content of from, its path in the
+// base save, which differs from file only when the file was renamed. It returns
+// the delta along with the size of the file content and is safe to call
+// concurrently.
+func (r *Repository) saveFileAsDelta(op *operation, file, from string, source ContentSource, baseSave *Save, inBase bool, chainLength int, policy util.StoragePolicy) (util.DeltaInfo, int, error) {
+	// Read current file content
+	currentContent, err := source(file)
+	if err != nil {
+		return util.DeltaInfo{}, 0, fmt.Errorf("failed to read file %s: %w", file, err)
+	}
+	// An empty file is stored as empty, never as missing
+	currentContent = util.EmptyIfNil(currentContent)
+	size := len(currentContent)
+
+	// This is a new file, store full content
+	if baseSave == nil || !inBase {
+		delta := util.CalculateDelta(nil, currentContent, file, "")
+
+		// Always store full content for new files
+		blob, err := op.storeBlob(currentContent)
+		if err != nil {
+			return util.DeltaInfo{}, 0, fmt.Errorf("failed to save full file %s: %w", file, err)
+		}
+		delta.Blob = blob
+		return delta, size, nil
+	}
+
+	// Try to read base content directly or from delta chain
+	baseContent, err := op.fileContent(from, baseSave.Hash)
+	if err != nil {
+		return util.DeltaInfo{}, 0, fmt.Errorf("failed to read base file %s: %w", from, err)
+	}
+	baseContent = util.EmptyIfNil(baseContent)
+
+	// Files that never diff well skip computing a delta when they change
+	if policy == util.StorageFull && !bytes.Equal(baseContent, currentContent) {
+		delta := util.DeltaInfo{
+			Path:         file,
+			BaseSaveHash: baseSave.Hash,
+			ContentHash:  util.CalculateFileHash(currentContent),
+			Compressed:   true,
+		}
+		if from != file {
+			delta.RenamedFrom = from
+		}
+		delta.Blob, err = op.storeBlob(currentContent)
+		if err != nil {
+			return util.DeltaInfo{}, 0, fmt.Errorf("failed to save full file %s: %w", file, err)
+		}
+		return delta, size, nil
+	}
+
+	// Calculate delta between base and current
+	engine := util.DeltaEngineConfig.Engine
+	if policy == util.StorageBinary {
+		engine = util.BinaryEngineName
+	}
+	delta := util.CalculateDeltaWithEngine(baseContent, currentContent, file, baseSave.Hash, engine)
+	if from != file {
+		delta.RenamedFrom = from
+	}
+
+	// Store full file only if:
+	// 1. The delta chain length exceeds our maximum limit (if configured)
+	// 2. There are actual changes (delta.Patches is not nil/empty)
+	// 3. The file is not required to be stored as deltas
+	if maxDeltaChainLength > 0 &&
+		delta.Patches != nil &&
+		len(delta.Patches) > 0 &&
+		chainLength >= maxDeltaChainLength &&
+		policy != util.StorageDelta {
+		// Store full file to avoid excessive delta chain length
+		blob, err := op.storeBlob(currentContent)
+		if err != nil {
+			return util.DeltaInfo{}, 0, fmt.Errorf("failed to save full file %s: %w", file, err)
+		}
+		delta.Blob = blob
+	}
+
+	return delta, size, nil
+}
+
+// saveDeltaSet saves a delta set to the filesystem
+func (r *Repository) saveDeltaSet(deltaSet util.DeltaSet) error {
+	return util.SaveDeltaSet(deltaSet, r.objectsDir, r.fs)
+}
+
+// loadDeltaSet loads a delta set from the filesystem
+func (r *Repository) loadDeltaSet(saveHash string) (util.DeltaSet, error) {
+	return util.LoadDeltaSet(saveHash, r.objectsDir, r.fs)
+}
+
+// saveFullFile saves a full file to the objects directory
+func (r *Repository) saveFullFile(content []byte, path, saveHash string) error {
+	return util.SaveFullFile(content, path, saveHash, r.objectsDir, r.fs)
+}
+
+// deltaChainLength counts the deltas that must be applied to reconstruct file
+// at the given save, following base saves until one stores the full content.
+// saveMap maps save hashes to their index in metadata.Saves.
+func (r *Repository) deltaChainLength(metadata Metadata, saveMap map[string]int, file, saveHash string, deltaSets map[string]map[string]util.DeltaInfo) int {
+	currentHash := saveHash
+	count := 0
+
+	// Follow delta chain back until we find a save with a full file
+	for currentHash != "" {
+		saveIndex, found := saveMap[currentHash]
+		if !found {
+			break
+		}
+
+		// Check if this save has a full file content stored
+		if r.hasFullContent(file, currentHash, deltaSets) {
+			// Full file found, chain ends here
+			break
+		}
+
+		// Follow renamed files to their previous path
+		delta := deltaSets[currentHash][file]
+		if delta.RenamedFrom != "" {
+			file = delta.RenamedFrom
+		}
+
+		// Move to the save the delta applies to, which is the base save
+		// unless the delta was repacked, and increment count
+		if delta.BaseSaveHash != "" {
+			currentHash = delta.BaseSaveHash
+		} else {
+			currentHash = metadata.Saves[saveIndex].BaseSaveHash
+		}
+		count++
+	}
+
+	return count
+}
+
+// hasFullContent reports whether the save stores a full copy of the file rather
+// than only a delta. deltaSets caches the per-save delta lookups.
+func (r *Repository) hasFullContent(file, saveHash string, deltaSets map[string]map[string]util.DeltaInfo) bool {
+	deltas, ok := deltaSets[saveHash]
+	if !ok {
+		deltas = make(map[string]util.DeltaInfo)
+		if deltaSet, err := r.loadDeltaSet(saveHash); err == nil {
+			for _, delta := range deltaSet.Deltas {
+				deltas[delta.Path] = delta
+			}
+		}
+		deltaSets[saveHash] = deltas
+	}
+
+	if deltas[file].Blob != "" {
+		return true
+	}
+
+	// Full-file objects written before content addressing
+	for _, fullPath := range util.FileObjectPaths(file, saveHash, r.objectsDir) {
+		if _, err := r.fs.Stat(fullPath); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// getFileContentFromSave retrieves file content from a specific save
+func (r *Repository) getFileContentFromSave(file, saveHash string) ([]byte, error) {
+	return r.newOperation().fileContent(file, saveHash)
+}
+
+// reconstructFileContent reads or rebuilds the content of file at the given save.
+// The delta chain is walked back to the nearest version that is stored in full
+// or was already reconstructed during op, and its deltas are then applied
+// forward, so chains of any length are rebuilt without recursing. Every
+// version passed on the way is remembered by op.
+func (r *Repository) reconstructFileContent(op *operation, file, saveHash string) ([]byte, error) {
+	var chain []util.DeltaInfo
+	var keys []contentKey
+	visited := make(map[contentKey]bool)
+	key := contentKey{path: file, saveHash: saveHash}
+
+	var content []byte
+	for {
+		if visited[key] {
+			return nil, fmt.Errorf("delta chain of %s loops back to save %s", file, key.saveHash)
+		}
+		visited[key] = true
+
+		stored, delta, err := r.storedContent(op, key.path, key.saveHash)
+		if err != nil {
+			return nil, err
+		}
+		if delta == nil {
+			content = stored
+			if len(chain) > 0 {
+				op.remember(key, content)
+			}
+			break
+		}
+		chain = append(chain, *delta)
+		keys = append(keys, key)
+
+		// Deleted files have no base to read
+		if delta.IsDeleted {
+			break
+		}
+		basePath, baseSaveHash := util.DeltaBase(*delta)
+		key = contentKey{path: basePath, saveHash: baseSaveHash}
+		if cached, ok := op.cached(key); ok {
+			content = cached
+			break
+		}
+	}
+
+	// Apply the deltas from the oldest version on
+	for i := len(chain) - 1; i >= 0; i-- {
+		base := content
+		var err error
+		content, err = util.ApplyDelta(chain[i], func(string, string) ([]byte, error) {
+			return base, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			op.remember(keys[i], content)
+		}
+	}
+	return content, nil
+}
+
+// storedContent returns the content of file at the given save when the save
+// stores it in full, and otherwise the delta that rebuilds it from its base
+func (r *Repository) storedContent(op *operation, file, saveHash string) ([]byte, *util.DeltaInfo, error) {
+	if saveHash == "" {
+		return nil, nil, fmt.Errorf("invalid save hash")
+	}
+
+	// Load delta set
+	deltas, err := op.deltaSet(saveHash)
+	if err != nil {
+		// Saves made without delta storage only have full-file objects
+		if content, legacyErr := util.GetFileContent(file, saveHash, r.objectsDir, r.fs); legacyErr == nil {
+			return content, nil, nil
+		}
+
+		if save, _ := op.save(saveHash); save == nil {
+			return nil, nil, fmt.Errorf("save with hash %s not found", saveHash)
+		}
+		return nil, nil, fmt.Errorf("failed to load delta set: %w", err)
+	}
+
+	// Find delta for this file
+	var fileDelta *util.DeltaInfo
+	if delta, ok := deltas[file]; ok {
+		fileDelta = &delta
+	}
+
+	// Full content stored in the content-addressed blob store
+	if fileDelta != nil && fileDelta.Blob != "" {
+		content, err := util.GetBlobContent(fileDelta.Blob, r.objectsDir, r.fs)
+		return content, nil, err
+	}
+
+	// Full content stored under the legacy <saveHash>_<path> name
+	if content, err := util.GetFileContent(file, saveHash, r.objectsDir, r.fs); err == nil {
+		return content, nil, nil
+	}
+
+	if fileDelta == nil {
+		return nil, nil, fmt.Errorf("delta for file %s not found in save %s", file, saveHash)
+	}
+	return nil, fileDelta, nil
+}
+
+// ListSaves returns a list of all saves
+func (r *Repository) ListSaves() ([]Save, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	return metadata.Saves, nil
+}
+
+// ListOptions selects the page of saves returned by ListSavesFiltered. The
+// zero value selects every save, like ListSaves.
+type ListOptions struct {
+	// Branch, when set, lists only the saves of that branch as in LogBranch
+	Branch string
+	// Name, when set, keeps only saves whose name contains it
+	Name string
+	// Reverse lists the newest save first
+	Reverse bool
+	// Offset skips that many of the matching saves
+	Offset int
+	// Limit, when positive, returns at most that many saves
+	Limit int
+}
+
+// ListSavesFiltered returns the saves matching opts, oldest first unless
+// opts.Reverse is set. Offset and Limit apply after filtering and ordering,
+// so consecutive offsets page through the matching saves.
+func (r *Repository) ListSavesFiltered(opts ListOptions) ([]Save, error) {
+	if opts.Offset < 0 || opts.Limit < 0 {
+		return nil, fmt.Errorf("offset and limit cannot be negative")
+	}
+
+	saves, err := r.LogBranch(opts.Branch, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	var matching []Save
+	for _, save := range saves {
+		if strings.Contains(save.Name, opts.Name) {
+			matching = append(matching, save)
+		}
+	}
+	if opts.Reverse {
+		for i, j := 0, len(matching)-1; i < j; i, j = i+1, j-1 {
+			matching[i], matching[j] = matching[j], matching[i]
+		}
+	}
+
+	matching = matching[min(opts.Offset, len(matching)):]
+	if opts.Limit > 0 && opts.Limit < len(matching) {
+		matching = matching[:opts.Limit]
+	}
+	return matching, nil
+}
+
+// Log returns the saves whose timestamp falls inside the inclusive range
+// [since, until]. A zero since or until leaves that side of the range open.
+func (r *Repository) Log(since, until time.Time) ([]Save, error) {
+	return r.LogBranch("", since, until)
+}
+
+// LogBranch returns the saves of the given branch, as listed by BranchSaves,
+// whose timestamp falls inside [since, until] as in Log. An empty branch
+// name stands for every save.
+func (r *Repository) LogBranch(branch string, since, until time.Time) ([]Save, error) {
+	var saves []Save
+	var err error
+	if branch == "" {
+		saves, err = r.ListSaves()
+	} else {
+		saves, err = r.BranchSaves(branch)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered []Save
+	for _, save := range saves {
+		if !since.IsZero() && save.Timestamp.Before(since) {
+			continue
+		}
+		if !until.IsZero() && save.Timestamp.After(until) {
+			continue
+		}
+		filtered = append(filtered, save)
+	}
+
+	return filtered, nil
+}
+
+// Ancestors returns every save the save referenced by hash, which may be a
+// hash prefix or a tag, descends from, following both its base and merged
+// saves. Nearer saves come first, so the first entry is its base. Parents
+// missing from the metadata are skipped.
+func (r *Repository) Ancestors(hash string) ([]Save, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	save, err := resolveHash(metadata, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var ancestors []Save
+	visited := map[string]bool{save.Hash: true}
+	for queue := save.Parents(); len(queue) > 0; queue = queue[1:] {
+		if visited[queue[0]] {
+			continue
+		}
+		visited[queue[0]] = true
+		i := saveIndex(metadata, queue[0])
+		if i < 0 {
+			continue
+		}
+		ancestors = append(ancestors, metadata.Saves[i])
+		queue = append(queue, metadata.Saves[i].Parents()...)
+	}
+	return ancestors, nil
+}
+
+// Children returns the saves made directly from the save referenced by hash,
+// based on it or merging it, oldest first. More than one child means that
+// history branched at that save.
+func (r *Repository) Children(hash string) ([]Save, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	save, err := resolveHash(metadata, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []Save
+	for _, child := range metadata.Saves {
+		for _, parent := range child.Parents() {
+			if parent == save.Hash {
+				children = append(children, child)
+				break
+			}
+		}
+	}
+	return children, nil
+}
+
+// SaveFiles returns the paths of the files tracked by the save referenced by
+// hash, a hash prefix or a tag, sorted and relative to the repository root.
+// Empty directories the save records are not included.
+func (r *Repository) SaveFiles(hash string) ([]string, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	save, err := resolveHash(metadata, hash)
+	if err != nil {
+		return nil, err
+	}
+	return save.Files, nil
+}
+
+// FileHistory returns every save in which the content of the given file
+// changed compared to the save it is based on, in save order. Saves on
+// different branches are each compared with their own base. A file that is
+// deleted and later re-added is reported as added again.
+func (r *Repository) FileHistory(file string) ([]FileChange, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	file = path.Clean(filepath.ToSlash(file))
+	op := r.newOperation()
+
+	// The content hash of the file at every save that has it. Bases come
+	// before the saves made on them; saves made without delta storage record
+	// no base and follow the previous save.
+	sums := make(map[string][sha256.Size]byte, len(metadata.Saves))
+	var history []FileChange
+	for i, save := range metadata.Saves {
+		base := save.BaseSaveHash
+		if base == "" && i > 0 {
+			base = metadata.Saves[i-1].Hash
+		}
+		previous, present := sums[base]
+
+		if !containsFile(save.Files, file) {
+			if present {
+				history = append(history, FileChange{Save: save, Change: "deleted"})
+			}
+			continue
+		}
+
+		content, err := op.fileContent(file, save.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reconstruct %s in save %s: %w", file, save.Hash, err)
+		}
+		sum := sha256.Sum256(content)
+
+		switch {
+		case !present:
+			history = append(history, FileChange{Save: save, Change: "added"})
+		case sum != previous:
+			history = append(history, FileChange{Save: save, Change: "modified"})
+		}
+		sums[save.Hash] = sum
+	}
+
+	return history, nil
+}
+
+// Diff returns the changes from the save referenced by from to the one
+// referenced by to as a unified diff that git apply and patch accept, with
+// context unchanged lines around each change. An empty from stands for the
+// checked out save and an empty to for the working tree. Binary files are
+// only noted as changed.
+func (r *Repository) Diff(from, to string, context int) (string, error) {
+	var patch strings.Builder
+	err := r.forEachChangedFile(from, to, func(change fileChange) error {
+		if IsBinary(change.before) || IsBinary(change.after) {
+			patch.WriteString(util.BinaryDiff(change.oldPath, change.newPath))
+			return nil
+		}
+		patch.WriteString(util.UnifiedDiff(change.oldPath, change.newPath, string(change.before), string(change.after), context))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return patch.String(), nil
+}
+
+// FileStat counts the lines inserted and deleted in a changed file
+type FileStat struct {
+	Path       string `json:"path"`
+	Insertions int    `json:"insertions"`
+	Deletions  int    `json:"deletions"`
+	// Binary files are reported as changed without line counts
+	Binary bool `json:"binary"`
+}
+
+// DiffStat returns, for every file that changed from the save referenced by
+// from to the one referenced by to, the number of lines inserted and deleted,
+// sorted by path. Empty from and to stand for the checked out save and the
+// working tree as in Diff.
+func (r *Repository) DiffStat(from, to string) ([]FileStat, error) {
+	stats := []FileStat{}
+	err := r.forEachChangedFile(from, to, func(change fileChange) error {
+		stat := FileStat{Path: change.path}
+		if IsBinary(change.before) || IsBinary(change.after) {
+			stat.Binary = true
+		} else {
+			stat.Insertions, stat.Deletions = util.CountLineChanges(string(change.before), string(change.after))
+		}
+		stats = append(stats, stat)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// fileChange is a file whose content differs between two states. oldPath or
+// newPath is empty when the file does not exist on that side.
+type fileChange struct {
+	path             string
+	oldPath, newPath string
+	before, after    []byte
+}
+
+// forEachChangedFile calls fn, in path order, with every file that differs
+// from the save referenced by from to the one referenced by to. An empty from
+// stands for the checked out save and an empty to for the working tree.
+func (r *Repository) forEachChangedFile(from, to string, fn func(fileChange) error) error {
+	if err := r.ensureInitialized(); err != nil {
+		return err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	if from == "" {
+		if from, err = r.Head(); err != nil {
+			return err
+		}
+		if from == "" {
+			return fmt.Errorf("nothing to compare with before the first save")
+		}
+	}
+	fromSave, err := resolveHash(metadata, from)
+	if err != nil {
+		return err
+	}
+
+	op := r.newOperation()
+	oldContent := func(file string) ([]byte, error) {
+		return op.fileContent(file, fromSave.Hash)
+	}
+	var newFiles []string
+	var newContent ContentSource
+	if to == "" {
+		snap, err := r.getFilesToSave()
+		if err != nil {
+			return err
+		}
+		newFiles, newContent = snap.files, r.workingTreeSource(snap)
+	} else {
+		toSave, err := resolveHash(metadata, to)
+		if err != nil {
+			return err
+		}
+		newFiles = toSave.Files
+		newContent = func(file string) ([]byte, error) {
+			return op.fileContent(file, toSave.Hash)
+		}
+	}
+
+	inOld := make(map[string]bool, len(fromSave.Files))
+	inNew := make(map[string]bool, len(newFiles))
+	var files []string
+	for _, file := range fromSave.Files {
+		inOld[file] = true
+		files = append(files, file)
+	}
+	for _, file := range newFiles {
+		inNew[file] = true
+		if !inOld[file] {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		change := fileChange{path: file}
+		if inOld[file] {
+			change.oldPath = file
+			if change.before, err = oldContent(file); err != nil {
+				return fmt.Errorf("failed to reconstruct %s: %w", file, err)
+			}
+		}
+		if inNew[file] {
+			change.newPath = file
+			if change.after, err = newContent(file); err != nil {
+				return fmt.Errorf("failed to read %s: %w", file, err)
+			}
+		}
+		if inOld[file] && inNew[file] && bytes.Equal(change.before, change.after) {
+			continue
+		}
+		if err := fn(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompareSaves lists the files added, removed and modified from save a to save b.
+// Files are compared by content hash, so no diffs are computed.
+func (r *Repository) CompareSaves(a, b string) (*ChangeSet, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	from, err := resolveHash(metadata, a)
+	if err != nil {
+		return nil, err
+	}
+	to, err := resolveHash(metadata, b)
+	if err != nil {
+		return nil, err
+	}
+
+	op := r.newOperation()
+	fromHashes, err := r.contentHashes(op, *from)
+	if err != nil {
+		return nil, err
+	}
+	toHashes, err := r.contentHashes(op, *to)
+	if err != nil {
+		return nil, err
+	}
+
+	return compareHashes(from.Hash, to.Hash, fromHashes, toHashes), nil
+}
+
+// ChangedFiles lists the files added, removed and modified from the save
+// referenced by from to the one referenced by to, like Diff but comparing
+// content hashes instead of computing diffs. An empty from stands for the
+// checked out save and an empty to for the working tree, whose files are
+// read to hash them; To is left empty then.
+func (r *Repository) ChangedFiles(from, to string) (*ChangeSet, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+	if from == "" {
+		head, err := r.Head()
+		if err != nil {
+			return nil, err
+		}
+		if head == "" {
+			return nil, fmt.Errorf("nothing to compare with before the first save")
+		}
+		from = head
+	}
+	if to != "" {
+		return r.CompareSaves(from, to)
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	fromSave, err := resolveHash(metadata, from)
+	if err != nil {
+		return nil, err
+	}
+	fromHashes, err := r.contentHashes(r.newOperation(), *fromSave)
+	if err != nil {
+		return nil, err
+	}
+
+	snap, err := r.getFilesToSave()
+	if err != nil {
+		return nil, err
+	}
+	source := r.workingTreeSource(snap)
+	toHashes := make(map[string]string, len(snap.files))
+	for _, file := range snap.files {
+		content, err := source(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %s: %w", file, err)
+		}
+		toHashes[file] = util.CalculateFileHash(content)
+	}
+	return compareHashes(fromSave.Hash, "", fromHashes, toHashes), nil
+}
+
+// compareHashes builds the ChangeSet from the state named from to the one
+// named to, given the content hash of every file of each
+func compareHashes(from, to string, fromHashes, toHashes map[string]string) *ChangeSet {
+	changes := &ChangeSet{From: from, To: to, Added: []string{}, Removed: []string{}, Modified: []string{}}
+	for file, toHash := range toHashes {
+		fromHash, ok := fromHashes[file]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, file)
+		case fromHash != toHash:
+			changes.Modified = append(changes.Modified, file)
+		}
+	}
+	for file := range fromHashes {
+		if _, ok := toHashes[file]; !ok {
+			changes.Removed = append(changes.Removed, file)
+		}
+	}
+
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Modified)
+	return changes
+}
+
+// Grep returns the lines matching the regular expression pattern in the files
+// of the given save, or of the working tree when hash is empty, ordered by path
+// and line. Binary files and symbolic links are skipped.
+func (r *Repository) Grep(pattern, hash string) ([]GrepMatch, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	var files []string
+	var symlinks map[string]bool
+	var source ContentSource
+	if hash == "" {
+		snap, err := r.getFilesToSave()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files: %w", err)
+		}
+		files, symlinks = snap.files, snap.symlinks
+		source = r.workingTreeSource(snap)
+	} else {
+		metadata, err := r.loadMetadata()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load metadata: %w", err)
+		}
+		save, err := resolveHash(metadata, hash)
+		if err != nil {
+			return nil, err
+		}
+		files, symlinks = save.Files, r.symlinksInSave(save.Hash)
+		op := r.newOperation()
+		source = func(file string) ([]byte, error) {
+			return op.fileContent(file, save.Hash)
+		}
+	}
+
+	matches := []GrepMatch{}
+	for _, file := range files {
+		if symlinks[file] {
+			continue
+		}
+		content, err := source(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		if IsBinary(content) {
+			continue
+		}
+
+		for i, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSuffix(line, "\r")
+			if re.MatchString(line) {
+				matches = append(matches, GrepMatch{Path: file, Line: i + 1, Text: line})
+			}
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Path < matches[j].Path
+	})
+	return matches, nil
+}
+
+// CatFile returns the content of file as it was at the save referenced by
+// hash, which may be a hash prefix or a tag
+func (r *Repository) CatFile(hash, file string) ([]byte, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	save, err := resolveHash(metadata, hash)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, saved := range save.Files {
+		if saved == file {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("file %s is not in save %s", file, save.Hash)
+	}
+
+	content, err := r.getFileContentFromSave(file, save.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	return content, nil
+}
+
+// IsBinary guesses whether content is binary the way most tools do, by
+// looking for a NUL byte near its start
+func IsBinary(content []byte) bool {
+	const sniffLen = 8000
+	if len(content) > sniffLen {
+		content = content[:sniffLen]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// Size adds up the size of every stored object and attributes it to the save
+// that wrote it
+func (r *Repository) Size() (SizeReport, error) {
+	report := SizeReport{Saves: []SaveSize{}}
+
+	if err := r.ensureInitialized(); err != nil {
+		return report, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return report, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	sizes := make(map[string]*SaveSize, len(metadata.Saves))
+	for _, save := range metadata.Saves {
+		sizes[save.Hash] = &SaveSize{Hash: save.Hash, Name: save.Name}
+	}
+	blobOwners := r.blobOwners(metadata)
+
+	err = r.forEachObject("", func(rel string, info os.FileInfo) error {
+		report.Objects++
+		report.TotalBytes += info.Size()
+
+		if size, ok := sizes[objectOwner(rel, blobOwners)]; ok {
+			size.Bytes += info.Size()
+		} else {
+			report.UnreferencedBytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return report, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	for _, save := range metadata.Saves {
+		report.Saves = append(report.Saves, *sizes[save.Hash])
+	}
+	sort.SliceStable(report.Saves, func(i, j int) bool {
+		return report.Saves[i].Bytes > report.Saves[j].Bytes
+	})
+	return report, nil
+}
+
+// FindOrphans returns the objects that no save refers to, as paths relative to
+// the objects directory in sorted order. Nothing is deleted.
+func (r *Repository) FindOrphans() ([]string, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	// Stashes are kept out of the metadata but still refer to their objects
+	metadata.Saves = append(metadata.Saves, r.stashSaves()...)
+	saves := make(map[string]bool, len(metadata.Saves))
+	for _, save := range metadata.Saves {
+		saves[save.Hash] = true
+	}
+	blobOwners := r.blobOwners(metadata)
+
+	orphans := []string{}
+	err = r.forEachObject("", func(rel string, info os.FileInfo) error {
+		if !saves[objectOwner(rel, blobOwners)] {
+			orphans = append(orphans, rel)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	sort.Strings(orphans)
+	return orphans, nil
+}
+
+// Objects lists every file in the objects directory with what it stores and
+// the save it belongs to, decoding object headers where present. It is meant
+// for debugging storage issues and reads nothing but headers.
+func (r *Repository) Objects() ([]ObjectInfo, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	// The first save and path referring to each blob
+	blobPaths := make(map[string]string)
+	blobOwners := make(map[string]string)
+	for _, save := range metadata.Saves {
+		deltaSet, err := r.loadDeltaSet(save.Hash)
+		if err != nil {
+			continue
+		}
+		for _, delta := range deltaSet.Deltas {
+			if _, ok := blobOwners[delta.Blob]; delta.Blob != "" && !ok {
+				blobOwners[delta.Blob] = save.Hash
+				blobPaths[delta.Blob] = delta.Path
+			}
+		}
+	}
+
+	objects := []ObjectInfo{}
+	err = r.forEachObject("", func(rel string, info os.FileInfo) error {
+		object := ObjectInfo{Name: rel, Type: "unknown", Size: info.Size()}
+		switch {
+		case strings.HasPrefix(rel, "blobs/"):
+			object.Type = "blob"
+			object.Save = objectOwner(rel, blobOwners)
+			object.Path = blobPaths[strings.TrimPrefix(rel, "blobs/")]
+		case strings.HasPrefix(rel, "delta_") && strings.HasSuffix(rel, ".json"):
+			object.Type = "delta"
+			object.Save = objectOwner(rel, blobOwners)
+		default:
+			if saveHash, file, ok := util.ParseFileObjectName(rel); ok {
+				object.Type = "file"
+				object.Save = saveHash
+				object.Path = file
+			}
+		}
+
+		if object.Type == "blob" || object.Type == "file" {
+			header, ok, err := util.ReadObjectHeader(filepath.Join(r.objectsDir, filepath.FromSlash(rel)), r.fs)
+			if err != nil {
+				object.Error = err.Error()
+			} else if ok {
+				object.Header = &header
+			}
+		}
+
+		objects = append(objects, object)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
+
+// blobOwners maps every blob referred to by a save to the first save that
+// refers to it
+func (r *Repository) blobOwners(metadata Metadata) map[string]string {
+	owners := make(map[string]string)
+	for _, save := range metadata.Saves {
+		deltaSet, err := r.loadDeltaSet(save.Hash)
+		if err != nil {
+			continue
+		}
+		for _, delta := range deltaSet.Deltas {
+			if _, ok := owners[delta.Blob]; delta.Blob != "" && !ok {
+				owners[delta.Blob] = save.Hash
+			}
+		}
+	}
+	return owners
+}
+
+// objectOwner returns the hash of the save the object at rel, relative to the
+// objects directory, belongs to, or "" if no save refers to it. Objects are
+// blobs/<content hash>, delta_<save hash>.json or, for saves written before
+// blobs, full copies named after the save.
+func objectOwner(rel string, blobOwners map[string]string) string {
+	switch {
+	case strings.HasPrefix(rel, "blobs/"):
+		return blobOwners[strings.TrimPrefix(rel, "blobs/")]
+	case strings.HasPrefix(rel, "delta_") && strings.HasSuffix(rel, ".json"):
+		return strings.TrimSuffix(strings.TrimPrefix(rel, "delta_"), ".json")
+	default:
+		owner, _, _ := util.ParseFileObjectName(rel)
+		return owner
+	}
+}
+
+// forEachObject calls fn with every object below the objects subdirectory dir,
+// given by its slash-separated path relative to the objects directory.
+// Directories are listed with ReadDir, so entries are only stat'ed when their
+// size is needed.
+func (r *Repository) forEachObject(dir string, fn func(rel string, info os.FileInfo) error) error {
+	entries, err := r.fs.ReadDir(filepath.Join(r.objectsDir, filepath.FromSlash(dir)))
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		rel := path.Join(dir, entry.Name())
+		if entry.IsDir() {
+			if err := r.forEachObject(rel, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if err := fn(rel, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contentHashes returns the content hash of every file in save. Hashes are
+// taken from the save's deltas and files are only reconstructed when their
+// delta does not record one.
+func (r *Repository) contentHashes(op *operation, save Save) (map[string]string, error) {
+	recorded := make(map[string]string)
+	if deltaSet, err := r.loadDeltaSet(save.Hash); err == nil {
+		for _, delta := range deltaSet.Deltas {
+			if !delta.IsDeleted && delta.ContentHash != "" {
+				recorded[delta.Path] = delta.ContentHash
+			}
+		}
+	}
+
+	hashes := make(map[string]string, len(save.Files))
+	for _, file := range save.Files {
+		if hash, ok := recorded[file]; ok {
+			hashes[file] = hash
+			continue
+		}
+		content, err := op.fileContent(file, save.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reconstruct %s in save %s: %w", file, save.Hash, err)
+		}
+		hashes[file] = util.CalculateFileHash(content)
+	}
+	return hashes, nil
+}
+
+// Checkout restores the project to the state of the given save hash
+func (r *Repository) Checkout(hash string) error {
+	return r.CheckoutPaths(hash, nil)
+}
+
+// CheckoutPaths restores only the files of a save whose path relative to the
+// repository root matches paths, and removes only matching working files that
+// are not in the save. Other files are left untouched. A nil paths restores
+// the whole save like Checkout.
+func (r *Repository) CheckoutPaths(hash string, paths glob.Glob) error {
+	return r.CheckoutWithOptions(hash, CheckoutOptions{Paths: paths})
+}
+
+// CheckoutOptions adjusts how CheckoutWithOptions restores a save
+type CheckoutOptions struct {
+	// Paths, when set, restricts the checkout to matching files as in CheckoutPaths
+	Paths glob.Glob
+	// Progress, when set, is called as files are restored
+	Progress ProgressFunc
+	// Keep lists patterns of paths that are left in place even though they
+	// are not in the save, as if they were ignored
+	Keep []glob.Glob
+}
+
+// CheckoutWithOptions restores a save like Checkout, adjusted by opts
+func (r *Repository) CheckoutWithOptions(hash string, opts CheckoutOptions) error {
+	// Check if repository is initialized
+	if err := r.ensureInitialized(); err != nil {
+		return err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return r.checkout("checkout", hash, opts)
+}
+
+// checkout restores a save for CheckoutWithOptions, recording command in the
+// reflog. Callers hold the repository lock.
+func (r *Repository) checkout(command, hash string, opts CheckoutOptions) error {
+	// Load metadata
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	// Find the save with the given hash, prefix or tag
+	save, err := resolveHash(metadata, hash)
+	if err != nil {
+		return err
+	}
+	hash = save.Hash
+
+	// Unsaved work is backed up before the working tree is replaced
+	if err := r.stashWorkingTree(command); err != nil {
+		return err
+	}
+	if err := r.restoreSave(*save, opts); err != nil {
+		return err
+	}
+
+	// Pending renames and merges refer to the working tree that was just replaced
+	if opts.Paths == nil {
+		if err := r.saveRenames(nil); err != nil {
+			return err
+		}
+		if err := r.clearMergeHead(); err != nil {
+			return err
+		}
+		return r.setHead(command, hash)
+	}
+	renames, err := r.loadRenames()
+	if err != nil {
+		return err
+	}
+	for file, from := range renames {
+		if opts.selects(file) || opts.selects(from) {
+			delete(renames, file)
+		}
+	}
+	return r.saveRenames(renames)
+}
+
+// selects reports whether file, relative to the repository root, is restored
+// by a checkout with these options
+func (opts CheckoutOptions) selects(file string) bool {
+	return opts.Paths == nil || opts.Paths.Match(filepath.ToSlash(file))
+}
+
+// restoreSave replaces the selected files of the working tree with those of
+// save, for checkout. Neither the checked out save nor pending renames are
+// updated.
+func (r *Repository) restoreSave(save Save, opts CheckoutOptions) error {
+	hash := save.Hash
+	op := r.newOperation()
+	op.progress = opts.Progress
+	symlinks := r.symlinksInSave(hash)
+	modes := r.modesInSave(hash)
+	modTimes := r.modTimesInSave(hash)
+	contentHashes := r.contentHashesInSave(hash)
+	normalized := r.normalizedInSave(hash)
+	config, err := r.loadConfig()
+	if err != nil {
+		return err
+	}
+	restoreEndings := checkoutCRLF(config.LineEndings)
+	selected := opts.selects
+
+	// First, get a list of all current files
+	currentFiles, err := r.listAllFiles()
+	if err != nil {
+		return fmt.Errorf("failed to get current files: %w", err)
+	}
+
+	// Files are staged by the transaction and only replace the working tree
+	// once every one of them has been reconstructed, so a checkout that fails
+	// partway leaves the working tree as it was
+	tx, err := util.NewTransaction(r.fs, r.bitPath(stagingDir))
+	if err != nil {
+		return err
+	}
+	defer tx.Abort()
+	// Every file is checked against its recorded hash before it is staged,
+	// so corrupt objects never reach the working tree
+	var written []string
+	stage := func(file string, content []byte) error {
+		if expected := contentHashes[file]; expected != "" && util.CalculateFileHash(content) != expected {
+			return fmt.Errorf("checkout aborted, %s is corrupt in save %s: %w", file, hash, ErrCorruptContent)
+		}
+		if restoreEndings && normalized[file] {
+			content = restoreCRLF(content)
+		}
+		if symlinks[file] {
+			return tx.Symlink(string(content), r.path(file))
+		}
+		written = append(written, file)
+		return tx.Write(r.path(file), content, modes[file])
+	}
+
+	// The .bitignore file of the save, if it has one, decides which files are
+	// ignored. Otherwise the current one, if any, is kept.
+	ignoredPatterns, err := r.loadIgnorePatterns()
+	if err != nil {
+		return fmt.Errorf("failed to load ignore patterns: %w", err)
+	}
+	for _, file := range save.Files {
+		if file == ignoreFile && selected(file) {
+			// Get the content of the .bitignore file from save
+			ignoreContent, err := op.fileContent(file, hash)
+			if err != nil {
+				return fmt.Errorf("failed to get ignore file content: %w", err)
+			}
+			if err := stage(file, ignoreContent); errors.Is(err, ErrCorruptContent) {
+				return err
+			} else if err != nil {
+				return fmt.Errorf("failed to restore ignore file: %w", err)
+			}
+			if ignoredPatterns, err = ignorePatternsFrom(ignoreContent); err != nil {
+				return fmt.Errorf("failed to load ignore patterns: %w", err)
+			}
+			break
+		}
+	}
+
+	// Remove non-ignored files that aren't in the save. Ignored files are
+	// never read, removed or rewritten, so they are left exactly as they are
+	// on disk.
+	for _, file := range currentFiles {
+		if util.IsBitDirectory(file) || file == ignoreFile || !selected(file) {
+			continue
+		}
+
+		// Don't remove ignored files or files the caller keeps
+		if util.IsIgnored(file, ignoredPatterns) || keeps(opts.Keep, file) {
+			continue
+		}
+
+		// Remove file if not in save
+		if !containsFile(save.Files, file) {
+			tx.Remove(r.path(file))
+		}
+	}
+
+	// Restore non-ignored files from the save
+	var restore []string
+	for _, file := range save.Files {
+		// Skip .bit directory and files outside the selected paths
+		if util.IsBitDirectory(file) || file == ignoreFile || !selected(file) {
+			continue
+		}
+
+		// Skip restoring ignored files
+		if util.IsIgnored(file, ignoredPatterns) {
+			continue
+		}
+		restore = append(restore, file)
+	}
+	for _, file := range restore {
+		// Get file content from save (either directly or by applying deltas)
+		content, err := op.fileContent(file, hash)
+		if err != nil {
+			return fmt.Errorf("failed to get content for file %s: %w", file, err)
+		}
+		if err := stage(file, content); errors.Is(err, ErrCorruptContent) {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("failed to restore file %s: %w", file, err)
+		}
+		op.fileDone(len(restore), file)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to update working tree: %w", err)
+	}
+
+	// Files keep the modification time they had when they were saved, so
+	// that build tools do not take them all for changed
+	for _, file := range written {
+		if modTime, ok := modTimes[file]; ok {
+			if err := r.fs.Chtimes(r.path(file), time.Time{}, modTime); err != nil {
+				return fmt.Errorf("failed to set modification time of %s: %w", file, err)
+			}
+		}
+	}
+
+	// Recreate directories that contain no tracked files
+	for _, dir := range save.Dirs {
+		if !selected(dir) {
+			continue
+		}
+		if err := r.fs.MkdirAll(r.path(dir), 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// keeps reports whether file, relative to the repository root, matches one of
+// the patterns of CheckoutOptions.Keep
+func keeps(patterns []glob.Glob, file string) bool {
+	for _, pattern := range patterns {
+		if pattern.Match(filepath.ToSlash(file)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckoutInto writes every file of the save referenced by hash, which may be
+// a hash prefix or a tag, under targetDir, creating it if needed. Files already
+// in targetDir are overwritten but never removed, and the working tree is left
+// alone, so targetDir may not be inside the repository.
+func (r *Repository) CheckoutInto(hash, targetDir string) error {
+	if err := r.ensureInitialized(); err != nil {
+		return err
+	}
+
+	absTarget, err := filepath.Abs(targetDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", targetDir, err)
+	}
+	root, err := filepath.Abs(r.root)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", r.root, err)
+	}
+	if rel, err := filepath.Rel(root, absTarget); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("cannot check out into %s: it is inside the repository", targetDir)
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+	save, err := resolveHash(metadata, hash)
+	if err != nil {
+		return err
+	}
+
+	// Stored paths are relative to the repository root, so one climbing out
+	// of it would also climb out of targetDir
+	inTarget := func(file string) (string, error) {
+		clean := path.Clean(filepath.ToSlash(file))
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return "", fmt.Errorf("refusing to write %s outside %s", file, targetDir)
+		}
+		return filepath.Join(targetDir, filepath.FromSlash(clean)), nil
+	}
+
+	// Every path is checked before anything is written
+	targets := make(map[string]string, len(save.Files)+len(save.Dirs))
+	for _, file := range append(append([]string(nil), save.Files...), save.Dirs...) {
+		if targets[file], err = inTarget(file); err != nil {
+			return err
+		}
+	}
+
+	if err := r.fs.MkdirAll(targetDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", targetDir, err)
+	}
+
+	op := r.newOperation()
+	symlinks := r.symlinksInSave(save.Hash)
+	modes := r.modesInSave(save.Hash)
+	modTimes := r.modTimesInSave(save.Hash)
+	for _, file := range save.Files {
+		if util.IsBitDirectory(file) {
+			continue
+		}
+		target := targets[file]
+
+		content, err := op.fileContent(file, save.Hash)
+		if err != nil {
+			return fmt.Errorf("failed to get content for file %s: %w", file, err)
+		}
+		if err := r.writeFileAt(target, file, content, symlinks[file]); err != nil {
+			return fmt.Errorf("failed to write file %s: %w", file, err)
+		}
+		if mode, ok := modes[file]; ok && !symlinks[file] {
+			if err := r.fs.Chmod(target, mode); err != nil {
+				return fmt.Errorf("failed to set mode of %s: %w", file, err)
+			}
+		}
+		if modTime, ok := modTimes[file]; ok && !symlinks[file] {
+			if err := r.fs.Chtimes(target, time.Time{}, modTime); err != nil {
+				return fmt.Errorf("failed to set modification time of %s: %w", file, err)
+			}
+		}
+	}
+
+	for _, dir := range save.Dirs {
+		if err := r.fs.MkdirAll(targets[dir], 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// Remove deletes a tracked file from the working tree so that the next save
+// records it as deleted. Ignored and untracked paths are refused.
+func (r *Repository) Remove(file string) error {
+	if err := r.ensureInitialized(); err != nil {
+		return err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err = r.checkRemovable(file)
+	if err != nil {
+		return err
+	}
+
+	if err := r.fs.Remove(r.path(file)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove file %s: %w", file, err)
+	}
+
+	return nil
+}
+
+// Move renames a tracked file in the working tree. The next save records the
+// new path as a rename of the old one, storing only the changes made to the
+// content instead of a full copy.
+func (r *Repository) Move(oldPath, newPath string) error {
+	if err := r.ensureInitialized(); err != nil {
+		return err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	renames, err := r.loadRenames()
+	if err != nil {
+		return err
+	}
+
+	// A file that was already moved keeps pointing at its saved path
+	oldPath = path.Clean(filepath.ToSlash(oldPath))
+	origin, moved := renames[oldPath]
+	if !moved {
+		if oldPath, err = r.checkRemovable(oldPath); err != nil {
+			return err
+		}
+		origin = oldPath
+	}
+
+	newPath = path.Clean(filepath.ToSlash(newPath))
+	if util.IsBitDirectory(newPath) || strings.HasPrefix(newPath, "../") || newPath == ".." {
+		return fmt.Errorf("cannot move to %s: path is outside the working tree", newPath)
+	}
+	ignoredPatterns, err := r.loadIgnorePatterns()
+	if err != nil {
+		return fmt.Errorf("failed to load ignore patterns: %w", err)
+	}
+	if util.IsIgnored(newPath, ignoredPatterns) {
+		return fmt.Errorf("cannot move to %s: path is ignored", newPath)
+	}
+	if r.fs.Exists(r.path(newPath)) {
+		return fmt.Errorf("cannot move to %s: path already exists", newPath)
+	}
+
+	if err := r.fs.MkdirAll(filepath.Dir(r.path(newPath)), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", newPath, err)
+	}
+	if err := r.fs.Rename(r.path(oldPath), r.path(newPath)); err != nil {
+		return fmt.Errorf("failed to move %s to %s: %w", oldPath, newPath, err)
+	}
+
+	delete(renames, oldPath)
+	if newPath != origin {
+		renames[newPath] = origin
+	}
+	return r.saveRenames(renames)
+}
+
+// loadRenames returns the pending renames recorded by Move, mapping new paths
+// to their path in the latest save
+func (r *Repository) loadRenames() (map[string]string, error) {
+	renames := make(map[string]string)
+
+	data, err := r.fs.ReadFile(r.bitPath(renamesFile))
+	if os.IsNotExist(err) {
+		return renames, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read pending renames: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &renames); err != nil {
+		return nil, fmt.Errorf("failed to parse pending renames: %w", err)
+	}
+	return renames, nil
+}
+
+// saveRenames records the pending renames for the next save
+func (r *Repository) saveRenames(renames map[string]string) error {
+	if len(renames) == 0 {
+		if err := r.fs.Remove(r.bitPath(renamesFile)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to clear pending renames: %w", err)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(renames, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal pending renames: %w", err)
+	}
+	if err := r.fs.WriteFile(r.bitPath(renamesFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write pending renames: %w", err)
+	}
+	return nil
+}
+
+// Reflog returns every recorded save and checkout, oldest first. Together they
+// trace which save was checked out over time, so saves that are no longer the
+// latest can still be found.
+func (r *Repository) Reflog() ([]ReflogEntry, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	data, err := r.readReflog()
+	if err != nil {
+		return nil, err
+	}
+	return parseReflog(data), nil
+}
+
+// readReflog returns the raw content of the reflog, which is empty until the
+// first entry is recorded
+func (r *Repository) readReflog() ([]byte, error) {
+	data, err := r.fs.ReadFile(r.bitPath(reflogFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read reflog: %w", err)
+	}
+	return data, nil
+}
+
+// parseReflog decodes one entry per line. Lines that do not decode can only
+// be left by an interrupted append and are skipped.
+func parseReflog(data []byte) []ReflogEntry {
+	entries := []ReflogEntry{}
+	for _, line := range strings.Split(string(data), "\n") {
+		var entry ReflogEntry
+		if line == "" || json.Unmarshal([]byte(line), &entry) != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Head returns the hash of the save most recently checked out or saved. Repositories
+// without a recorded HEAD, or whose HEAD save no longer exists, are at their latest
+// save. An empty hash means there are no saves yet.
+func (r *Repository) Head() (string, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return "", err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return "", fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	head, err := r.readHead()
+	if err != nil {
+		return "", err
+	}
+	if saveIndex(metadata, head) >= 0 {
+		return head, nil
+	}
+
+	if len(metadata.Saves) == 0 {
+		return "", nil
+	}
+	return metadata.Saves[len(metadata.Saves)-1].Hash, nil
+}
+
+// readHead returns the hash recorded in the HEAD file, empty if there is none
+func (r *Repository) readHead() (string, error) {
+	hash, _, err := r.readHeadState()
+	return hash, err
+}
+
+// readHeadState returns the hash and the current branch recorded in the HEAD
+// file. HEAD holds the hash on its first line, followed by a "branch: <name>"
+// line when saves go to a branch.
+func (r *Repository) readHeadState() (hash, branch string, err error) {
+	data, err := r.fs.ReadFile(r.bitPath(headFile))
+	if os.IsNotExist(err) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", fmt.Errorf("failed to read HEAD: %w", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for _, line := range lines[1:] {
+		if name, ok := strings.CutPrefix(strings.TrimSpace(line), headBranchPrefix); ok {
+			branch = name
+		}
+	}
+	return strings.TrimSpace(lines[0]), branch, nil
+}
+
+// writeHead replaces the HEAD file with the given hash and current branch
+func (r *Repository) writeHead(hash, branch string) error {
+	content := hash + "\n"
+	if branch != "" {
+		content += headBranchPrefix + branch + "\n"
+	}
+	if err := r.fs.WriteFile(r.bitPath(headFile), []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write HEAD: %w", err)
+	}
+	return nil
+}
+
+// setHead records that command checked out the save with the given hash,
+// updating HEAD and the reflog. The current branch is kept. Callers hold the
+// repository lock.
+func (r *Repository) setHead(command, hash string) error {
+	from, branch, err := r.readHeadState()
+	if err != nil {
+		return err
+	}
+
+	if err := r.appendReflog(command, from, hash); err != nil {
+		return err
+	}
+
+	return r.writeHead(hash, branch)
+}
+
+// appendReflog records that command moved the checked out state from one save
+// to another. Callers hold the repository lock, so entries are never
+// interleaved.
+func (r *Repository) appendReflog(command, fromHash, toHash string) error {
+	existing, err := r.readReflog()
+	if err != nil {
+		return err
+	}
+
+	entry := ReflogEntry{Timestamp: time.Now(), Command: command, From: fromHash, To: toHash}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal reflog entry: %w", err)
+	}
+	// Start on a new line if an earlier append was cut short
+	if len(existing) > 0 && existing[len(existing)-1] != '\n' {
+		data = append([]byte{'\n'}, data...)
+	}
+	if err := r.fs.AppendFile(r.bitPath(reflogFile), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to update reflog: %w", err)
+	}
+	return nil
+}
+
+// RemoveAndSave deletes a tracked file from the working tree and immediately
+// records a save that differs from the checked out save only by that deletion.
+// Other working tree changes are not included in the save.
+func (r *Repository) RemoveAndSave(file, name string) (string, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return "", err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	file, err = r.checkRemovable(file)
+	if err != nil {
+		return "", err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return "", fmt.Errorf("failed to load metadata: %w", err)
+	}
+	head, err := r.Head()
+	if err != nil {
+		return "", err
+	}
+	checkedOut := metadata.Saves[saveIndex(metadata, head)]
+
+	// Build the new save from the checked out save's content minus the removed file
+	var files []string
+	for _, saved := range checkedOut.Files {
+		if saved != file {
+			files = append(files, saved)
+		}
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("no files to save")
+	}
+
+	op := r.newOperation()
+	source := func(path string) ([]byte, error) {
+		return op.fileContent(path, checkedOut.Hash)
+	}
+	snap := snapshot{files: files, dirs: checkedOut.Dirs, symlinks: r.symlinksInSave(checkedOut.Hash), modes: r.modesInSave(checkedOut.Hash), modTimes: r.modTimesInSave(checkedOut.Hash), lineEndings: r.lineEndingsInSave(checkedOut.Hash)}
+
+	hash, err := r.createSave(op, name, snap, source)
+	if err != nil {
+		return "", err
+	}
+
+	if err := r.fs.Remove(r.path(file)); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to remove file %s: %w", file, err)
+	}
+
+	return hash, r.setHead("rm", hash)
+}
+
+// Status compares the working tree with the checked out save, see Head.
+// Without any saves every file is reported as added.
+func (r *Repository) Status() (Status, error) {
+	status := Status{Added: []string{}, Modified: []string{}, Deleted: []string{}}
+
+	if err := r.ensureInitialized(); err != nil {
+		return status, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return status, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	snap, err := r.getFilesToSave()
+	if err != nil {
+		return status, err
+	}
+	source := r.workingTreeSource(snap)
+
+	// Compare against the checked out save rather than the latest one
+	head, err := r.Head()
+	if err != nil {
+		return status, err
+	}
+	status.Head = head
+
+	saved := make(map[string]bool)
+	var base Save
+	if i := saveIndex(metadata, head); i >= 0 {
+		base = metadata.Saves[i]
+		for _, file := range base.Files {
+			saved[file] = true
+		}
+	}
+
+	op := r.newOperation()
+	current := make(map[string]bool)
+	for _, file := range snap.files {
+		current[file] = true
+		if !saved[file] {
+			status.Added = append(status.Added, file)
+			continue
+		}
+
+		content, err := source(file)
+		if err != nil {
+			return status, fmt.Errorf("failed to read file %s: %w", file, err)
+		}
+		savedContent, err := op.fileContent(file, base.Hash)
+		if err != nil {
+			return status, fmt.Errorf("failed to reconstruct file %s: %w", file, err)
+		}
+		if !bytes.Equal(content, savedContent) {
+			status.Modified = append(status.Modified, file)
+		}
+	}
+
+	for _, file := range base.Files {
+		if !current[file] {
+			status.Deleted = append(status.Deleted, file)
+		}
+	}
+
+	sort.Strings(status.Added)
+	sort.Strings(status.Modified)
+	sort.Strings(status.Deleted)
+	return status, nil
+}
+
+// WorkingTreeHash returns the tree hash of the files in the working tree, to
+// be compared with the TreeHash of a save. Files are read and hashed once, and
+// no save content is reconstructed.
+func (r *Repository) WorkingTreeHash() (string, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return "", err
+	}
+
+	snap, err := r.getFilesToSave()
+	if err != nil {
+		return "", err
+	}
+	source := r.workingTreeSource(snap)
+
+	contentHashes := make(map[string]string, len(snap.files))
+	for _, file := range snap.files {
+		content, err := source(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read file %s: %w", file, err)
+		}
+		contentHashes[file] = util.CalculateFileHash(content)
+	}
+	return treeHash(snap.files, contentHashes), nil
+}
+
+// IsClean reports whether the working tree matches the checked out save,
+// comparing tree hashes. Saves made before tree hashes were recorded are
+// compared file by file with Status instead.
+func (r *Repository) IsClean() (bool, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return false, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return false, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	head, err := r.Head()
+	if err != nil {
+		return false, err
+	}
+
+	if i := saveIndex(metadata, head); i >= 0 && metadata.Saves[i].TreeHash != "" {
+		hash, err := r.WorkingTreeHash()
+		if err != nil {
+			return false, err
+		}
+		return hash == metadata.Saves[i].TreeHash, nil
+	}
+
+	status, err := r.Status()
+	if err != nil {
+		return false, err
+	}
+	return len(status.Added)+len(status.Modified)+len(status.Deleted) == 0, nil
+}
+
+// treeHash hashes the sorted paths of files together with their content hashes
+func treeHash(files []string, contentHashes map[string]string) string {
+	sorted := append([]string(nil), files...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	for _, file := range sorted {
+		h.Write([]byte(file))
+		h.Write([]byte{0})
+		h.Write([]byte(contentHashes[file]))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Squash collapses the contiguous range of saves from fromHash to toHash,
+// inclusive, into a single save with the content and name of toHash
+func (r *Repository) Squash(fromHash, toHash string) (string, error) {
+	return r.SquashNamed(fromHash, toHash, "")
+}
+
+// SquashNamed is like Squash but names the resulting save. An empty name keeps
+// the name of toHash. The squashed save is stored on top of the save preceding
+// fromHash and the saves based on toHash are re-parented onto it. Deltas of
+// later saves that apply to a squashed save are rewritten not to need it. The
+// range is refused when a save outside it is based on another of its saves,
+// such as a branch leaving it before toHash.
+func (r *Repository) SquashNamed(fromHash, toHash, name string) (string, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return "", err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return "", fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	from, err := resolveHash(metadata, fromHash)
+	if err != nil {
+		return "", err
+	}
+	to, err := resolveHash(metadata, toHash)
+	if err != nil {
+		return "", err
+	}
+
+	first, last := saveIndex(metadata, from.Hash), saveIndex(metadata, to.Hash)
+	if first >= last {
+		return "", fmt.Errorf("cannot squash %s..%s: %s must be an earlier save than %s", from.Hash, to.Hash, from.Hash, to.Hash)
+	}
+	for i := first + 1; i <= last; i++ {
+		if metadata.Saves[i].BaseSaveHash != metadata.Saves[i-1].Hash {
+			return "", fmt.Errorf("cannot squash %s..%s: save %s is not based on %s", from.Hash, to.Hash, metadata.Saves[i].Hash, metadata.Saves[i-1].Hash)
+		}
+	}
+
+	// Tags on squashed saves other than the tip would lose their target
+	tip := metadata.Saves[last]
+	for tag, hash := range metadata.Tags {
+		for _, squashed := range metadata.Saves[first:last] {
+			if hash == squashed.Hash {
+				return "", fmt.Errorf("cannot squash %s..%s: save %s is tagged as %s", from.Hash, to.Hash, hash, tag)
+			}
+		}
+	}
+
+	// Saves outside the range may only build on its tip, whose content the
+	// squashed save keeps. One branching off earlier would lose its parent.
+	inRange := make(map[string]bool, last-first+1)
+	for _, save := range metadata.Saves[first : last+1] {
+		inRange[save.Hash] = true
+	}
+	for _, save := range metadata.Saves {
+		if inRange[save.Hash] {
+			continue
+		}
+		for _, parent := range save.Parents() {
+			if inRange[parent] && parent != tip.Hash {
+				return "", fmt.Errorf("cannot squash %s..%s: save %s is based on %s", from.Hash, to.Hash, save.Hash, parent)
+			}
+		}
+	}
+
+	if name == "" {
+		name = tip.Name
+	}
+
+	var baseSave *Save
+	if first > 0 {
+		baseSave = &metadata.Saves[first-1]
+	}
+
+	// Store the tip's content as a single save on top of the range's base
+	op := r.newOperation()
+	source := func(file string) ([]byte, error) {
+		return op.fileContent(file, tip.Hash)
+	}
+	snap := snapshot{files: tip.Files, dirs: tip.Dirs, symlinks: r.symlinksInSave(tip.Hash), modes: r.modesInSave(tip.Hash), modTimes: r.modTimesInSave(tip.Hash), lineEndings: r.lineEndingsInSave(tip.Hash)}
+	squashed, err := r.writeSave(op, name, tip.Timestamp, snap, source, baseSave)
+	if err != nil {
+		op.rollback()
+		return "", err
+	}
+	squashed.Author, squashed.Host = tip.Author, tip.Host
+	if err := r.signSave(&squashed); err != nil {
+		op.rollback()
+		return "", err
+	}
+	hash := squashed.Hash
+
+	// Later deltas may apply to any squashed save, not only the tip, once
+	// RepackDeltas rewrote them. They are all worked out before any is
+	// rewritten, while every squashed save can still be read.
+	rebased, err := r.squashedDeltas(op, metadata.Saves[first:last+1], metadata.Saves[last+1:], hash)
+	if err != nil {
+		op.rollback()
+		return "", err
+	}
+
+	// Delta sets are rewritten in place, so their original content is put
+	// back if the squash fails before the metadata records it
+	originals := make(map[string][]byte, len(rebased))
+	undo := func() {
+		for saveHash, data := range originals {
+			r.fs.WriteFile(util.DeltaSetPath(saveHash, r.objectsDir), data, 0644)
+		}
+		op.rollback()
+	}
+	for saveHash, deltas := range rebased {
+		data, err := r.fs.ReadFile(util.DeltaSetPath(saveHash, r.objectsDir))
+		if err != nil {
+			undo()
+			return "", fmt.Errorf("failed to read delta set for save %s: %w", saveHash, err)
+		}
+		originals[saveHash] = data
+		err = r.rewriteDeltaSet(saveHash, func(delta *util.DeltaInfo) {
+			if rewritten, ok := deltas[delta.Path]; ok {
+				*delta = rewritten
+			}
+		})
+		if err != nil {
+			undo()
+			return "", err
+		}
+	}
+
+	// Saves based on or merging the tip use the squashed save instead, as it
+	// has the same content
+	for i := last + 1; i < len(metadata.Saves); i++ {
+		save := &metadata.Saves[i]
+		changed := save.BaseSaveHash == tip.Hash
+		if changed {
+			save.BaseSaveHash = hash
+		}
+		for j, parent := range save.MergeParents {
+			if parent == tip.Hash {
+				save.MergeParents[j] = hash
+				changed = true
+			}
+		}
+		if changed {
+			if err := r.signSave(save); err != nil {
+				undo()
+				return "", err
+			}
+		}
+	}
+
+	for tag, tagged := range metadata.Tags {
+		if tagged == tip.Hash {
+			metadata.Tags[tag] = hash
+		}
+	}
+
+	removed := append([]Save(nil), metadata.Saves[first:last+1]...)
+
+	// Branches ending inside the range end at the squashed save instead
+	for branch, branchTip := range metadata.Branches {
+		for _, save := range removed {
+			if save.Hash == branchTip {
+				metadata.Branches[branch] = hash
+			}
+		}
+	}
+	saves := append([]Save(nil), metadata.Saves[:first]...)
+	saves = append(saves, squashed)
+	metadata.Saves = append(saves, metadata.Saves[last+1:]...)
+
+	// Chains through the squashed range got shorter for every later save
+	if err := r.updateDeltaDepths(&metadata, first+1); err != nil {
+		undo()
+		return "", err
+	}
+	if err := r.saveMetadata(metadata); err != nil {
+		undo()
+		return "", fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	// Objects are only removed once nothing references them. Blobs are
+	// shared between saves and are left in place.
+	for _, save := range removed {
+		r.removeSaveObjects(save)
+	}
+
+	// A checked out save that was squashed is replaced by the squashed save
+	head, err := r.readHead()
+	if err != nil {
+		return "", err
+	}
+	for _, save := range removed {
+		if save.Hash == head {
+			return hash, r.setHead("squash", hash)
+		}
+	}
+
+	return hash, nil
+}
+
+// squashedDeltas returns the deltas of the later saves that are based on one
+// of the squashed saves, by save and path, rewritten to no longer need it.
+// Deltas based on the tip of the range apply to the identical content of the
+// squashed save, so only their base changes. Any other such delta is replaced
+// by the full content it rebuilds.
+func (r *Repository) squashedDeltas(op *operation, squashed, later []Save, hash string) (map[string]map[string]util.DeltaInfo, error) {
+	tip := squashed[len(squashed)-1].Hash
+	inRange := make(map[string]bool, len(squashed))
+	for _, save := range squashed {
+		inRange[save.Hash] = true
+	}
+
+	rebased := make(map[string]map[string]util.DeltaInfo)
+	for _, save := range later {
+		// Saves without a delta set store full files
+		deltaSet, err := r.loadDeltaSet(save.Hash)
+		if err != nil {
+			continue
+		}
+		for _, delta := range deltaSet.Deltas {
+			if !inRange[delta.BaseSaveHash] {
+				continue
+			}
+			if delta.BaseSaveHash != tip && delta.Blob == "" && !delta.IsDeleted {
+				content, err := op.fileContent(delta.Path, save.Hash)
+				if err != nil {
+					return nil, fmt.Errorf("failed to reconstruct %s in save %s: %w", delta.Path, save.Hash, err)
+				}
+				if delta.Blob, err = op.storeBlob(content); err != nil {
+					return nil, fmt.Errorf("failed to save full file %s: %w", delta.Path, err)
+				}
+				delta.Patches = nil
+			}
+			delta.BaseSaveHash = hash
+
+			if rebased[save.Hash] == nil {
+				rebased[save.Hash] = make(map[string]util.DeltaInfo)
+			}
+			rebased[save.Hash][delta.Path] = delta
+		}
+	}
+	return rebased, nil
+}
+
+// rewriteDeltaSet applies update to every delta of a save. The delta set is
+// rewritten as stored, without touching the already compressed patches.
+// Saves without a delta set store full files and are left alone.
+func (r *Repository) rewriteDeltaSet(saveHash string, update func(delta *util.DeltaInfo)) error {
+	return r.editDeltaSet(saveHash, func(deltaSet *util.DeltaSet) {
+		for i := range deltaSet.Deltas {
+			update(&deltaSet.Deltas[i])
+		}
+	})
+}
+
+// editDeltaSet is like rewriteDeltaSet, but lets edit change the delta set as
+// a whole. Deltas added by edit must already be compressed.
+func (r *Repository) editDeltaSet(saveHash string, edit func(deltaSet *util.DeltaSet)) error {
+	deltaPath := util.DeltaSetPath(saveHash, r.objectsDir)
+	data, err := r.fs.ReadFile(deltaPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read delta set for save %s: %w", saveHash, err)
+	}
+
+	var deltaSet util.DeltaSet
+	if err := json.Unmarshal(data, &deltaSet); err != nil {
+		return fmt.Errorf("failed to unmarshal delta set for save %s: %w", saveHash, err)
+	}
+	edit(&deltaSet)
+
+	data, err = json.MarshalIndent(deltaSet, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal delta set for save %s: %w", saveHash, err)
+	}
+	if err := r.fs.WriteFile(deltaPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write delta set for save %s: %w", saveHash, err)
+	}
+	return nil
+}
+
+// Compact shortens the delta chains of the latest save. Every file that needs
+// more than maxChain deltas to be reconstructed is stored as a full-file blob
+// at the latest save, so it and the saves built on it reconstruct quickly. A
+// maxChain of zero or less uses the limit applied when saving. Compact
+// returns the number of chains that were shortened.
+func (r *Repository) Compact(maxChain int) (int, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return 0, err
+	}
+	if maxChain <= 0 {
+		maxChain = maxDeltaChainLength
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	if len(metadata.Saves) == 0 {
+		return 0, nil
+	}
+	tip := metadata.Saves[len(metadata.Saves)-1]
+
+	saveMap := make(map[string]int, len(metadata.Saves))
+	for i, save := range metadata.Saves {
+		saveMap[save.Hash] = i
+	}
+	deltaSets := make(map[string]map[string]util.DeltaInfo)
+
+	// Store the reconstructed content of every over-long chain as a blob
+	op := r.newOperation()
+	blobs := make(map[string]string)
+	for _, file := range tip.Files {
+		if r.deltaChainLength(metadata, saveMap, file, tip.Hash, deltaSets) <= maxChain {
+			continue
+		}
+		if _, ok := deltaSets[tip.Hash][file]; !ok {
+			continue
+		}
+
+		content, err := op.fileContent(file, tip.Hash)
+		if err != nil {
+			return 0, fmt.Errorf("failed to reconstruct file %s: %w", file, err)
+		}
+		blob, err := util.SaveBlob(content, r.objectsDir, r.fs)
+		if err != nil {
+			return 0, fmt.Errorf("failed to save full file %s: %w", file, err)
+		}
+		blobs[file] = blob
+	}
+
+	if len(blobs) == 0 {
+		return 0, nil
+	}
+
+	err = r.rewriteDeltaSet(tip.Hash, func(delta *util.DeltaInfo) {
+		if blob, ok := blobs[delta.Path]; ok {
+			delta.Blob = blob
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// The rewritten delta set shortens the recorded depths and needs a new
+	// signature
+	if err := r.updateDeltaDepths(&metadata, len(metadata.Saves)-1); err != nil {
+		return 0, err
+	}
+	if err := r.saveMetadata(metadata); err != nil {
+		return 0, fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	return len(blobs), nil
+}
+
+// removeSaveObjects deletes the delta set and legacy full-file objects that
+// belong only to the given save
+func (r *Repository) removeSaveObjects(save Save) {
+	r.fs.Remove(util.DeltaSetPath(save.Hash, r.objectsDir))
+	for _, file := range save.Files {
+		for _, fullPath := range util.FileObjectPaths(file, save.Hash, r.objectsDir) {
+			r.fs.Remove(fullPath)
+		}
+	}
+}
+
+// Clean removes working tree files that are neither tracked by the checked
+// out save, nor moved there from a tracked path, nor ignored, and returns
+// their paths. With dryRun set the files are
+// only listed. Ignored files and the .bit directory are never touched.
+func (r *Repository) Clean(dryRun bool) ([]string, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	if len(metadata.Saves) == 0 {
+		return nil, fmt.Errorf("no saves found")
+	}
+	head, err := r.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := make(map[string]bool)
+	for _, file := range metadata.Saves[saveIndex(metadata, head)].Files {
+		tracked[file] = true
+	}
+
+	// Files moved with Move are tracked under their new path until saved
+	renames, err := r.loadRenames()
+	if err != nil {
+		return nil, err
+	}
+	for file := range renames {
+		tracked[file] = true
+	}
+
+	// The snapshot already excludes ignored files and the .bit directory
+	snap, err := r.getFilesToSave()
+	if err != nil {
+		return nil, err
+	}
+
+	var untracked []string
+	for _, file := range snap.files {
+		if !tracked[file] {
+			untracked = append(untracked, file)
+		}
+	}
+	sort.Strings(untracked)
+
+	if dryRun {
+		return untracked, nil
+	}
+
+	for _, file := range untracked {
+		if err := r.fs.Remove(r.path(file)); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove file %s: %w", file, err)
+		}
+	}
+
+	return untracked, nil
+}
+
+// checkRemovable validates that file is tracked by the checked out save and
+// not ignored, returning its cleaned repository-relative path
+func (r *Repository) checkRemovable(file string) (string, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return "", err
+	}
+
+	file = path.Clean(filepath.ToSlash(file))
+	if util.IsBitDirectory(file) {
+		return "", fmt.Errorf("cannot remove %s: path is inside the repository directory", file)
+	}
+
+	ignoredPatterns, err := r.loadIgnorePatterns()
+	if err != nil {
+		return "", fmt.Errorf("failed to load ignore patterns: %w", err)
+	}
+	if file != ignoreFile && util.IsIgnored(file, ignoredPatterns) {
+		return "", fmt.Errorf("cannot remove %s: path is ignored", file)
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return "", fmt.Errorf("failed to load metadata: %w", err)
+	}
+	head, err := r.Head()
+	if err != nil {
+		return "", err
+	}
+	if i := saveIndex(metadata, head); i >= 0 && containsFile(metadata.Saves[i].Files, file) {
+		return file, nil
+	}
+
+	return "", fmt.Errorf("cannot remove %s: path is not tracked", file)
+}
+
+// ExportTar writes every file of the given save into a tar archive. Parent
+// directories are emitted before their files and the .bit directory is never included.
+func (r *Repository) ExportTar(hash string, w io.Writer) error {
+	if err := r.ensureInitialized(); err != nil {
+		return err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	save, err := resolveHash(metadata, hash)
+	if err != nil {
+		return err
+	}
+
+	files := make([]string, 0, len(save.Files))
+	for _, file := range save.Files {
+		if !util.IsBitDirectory(file) {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+
+	op := r.newOperation()
+	symlinks := r.symlinksInSave(save.Hash)
+	modes := r.modesInSave(save.Hash)
+	modTimes := r.modTimesInSave(save.Hash)
+	tw := tar.NewWriter(w)
+	writtenDirs := make(map[string]bool)
+
+	// Empty directories are emitted as entries of their own
+	entries := append([]string(nil), files...)
+	isDir := make(map[string]bool, len(save.Dirs))
+	for _, dir := range save.Dirs {
+		entries = append(entries, dir)
+		isDir[dir] = true
+	}
+	sort.Strings(entries)
+
+	for _, file := range entries {
+		// Emit any parent directories that have not been written yet
+		var parents []string
+		start := path.Dir(file)
+		if isDir[file] {
+			start = file
+		}
+		for dir := start; dir != "." && dir != "/" && !writtenDirs[dir]; dir = path.Dir(dir) {
+			parents = append(parents, dir)
+		}
+		for i := len(parents) - 1; i >= 0; i-- {
+			header := &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     parents[i] + "/",
+				Mode:     0755,
+				ModTime:  save.Timestamp,
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return fmt.Errorf("failed to write directory %s: %w", parents[i], err)
+			}
+			writtenDirs[parents[i]] = true
+		}
+
+		if isDir[file] {
+			continue
+		}
+
+		content, err := op.fileContent(file, save.Hash)
+		if err != nil {
+			return fmt.Errorf("failed to get content for file %s: %w", file, err)
+		}
+
+		if symlinks[file] {
+			header := &tar.Header{
+				Typeflag: tar.TypeSymlink,
+				Name:     file,
+				Linkname: string(content),
+				Mode:     0777,
+				ModTime:  save.Timestamp,
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return fmt.Errorf("failed to write header for %s: %w", file, err)
+			}
+			continue
+		}
+
+		// Saves made before modes and modification times were recorded
+		// have none to export
+		mode, ok := modes[file]
+		if !ok {
+			mode = 0644
+		}
+		modTime, ok := modTimes[file]
+		if !ok {
+			modTime = save.Timestamp
+		}
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file,
+			Mode:     int64(mode),
+			Size:     int64(len(content)),
+			ModTime:  modTime,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write header for %s: %w", file, err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			return fmt.Errorf("failed to write content for %s: %w", file, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+// AddTag points the tag name at the save identified by hash (or a unique hash prefix)
+func (r *Repository) AddTag(hash, name string) error {
+	if err := r.ensureInitialized(); err != nil {
+		return err
+	}
+
+	if err := validateRefName("tag", name); err != nil {
+		return err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	if existing, ok := metadata.Tags[name]; ok {
+		return fmt.Errorf("tag %s already exists (points to %s)", name, existing)
+	}
+
+	save, err := resolveHash(metadata, hash)
+	if err != nil {
+		return err
+	}
+
+	if metadata.Tags == nil {
+		metadata.Tags = make(map[string]string)
+	}
+	metadata.Tags[name] = save.Hash
+
+	return r.saveMetadata(metadata)
+}
+
+// RemoveTag deletes the tag with the given name
+func (r *Repository) RemoveTag(name string) error {
+	if err := r.ensureInitialized(); err != nil {
+		return err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	if _, ok := metadata.Tags[name]; !ok {
+		return fmt.Errorf("tag %s not found", name)
+	}
+	delete(metadata.Tags, name)
+
+	return r.saveMetadata(metadata)
+}
+
+// ListTags returns all tags sorted by name
+func (r *Repository) ListTags() ([]Tag, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	tags := make([]Tag, 0, len(metadata.Tags))
+	for name, hash := range metadata.Tags {
+		tags = append(tags, Tag{Name: name, Hash: hash})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+
+	return tags, nil
+}
+
+// Helper functions
+
+// lock acquires the repository lock, serializing operations that modify
+// metadata or the working tree across processes. The returned function
+// releases the lock.
+func (r *Repository) lock() (func(), error) {
+	if err := r.fs.Lock(r.bitPath(lockFile)); err != nil {
+		if errors.Is(err, util.ErrLocked) {
+			return nil, fmt.Errorf("repository is locked by another process (remove %s if no bit command is running; locks of exited processes are broken automatically)", r.bitPath(lockFile))
+		}
+		return nil, fmt.Errorf("failed to lock repository: %w", err)
+	}
+	return func() { r.fs.Unlock(r.bitPath(lockFile)) }, nil
+}
+
+// saveIndex returns the position of the save with the given full hash, or -1
+func saveIndex(metadata Metadata, hash string) int {
+	for i, save := range metadata.Saves {
+		if save.Hash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+// resolveHash finds the save referenced by ref, which may be a full hash,
+// a unique hash prefix or a tag name
+func resolveHash(metadata Metadata, ref string) (*Save, error) {
+	if ref == "" {
+		return nil, fmt.Errorf("empty save reference")
+	}
+
+	if tagged, ok := metadata.Tags[ref]; ok {
+		ref = tagged
+	}
+
+	// Hashes vary in length, so a full hash may also be the prefix of a
+	// longer one
+	for i := range metadata.Saves {
+		if metadata.Saves[i].Hash == ref {
+			return &metadata.Saves[i], nil
+		}
+	}
+
+	var match *Save
+	for i := range metadata.Saves {
+		if strings.HasPrefix(metadata.Saves[i].Hash, ref) {
+			if match != nil {
+				return nil, fmt.Errorf("save reference %s is ambiguous", ref)
+			}
+			match = &metadata.Saves[i]
+		}
+	}
+
+	if match == nil {
+		return nil, fmt.Errorf("save with hash %s not found", ref)
+	}
+
+	return match, nil
+}
+
+// validateRefName rejects tag or branch names, as told by kind, that could be
+// confused with save hashes
+func validateRefName(kind, name string) error {
+	if name == "" {
+		return fmt.Errorf("%s name cannot be empty", kind)
+	}
+	if strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("%s name %q cannot contain whitespace", kind, name)
+	}
+	if hexPattern.MatchString(name) {
+		return fmt.Errorf("%s name %q looks like a save hash", kind, name)
+	}
+	return nil
+}
+
+// getFilesToSave returns the files to save and the directories that contain no
+// tracked files
+func (r *Repository) getFilesToSave() (snapshot, error) {
+	return r.getFilesToSaveWith(nil, nil)
+}
+
+// walk walks the file tree rooted at root like FileSystem.Walk, but never
+// follows symbolic links: a link to a directory is passed to walkFn as a link
+// and is not descended into, even by a Walk that would follow it. Following
+// links could leave the repository or loop forever on a link to a parent.
+func (r *Repository) walk(root string, walkFn filepath.WalkFunc) error {
+	return r.fs.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() || path == root {
+			return walkFn(path, info, err)
+		}
+		linkInfo, lerr := r.fs.Lstat(path)
+		if lerr != nil || linkInfo.Mode()&os.ModeSymlink == 0 {
+			return walkFn(path, info, nil)
+		}
+		if err := walkFn(path, linkInfo, nil); err != nil {
+			return err
+		}
+		return filepath.SkipDir
+	})
+}
+
+// getFilesToSaveWith is like getFilesToSave, but files matching include are
+// listed even if ignored and files matching exclude are never listed
+func (r *Repository) getFilesToSaveWith(include, exclude []glob.Glob) (snapshot, error) {
+	var files, dirs []string
+	symlinks := make(map[string]bool)
+	sizes := make(map[string]int64)
+	modes := make(map[string]os.FileMode)
+	modTimes := make(map[string]time.Time)
+
+	// Load ignore patterns from .bitignore
+	ignoredPatterns, err := r.loadIgnorePatterns()
+	if err != nil {
+		return snapshot{}, fmt.Errorf("failed to load ignore patterns: %w", err)
+	}
+
+	// Walk through the current directory and add all files
+	err = r.walk(r.root, func(absPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Record paths relative to the repository root
+		path, err := r.relPath(absPath)
+		if err != nil {
+			return err
+		}
+
+		// Skip directories
+		if info.IsDir() {
+			// Skip .bit directory completely
+			if path == bitDir || filepath.HasPrefix(path, bitDir+"/") {
+				return filepath.SkipDir
+			}
+
+			if path != "." && util.IsIgnoredDir(path, exclude) {
+				return filepath.SkipDir
+			}
+
+			// Don't descend into ignored directories such as node_modules/,
+			// unless included files may be inside
+			if path != "." && util.IsIgnoredDir(path, ignoredPatterns) {
+				if len(include) == 0 {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			// Remember directories so empty ones can be recorded
+			if path != "." && !util.IsIgnored(path, ignoredPatterns) {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+
+		// A .bit file points to the repository directory and is never saved
+		if path == bitDir {
+			return nil
+		}
+
+		if util.IsIgnored(path, exclude) {
+			return nil
+		}
+
+		// Always include .bitignore file
+		if path == ignoreFile {
+			files = append(files, path)
+			sizes[path] = info.Size()
+			modes[path] = info.Mode().Perm()
+			modTimes[path] = info.ModTime()
+			return nil
+		}
+
+		// Skip files matching ignore patterns
+		if util.IsIgnored(path, ignoredPatterns) && !util.IsIgnored(path, include) {
+			// We intentionally skip ALL ignored files
+			return nil
+		}
+
+		// Symbolic links are stored as links, never dereferenced
+		if info.Mode()&os.ModeSymlink != 0 {
+			symlinks[path] = true
+		} else {
+			modes[path] = info.Mode().Perm()
+			modTimes[path] = info.ModTime()
+		}
+
+		files = append(files, path)
+		sizes[path] = info.Size()
+		return nil
+	})
+
+	if err != nil {
+		return snapshot{}, fmt.Errorf("failed to walk directory: %w", err)
+	}
+
+	// Walk order depends on the filesystem, so sort to keep saves stable
+	sort.Strings(files)
+	sort.Strings(dirs)
+
+	config, err := r.loadConfig()
+	if err != nil {
+		return snapshot{}, err
+	}
+	converter, err := r.lineEndingsFor(config)
+	if err != nil {
+		return snapshot{}, err
+	}
+
+	return snapshot{files: files, dirs: emptyDirs(dirs, files), symlinks: symlinks, sizes: sizes, modes: modes, modTimes: modTimes, lineEndings: converter}, nil
+}
+
+// loadAttributes loads the storage policies from the repository's
+// .bitattributes file. A missing file assigns no policies.
+func (r *Repository) loadAttributes() (util.Attributes, error) {
+	attributes, err := util.LoadAttributes(r.path(attributesFile), r.fs)
+	if os.IsNotExist(err) {
+		return util.Attributes{}, nil
+	} else if err != nil {
+		return util.Attributes{}, fmt.Errorf("failed to load %s: %w", attributesFile, err)
+	}
+	return attributes, nil
+}
+
+// loadIgnorePatterns loads the user's global ignore patterns followed by those
+// of the repository's .bitignore file, so repository patterns, negations
+// included, take precedence. Missing files contribute no patterns.
+func (r *Repository) loadIgnorePatterns() ([]glob.Glob, error) {
+	patterns, err := util.LoadGlobalIgnore()
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := util.LoadIgnorePatterns(r.ignorePath, r.fs)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return append(patterns, local...), nil
+}
+
+// ignorePatternsFrom returns the global ignore patterns followed by those of
+// content, read as a .bitignore file
+func ignorePatternsFrom(content []byte) ([]glob.Glob, error) {
+	patterns, err := util.LoadGlobalIgnore()
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := util.ParseIgnorePatterns(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	return append(patterns, local...), nil
+}
+
+// symlinksInSave returns the files stored as symbolic links in the given save
+func (r *Repository) symlinksInSave(saveHash string) map[string]bool {
+	symlinks := make(map[string]bool)
+
+	// Saves without a delta set predate symlink support
+	deltaSet, err := r.loadDeltaSet(saveHash)
+	if err != nil {
+		return symlinks
+	}
+
+	for _, delta := range deltaSet.Deltas {
+		if delta.IsSymlink {
+			symlinks[delta.Path] = true
+		}
+	}
+	return symlinks
+}
+
+// modesInSave returns the permission bits recorded for the files of the given
+// save. Saves made before modes were recorded have none.
+func (r *Repository) modesInSave(saveHash string) map[string]os.FileMode {
+	modes := make(map[string]os.FileMode)
+
+	deltaSet, err := r.loadDeltaSet(saveHash)
+	if err != nil {
+		return modes
+	}
+
+	for _, delta := range deltaSet.Deltas {
+		if delta.Mode != 0 {
+			modes[delta.Path] = delta.Mode
+		}
+	}
+	return modes
+}
+
+// modTimesInSave returns the modification time recorded for each regular file
+// of the given save. Saves made before modification times were recorded have
+// none.
+func (r *Repository) modTimesInSave(saveHash string) map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+
+	deltaSet, err := r.loadDeltaSet(saveHash)
+	if err != nil {
+		return modTimes
+	}
+
+	for _, delta := range deltaSet.Deltas {
+		if delta.ModTime != 0 {
+			modTimes[delta.Path] = time.Unix(0, delta.ModTime)
+		}
+	}
+	return modTimes
+}
+
+// unixNano returns t in nanoseconds since the Unix epoch, or 0 for the zero
+// time, as recorded in DeltaInfo.ModTime
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// contentHashesInSave returns the content hash recorded for each file of the
+// given save. Saves without a delta set record none.
+func (r *Repository) contentHashesInSave(saveHash string) map[string]string {
+	hashes := make(map[string]string)
+
+	deltaSet, err := r.loadDeltaSet(saveHash)
+	if err != nil {
+		return hashes
+	}
+
+	for _, delta := range deltaSet.Deltas {
+		if !delta.IsDeleted && delta.ContentHash != "" {
+			hashes[delta.Path] = delta.ContentHash
+		}
+	}
+	return hashes
+}
+
+// writeWorkingFile writes restored content to the working tree, as a symbolic
+// link when the content is a link target. An existing link at the path is
+// replaced rather than written through.
+func (r *Repository) writeWorkingFile(file string, content []byte, isSymlink bool) error {
+	return r.writeFileAt(r.path(file), file, content, isSymlink)
+}
+
+// writeFileAt is writeWorkingFile for the file written at target
+func (r *Repository) writeFileAt(target, file string, content []byte, isSymlink bool) error {
+	// Create parent directories if needed
+	targetDir := filepath.Dir(target)
+	if err := r.fs.MkdirAll(targetDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", targetDir, err)
+	}
+
+	if _, err := r.fs.Readlink(target); err == nil || isSymlink {
+		if err := r.fs.Remove(target); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to replace %s: %w", file, err)
+		}
+	}
+
+	if isSymlink {
+		return r.fs.Symlink(string(content), target)
+	}
+	return r.fs.WriteFile(target, content, 0644)
+}
+
+// emptyDirs returns the directories that contain no files. Only the deepest empty
+// directories are kept since recreating them also recreates their parents.
+func emptyDirs(dirs, files []string) []string {
+	occupied := make(map[string]bool)
+	mark := func(p string) {
+		for dir := path.Dir(p); dir != "." && dir != "/" && !occupied[dir]; dir = path.Dir(dir) {
+			occupied[dir] = true
+		}
+	}
+	for _, file := range files {
+		mark(file)
+	}
+	// A directory containing another directory is not a leaf
+	for _, dir := range dirs {
+		mark(dir)
+	}
+
+	var empty []string
+	for _, dir := range dirs {
+		if !occupied[dir] {
+			empty = append(empty, dir)
+		}
+	}
+	return empty
+}
+
+// newSaveHash shortens the full hash of a new save to the configured length,
+// extending it as long as it equals the hash of an existing save. The length
+// used is kept as the length of the returned hash.
+func (r *Repository) newSaveHash(full string) (string, error) {
+	config, err := r.loadConfig()
+	if err != nil {
+		return "", err
+	}
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return "", fmt.Errorf("failed to load metadata: %w", err)
+	}
+	return uniqueSaveHash(full, config.HashLength, metadata), nil
+}
+
+// uniqueSaveHash returns the shortest prefix of full, at least length
+// characters long, that is not the hash of a save in metadata
+func uniqueSaveHash(full string, length int, metadata Metadata) string {
+	existing := make(map[string]bool, len(metadata.Saves))
+	for _, save := range metadata.Saves {
+		existing[save.Hash] = true
+	}
+
+	length = min(length, len(full))
+	for length < len(full) && existing[full[:length]] {
+		length++
+	}
+	return full[:length]
+}
+
+// createSaveHash identifies a save by its name, time, base and the content of
+// its files, given as content hashes by path
+func createSaveHash(name string, timestamp time.Time, baseSaveHash string, files []string, contentHashes map[string]string) string {
+	h := sha256.New()
+	h.Write([]byte(name))
+	h.Write([]byte(timestamp.String()))
+	// The base keeps a squashed save distinct from the tip it replaces
+	h.Write([]byte(baseSaveHash))
+	for _, file := range files {
+		h.Write([]byte(file))
+		h.Write([]byte(contentHashes[file]))
+	}
+	// Shortened to the configured length by newSaveHash
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (r *Repository) loadMetadata() (Metadata, error) {
+	var metadata Metadata
+
+	data, err := r.fs.ReadFile(r.metadataFile)
+	if os.IsNotExist(err) {
+		return Metadata{Saves: []Save{}}, nil
+	} else if err != nil {
+		return metadata, err
+	}
+
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return metadata, fmt.Errorf("%w: %v", ErrCorruptMetadata, err)
+	}
+	return metadata, nil
+}
+
+func (r *Repository) saveMetadata(metadata Metadata) error {
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return r.fs.WriteFile(r.metadataFile, data, 0644)
+}
 
-	// Read content of all current ignored files before we make any changes
-	for _, file := range currentFiles {
-		if util.IsBitDirectory(file) || file == ignoreFile {
-			continue
-		}
+// RebuildMetadata recovers the save list from the delta sets in the objects
+// directory when metadata.json cannot be decoded, and returns the number of
+// saves recovered. Readable metadata is never overwritten. The corrupt file is
+// kept as metadata.json.corrupt.
+//
+// Names, tags and empty directories are not stored outside the metadata, so
+// they are lost. Saves are ordered by the time the reflog recorded for them,
+// or by the time their delta set was written. Saves made without delta storage
+// have no delta set and cannot be recovered.
+func (r *Repository) RebuildMetadata() (int, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return 0, err
+	}
 
-		if util.IsIgnored(file, ignoredPatterns) {
-			// Read file content
-			content, err := r.fs.ReadFile(file)
-			if err == nil {
-				currentIgnoredFiles[file] = string(content)
-			}
-			// We intentionally ignore errors here as they might be symlinks or special files
-		}
+	unlock, err := r.lock()
+	if err != nil {
+		return 0, err
 	}
+	defer unlock()
 
-	// Remove non-ignored files that aren't in the save
-	for _, file := range currentFiles {
-		if util.IsBitDirectory(file) || file == ignoreFile {
-			continue
-		}
+	_, err = r.loadMetadata()
+	if err == nil {
+		return 0, fmt.Errorf("metadata is intact, refusing to overwrite it")
+	} else if !errors.Is(err, ErrCorruptMetadata) {
+		return 0, fmt.Errorf("failed to load metadata: %w", err)
+	}
 
-		// Don't remove ignored files
-		if util.IsIgnored(file, ignoredPatterns) {
-			continue
+	// The reflog records when each save was made
+	data, err := r.readReflog()
+	if err != nil {
+		return 0, err
+	}
+	recorded := make(map[string]time.Time)
+	for _, entry := range parseReflog(data) {
+		if _, ok := recorded[entry.To]; !ok && entry.To != "" {
+			recorded[entry.To] = entry.Timestamp
 		}
+	}
 
-		// Check if file is in the save
-		inSave := false
-		for _, savedFile := range save.Files {
-			if file == savedFile {
-				inSave = true
-				break
-			}
-		}
+	// Delta sets sit directly in the objects directory, so blobs need not be listed
+	entries, err := r.fs.ReadDir(r.objectsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to list objects: %w", err)
+	}
 
-		// Remove file if not in save
-		if !inSave {
-			if err := r.fs.Remove(file); err != nil && !os.IsNotExist(err) {
-				return fmt.Errorf("failed to remove file %s: %w", file, err)
-			}
-		}
+	stashes := make(map[string]bool)
+	for _, save := range r.stashSaves() {
+		stashes[save.Hash] = true
 	}
 
-	// Restore non-ignored files from the save
-	for _, file := range save.Files {
-		// Skip .bit directory
-		if util.IsBitDirectory(file) {
+	var saves []Save
+	var baseHashes []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, "delta_") || !strings.HasSuffix(name, ".json") {
 			continue
 		}
 
-		// Skip restoring ignored files (except .bitignore which we already handled)
-		if file != ignoreFile && util.IsIgnored(file, ignoredPatterns) {
+		// Stashes have delta sets too, but were never saves
+		hash := strings.TrimSuffix(strings.TrimPrefix(name, "delta_"), ".json")
+		if stashes[hash] {
 			continue
 		}
-
-		// Get file content from save (either directly or by applying deltas)
-		content, err := r.getFileContentFromSave(file, hash)
+		deltaSet, err := r.loadDeltaSet(hash)
 		if err != nil {
-			return fmt.Errorf("failed to get content for file %s: %w", file, err)
+			// A delta set damaged along with the metadata loses only its save
+			continue
 		}
 
-		// Create parent directories if needed
-		targetDir := filepath.Dir(file)
-		if err := r.fs.MkdirAll(targetDir, 0755); err != nil {
-			return fmt.Errorf("failed to create directory %s: %w", targetDir, err)
+		save := Save{Hash: hash, Files: []string{}}
+		if timestamp, ok := recorded[hash]; ok {
+			save.Timestamp = timestamp
+		} else if info, err := entry.Info(); err == nil {
+			save.Timestamp = info.ModTime()
 		}
-
-		// Write the file
-		if err := r.fs.WriteFile(file, content, 0644); err != nil {
-			return fmt.Errorf("failed to restore file %s: %w", file, err)
+		var baseHash string
+		for _, delta := range deltaSet.Deltas {
+			if !delta.IsDeleted {
+				save.Files = append(save.Files, delta.Path)
+			}
+			if baseHash == "" {
+				baseHash = delta.BaseSaveHash
+			}
 		}
+		sort.Strings(save.Files)
+
+		saves = append(saves, save)
+		baseHashes = append(baseHashes, baseHash)
 	}
 
-	// Restore all previously existing ignored files
-	for file, content := range currentIgnoredFiles {
-		// Create parent directories if needed
-		targetDir := filepath.Dir(file)
-		if err := r.fs.MkdirAll(targetDir, 0755); err != nil {
-			return fmt.Errorf("failed to create directory %s: %w", targetDir, err)
+	order := make([]int, len(saves))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := saves[order[i]], saves[order[j]]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
 		}
+		return a.Hash < b.Hash
+	})
 
-		// Write file content
-		if err := r.fs.WriteFile(file, []byte(content), 0644); err != nil {
-			return fmt.Errorf("failed to restore ignored file %s: %w", file, err)
+	// Each save was based on the one before it unless its deltas say otherwise
+	metadata := Metadata{Saves: make([]Save, 0, len(saves))}
+	for _, i := range order {
+		save := saves[i]
+		save.Name = "recovered " + save.Hash
+		save.BaseSaveHash = baseHashes[i]
+		if save.BaseSaveHash == "" && len(metadata.Saves) > 0 {
+			save.BaseSaveHash = metadata.Saves[len(metadata.Saves)-1].Hash
 		}
+		metadata.Saves = append(metadata.Saves, save)
 	}
 
-	return nil
-}
+	corrupt, err := r.fs.ReadFile(r.metadataFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	if err := r.fs.WriteFile(r.metadataFile+".corrupt", corrupt, 0644); err != nil {
+		return 0, fmt.Errorf("failed to back up corrupt metadata: %w", err)
+	}
+	if err := r.saveMetadata(metadata); err != nil {
+		return 0, fmt.Errorf("failed to save metadata: %w", err)
+	}
 
-// Helper functions
+	return len(metadata.Saves), nil
+}
 
-func (r *Repository) getFilesToSave() ([]string, error) {
+// listAllFiles lists all files in the workspace (including ignored files)
+func (r *Repository) listAllFiles() ([]string, error) {
 	var files []string
 
-	// Load ignore patterns from .bitignore
-	ignoredPatterns, err := util.GetIgnorePatterns(ignoreFile)
-	if err != nil && !os.IsNotExist(err) {
-		return nil, fmt.Errorf("failed to load ignore patterns: %w", err)
-	}
-
 	// Walk through the current directory and add all files
-	err = r.fs.Walk(".", func(path string, info os.FileInfo, err error) error {
+	err := r.walk(r.root, func(absPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Record paths relative to the repository root
+		path, err := r.relPath(absPath)
 		if err != nil {
 			return err
 		}
@@ -545,18 +4406,6 @@ func (r *Repository) getFilesToSave() ([]string, error) {
 			return nil
 		}
 
-		// Always include .bitignore file
-		if path == ignoreFile {
-			files = append(files, path)
-			return nil
-		}
-
-		// Skip files matching ignore patterns
-		if util.IsIgnored(path, ignoredPatterns) {
-			// We intentionally skip ALL ignored files
-			return nil
-		}
-
 		files = append(files, path)
 		return nil
 	})
@@ -568,100 +4417,471 @@ func (r *Repository) getFilesToSave() ([]string, error) {
 	return files, nil
 }
 
-func createSaveHash(name string, timestamp time.Time, files []string) string {
-	h := sha256.New()
-	h.Write([]byte(name))
-	h.Write([]byte(timestamp.String()))
-	for _, file := range files {
-		h.Write([]byte(file))
+// Static wrapper functions to maintain backwards compatibility
+
+// openRepository opens the repository containing the working directory using the
+// OS filesystem. When no repository is found it falls back to the working directory
+// so that commands report why the search failed.
+func openRepository() *Repository {
+	fs := util.NewOsFileSystem()
+	if repo := repositoryFromEnv(fs); repo != nil {
+		return repo
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return NewRepository(fs)
+	}
+
+	repo, err := OpenRepository(fs, cwd)
+	if err != nil {
+		repo = NewRepository(fs)
+		repo.searchErr = err
+	}
+	return repo
+}
+
+// EnsureRepository returns an error wrapping ErrNotRepository when the working
+// directory is not inside a repository, using the OS filesystem
+func EnsureRepository() error {
+	repo := openRepository()
+	return repo.ensureInitialized()
+}
+
+// InitRepository initializes a new bit repository using the OS filesystem, in
+// $BIT_DIR when set
+func InitRepository() error {
+	fs := util.NewOsFileSystem()
+	repo := repositoryFromEnv(fs)
+	if repo == nil {
+		repo = NewRepository(fs)
 	}
-	return hex.EncodeToString(h.Sum(nil))[:12] // Use first 12 characters of hash for brevity
+	return repo.InitRepository()
+}
+
+// WriteStarterIgnore writes a starter .bitignore unless one exists using the
+// OS filesystem
+func WriteStarterIgnore() (bool, error) {
+	repo := openRepository()
+	return repo.WriteStarterIgnore()
 }
 
-func (r *Repository) copyFile(src, dst string) error {
-	sourceContent, err := r.fs.ReadFile(src)
+// InitRepositoryAt initializes a new bit repository in the current directory whose
+// data is kept in dir, outside the working tree, using the OS filesystem
+func InitRepositoryAt(dir string) error {
+	abs, err := filepath.Abs(dir)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to resolve %s: %w", dir, err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+
+	// Saves would otherwise include the repository's own data
+	if rel, err := filepath.Rel(cwd, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("repository directory %s must be outside the working tree", dir)
 	}
 
-	return r.fs.WriteFile(dst, sourceContent, 0644)
+	repo := NewRepositoryWithDir(util.NewOsFileSystem(), ".", abs)
+	return repo.InitRepository()
 }
 
-func (r *Repository) loadMetadata() (Metadata, error) {
-	var metadata Metadata
+// SaveState creates a snapshot of the current state with the given name using the OS filesystem
+func SaveState(name string) (string, error) {
+	repo := openRepository()
+	return repo.SaveState(name)
+}
 
-	data, err := r.fs.ReadFile(metadataFile)
-	if os.IsNotExist(err) {
-		return Metadata{Saves: []Save{}}, nil
-	} else if err != nil {
-		return metadata, err
+// SaveStateWithOptions creates a new save adjusted by opts using the OS filesystem
+func SaveStateWithOptions(name string, opts SaveOptions) (string, error) {
+	repo := openRepository()
+	return repo.SaveStateWithOptions(name, opts)
+}
+
+// ListSaves returns a list of all saves using the OS filesystem
+func ListSaves() ([]Save, error) {
+	repo := openRepository()
+	return repo.ListSaves()
+}
+
+// ListSavesFiltered returns the saves selected by opts using the OS filesystem
+func ListSavesFiltered(opts ListOptions) ([]Save, error) {
+	repo := openRepository()
+	return repo.ListSavesFiltered(opts)
+}
+
+// SaveFiles returns the files tracked by a save using the OS filesystem
+func SaveFiles(hash string) ([]string, error) {
+	repo := openRepository()
+	return repo.SaveFiles(hash)
+}
+
+// ChangedFiles lists the files that differ between two states by content hash
+// using the OS filesystem
+func ChangedFiles(from, to string) (*ChangeSet, error) {
+	repo := openRepository()
+	return repo.ChangedFiles(from, to)
+}
+
+// Log lists the saves inside the given time range using the OS filesystem
+func Log(since, until time.Time) ([]Save, error) {
+	repo := openRepository()
+	return repo.Log(since, until)
+}
+
+// LogBranch lists the saves of a branch inside the given time range using the OS filesystem
+func LogBranch(branch string, since, until time.Time) ([]Save, error) {
+	repo := openRepository()
+	return repo.LogBranch(branch, since, until)
+}
+
+// CreateBranch starts a branch at the checked out save using the OS filesystem
+func CreateBranch(name string) error {
+	repo := openRepository()
+	return repo.CreateBranch(name)
+}
+
+// Switch checks out a branch and makes it current using the OS filesystem
+func Switch(name string, progress ProgressFunc) error {
+	repo := openRepository()
+	return repo.Switch(name, progress)
+}
+
+// Undo deletes the latest save and checks out the save before it using the
+// OS filesystem
+func Undo(force bool) (Save, error) {
+	repo := openRepository()
+	return repo.Undo(force)
+}
+
+// Stashes lists the working tree backups taken before checkouts using the OS
+// filesystem
+func Stashes() ([]Stash, error) {
+	repo := openRepository()
+	return repo.Stashes()
+}
+
+// PopStash restores a working tree backup using the OS filesystem
+func PopStash(name string) (Stash, error) {
+	repo := openRepository()
+	return repo.PopStash(name)
+}
+
+// ConfigValues lists the settings in effect using the OS filesystem
+func ConfigValues() ([]ConfigValue, error) {
+	repo := openRepository()
+	return repo.ConfigValues()
+}
+
+// SetConfig changes a setting in config.json using the OS filesystem
+func SetConfig(key, value string) error {
+	repo := openRepository()
+	return repo.SetConfig(key, value)
+}
+
+// UnsetConfig removes a setting from config.json using the OS filesystem
+func UnsetConfig(key string) error {
+	repo := openRepository()
+	return repo.UnsetConfig(key)
+}
+
+// Merge merges another save into the checked out one using the OS filesystem
+func Merge(other string) (MergeResult, error) {
+	repo := openRepository()
+	return repo.Merge(other)
+}
+
+// ListBranches returns all branches using the OS filesystem
+func ListBranches() ([]Branch, error) {
+	repo := openRepository()
+	return repo.ListBranches()
+}
+
+// FileHistory lists the saves that changed a file using the OS filesystem.
+// The path is relative to the working directory.
+func FileHistory(file string) ([]FileChange, error) {
+	repo := openRepository()
+	rel, err := repo.pathFromWorkingDir(file)
+	if err != nil {
+		return nil, err
 	}
+	return repo.FileHistory(rel)
+}
+
+// Checkout restores the project to the state of the given save hash using the OS filesystem
+func Checkout(hash string) error {
+	repo := openRepository()
+	return repo.Checkout(hash)
+}
 
-	err = json.Unmarshal(data, &metadata)
-	return metadata, err
+// CheckoutInto writes the files of a save under another directory using the
+// OS filesystem
+func CheckoutInto(hash, targetDir string) error {
+	repo := openRepository()
+	return repo.CheckoutInto(hash, targetDir)
 }
 
-func (r *Repository) saveMetadata(metadata Metadata) error {
-	data, err := json.MarshalIndent(metadata, "", "  ")
+// Diff returns the changes between two saves, or a save and the working tree,
+// as a unified diff using the OS filesystem
+func Diff(from, to string, context int) (string, error) {
+	repo := openRepository()
+	return repo.Diff(from, to, context)
+}
+
+// DiffStat counts the lines changed in each file between two states using the
+// OS filesystem
+func DiffStat(from, to string) ([]FileStat, error) {
+	repo := openRepository()
+	return repo.DiffStat(from, to)
+}
+
+// CompareSaves lists the files that differ between two saves using the OS filesystem
+func CompareSaves(a, b string) (*ChangeSet, error) {
+	repo := openRepository()
+	return repo.CompareSaves(a, b)
+}
+
+// Grep searches the files of a save, or of the working tree, using the OS filesystem
+func Grep(pattern, hash string) ([]GrepMatch, error) {
+	repo := openRepository()
+	return repo.Grep(pattern, hash)
+}
+
+// CatFile returns the content of a file at a save using the OS filesystem.
+// The path is relative to the working directory.
+func CatFile(hash, file string) ([]byte, error) {
+	repo := openRepository()
+	rel, err := repo.pathFromWorkingDir(file)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return repo.CatFile(hash, rel)
+}
 
-	return r.fs.WriteFile(metadataFile, data, 0644)
+// Annotate returns the lines of a file at a save with the saves that last
+// changed them using the OS filesystem. The path is relative to the working
+// directory.
+func Annotate(file, hash string) ([]AnnotatedLine, error) {
+	repo := openRepository()
+	rel, err := repo.pathFromWorkingDir(file)
+	if err != nil {
+		return nil, err
+	}
+	return repo.Annotate(rel, hash)
 }
 
-// listAllFiles lists all files in the workspace (including ignored files)
-func (r *Repository) listAllFiles() ([]string, error) {
-	var files []string
+// FindOrphans lists the objects no save refers to using the OS filesystem
+func FindOrphans() ([]string, error) {
+	repo := openRepository()
+	return repo.FindOrphans()
+}
 
-	// Walk through the current directory and add all files
-	err := r.fs.Walk(".", func(path string, info os.FileInfo, err error) error {
+// Objects lists the files in the objects directory using the OS filesystem
+func Objects() ([]ObjectInfo, error) {
+	repo := openRepository()
+	return repo.Objects()
+}
+
+// Doctor runs the repository health checks using the OS filesystem
+func Doctor() DoctorReport {
+	repo := openRepository()
+	return repo.Doctor()
+}
+
+// VerifyIntegrity checks the content and signatures of every save using the
+// OS filesystem
+func VerifyIntegrity() ([]IntegrityIssue, error) {
+	repo := openRepository()
+	return repo.VerifyIntegrity()
+}
+
+// DeltaDepths reports the delta depth of every file of a save using the OS
+// filesystem
+func DeltaDepths(hash string) (DepthReport, error) {
+	repo := openRepository()
+	return repo.DeltaDepths(hash)
+}
+
+// Size reports the storage used by the repository using the OS filesystem
+func Size() (SizeReport, error) {
+	repo := openRepository()
+	return repo.Size()
+}
+
+// RebuildMetadata recovers corrupt metadata from the stored delta sets using the OS filesystem
+func RebuildMetadata() (int, error) {
+	repo := openRepository()
+	return repo.RebuildMetadata()
+}
+
+// Head returns the hash of the checked out save using the OS filesystem
+func Head() (string, error) {
+	repo := openRepository()
+	return repo.Head()
+}
+
+// Reflog returns the recorded saves and checkouts using the OS filesystem
+func Reflog() ([]ReflogEntry, error) {
+	repo := openRepository()
+	return repo.Reflog()
+}
+
+// CheckoutMerge checks out a save, merging the unsaved changes of the working
+// tree into it, using the OS filesystem
+func CheckoutMerge(hash string, progress ProgressFunc) ([]string, error) {
+	repo := openRepository()
+	return repo.CheckoutMerge(hash, progress)
+}
+
+// CheckoutPaths restores the files of a save matching a glob pattern using the
+// OS filesystem. Patterns match paths relative to the repository root, with *
+// staying within one directory and ** crossing directories. An empty pattern
+// restores the whole save. Files not in the save matching any of the keep
+// patterns are not removed. A non-nil progress is called as files are restored.
+func CheckoutPaths(hash, pattern string, keep []string, progress ProgressFunc) error {
+	opts := CheckoutOptions{Progress: progress}
+	if pattern != "" {
+		paths, err := glob.Compile(pattern, '/')
 		if err != nil {
-			return err
+			return fmt.Errorf("invalid path pattern %q: %w", pattern, err)
 		}
-
-		// Skip directories
-		if info.IsDir() {
-			// Skip .bit directory completely
-			if path == bitDir || filepath.HasPrefix(path, bitDir+"/") {
-				return filepath.SkipDir
-			}
-			return nil
+		opts.Paths = paths
+	}
+	for _, pattern := range keep {
+		compiled, err := glob.Compile(pattern, '/')
+		if err != nil {
+			return fmt.Errorf("invalid keep pattern %q: %w", pattern, err)
 		}
+		opts.Keep = append(opts.Keep, compiled)
+	}
+	repo := openRepository()
+	return repo.CheckoutWithOptions(hash, opts)
+}
 
-		files = append(files, path)
-		return nil
-	})
+// ImportTar creates a new save from a tar archive using the OS filesystem
+func ImportTar(name string, reader io.Reader) (string, error) {
+	repo := openRepository()
+	return repo.ImportTar(name, reader)
+}
 
+// Remove stops tracking a file using the OS filesystem. The path is relative to the working directory.
+func Remove(file string) error {
+	repo := openRepository()
+	rel, err := repo.pathFromWorkingDir(file)
 	if err != nil {
-		return nil, fmt.Errorf("failed to walk directory: %w", err)
+		return err
 	}
+	return repo.Remove(rel)
+}
 
-	return files, nil
+// Move renames a tracked file using the OS filesystem. Paths are relative to the working directory.
+func Move(oldPath, newPath string) error {
+	repo := openRepository()
+	from, err := repo.pathFromWorkingDir(oldPath)
+	if err != nil {
+		return err
+	}
+	to, err := repo.pathFromWorkingDir(newPath)
+	if err != nil {
+		return err
+	}
+	return repo.Move(from, to)
 }
 
-// Static wrapper functions to maintain backwards compatibility
+// RemoveAndSave removes a file and records a deletion-only save using the OS filesystem.
+// The path is relative to the working directory.
+func RemoveAndSave(file, name string) (string, error) {
+	repo := openRepository()
+	rel, err := repo.pathFromWorkingDir(file)
+	if err != nil {
+		return "", err
+	}
+	return repo.RemoveAndSave(rel, name)
+}
 
-// InitRepository initializes a new bit repository using the OS filesystem
-func InitRepository() error {
-	repo := NewRepository(util.NewOsFileSystem())
-	return repo.InitRepository()
+// GetStatus compares the working tree with the checked out save using the OS filesystem
+func GetStatus() (Status, error) {
+	repo := openRepository()
+	return repo.Status()
 }
 
-// SaveState creates a snapshot of the current state with the given name using the OS filesystem
-func SaveState(name string) (string, error) {
-	repo := NewRepository(util.NewOsFileSystem())
-	return repo.SaveState(name)
+// Squash collapses a range of saves into one using the OS filesystem
+func Squash(fromHash, toHash, name string) (string, error) {
+	repo := openRepository()
+	return repo.SquashNamed(fromHash, toHash, name)
 }
 
-// ListSaves returns a list of all saves using the OS filesystem
-func ListSaves() ([]Save, error) {
-	repo := NewRepository(util.NewOsFileSystem())
-	return repo.ListSaves()
+// Compact shortens long delta chains of the latest save using the OS filesystem
+func Compact(maxChain int) (int, error) {
+	repo := openRepository()
+	return repo.Compact(maxChain)
 }
 
-// Checkout restores the project to the state of the given save hash using the OS filesystem
-func Checkout(hash string) error {
-	repo := NewRepository(util.NewOsFileSystem())
-	return repo.Checkout(hash)
+// RepackDeltas shortens the delta chains of a file using the OS filesystem.
+// The path is resolved relative to the working directory.
+func RepackDeltas(file string) (int, error) {
+	repo := openRepository()
+	rel, err := repo.pathFromWorkingDir(file)
+	if err != nil {
+		return 0, err
+	}
+	return repo.RepackDeltas(rel)
+}
+
+// AmendFile stores a single file in the latest save using the OS filesystem.
+// The path is resolved relative to the working directory.
+func AmendFile(file string, allowLarge bool) (Save, error) {
+	repo := openRepository()
+	rel, err := repo.pathFromWorkingDir(file)
+	if err != nil {
+		return Save{}, err
+	}
+	return repo.AmendFile(rel, allowLarge)
+}
+
+// Clean removes untracked, non-ignored files using the OS filesystem
+func Clean(dryRun bool) ([]string, error) {
+	repo := openRepository()
+	return repo.Clean(dryRun)
+}
+
+// ExportTar writes the given save as a tar archive using the OS filesystem
+func ExportTar(hash string, w io.Writer) error {
+	repo := openRepository()
+	return repo.ExportTar(hash, w)
+}
+
+// Bundle writes the whole repository as a single archive using the OS filesystem
+func Bundle(w io.Writer) error {
+	repo := openRepository()
+	return repo.Bundle(w)
+}
+
+// Unbundle creates a repository in the current directory, or in $BIT_DIR when
+// set, from a bundle using the OS filesystem
+func Unbundle(reader io.Reader) error {
+	fs := util.NewOsFileSystem()
+	repo := repositoryFromEnv(fs)
+	if repo == nil {
+		repo = NewRepository(fs)
+	}
+	return repo.Unbundle(reader)
+}
+
+// AddTag tags the save with the given hash using the OS filesystem
+func AddTag(hash, name string) error {
+	repo := openRepository()
+	return repo.AddTag(hash, name)
+}
+
+// RemoveTag deletes a tag using the OS filesystem
+func RemoveTag(name string) error {
+	repo := openRepository()
+	return repo.RemoveTag(name)
+}
+
+// ListTags returns all tags using the OS filesystem
+func ListTags() ([]Tag, error) {
+	repo := openRepository()
+	return repo.ListTags()
 }
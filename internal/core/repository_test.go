@@ -1,11 +1,24 @@
 package core
 
 import (
+	"archive/tar"
 	"bit/internal/util"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/gobwas/glob"
 )
 
 // mockFileSystemWithTestFiles extends MockFileSystem to expose test files for repository tests
@@ -26,9 +39,16 @@ func NewMockFSWithTestFiles() *mockFileSystemWithTestFiles {
 func (fs *mockFileSystemWithTestFiles) AddTestFile(path string, content []byte) {
 	fs.MockFileSystem.AddFile(path, content)
 	// Only add non-.bit files to the test files list
-	if !util.IsBitDirectory(path) && path != ".bitignore" {
-		fs.testFiles = append(fs.testFiles, path)
+	if util.IsBitDirectory(path) || path == ".bitignore" {
+		return
+	}
+	// Re-adding a file only updates its content
+	for _, existing := range fs.testFiles {
+		if existing == path {
+			return
+		}
 	}
+	fs.testFiles = append(fs.testFiles, path)
 }
 
 // Walk overrides the standard Walk to expose test files directly when called
@@ -43,11 +63,19 @@ func (fs *mockFileSystemWithTestFiles) Walk(root string, walkFn filepath.WalkFun
 
 		// Create fake file info for each file
 		for _, path := range fs.testFiles {
+			// Skip test files that have since been removed or replaced by
+			// a directory
+			stat, err := fs.Stat(path)
+			if err != nil || stat.IsDir() {
+				continue
+			}
+
+			content, _ := fs.ReadFile(path)
 			info := util.MockFileInfo{
 				FileName:    filepath.Base(path),
-				FileSize:    0,
+				FileSize:    int64(len(content)),
 				FileMode:    0644,
-				FileModTime: time.Now(),
+				FileModTime: stat.ModTime(),
 				FileIsDir:   false,
 			}
 
@@ -97,13 +125,13 @@ func TestInitRepository(t *testing.T) {
 	}
 
 	// Verify objects directory was created
-	if !mockFS.Exists(objectsDir) {
-		t.Errorf("Expected %s directory to be created", objectsDir)
+	if !mockFS.Exists(repo.objectsDir) {
+		t.Errorf("Expected %s directory to be created", repo.objectsDir)
 	}
 
 	// Verify metadata file was created
-	if !mockFS.Exists(metadataFile) {
-		t.Errorf("Expected %s file to be created", metadataFile)
+	if !mockFS.Exists(repo.metadataFile) {
+		t.Errorf("Expected %s file to be created", repo.metadataFile)
 	}
 
 	// Try to initialize again, should fail
@@ -233,7 +261,7 @@ func TestSaveStateWithDeltas(t *testing.T) {
 	}
 
 	// Check delta was created
-	deltaPath := filepath.Join(objectsDir, "delta_"+hash2+".json")
+	deltaPath := filepath.Join(repo.objectsDir, "delta_"+hash2+".json")
 	if !mockFS.Exists(deltaPath) {
 		t.Errorf("Expected delta file %s to be created", deltaPath)
 	}
@@ -329,6 +357,420 @@ func TestCheckout(t *testing.T) {
 	}
 }
 
+func TestCheckoutVerifiesContentHashes(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("original content"))
+	mockFS.AddTestFile("other.txt", []byte("other content"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	mockFS.AddTestFile("file.txt", []byte("changed content"))
+	if _, err := repo.SaveState("Second save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Overwrite the stored blob with headerless content, which carries no hash
+	// for the object reader to check
+	blob := util.BlobPath(util.CalculateFileHash([]byte("original content")), repo.objectsDir)
+	mockFS.WriteFile(blob, []byte("tampered content"), 0644)
+
+	err = repo.Checkout(first)
+	if !errors.Is(err, ErrCorruptContent) || !strings.Contains(err.Error(), "file.txt") {
+		t.Fatalf("Expected checkout to abort naming file.txt, got %v", err)
+	}
+	if content, _ := mockFS.ReadFile("file.txt"); string(content) != "changed content" {
+		t.Errorf("Expected the working tree untouched, got %q", content)
+	}
+	if head, _ := repo.Head(); head == first {
+		t.Error("Expected HEAD to stay at the second save")
+	}
+}
+
+func TestLineEndingNormalization(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"lineEndings": "crlf"}`), 0644)
+
+	binary := []byte("\x00binary\r\ndata\r\n")
+	mockFS.AddTestFile("windows.txt", []byte("line 1\r\nline 2\r\n"))
+	mockFS.AddTestFile("unix.txt", []byte("line 1\nline 2\n"))
+	mockFS.AddTestFile("image.bin", binary)
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Text files are stored with \n, and the conversion is recorded
+	for file, want := range map[string]string{"windows.txt": "line 1\nline 2\n", "unix.txt": "line 1\nline 2\n", "image.bin": string(binary)} {
+		if content, err := repo.getFileContentFromSave(file, first); err != nil || string(content) != want {
+			t.Errorf("Expected %s stored as %q, got %q, %v", file, want, content, err)
+		}
+	}
+	if normalized := repo.normalizedInSave(first); !reflect.DeepEqual(normalized, map[string]bool{"windows.txt": true}) {
+		t.Errorf("Expected only windows.txt recorded as normalized, got %v", normalized)
+	}
+	if clean, err := repo.IsClean(); err != nil || !clean {
+		t.Errorf("Expected \\r\\n endings not to count as changes, got %v, %v", clean, err)
+	}
+
+	// A change of line endings alone is not a change
+	mockFS.AddTestFile("unix.txt", []byte("line 1\r\nline 2\r\n"))
+	if status, err := repo.Status(); err != nil || len(status.Modified) != 0 {
+		t.Errorf("Expected no modified files, got %v, %v", status.Modified, err)
+	}
+	mockFS.AddTestFile("unix.txt", []byte("line 1\nline 2\n"))
+
+	mockFS.AddTestFile("windows.txt", []byte("line 1\r\nline 2 changed\r\n"))
+	second, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Checkout restores the configured endings of converted files only
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Failed to check out first save: %v", err)
+	}
+	for file, want := range map[string]string{"windows.txt": "line 1\r\nline 2\r\n", "unix.txt": "line 1\nline 2\n", "image.bin": string(binary)} {
+		if content, _ := mockFS.ReadFile(file); string(content) != want {
+			t.Errorf("Expected %s checked out as %q, got %q", file, want, content)
+		}
+	}
+
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"lineEndings": "lf"}`), 0644)
+	if err := repo.Checkout(second); err != nil {
+		t.Fatalf("Failed to check out second save: %v", err)
+	}
+	if content, _ := mockFS.ReadFile("windows.txt"); string(content) != "line 1\nline 2 changed\n" {
+		t.Errorf("Expected windows.txt checked out with \\n, got %q", content)
+	}
+
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"lineEndings": "cr"}`), 0644)
+	if _, err := repo.SaveState("Invalid setting"); err == nil || !strings.Contains(err.Error(), "lineEndings") {
+		t.Errorf("Expected an unknown lineEndings setting to be refused, got %v", err)
+	}
+}
+
+func TestConfigValuesAndSetConfig(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	// Without a config file every setting has its default
+	values, err := repo.ConfigValues()
+	if err != nil {
+		t.Fatalf("Failed to list config: %v", err)
+	}
+	want := []ConfigValue{
+		{Key: "maxFileSize", Value: "104857600"},
+		{Key: "maxSaveSize", Value: "1073741824"},
+		{Key: "hashLength", Value: "12"},
+		{Key: "signingKey"},
+		{Key: "lineEndings"},
+		{Key: "maxStashes", Value: "10"},
+		{Key: "author"},
+		{Key: "host"},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Expected the defaults %v, got %v", want, values)
+	}
+
+	// Settings are written with their type, keeping those already in the file
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"signingKey": "secret"}`), 0644)
+	if err := repo.SetConfig("hashLength", "16"); err != nil {
+		t.Fatalf("Failed to set hashLength: %v", err)
+	}
+	config, err := repo.loadConfig()
+	if err != nil || config.HashLength != 16 || config.SigningKey != "secret" {
+		t.Errorf("Expected hashLength 16 and the signing key kept, got %+v, %v", config, err)
+	}
+	values, _ = repo.ConfigValues()
+	if values[2] != (ConfigValue{Key: "hashLength", Value: "16", Set: true}) {
+		t.Errorf("Expected hashLength listed as set to 16, got %+v", values[2])
+	}
+	if values[3].Value != hiddenConfigValue {
+		t.Errorf("Expected the signing key hidden, got %q", values[3].Value)
+	}
+
+	// Invalid values are refused without touching the file
+	before, _ := mockFS.ReadFile(repo.bitPath(configFile))
+	for _, setting := range [][2]string{{"hashLength", "2"}, {"hashLength", "twelve"}, {"maxStashes", "-1"}, {"lineEndings", "cr"}, {"unknown", "1"}} {
+		if err := repo.SetConfig(setting[0], setting[1]); err == nil || !strings.Contains(err.Error(), setting[0]) {
+			t.Errorf("Expected %s %s to be refused, got %v", setting[0], setting[1], err)
+		}
+	}
+	if after, _ := mockFS.ReadFile(repo.bitPath(configFile)); !bytes.Equal(before, after) {
+		t.Errorf("Expected config.json unchanged, got %s", after)
+	}
+
+	// Unsetting a setting restores its default
+	if err := repo.UnsetConfig("hashLength"); err != nil {
+		t.Fatalf("Failed to unset hashLength: %v", err)
+	}
+	if config, _ := repo.loadConfig(); config.HashLength != DefaultConfig().HashLength {
+		t.Errorf("Expected the default hashLength, got %d", config.HashLength)
+	}
+}
+
+func TestSaveAndCheckoutEmptyFiles(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	// The mock filesystem reads files added with nil content back as nil
+	versions := []map[string][]byte{
+		{"empty.txt": nil, "blank.txt": []byte(" \n\t\n"), "file.txt": []byte("content")},
+		{"empty.txt": []byte("filled"), "blank.txt": []byte{}, "file.txt": nil},
+		{"empty.txt": []byte{}, "blank.txt": []byte("\n"), "file.txt": []byte(" ")},
+	}
+	var hashes []string
+	for i, files := range versions {
+		for name, content := range files {
+			mockFS.AddTestFile(name, content)
+		}
+		hash, err := repo.SaveState(fmt.Sprintf("Save %d", i))
+		if err != nil {
+			t.Fatalf("Failed to create save %d: %v", i, err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	// Empty files are kept in every save, in any checkout order
+	for _, i := range []int{0, 2, 1, 0, 1, 2} {
+		if err := repo.Checkout(hashes[i]); err != nil {
+			t.Fatalf("Failed to check out save %d: %v", i, err)
+		}
+		for name, want := range versions[i] {
+			content, err := mockFS.ReadFile(name)
+			if err != nil {
+				t.Errorf("Save %d: expected %s to exist: %v", i, name, err)
+				continue
+			}
+			if !bytes.Equal(content, want) {
+				t.Errorf("Save %d: expected %s to hold %q, got %q", i, name, want, content)
+			}
+			stored, err := repo.getFileContentFromSave(name, hashes[i])
+			if err != nil || stored == nil || !bytes.Equal(stored, want) {
+				t.Errorf("Save %d: expected stored %s to be %q, got %q (nil: %v), %v", i, name, want, stored, stored == nil, err)
+			}
+		}
+		if clean, err := repo.IsClean(); err != nil || !clean {
+			t.Errorf("Save %d: expected a clean working tree after checkout, got %v, %v", i, clean, err)
+		}
+	}
+
+	// Deleting an empty file is recorded as a deletion
+	mockFS.Remove("empty.txt")
+	hash, err := repo.SaveState("Deleted empty file")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	saves, _ := repo.ListSaves()
+	if containsFile(saves[len(saves)-1].Files, "empty.txt") {
+		t.Errorf("Expected empty.txt deleted in save %s", hash)
+	}
+	if issues, err := repo.VerifyIntegrity(); err != nil || len(issues) != 0 {
+		t.Errorf("Expected every save to verify, got %v, %v", issues, err)
+	}
+}
+
+func TestCheckoutRestoresModificationTimes(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	built := time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.UTC)
+	mockFS.AddTestFile("main.go", []byte("package main\n"))
+	mockFS.AddTestFile("main.o", []byte("object code\n"))
+	for _, file := range []string{"main.go", "main.o"} {
+		if err := mockFS.Chtimes(file, time.Time{}, built); err != nil {
+			t.Fatalf("Failed to set modification time: %v", err)
+		}
+	}
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Touching a file alone is not a change
+	if err := mockFS.Chtimes("main.o", time.Time{}, time.Now()); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+	if clean, err := repo.IsClean(); err != nil || !clean {
+		t.Errorf("Expected a new modification time not to count as a change, got %v, %v", clean, err)
+	}
+
+	mockFS.AddTestFile("main.go", []byte("package main\n\nfunc main() {}\n"))
+	if _, err := repo.SaveState("Second save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Both the file stored in full and the one stored as a delta get the time
+	// they had when they were saved back
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Failed to check out first save: %v", err)
+	}
+	for _, file := range []string{"main.go", "main.o"} {
+		if info, err := mockFS.Stat(file); err != nil || !info.ModTime().Equal(built) {
+			t.Errorf("Expected %s to be modified at %v, got %v", file, built, info.ModTime())
+		}
+	}
+
+	if err := repo.CheckoutInto(first, "/elsewhere"); err != nil {
+		t.Fatalf("Failed to check out into another directory: %v", err)
+	}
+	if info, err := mockFS.Stat("/elsewhere/main.go"); err != nil || !info.ModTime().Equal(built) {
+		t.Errorf("Expected the copy of main.go to be modified at %v, got %v, %v", built, info, err)
+	}
+}
+
+func TestRewrittenSavesKeepModificationTimes(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	versions := []string{"line 0\n", "line 0\nline 1\n", "line 0\nline 1\nline 2\n", "line 3\n"}
+	var hashes []string
+	var times []time.Time
+	for i, version := range versions {
+		modTime := time.Date(2024, 3, i+1, 12, 0, 0, 0, time.UTC)
+		mockFS.AddTestFile("main.go", []byte(version))
+		mockFS.AddTestFile("drop.txt", []byte(fmt.Sprintf("drop %d\n", i)))
+		if err := mockFS.Chtimes("main.go", time.Time{}, modTime); err != nil {
+			t.Fatalf("Failed to set modification time: %v", err)
+		}
+		hash, err := repo.SaveState(fmt.Sprintf("Save %d", i))
+		if err != nil {
+			t.Fatalf("Failed to create save %d: %v", i, err)
+		}
+		hashes = append(hashes, hash)
+		times = append(times, modTime)
+	}
+	checkOut := func(hash string, want time.Time) {
+		t.Helper()
+		if err := repo.Checkout(hash); err != nil {
+			t.Fatalf("Failed to check out %s: %v", hash, err)
+		}
+		if info, err := mockFS.Stat("main.go"); err != nil || !info.ModTime().Equal(want) {
+			t.Errorf("Expected main.go to be modified at %v, got %v, %v", want, info.ModTime(), err)
+		}
+	}
+
+	// Repacked deltas keep the recorded times
+	if rewritten, err := repo.RepackDeltas("main.go"); err != nil || rewritten == 0 {
+		t.Fatalf("Expected deltas to be repacked, got %d, %v", rewritten, err)
+	}
+	for i, hash := range hashes {
+		checkOut(hash, times[i])
+	}
+
+	// So do saves made from the content of another save, and archives
+	removed, err := repo.RemoveAndSave("drop.txt", "Remove drop.txt")
+	if err != nil {
+		t.Fatalf("Failed to remove and save: %v", err)
+	}
+	squashed, err := repo.Squash(hashes[1], removed)
+	if err != nil {
+		t.Fatalf("Failed to squash: %v", err)
+	}
+	checkOut(hashes[0], times[0])
+	checkOut(squashed, times[len(times)-1])
+
+	var archive bytes.Buffer
+	if err := repo.ExportTar(squashed, &archive); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	imported, err := repo.ImportTar("Imported", &archive)
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if modTime := repo.modTimesInSave(imported)["main.go"]; !modTime.Equal(times[len(times)-1]) {
+		t.Errorf("Expected the imported main.go to keep its modification time, got %v", modTime)
+	}
+}
+
+func TestSaveAndCheckoutSpecialFileNames(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	files := []string{"my file (1).txt", "naïve café ☕.txt", "dir with space/🎉 emoji.md", ".hidden dir/.dotfile", "#50% off_sale.txt", "tab\tname.txt"}
+	for _, file := range files {
+		mockFS.AddTestFile(file, []byte("first "+file+"\n"))
+	}
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	for _, file := range files {
+		mockFS.AddTestFile(file, []byte("first "+file+"\nsecond\n"))
+	}
+	second, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Every name is recorded as given, and both the full first version and
+	// the delta of the second read back
+	saved, err := repo.SaveFiles(first)
+	if err != nil {
+		t.Fatalf("Failed to list files: %v", err)
+	}
+	for _, file := range files {
+		if !containsFile(saved, file) {
+			t.Errorf("Expected %q in the save, got %q", file, saved)
+		}
+		if history, err := repo.FileHistory(file); err != nil || len(history) != 2 {
+			t.Errorf("Expected two changes to %q, got %v, %v", file, history, err)
+		}
+	}
+
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Failed to check out first save: %v", err)
+	}
+	for _, file := range files {
+		if content, err := mockFS.ReadFile(file); err != nil || string(content) != "first "+file+"\n" {
+			t.Errorf("Expected %q restored from the first save, got %q, %v", file, content, err)
+		}
+	}
+	if err := repo.Checkout(second); err != nil {
+		t.Fatalf("Failed to check out second save: %v", err)
+	}
+	for _, file := range files {
+		if content, err := mockFS.ReadFile(file); err != nil || string(content) != "first "+file+"\nsecond\n" {
+			t.Errorf("Expected %q restored from the second save, got %q, %v", file, content, err)
+		}
+	}
+	if clean, err := repo.IsClean(); err != nil || !clean {
+		t.Errorf("Expected no changes after checkout, got %v, %v", clean, err)
+	}
+}
+
 func TestListSaves(t *testing.T) {
 	// Create mock filesystem with test files
 	mockFS := NewMockFSWithTestFiles()
@@ -378,3 +820,5050 @@ func TestListSaves(t *testing.T) {
 		}
 	}
 }
+
+func TestSaveStateParallelMatchesSerial(t *testing.T) {
+	// saveTwice creates two saves over many files using the given worker count
+	// and returns the resulting delta sets
+	saveTwice := func(workers int) []util.DeltaSet {
+		previous := saveWorkers
+		saveWorkers = workers
+		defer func() { saveWorkers = previous }()
+
+		mockFS := NewMockFSWithTestFiles()
+		repo := NewRepository(mockFS)
+		if err := repo.InitRepository(); err != nil {
+			t.Fatalf("Failed to initialize repository: %v", err)
+		}
+
+		for i := 0; i < 200; i++ {
+			mockFS.AddTestFile(fmt.Sprintf("dir%d/file%d.txt", i%7, i), []byte(fmt.Sprintf("content of file %d", i)))
+		}
+		hash1, err := repo.SaveState("First save")
+		if err != nil {
+			t.Fatalf("Failed to create first save: %v", err)
+		}
+
+		for i := 0; i < 200; i += 3 {
+			mockFS.AddTestFile(fmt.Sprintf("dir%d/file%d.txt", i%7, i), []byte(fmt.Sprintf("modified content of file %d", i)))
+		}
+		hash2, err := repo.SaveState("Second save")
+		if err != nil {
+			t.Fatalf("Failed to create second save: %v", err)
+		}
+
+		var sets []util.DeltaSet
+		for _, hash := range []string{hash1, hash2} {
+			deltaSet, err := repo.loadDeltaSet(hash)
+			if err != nil {
+				t.Fatalf("Failed to load delta set: %v", err)
+			}
+			sets = append(sets, deltaSet)
+		}
+		return sets
+	}
+
+	serial := saveTwice(1)
+	parallel := saveTwice(8)
+
+	for i := range serial {
+		if len(serial[i].Deltas) != len(parallel[i].Deltas) {
+			t.Fatalf("Save %d: expected %d deltas, got %d", i, len(serial[i].Deltas), len(parallel[i].Deltas))
+		}
+		for j, expected := range serial[i].Deltas {
+			actual := parallel[i].Deltas[j]
+			if expected.Path != actual.Path ||
+				expected.ContentHash != actual.ContentHash ||
+				expected.IsNew != actual.IsNew ||
+				expected.IsDeleted != actual.IsDeleted ||
+				len(expected.Patches) != len(actual.Patches) {
+				t.Errorf("Save %d delta %d differs: serial %+v, parallel %+v", i, j, expected, actual)
+			}
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("version 1"))
+	hash1, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create first save: %v", err)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("version 2"))
+	if _, err := repo.SaveState("Second save"); err != nil {
+		t.Fatalf("Failed to create second save: %v", err)
+	}
+
+	// Tag the first save using a hash prefix
+	if err := repo.AddTag(hash1[:6], "release-1"); err != nil {
+		t.Fatalf("Failed to add tag: %v", err)
+	}
+
+	// Duplicate tag names are rejected
+	if err := repo.AddTag(hash1, "release-1"); err == nil {
+		t.Error("Expected error when adding a duplicate tag")
+	}
+
+	// Tag names that look like hashes are rejected
+	if err := repo.AddTag(hash1, "abc123"); err == nil {
+		t.Error("Expected error when adding a hash-like tag name")
+	}
+
+	tags, err := repo.ListTags()
+	if err != nil {
+		t.Fatalf("Failed to list tags: %v", err)
+	}
+	if len(tags) != 1 || tags[0].Name != "release-1" || tags[0].Hash != hash1 {
+		t.Errorf("Unexpected tags: %+v", tags)
+	}
+
+	// Checkout by tag restores the tagged save
+	if err := repo.Checkout("release-1"); err != nil {
+		t.Fatalf("Failed to checkout tag: %v", err)
+	}
+	content, err := mockFS.ReadFile("file.txt")
+	if err != nil {
+		t.Fatalf("Failed to read file.txt: %v", err)
+	}
+	if string(content) != "version 1" {
+		t.Errorf("Expected file.txt to contain 'version 1', got '%s'", string(content))
+	}
+
+	// Removing the tag makes it unresolvable
+	if err := repo.RemoveTag("release-1"); err != nil {
+		t.Fatalf("Failed to remove tag: %v", err)
+	}
+	if err := repo.Checkout("release-1"); err == nil {
+		t.Error("Expected error when checking out a removed tag")
+	}
+	if err := repo.RemoveTag("release-1"); err == nil {
+		t.Error("Expected error when removing a missing tag")
+	}
+}
+
+func TestSaveAndCheckoutFromNestedDirectory(t *testing.T) {
+	root := t.TempDir()
+	fs := util.NewOsFileSystem()
+
+	if err := NewRepositoryAt(fs, root).InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	nested := filepath.Join(root, "src", "nested")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatalf("Failed to create nested directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "top.txt"), []byte("top v1"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(nested, "deep.txt"), []byte("deep v1"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	// Open the repository from the nested directory
+	repo, err := OpenRepository(fs, nested)
+	if err != nil {
+		t.Fatalf("Failed to open repository from nested directory: %v", err)
+	}
+
+	hash, err := repo.SaveState("From nested")
+	if err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	// Saved paths are relative to the repository root
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	expected := map[string]bool{"top.txt": true, "src/nested/deep.txt": true}
+	if len(saves[0].Files) != len(expected) {
+		t.Fatalf("Expected files %v, got %v", expected, saves[0].Files)
+	}
+	for _, file := range saves[0].Files {
+		if !expected[file] {
+			t.Errorf("Unexpected saved path %s", file)
+		}
+	}
+
+	// No repository data should have been created in the nested directory
+	if _, err := os.Stat(filepath.Join(nested, ".bit")); !os.IsNotExist(err) {
+		t.Error("Expected no .bit directory in the nested directory")
+	}
+
+	// Modify and checkout from the nested directory again
+	if err := os.WriteFile(filepath.Join(nested, "deep.txt"), []byte("deep v2"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := repo.Checkout(hash); err != nil {
+		t.Fatalf("Failed to checkout: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(nested, "deep.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read restored file: %v", err)
+	}
+	if string(content) != "deep v1" {
+		t.Errorf("Expected 'deep v1', got '%s'", string(content))
+	}
+}
+
+func TestExportTar(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("version 1"))
+	mockFS.AddTestFile("src/pkg/code.go", []byte("package pkg"))
+	hash1, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create first save: %v", err)
+	}
+
+	// Modify a file so the exported save requires delta reconstruction to differ
+	mockFS.AddTestFile("file.txt", []byte("version 2"))
+	hash2, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create second save: %v", err)
+	}
+
+	for hash, expected := range map[string]map[string]string{
+		hash1: {"file.txt": "version 1", "src/pkg/code.go": "package pkg"},
+		hash2: {"file.txt": "version 2", "src/pkg/code.go": "package pkg"},
+	} {
+		var buf bytes.Buffer
+		if err := repo.ExportTar(hash, &buf); err != nil {
+			t.Fatalf("Failed to export save %s: %v", hash, err)
+		}
+
+		files := make(map[string]string)
+		dirs := make(map[string]bool)
+		tr := tar.NewReader(&buf)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Failed to read tar entry: %v", err)
+			}
+			if util.IsBitDirectory(header.Name) {
+				t.Errorf("Unexpected .bit entry %s in archive", header.Name)
+			}
+			if header.Typeflag == tar.TypeDir {
+				dirs[header.Name] = true
+				continue
+			}
+
+			// Directories must be emitted before the files they contain
+			if dir := filepath.Dir(header.Name); dir != "." && !dirs[dir+"/"] {
+				t.Errorf("Directory %s not emitted before %s", dir, header.Name)
+			}
+
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("Failed to read tar content: %v", err)
+			}
+			files[header.Name] = string(content)
+		}
+
+		if len(files) != len(expected) {
+			t.Errorf("Expected %d files in archive, got %d: %v", len(expected), len(files), files)
+		}
+		for path, content := range expected {
+			if files[path] != content {
+				t.Errorf("Expected %s to contain '%s', got '%s'", path, content, files[path])
+			}
+		}
+	}
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.AddTestFile("file.txt", []byte("version 1"))
+	mockFS.AddTestFile("docs/notes.md", []byte("notes"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	mockFS.AddTestFile("file.txt", []byte("version 2"))
+	second, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	if err := repo.AddTag(first, "v1"); err != nil {
+		t.Fatalf("Failed to tag save: %v", err)
+	}
+
+	// Checking out over unsaved changes stashes them; the stash stays behind
+	mockFS.AddTestFile("file.txt", []byte("unsaved"))
+	if err := repo.Checkout(second); err != nil {
+		t.Fatalf("Failed to check out: %v", err)
+	}
+	stashes, err := repo.Stashes()
+	if err != nil || len(stashes) != 1 {
+		t.Fatalf("Expected one stash, got %v, %v", stashes, err)
+	}
+
+	var bundle bytes.Buffer
+	if err := repo.Bundle(&bundle); err != nil {
+		t.Fatalf("Bundle failed: %v", err)
+	}
+	entries := tar.NewReader(bytes.NewReader(bundle.Bytes()))
+	for {
+		header, err := entries.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read bundle: %v", err)
+		}
+		content, _ := io.ReadAll(entries)
+		if strings.Contains(header.Name, stashes[0].Save.Hash) || bytes.Contains(content, []byte("unsaved")) {
+			t.Errorf("Expected the stash to be left out of the bundle, found %s", header.Name)
+		}
+	}
+
+	// Unbundle into a filesystem that has never seen the repository
+	freshFS := util.NewMockFileSystem()
+	fresh := NewRepository(freshFS)
+	if err := fresh.Unbundle(bytes.NewReader(bundle.Bytes())); err != nil {
+		t.Fatalf("Unbundle failed: %v", err)
+	}
+
+	saves, err := fresh.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if len(saves) != 2 || saves[0].Hash != first || saves[1].Hash != second {
+		t.Fatalf("Expected saves %s and %s, got %v", first, second, saves)
+	}
+	if err := fresh.Checkout("v1"); err != nil {
+		t.Fatalf("Failed to check out unbundled save: %v", err)
+	}
+	for file, want := range map[string]string{"file.txt": "version 1", "docs/notes.md": "notes"} {
+		if content, err := freshFS.ReadFile(file); err != nil || string(content) != want {
+			t.Errorf("Expected %s to hold %q, got %q, %v", file, want, content, err)
+		}
+	}
+
+	// A repository is never unbundled over an existing one
+	if err := fresh.Unbundle(bytes.NewReader(bundle.Bytes())); err == nil {
+		t.Error("Expected unbundling into an existing repository to fail")
+	}
+
+	// A corrupt object is caught and leaves no repository behind
+	var corrupt bytes.Buffer
+	tr := tar.NewReader(bytes.NewReader(bundle.Bytes()))
+	tw := tar.NewWriter(&corrupt)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read bundle: %v", err)
+		}
+		content, _ := io.ReadAll(tr)
+		if strings.HasPrefix(header.Name, "objects/blobs/") {
+			content = []byte("tampered")
+			header.Size = int64(len(content))
+		}
+		tw.WriteHeader(header)
+		tw.Write(content)
+	}
+	tw.Close()
+
+	otherFS := util.NewMockFileSystem()
+	other := NewRepository(otherFS)
+	if err := other.Unbundle(&corrupt); err == nil || !strings.Contains(err.Error(), "bundle is corrupt") {
+		t.Errorf("Expected a corrupt bundle to be refused, got %v", err)
+	}
+	if otherFS.Exists(".bit") {
+		t.Error("Expected no repository left after a failed unbundle")
+	}
+	if err := other.Unbundle(strings.NewReader("not a bundle")); err == nil {
+		t.Error("Expected a file that is not a bundle to be refused")
+	}
+}
+
+func TestImportTarRoundTrip(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("version 1"))
+	mockFS.AddTestFile("src/code.go", []byte("package src"))
+	hash1, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create first save: %v", err)
+	}
+
+	// Export the save and import it back as a new save
+	var buf bytes.Buffer
+	if err := repo.ExportTar(hash1, &buf); err != nil {
+		t.Fatalf("Failed to export save: %v", err)
+	}
+
+	// Change the working tree to confirm import does not read or write it
+	mockFS.AddTestFile("file.txt", []byte("working tree edit"))
+
+	hash2, err := repo.ImportTar("Imported", &buf)
+	if err != nil {
+		t.Fatalf("Failed to import archive: %v", err)
+	}
+
+	content, err := mockFS.ReadFile("file.txt")
+	if err != nil {
+		t.Fatalf("Failed to read file.txt: %v", err)
+	}
+	if string(content) != "working tree edit" {
+		t.Errorf("Expected working tree to be untouched, got '%s'", string(content))
+	}
+
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if len(saves) != 2 || saves[1].Hash != hash2 || saves[1].Name != "Imported" {
+		t.Fatalf("Expected imported save to be appended, got %+v", saves)
+	}
+	if saves[1].BaseSaveHash != hash1 {
+		t.Errorf("Expected imported save to be based on %s, got %s", hash1, saves[1].BaseSaveHash)
+	}
+
+	for path, expected := range map[string]string{"file.txt": "version 1", "src/code.go": "package src"} {
+		content, err := repo.getFileContentFromSave(path, hash2)
+		if err != nil {
+			t.Fatalf("Failed to read %s from imported save: %v", path, err)
+		}
+		if string(content) != expected {
+			t.Errorf("Expected %s to contain '%s', got '%s'", path, expected, string(content))
+		}
+	}
+}
+
+func TestSaveFromSyntheticContentSource(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	// Content is generated on demand and never exists in the working tree
+	generated := func(path string) ([]byte, error) {
+		return []byte("generated content for " + path), nil
+	}
+	files := []string{"gen/b.txt", "gen/a.txt"}
+
+	hash, err := repo.createSave(repo.newOperation(), "Synthetic", snapshot{files: files}, generated)
+	if err != nil {
+		t.Fatalf("Failed to save from synthetic source: %v", err)
+	}
+
+	for _, file := range files {
+		if mockFS.Exists(file) {
+			t.Errorf("Expected %s not to be written to the working tree", file)
+		}
+
+		content, err := repo.getFileContentFromSave(file, hash)
+		if err != nil {
+			t.Fatalf("Failed to read %s from save: %v", file, err)
+		}
+		if string(content) != "generated content for "+file {
+			t.Errorf("Unexpected content for %s: '%s'", file, string(content))
+		}
+	}
+
+	// Errors from the source abort the save without recording it
+	failing := func(path string) ([]byte, error) {
+		return nil, fmt.Errorf("source unavailable")
+	}
+	if _, err := repo.createSave(repo.newOperation(), "Broken", snapshot{files: files}, failing); err == nil {
+		t.Error("Expected error when the content source fails")
+	}
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if len(saves) != 1 {
+		t.Errorf("Expected 1 save, got %d", len(saves))
+	}
+}
+
+func TestContentAddressedBlobs(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	shared := []byte("the same large content stored across saves")
+	mockFS.AddTestFile("first.txt", shared)
+	hash1, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create first save: %v", err)
+	}
+
+	// A new file with identical content in a later save reuses the blob
+	mockFS.AddTestFile("second.txt", shared)
+	hash2, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create second save: %v", err)
+	}
+
+	blobs := 0
+	for path := range mockFS.Files {
+		if filepath.Dir(path) == filepath.Join(repo.objectsDir, "blobs") {
+			blobs++
+		}
+	}
+	if blobs != 1 {
+		t.Errorf("Expected exactly 1 blob on disk, got %d", blobs)
+	}
+
+	for _, check := range []struct{ file, hash string }{
+		{"first.txt", hash1},
+		{"first.txt", hash2},
+		{"second.txt", hash2},
+	} {
+		content, err := repo.getFileContentFromSave(check.file, check.hash)
+		if err != nil {
+			t.Fatalf("Failed to read %s from save %s: %v", check.file, check.hash, err)
+		}
+		if !bytes.Equal(content, shared) {
+			t.Errorf("Unexpected content for %s in save %s: '%s'", check.file, check.hash, string(content))
+		}
+	}
+}
+
+func TestLegacyFullFileObjects(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	// Simulate a save written before content addressing: a <saveHash>_<path>
+	// object and no blob reference
+	legacyHash := "0123456789ab"
+	if err := util.SaveFullFile([]byte("legacy content"), "old.txt", legacyHash, repo.objectsDir, mockFS); err != nil {
+		t.Fatalf("Failed to write legacy object: %v", err)
+	}
+	metadata := Metadata{Saves: []Save{{Hash: legacyHash, Name: "Legacy", Timestamp: time.Now(), Files: []string{"old.txt"}}}}
+	if err := repo.saveMetadata(metadata); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+
+	content, err := repo.getFileContentFromSave("old.txt", legacyHash)
+	if err != nil {
+		t.Fatalf("Failed to read legacy object: %v", err)
+	}
+	if string(content) != "legacy content" {
+		t.Errorf("Expected 'legacy content', got '%s'", string(content))
+	}
+
+	// New saves can build deltas on top of the legacy save
+	mockFS.AddTestFile("old.txt", []byte("legacy content, edited"))
+	hash, err := repo.SaveState("Modern")
+	if err != nil {
+		t.Fatalf("Failed to save on top of legacy save: %v", err)
+	}
+	content, err = repo.getFileContentFromSave("old.txt", hash)
+	if err != nil {
+		t.Fatalf("Failed to read new save: %v", err)
+	}
+	if string(content) != "legacy content, edited" {
+		t.Errorf("Expected 'legacy content, edited', got '%s'", string(content))
+	}
+}
+
+// buildDeltaChain creates a repository with one file edited across the given number of saves
+func buildDeltaChain(tb testing.TB, depth int) (*Repository, []string) {
+	tb.Helper()
+
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+	if err := repo.InitRepository(); err != nil {
+		tb.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	var hashes []string
+	content := "line 0\n"
+	for i := 0; i < depth; i++ {
+		content += fmt.Sprintf("line %d\n", i+1)
+		mockFS.AddTestFile("file.txt", []byte(content))
+		hash, err := repo.SaveState(fmt.Sprintf("Save %d", i))
+		if err != nil {
+			tb.Fatalf("Failed to create save %d: %v", i, err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	return repo, hashes
+}
+
+func TestOperationMemoizesReconstruction(t *testing.T) {
+	repo, hashes := buildDeltaChain(t, 20)
+
+	// Reconstructing every version separately replays the chain each time
+	uncached := 0
+	for _, hash := range hashes {
+		op := repo.newOperation()
+		if _, err := op.fileContent("file.txt", hash); err != nil {
+			t.Fatalf("Failed to reconstruct file: %v", err)
+		}
+		uncached += op.reconstructions
+	}
+
+	// Within one operation each version is reconstructed exactly once
+	op := repo.newOperation()
+	for i := len(hashes) - 1; i >= 0; i-- {
+		content, err := op.fileContent("file.txt", hashes[i])
+		if err != nil {
+			t.Fatalf("Failed to reconstruct file: %v", err)
+		}
+		if !bytes.HasSuffix(content, []byte(fmt.Sprintf("line %d\n", i+1))) {
+			t.Errorf("Unexpected content at save %d: %q", i, content)
+		}
+	}
+
+	if op.reconstructions != len(hashes) {
+		t.Errorf("Expected %d reconstructions within one operation, got %d", len(hashes), op.reconstructions)
+	}
+	if op.reconstructions >= uncached {
+		t.Errorf("Expected memoization to reduce reconstructions, got %d cached vs %d uncached", op.reconstructions, uncached)
+	}
+}
+
+func TestReconstructVeryDeepDeltaChain(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	// The delta policy keeps the file as deltas past the chain limit
+	const depth = 200
+	mockFS.AddTestFile(".bitattributes", []byte("file.txt delta\n"))
+	var hashes []string
+	var versions []string
+	for i := 0; i < depth; i++ {
+		content := fmt.Sprintf("header\nversion %d\nfooter\n", i)
+		mockFS.AddTestFile("file.txt", []byte(content))
+		hash, err := repo.SaveState(fmt.Sprintf("Save %d", i))
+		if err != nil {
+			t.Fatalf("Failed to create save %d: %v", i, err)
+		}
+		hashes = append(hashes, hash)
+		versions = append(versions, content)
+	}
+
+	report, err := repo.DeltaDepths(hashes[depth-1])
+	if err != nil {
+		t.Fatalf("Failed to get delta depths: %v", err)
+	}
+	for _, file := range report.Files {
+		if file.Path == "file.txt" && file.Depth != depth-1 {
+			t.Fatalf("Expected a chain of %d deltas, got %d", depth-1, file.Depth)
+		}
+	}
+
+	// The tip and every version on the way match what was saved
+	op := repo.newOperation()
+	if got, err := op.fileContent("file.txt", hashes[depth-1]); err != nil || string(got) != versions[depth-1] {
+		t.Fatalf("Failed to reconstruct the tip of the chain: %v", err)
+	}
+	if op.reconstructions != depth {
+		t.Errorf("Expected each version to be rebuilt once, got %d reconstructions", op.reconstructions)
+	}
+	for i, hash := range hashes {
+		if got, err := op.fileContent("file.txt", hash); err != nil || string(got) != versions[i] {
+			t.Fatalf("Unexpected content at save %d: %v", i, err)
+		}
+	}
+	if op.reconstructions != depth {
+		t.Errorf("Expected the versions on the way to be remembered, got %d reconstructions", op.reconstructions)
+	}
+
+	// A corrupt chain leading back to itself is reported instead of followed forever
+	err = repo.rewriteDeltaSet(hashes[depth-1], func(delta *util.DeltaInfo) {
+		if delta.Path == "file.txt" {
+			delta.BaseSaveHash = hashes[depth-1]
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to rewrite delta set: %v", err)
+	}
+	if _, err := repo.getFileContentFromSave("file.txt", hashes[depth-1]); err == nil || !strings.Contains(err.Error(), "loops") {
+		t.Errorf("Expected a looping chain to be reported, got %v", err)
+	}
+}
+
+// readCountingFileSystem counts how often each path is read
+type readCountingFileSystem struct {
+	util.FileSystem
+	mutex sync.Mutex
+	reads map[string]int
+}
+
+func (fs *readCountingFileSystem) ReadFile(name string) ([]byte, error) {
+	fs.mutex.Lock()
+	fs.reads[filepath.ToSlash(name)]++
+	fs.mutex.Unlock()
+	return fs.FileSystem.ReadFile(name)
+}
+
+func TestOperationIndexesDeltaSetsAndSaves(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	fs := &readCountingFileSystem{FileSystem: mockFS, reads: make(map[string]int)}
+	repo := NewRepository(fs)
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	files := []string{"a.txt", "b.txt", "c.txt"}
+	var hashes []string
+	for i := 0; i < 10; i++ {
+		for _, file := range files {
+			mockFS.AddTestFile(file, []byte(strings.Repeat(file+"\n", i+1)))
+		}
+		hash, err := repo.SaveState(fmt.Sprintf("Save %d", i))
+		if err != nil {
+			t.Fatalf("Failed to create save %d: %v", i, err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	// Every file walks the same chain, but each delta set is read once
+	fs.reads = make(map[string]int)
+	op := repo.newOperation()
+	for _, file := range files {
+		if content, err := op.fileContent(file, hashes[len(hashes)-1]); err != nil || string(content) != strings.Repeat(file+"\n", 10) {
+			t.Fatalf("Unexpected content of %s: %q, %v", file, content, err)
+		}
+	}
+	for _, hash := range hashes {
+		if reads := fs.reads[filepath.ToSlash(util.DeltaSetPath(hash, repo.objectsDir))]; reads > 1 {
+			t.Errorf("Expected the delta set of %s to be read at most once, got %d reads", hash, reads)
+		}
+	}
+	if reads := fs.reads[filepath.ToSlash(repo.metadataFile)]; reads != 0 {
+		t.Errorf("Expected reconstruction not to read the metadata, got %d reads", reads)
+	}
+
+	// Looking up saves that do not exist loads the metadata only once
+	for _, file := range files {
+		if _, err := op.fileContent(file, "ffffffffffff"); err == nil || !strings.Contains(err.Error(), "not found") {
+			t.Errorf("Expected a missing save to be reported, got %v", err)
+		}
+	}
+	if reads := fs.reads[filepath.ToSlash(repo.metadataFile)]; reads != 1 {
+		t.Errorf("Expected the metadata to be read once, got %d reads", reads)
+	}
+}
+
+// createCountingFileSystem counts how often each path is created. Creating a
+// file is slowed down so that concurrent writes of one path overlap.
+type createCountingFileSystem struct {
+	util.FileSystem
+	mutex   sync.Mutex
+	creates map[string]int
+}
+
+func (fs *createCountingFileSystem) Create(name string) (util.File, error) {
+	fs.mutex.Lock()
+	fs.creates[filepath.ToSlash(name)]++
+	fs.mutex.Unlock()
+	time.Sleep(time.Millisecond)
+	return fs.FileSystem.Create(name)
+}
+
+func TestSaveWritesIdenticalContentOnce(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	fs := &createCountingFileSystem{FileSystem: mockFS, creates: make(map[string]int)}
+	repo := NewRepository(fs)
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	// Every worker stores a copy of the same content at the same time
+	defer func(workers int) { saveWorkers = workers }(saveWorkers)
+	saveWorkers = 8
+	content := []byte(strings.Repeat("identical content\n", 100))
+	files := []string{"a.txt", "b.txt", "c.txt", "d.txt", "dir/e.txt", "dir/f.txt", "g.txt", "h.txt"}
+	for _, file := range files {
+		mockFS.AddTestFile(file, content)
+	}
+	hash, err := repo.SaveState("Copies")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	blobPath := filepath.ToSlash(util.BlobPath(util.CalculateFileHash(content), repo.objectsDir))
+	if creates := fs.creates[blobPath]; creates != 1 {
+		t.Errorf("Expected the shared blob to be written once, got %d writes", creates)
+	}
+	blobs := 0
+	for path, creates := range fs.creates {
+		if strings.HasPrefix(path, filepath.ToSlash(filepath.Join(repo.objectsDir, "blobs"))) {
+			blobs += creates
+		}
+	}
+	if blobs != 1 {
+		t.Errorf("Expected a single blob to be written, got %d", blobs)
+	}
+
+	for _, file := range files {
+		if got, err := repo.getFileContentFromSave(file, hash); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("Expected %s to read back the shared content, got %q, %v", file, got, err)
+		}
+	}
+	if issues, err := repo.VerifyIntegrity(); err != nil || len(issues) != 0 {
+		t.Errorf("Expected the save to verify, got %v, %v", issues, err)
+	}
+}
+
+func BenchmarkChainReconstruction(b *testing.B) {
+	repo, hashes := buildDeltaChain(b, 20)
+
+	b.Run("PerCall", func(b *testing.B) {
+		reconstructions := 0
+		for n := 0; n < b.N; n++ {
+			for _, hash := range hashes {
+				op := repo.newOperation()
+				if _, err := op.fileContent("file.txt", hash); err != nil {
+					b.Fatalf("Failed to reconstruct file: %v", err)
+				}
+				reconstructions += op.reconstructions
+			}
+		}
+		b.ReportMetric(float64(reconstructions)/float64(b.N), "reconstructions/op")
+	})
+
+	b.Run("SingleOperation", func(b *testing.B) {
+		reconstructions := 0
+		for n := 0; n < b.N; n++ {
+			op := repo.newOperation()
+			for _, hash := range hashes {
+				if _, err := op.fileContent("file.txt", hash); err != nil {
+					b.Fatalf("Failed to reconstruct file: %v", err)
+				}
+			}
+			reconstructions += op.reconstructions
+		}
+		b.ReportMetric(float64(reconstructions)/float64(b.N), "reconstructions/op")
+	})
+}
+
+func TestEmptyDirectoriesSurviveCheckout(t *testing.T) {
+	root := t.TempDir()
+	fs := util.NewOsFileSystem()
+	repo := NewRepositoryAt(fs, root)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "empty", "nested"), 0755); err != nil {
+		t.Fatalf("Failed to create empty directory: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "src"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "src", "code.go"), []byte("package src"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	hash, err := repo.SaveState("With empty directory")
+	if err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if len(saves[0].Dirs) != 1 || saves[0].Dirs[0] != "empty/nested" {
+		t.Errorf("Expected only empty/nested to be recorded, got %v", saves[0].Dirs)
+	}
+
+	if err := os.RemoveAll(filepath.Join(root, "empty")); err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+
+	if err := repo.Checkout(hash); err != nil {
+		t.Fatalf("Failed to checkout: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(root, "empty", "nested"))
+	if err != nil {
+		t.Fatalf("Expected empty/nested to be recreated: %v", err)
+	}
+	if !info.IsDir() {
+		t.Error("Expected empty/nested to be a directory")
+	}
+}
+
+func TestSymlinkRoundTrip(t *testing.T) {
+	root := t.TempDir()
+	fs := util.NewOsFileSystem()
+	repo := NewRepositoryAt(fs, root)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "target.txt"), []byte("target content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Symlink("target.txt", filepath.Join(root, "link.txt")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	hash, err := repo.SaveState("With symlink")
+	if err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+
+	// The link target is stored, not the dereferenced content
+	content, err := repo.getFileContentFromSave("link.txt", hash)
+	if err != nil {
+		t.Fatalf("Failed to read link from save: %v", err)
+	}
+	if string(content) != "target.txt" {
+		t.Errorf("Expected stored link target 'target.txt', got '%s'", string(content))
+	}
+	if !repo.symlinksInSave(hash)["link.txt"] {
+		t.Error("Expected link.txt to be flagged as a symlink")
+	}
+
+	// Replace the link with a regular file, then restore
+	if err := os.Remove(filepath.Join(root, "link.txt")); err != nil {
+		t.Fatalf("Failed to remove link: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "link.txt"), []byte("not a link"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if err := repo.Checkout(hash); err != nil {
+		t.Fatalf("Failed to checkout: %v", err)
+	}
+
+	target, err := os.Readlink(filepath.Join(root, "link.txt"))
+	if err != nil {
+		t.Fatalf("Expected link.txt to be restored as a symlink: %v", err)
+	}
+	if target != "target.txt" {
+		t.Errorf("Expected link to point at target.txt, got %s", target)
+	}
+
+	// The link target itself must not have been overwritten
+	data, err := os.ReadFile(filepath.Join(root, "target.txt"))
+	if err != nil {
+		t.Fatalf("Failed to read target: %v", err)
+	}
+	if string(data) != "target content" {
+		t.Errorf("Expected target content to be untouched, got '%s'", string(data))
+	}
+}
+
+func TestRemove(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("keep.txt", []byte("keep"))
+	mockFS.AddTestFile("drop.txt", []byte("drop"))
+	mockFS.AddTestFile("debug.log", []byte("log"))
+	mockFS.AddTestFile(".bitignore", []byte("*.log\n"))
+	if _, err := repo.SaveState("Initial save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Untracked and ignored paths are refused
+	if err := repo.Remove("missing.txt"); err == nil {
+		t.Error("Expected error when removing an untracked file")
+	}
+	if err := repo.Remove("debug.log"); err == nil {
+		t.Error("Expected error when removing an ignored file")
+	}
+	if err := repo.Remove(".bit/metadata.json"); err == nil {
+		t.Error("Expected error when removing a repository file")
+	}
+
+	if err := repo.Remove("drop.txt"); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	if mockFS.Exists("drop.txt") {
+		t.Error("drop.txt should be removed from the working tree")
+	}
+
+	// The next save records the deletion
+	hash, err := repo.SaveState("After removal")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	deltaSet, err := repo.loadDeltaSet(hash)
+	if err != nil {
+		t.Fatalf("Failed to load delta set: %v", err)
+	}
+	deleted := false
+	for _, delta := range deltaSet.Deltas {
+		if delta.Path == "drop.txt" && delta.IsDeleted {
+			deleted = true
+		}
+	}
+	if !deleted {
+		t.Error("Expected drop.txt to be recorded as deleted")
+	}
+}
+
+func TestRemoveAndSave(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("keep.txt", []byte("saved content"))
+	mockFS.AddTestFile("drop.txt", []byte("drop"))
+	if _, err := repo.SaveState("Initial save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Unsaved edits to other files are not part of the removal save
+	mockFS.AddTestFile("keep.txt", []byte("unsaved edit"))
+
+	hash, err := repo.RemoveAndSave("drop.txt", "Remove drop.txt")
+	if err != nil {
+		t.Fatalf("Failed to remove and save: %v", err)
+	}
+	if mockFS.Exists("drop.txt") {
+		t.Error("drop.txt should be removed from the working tree")
+	}
+
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	latest := saves[len(saves)-1]
+	if latest.Hash != hash || len(latest.Files) != 1 || latest.Files[0] != "keep.txt" {
+		t.Errorf("Unexpected save: %+v", latest)
+	}
+
+	content, err := repo.getFileContentFromSave("keep.txt", hash)
+	if err != nil {
+		t.Fatalf("Failed to read keep.txt from save: %v", err)
+	}
+	if string(content) != "saved content" {
+		t.Errorf("Expected saved content, got %q", content)
+	}
+}
+
+func TestListSavesFiltered(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	saveNames := []string{"release 1", "fix", "release 2", "docs", "release 3"}
+	for i, name := range saveNames {
+		mockFS.AddTestFile("file.txt", []byte(fmt.Sprintf("Content %d", i)))
+		if _, err := repo.SaveState(name); err != nil {
+			t.Fatalf("Failed to create save '%s': %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		opts     ListOptions
+		expected []string
+	}{
+		{"zero options list everything", ListOptions{}, saveNames},
+		{"limit", ListOptions{Limit: 2}, []string{"release 1", "fix"}},
+		{"offset and limit", ListOptions{Offset: 1, Limit: 3}, []string{"fix", "release 2", "docs"}},
+		{"limit past the end", ListOptions{Offset: 3, Limit: 10}, []string{"docs", "release 3"}},
+		{"offset at the end", ListOptions{Offset: 5}, nil},
+		{"offset past the end", ListOptions{Offset: 9, Limit: 1}, nil},
+		{"name", ListOptions{Name: "release"}, []string{"release 1", "release 2", "release 3"}},
+		{"name with no match", ListOptions{Name: "Release"}, nil},
+		{"reverse", ListOptions{Reverse: true, Limit: 2}, []string{"release 3", "docs"}},
+		{"everything", ListOptions{Name: "release", Reverse: true, Offset: 1, Limit: 1}, []string{"release 2"}},
+	}
+	for _, test := range tests {
+		saves, err := repo.ListSavesFiltered(test.opts)
+		if err != nil {
+			t.Fatalf("%s: failed to list saves: %v", test.name, err)
+		}
+		var names []string
+		for _, save := range saves {
+			names = append(names, save.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, names)
+		}
+	}
+
+	if _, err := repo.ListSavesFiltered(ListOptions{Limit: -1}); err == nil {
+		t.Error("Expected a negative limit to be refused")
+	}
+}
+
+func TestAncestorsAndChildren(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	var hashes []string
+	for i := 0; i < 3; i++ {
+		mockFS.AddTestFile("file.txt", []byte(fmt.Sprintf("Content %d", i)))
+		hash, err := repo.SaveState(fmt.Sprintf("Save %d", i))
+		if err != nil {
+			t.Fatalf("Failed to create save: %v", err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	saveHashes := func(saves []Save) string {
+		var list []string
+		for _, save := range saves {
+			list = append(list, save.Hash)
+		}
+		return strings.Join(list, ",")
+	}
+
+	tests := []struct {
+		hash      string
+		ancestors []string
+		children  []string
+	}{
+		{hashes[0], nil, []string{hashes[1]}},
+		{hashes[1], []string{hashes[0]}, []string{hashes[2]}},
+		{hashes[2], []string{hashes[1], hashes[0]}, nil},
+	}
+	for _, test := range tests {
+		ancestors, err := repo.Ancestors(test.hash)
+		if err != nil {
+			t.Fatalf("Failed to get ancestors of %s: %v", test.hash, err)
+		}
+		if saveHashes(ancestors) != strings.Join(test.ancestors, ",") {
+			t.Errorf("Expected ancestors %v of %s, got %s", test.ancestors, test.hash, saveHashes(ancestors))
+		}
+		children, err := repo.Children(test.hash)
+		if err != nil {
+			t.Fatalf("Failed to get children of %s: %v", test.hash, err)
+		}
+		if saveHashes(children) != strings.Join(test.children, ",") {
+			t.Errorf("Expected children %v of %s, got %s", test.children, test.hash, saveHashes(children))
+		}
+	}
+
+	// A base missing from the metadata ends the ancestry instead of failing
+	metadata, err := repo.loadMetadata()
+	if err != nil {
+		t.Fatalf("Failed to load metadata: %v", err)
+	}
+	metadata.Saves[1].BaseSaveHash = "missing"
+	if err := repo.saveMetadata(metadata); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+	if ancestors, err := repo.Ancestors(hashes[2]); err != nil || saveHashes(ancestors) != hashes[1] {
+		t.Errorf("Expected only %s as ancestor, got %s, %v", hashes[1], saveHashes(ancestors), err)
+	}
+	if _, err := repo.Ancestors("unknown"); err == nil {
+		t.Error("Expected an unknown save to be reported")
+	}
+}
+
+func TestLogTimeRange(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	for i := 1; i <= 4; i++ {
+		mockFS.AddTestFile("file.txt", []byte(fmt.Sprintf("version %d", i)))
+		if _, err := repo.SaveState(fmt.Sprintf("Day %d", i)); err != nil {
+			t.Fatalf("Failed to create save %d: %v", i, err)
+		}
+	}
+
+	// Spread the saves over consecutive days at noon
+	metadata, err := repo.loadMetadata()
+	if err != nil {
+		t.Fatalf("Failed to load metadata: %v", err)
+	}
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 12, 0, 0, 0, time.UTC) }
+	for i := range metadata.Saves {
+		metadata.Saves[i].Timestamp = day(i + 1)
+	}
+	if err := repo.saveMetadata(metadata); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		since    time.Time
+		until    time.Time
+		expected []string
+	}{
+		{"no bounds", time.Time{}, time.Time{}, []string{"Day 1", "Day 2", "Day 3", "Day 4"}},
+		{"since only", day(3), time.Time{}, []string{"Day 3", "Day 4"}},
+		{"until only", time.Time{}, day(2), []string{"Day 1", "Day 2"}},
+		{"inclusive bounds", day(2), day(3), []string{"Day 2", "Day 3"}},
+		{"just outside bounds", day(2).Add(time.Second), day(3).Add(-time.Second), nil},
+		{"empty range", day(4).Add(time.Hour), time.Time{}, nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			saves, err := repo.Log(tc.since, tc.until)
+			if err != nil {
+				t.Fatalf("Log failed: %v", err)
+			}
+			var names []string
+			for _, save := range saves {
+				names = append(names, save.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("Expected %v, got %v", tc.expected, names)
+			}
+		})
+	}
+}
+
+func TestFileHistory(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	save := func(name string) string {
+		hash, err := repo.SaveState(name)
+		if err != nil {
+			t.Fatalf("Failed to create save %q: %v", name, err)
+		}
+		return hash
+	}
+
+	mockFS.AddTestFile("other.txt", []byte("unrelated"))
+	mockFS.AddTestFile("file.txt", []byte("version 1"))
+	added := save("Add file")
+
+	mockFS.AddTestFile("other.txt", []byte("unrelated change"))
+	save("Unrelated change")
+
+	mockFS.AddTestFile("file.txt", []byte("version 2"))
+	modified := save("Modify file")
+
+	if err := mockFS.Remove("file.txt"); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	deleted := save("Delete file")
+
+	mockFS.AddTestFile("file.txt", []byte("version 3"))
+	readded := save("Re-add file")
+
+	history, err := repo.FileHistory("file.txt")
+	if err != nil {
+		t.Fatalf("FileHistory failed: %v", err)
+	}
+
+	expected := []struct {
+		hash   string
+		change string
+	}{
+		{added, "added"},
+		{modified, "modified"},
+		{deleted, "deleted"},
+		{readded, "added"},
+	}
+	if len(history) != len(expected) {
+		t.Fatalf("Expected %d changes, got %d: %+v", len(expected), len(history), history)
+	}
+	for i, exp := range expected {
+		if history[i].Save.Hash != exp.hash || history[i].Change != exp.change {
+			t.Errorf("Change %d: expected %s %s, got %s %s", i, exp.hash, exp.change, history[i].Save.Hash, history[i].Change)
+		}
+	}
+
+	// Unknown files have no history
+	history, err = repo.FileHistory("missing.txt")
+	if err != nil {
+		t.Fatalf("FileHistory failed: %v", err)
+	}
+	if len(history) != 0 {
+		t.Errorf("Expected no history for missing file, got %+v", history)
+	}
+}
+
+func TestFileHistoryOnBranches(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	save := func(name string) string {
+		hash, err := repo.SaveState(name)
+		if err != nil {
+			t.Fatalf("Failed to create save %q: %v", name, err)
+		}
+		return hash
+	}
+
+	mockFS.AddTestFile("f.txt", []byte("base"))
+	mockFS.AddTestFile("other.txt", []byte("base"))
+	added := save("Base")
+	if err := repo.CreateBranch("feat"); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	if err := repo.Switch("feat", nil); err != nil {
+		t.Fatalf("Failed to switch branch: %v", err)
+	}
+	mockFS.AddTestFile("f.txt", []byte("feat change"))
+	onFeat := save("Change f on feat")
+
+	// The next main save follows the feat save in the list but is based on
+	// the base save, where f.txt is unchanged
+	if err := repo.Switch("main", nil); err != nil {
+		t.Fatalf("Failed to switch branch: %v", err)
+	}
+	mockFS.AddTestFile("other.txt", []byte("main change"))
+	save("Change other on main")
+	mockFS.AddTestFile("f.txt", []byte("main change"))
+	onMain := save("Change f on main")
+
+	history, err := repo.FileHistory("f.txt")
+	if err != nil {
+		t.Fatalf("FileHistory failed: %v", err)
+	}
+	var got []string
+	for _, change := range history {
+		got = append(got, change.Save.Hash+" "+change.Change)
+	}
+	want := []string{added + " added", onFeat + " modified", onMain + " modified"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected history %v, got %v", want, got)
+	}
+}
+
+func TestClean(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile(".bitignore", []byte("*.log\n"))
+	mockFS.AddTestFile("tracked.txt", []byte("tracked"))
+	if _, err := repo.SaveState("Initial save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	mockFS.AddTestFile("untracked.txt", []byte("experiment"))
+	mockFS.AddTestFile("debug.log", []byte("ignored"))
+
+	// A dry run only lists the untracked file
+	files, err := repo.Clean(true)
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if len(files) != 1 || files[0] != "untracked.txt" {
+		t.Errorf("Expected only untracked.txt, got %v", files)
+	}
+	if !mockFS.Exists("untracked.txt") {
+		t.Error("Dry run should not remove files")
+	}
+
+	files, err = repo.Clean(false)
+	if err != nil {
+		t.Fatalf("Clean failed: %v", err)
+	}
+	if len(files) != 1 || files[0] != "untracked.txt" {
+		t.Errorf("Expected only untracked.txt, got %v", files)
+	}
+
+	if mockFS.Exists("untracked.txt") {
+		t.Error("Untracked file should be removed")
+	}
+	for _, kept := range []string{"tracked.txt", "debug.log", ".bitignore", ".bit/metadata.json"} {
+		if !mockFS.Exists(kept) {
+			t.Errorf("%s should be kept", kept)
+		}
+	}
+}
+
+func TestCleanKeepsMovedFiles(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.AddTestFile("a.txt", []byte("saved"))
+	if _, err := repo.SaveState("Initial save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// A moved file is tracked under its new path, unsaved edits included
+	if err := repo.Move("a.txt", "b.txt"); err != nil {
+		t.Fatalf("Failed to move file: %v", err)
+	}
+	mockFS.AddTestFile("b.txt", []byte("saved and edited"))
+	mockFS.AddTestFile("stray.txt", []byte("stray"))
+
+	files, err := repo.Clean(false)
+	if err != nil {
+		t.Fatalf("Clean failed: %v", err)
+	}
+	if len(files) != 1 || files[0] != "stray.txt" {
+		t.Errorf("Expected only stray.txt to be removed, got %v", files)
+	}
+	if content, err := mockFS.ReadFile("b.txt"); err != nil || string(content) != "saved and edited" {
+		t.Errorf("Expected the moved file to be kept with its edit, got %q, %v", content, err)
+	}
+}
+
+func TestRepositoryLock(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.AddTestFile("file.txt", []byte("content"))
+
+	// Another process holds the lock
+	if err := mockFS.Lock(repo.bitPath(lockFile)); err != nil {
+		t.Fatalf("Failed to take lock: %v", err)
+	}
+	if _, err := repo.SaveState("Blocked save"); err == nil || !strings.Contains(err.Error(), "locked by another process") {
+		t.Errorf("Expected locked error, got: %v", err)
+	}
+	if err := repo.Remove("file.txt"); err == nil || !strings.Contains(err.Error(), "locked by another process") {
+		t.Errorf("Expected locked error from remove, got: %v", err)
+	}
+	if _, err := repo.Clean(false); err == nil || !strings.Contains(err.Error(), "locked by another process") {
+		t.Errorf("Expected locked error from clean, got: %v", err)
+	}
+	if err := mockFS.Unlock(repo.bitPath(lockFile)); err != nil {
+		t.Fatalf("Failed to release lock: %v", err)
+	}
+
+	hash, err := repo.SaveState("Unblocked save")
+	if err != nil {
+		t.Fatalf("Failed to save after lock was released: %v", err)
+	}
+	if mockFS.Locks[repo.bitPath(lockFile)] {
+		t.Error("SaveState should release the lock")
+	}
+	if err := repo.Checkout(hash); err != nil {
+		t.Fatalf("Failed to checkout: %v", err)
+	}
+}
+
+func TestConcurrentSavesDoNotLoseMetadata(t *testing.T) {
+	root := t.TempDir()
+	fs := util.NewOsFileSystem()
+	repo := NewRepositoryAt(fs, root)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	// Separate repository values stand in for separate processes
+	const savers = 8
+	var succeeded int32
+	var wg sync.WaitGroup
+	for i := 0; i < savers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// The tree never changes, so empty saves must be allowed
+			_, err := NewRepositoryAt(fs, root).SaveStateWithOptions(fmt.Sprintf("Save %d", i), SaveOptions{AllowEmpty: true})
+			if err == nil {
+				atomic.AddInt32(&succeeded, 1)
+			} else if !strings.Contains(err.Error(), "locked by another process") {
+				t.Errorf("Unexpected save error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if succeeded == 0 || len(saves) != int(succeeded) {
+		t.Errorf("Expected %d saves in metadata, got %d", succeeded, len(saves))
+	}
+}
+
+func TestStatus(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("same.txt", []byte("unchanged"))
+	mockFS.AddTestFile("changed.txt", []byte("before"))
+	mockFS.AddTestFile("gone.txt", []byte("to be deleted"))
+
+	// Before any save every file is new
+	status, err := repo.Status()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if len(status.Added) != 3 || len(status.Modified) != 0 || len(status.Deleted) != 0 {
+		t.Errorf("Unexpected status before first save: %+v", status)
+	}
+
+	if _, err := repo.SaveState("Initial save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	mockFS.AddTestFile("changed.txt", []byte("after"))
+	mockFS.AddTestFile("new.txt", []byte("new"))
+	if err := mockFS.Remove("gone.txt"); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+
+	status, err = repo.Status()
+	if err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if strings.Join(status.Added, ",") != "new.txt" {
+		t.Errorf("Expected new.txt added, got %v", status.Added)
+	}
+	if strings.Join(status.Modified, ",") != "changed.txt" {
+		t.Errorf("Expected changed.txt modified, got %v", status.Modified)
+	}
+	if strings.Join(status.Deleted, ",") != "gone.txt" {
+		t.Errorf("Expected gone.txt deleted, got %v", status.Deleted)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("main.go", []byte("package main\n\nfunc main() {\n}\n"))
+	mockFS.AddTestFile("gone.txt", []byte("bye\n"))
+	mockFS.AddTestFile("logo.png", []byte("\x89PNG\x00one"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	mockFS.AddTestFile("main.go", []byte("package main\n\nfunc main() {\n\tprintln()\n}\n"))
+	mockFS.AddTestFile("new.txt", []byte("hello\n"))
+	mockFS.AddTestFile("logo.png", []byte("\x89PNG\x00two"))
+	if err := mockFS.Remove("gone.txt"); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+
+	expected := "diff --git a/gone.txt b/gone.txt\n" +
+		"deleted file mode 100644\n" +
+		"--- a/gone.txt\n" +
+		"+++ /dev/null\n" +
+		"@@ -1,1 +0,0 @@\n" +
+		"-bye\n" +
+		"diff --git a/logo.png b/logo.png\n" +
+		"Binary files a/logo.png and b/logo.png differ\n" +
+		"diff --git a/main.go b/main.go\n" +
+		"--- a/main.go\n" +
+		"+++ b/main.go\n" +
+		"@@ -3,2 +3,3 @@\n" +
+		" func main() {\n" +
+		"+\tprintln()\n" +
+		" }\n" +
+		"diff --git a/new.txt b/new.txt\n" +
+		"new file mode 100644\n" +
+		"--- /dev/null\n" +
+		"+++ b/new.txt\n" +
+		"@@ -0,0 +1,1 @@\n" +
+		"+hello\n"
+
+	// The working tree against the checked out save, then the same changes saved
+	patch, err := repo.Diff("", "", 1)
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	if patch != expected {
+		t.Errorf("Unexpected working tree diff:\n%s", patch)
+	}
+
+	second, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	if patch, err := repo.Diff(first, second, 1); err != nil || patch != expected {
+		t.Errorf("Unexpected diff between saves (%v):\n%s", err, patch)
+	}
+	if patch, err := repo.Diff("", "", 3); err != nil || patch != "" {
+		t.Errorf("Expected no diff for a clean tree, got %q, %v", patch, err)
+	}
+}
+
+func TestDiffStat(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("main.go", []byte("one\ntwo\nthree\nfour\n"))
+	mockFS.AddTestFile("gone.txt", []byte("a\nb\n"))
+	mockFS.AddTestFile("logo.png", []byte("\x89PNG\x00one"))
+	mockFS.AddTestFile("same.txt", []byte("unchanged\n"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// One line changed and one inserted, two lines removed with the file, and
+	// three lines added with a new one
+	mockFS.AddTestFile("main.go", []byte("one\n2\nthree\nfour\nfive\n"))
+	mockFS.AddTestFile("new.txt", []byte("x\ny\nz"))
+	mockFS.AddTestFile("logo.png", []byte("\x89PNG\x00two"))
+	if err := mockFS.Remove("gone.txt"); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	expected := []FileStat{
+		{Path: "gone.txt", Deletions: 2},
+		{Path: "logo.png", Binary: true},
+		{Path: "main.go", Insertions: 2, Deletions: 1},
+		{Path: "new.txt", Insertions: 3},
+	}
+
+	stats, err := repo.DiffStat("", "")
+	if err != nil {
+		t.Fatalf("DiffStat failed: %v", err)
+	}
+	if fmt.Sprint(stats) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected working tree diffstat: %+v", stats)
+	}
+
+	second, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	if stats, err := repo.DiffStat(first, second); err != nil || fmt.Sprint(stats) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected diffstat between saves (%v): %+v", err, stats)
+	}
+	if stats, err := repo.DiffStat("", ""); err != nil || len(stats) != 0 {
+		t.Errorf("Expected no changes for a clean tree, got %+v, %v", stats, err)
+	}
+}
+
+func TestIsClean(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("a.txt", []byte("content a"))
+	mockFS.AddTestFile("dir/b.txt", []byte("content b"))
+	hash, err := repo.SaveState("Initial save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	metadata, _ := repo.loadMetadata()
+	treeHash, err := repo.WorkingTreeHash()
+	if err != nil {
+		t.Fatalf("WorkingTreeHash failed: %v", err)
+	}
+	if saved := metadata.Saves[saveIndex(metadata, hash)].TreeHash; saved == "" || saved != treeHash {
+		t.Errorf("Expected the save to record the working tree hash %s, got %q", treeHash, saved)
+	}
+	if clean, err := repo.IsClean(); err != nil || !clean {
+		t.Errorf("Expected a clean tree right after saving, got %v, %v", clean, err)
+	}
+
+	// A one-byte edit makes the tree dirty without reconstructing anything
+	mockFS.AddTestFile("dir/b.txt", []byte("content c"))
+	if clean, err := repo.IsClean(); err != nil || clean {
+		t.Errorf("Expected a dirty tree after an edit, got %v, %v", clean, err)
+	}
+	mockFS.AddTestFile("dir/b.txt", []byte("content b"))
+	if clean, err := repo.IsClean(); err != nil || !clean {
+		t.Errorf("Expected a clean tree once the edit is undone, got %v, %v", clean, err)
+	}
+
+	// Saves without a tree hash are compared file by file
+	metadata.Saves[0].TreeHash = ""
+	if err := repo.saveMetadata(metadata); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+	mockFS.AddTestFile("new.txt", []byte("new"))
+	if clean, err := repo.IsClean(); err != nil || clean {
+		t.Errorf("Expected an added file to make the tree dirty, got %v, %v", clean, err)
+	}
+}
+
+func TestSquash(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	var hashes []string
+	save := func(name string) {
+		hash, err := repo.SaveState(name)
+		if err != nil {
+			t.Fatalf("Failed to create save %q: %v", name, err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("line 1\n"))
+	mockFS.AddTestFile("temp.txt", []byte("temporary"))
+	save("Base")
+
+	mockFS.AddTestFile("file.txt", []byte("line 1\nline 2\n"))
+	save("Step 1")
+
+	if err := mockFS.Remove("temp.txt"); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	mockFS.AddTestFile("added.txt", []byte("added"))
+	save("Step 2")
+
+	mockFS.AddTestFile("file.txt", []byte("line 1\nline 2\nline 3\n"))
+	save("Step 3")
+
+	mockFS.AddTestFile("file.txt", []byte("line 1\nline 2\nline 3\nline 4\n"))
+	save("After")
+
+	// Ranges must run forward
+	if _, err := repo.Squash(hashes[3], hashes[1]); err == nil {
+		t.Error("Expected error when squashing an out-of-order range")
+	}
+
+	squashed, err := repo.Squash(hashes[1], hashes[3])
+	if err != nil {
+		t.Fatalf("Squash failed: %v", err)
+	}
+
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if len(saves) != 3 || saves[0].Hash != hashes[0] || saves[1].Hash != squashed || saves[2].Hash != hashes[4] {
+		t.Fatalf("Unexpected saves after squash: %+v", saves)
+	}
+	if saves[1].Name != "Step 3" || saves[1].BaseSaveHash != hashes[0] || saves[2].BaseSaveHash != squashed {
+		t.Errorf("Unexpected squashed save: %+v", saves[1])
+	}
+	if mockFS.Exists(util.DeltaSetPath(hashes[2], repo.objectsDir)) {
+		t.Error("Delta set of a squashed save should be removed")
+	}
+
+	// The squashed save matches the original tip
+	if err := repo.Checkout(squashed); err != nil {
+		t.Fatalf("Failed to checkout squashed save: %v", err)
+	}
+	expected := map[string]string{"file.txt": "line 1\nline 2\nline 3\n", "added.txt": "added"}
+	for file, content := range expected {
+		got, err := mockFS.ReadFile(file)
+		if err != nil || string(got) != content {
+			t.Errorf("%s after checkout: expected %q, got %q (%v)", file, content, got, err)
+		}
+	}
+	if mockFS.Exists("temp.txt") {
+		t.Error("temp.txt should not exist in the squashed save")
+	}
+
+	// The save after the range still restores correctly
+	if err := repo.Checkout(hashes[4]); err != nil {
+		t.Fatalf("Failed to checkout save after squashed range: %v", err)
+	}
+	got, err := mockFS.ReadFile("file.txt")
+	if err != nil || string(got) != "line 1\nline 2\nline 3\nline 4\n" {
+		t.Errorf("file.txt after checkout: got %q (%v)", got, err)
+	}
+
+	// A checked out save that is squashed away is replaced by the squashed save
+	mockFS.AddTestFile("file.txt", []byte("line 1\nline 2\nline 3\nline 4\nline 5\n"))
+	save("Tip")
+	if err := repo.Checkout(hashes[4]); err != nil {
+		t.Fatalf("Failed to checkout: %v", err)
+	}
+	tip, err := repo.Squash(hashes[4], hashes[5])
+	if err != nil {
+		t.Fatalf("Squash failed: %v", err)
+	}
+	if head, err := repo.Head(); err != nil || head != tip {
+		t.Errorf("Expected HEAD to move to squashed save %s, got %s (%v)", tip, head, err)
+	}
+}
+
+func TestDeltaEnginesProduceEquivalentSaves(t *testing.T) {
+	originalEngine := util.DeltaEngineConfig.Engine
+	defer func() { util.DeltaEngineConfig.Engine = originalEngine }()
+
+	versions := []string{
+		"first line\nsecond line\n",
+		"first line\nsecond line changed\nthird line\n",
+		"zeroth line\nfirst line\nthird line\n",
+	}
+
+	for _, engine := range []string{util.TextEngineName, util.BinaryEngineName} {
+		t.Run(engine, func(t *testing.T) {
+			util.DeltaEngineConfig.Engine = engine
+
+			mockFS := NewMockFSWithTestFiles()
+			repo := NewRepository(mockFS)
+			if err := repo.InitRepository(); err != nil {
+				t.Fatalf("Failed to initialize repository: %v", err)
+			}
+
+			var hashes []string
+			for i, content := range versions {
+				mockFS.AddTestFile("file.txt", []byte(content))
+				hash, err := repo.SaveState(fmt.Sprintf("Version %d", i))
+				if err != nil {
+					t.Fatalf("Failed to save version %d: %v", i, err)
+				}
+				hashes = append(hashes, hash)
+			}
+
+			deltaSet, err := repo.loadDeltaSet(hashes[1])
+			if err != nil {
+				t.Fatalf("Failed to load delta set: %v", err)
+			}
+			if deltaSet.Deltas[0].Engine != engine {
+				t.Errorf("Expected delta made by %s, got %q", engine, deltaSet.Deltas[0].Engine)
+			}
+
+			for i, hash := range hashes {
+				content, err := repo.getFileContentFromSave("file.txt", hash)
+				if err != nil {
+					t.Fatalf("Failed to reconstruct version %d: %v", i, err)
+				}
+				if string(content) != versions[i] {
+					t.Errorf("Version %d: expected %q, got %q", i, versions[i], content)
+				}
+			}
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	repo, hashes := buildDeltaChain(t, 8)
+	tip := hashes[len(hashes)-1]
+
+	before := repo.newOperation()
+	expected, err := before.fileContent("file.txt", tip)
+	if err != nil {
+		t.Fatalf("Failed to reconstruct file: %v", err)
+	}
+
+	// Chains within the limit are left alone
+	shortened, err := repo.Compact(20)
+	if err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if shortened != 0 {
+		t.Errorf("Expected no chains to be shortened, got %d", shortened)
+	}
+
+	shortened, err = repo.Compact(3)
+	if err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if shortened != 1 {
+		t.Errorf("Expected 1 chain to be shortened, got %d", shortened)
+	}
+
+	// The tip is now read directly instead of replaying the chain
+	after := repo.newOperation()
+	content, err := after.fileContent("file.txt", tip)
+	if err != nil {
+		t.Fatalf("Failed to reconstruct file after compaction: %v", err)
+	}
+	if !bytes.Equal(content, expected) {
+		t.Errorf("Content changed by compaction: %q vs %q", content, expected)
+	}
+	if after.reconstructions >= before.reconstructions || after.reconstructions != 1 {
+		t.Errorf("Expected compaction to reduce reconstructions, got %d before and %d after", before.reconstructions, after.reconstructions)
+	}
+
+	// Earlier saves still reconstruct through their own chains
+	content, err = repo.getFileContentFromSave("file.txt", hashes[2])
+	if err != nil || !bytes.HasSuffix(content, []byte("line 3\n")) {
+		t.Errorf("Unexpected content for earlier save: %q (%v)", content, err)
+	}
+
+	// Running again finds nothing left to shorten
+	shortened, err = repo.Compact(3)
+	if err != nil || shortened != 0 {
+		t.Errorf("Expected nothing left to compact, got %d (%v)", shortened, err)
+	}
+}
+
+func TestDeltaDepths(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("line 0\n"))
+	mockFS.AddTestFile("static.txt", []byte("never changes\n"))
+	if _, err := repo.SaveState("Initial"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Each save adds a delta until the chain limit stores the file in full
+	for i := 1; i <= maxDeltaChainLength+1; i++ {
+		mockFS.AddTestFile("file.txt", append(mockFS.Files["file.txt"], []byte(fmt.Sprintf("line %d\n", i))...))
+		hash, err := repo.SaveState(fmt.Sprintf("Save %d", i))
+		if err != nil {
+			t.Fatalf("Failed to create save %d: %v", i, err)
+		}
+
+		want := i
+		if i == maxDeltaChainLength+1 {
+			want = 0
+		}
+		saves, err := repo.ListSaves()
+		if err != nil {
+			t.Fatalf("Failed to list saves: %v", err)
+		}
+		if got := saves[len(saves)-1].DeltaDepths["file.txt"]; got != want {
+			t.Errorf("Save %d: expected file.txt at depth %d, got %d", i, want, got)
+		}
+
+		report, err := repo.DeltaDepths(hash)
+		if err != nil {
+			t.Fatalf("DeltaDepths failed: %v", err)
+		}
+		depths := map[string]int{}
+		for _, file := range report.Files {
+			depths[file.Path] = file.Depth
+		}
+		if depths["file.txt"] != want || depths["static.txt"] != i || report.Limit != maxDeltaChainLength {
+			t.Errorf("Save %d: unexpected report %+v", i, report)
+		}
+	}
+
+	// Compacting stores the unchanged file in full and resets its depth
+	if _, err := repo.Compact(1); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	report, err := repo.DeltaDepths("")
+	if err != nil {
+		t.Fatalf("DeltaDepths failed: %v", err)
+	}
+	for _, file := range report.Files {
+		if file.Depth != 0 {
+			t.Errorf("Expected %s stored in full after compacting, got depth %d", file.Path, file.Depth)
+		}
+	}
+}
+
+func TestRepackDeltas(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"signingKey": "secret"}`), 0644)
+
+	// A chain of deltas, with an empty version and saves leaving the file
+	// unchanged along the way
+	versions := []string{"line 0\n", "line 0\nline 1\n", "", "", "line 0\nline 3\n", "line 0\nline 3\n", "line 4\n"}
+	var hashes []string
+	for i, version := range versions {
+		mockFS.AddTestFile("file.txt", []byte(version))
+		mockFS.AddTestFile("other.txt", []byte(fmt.Sprintf("other %d\n", i)))
+		hash, err := repo.SaveStateWithOptions(fmt.Sprintf("Save %d", i), SaveOptions{AllowEmpty: true})
+		if err != nil {
+			t.Fatalf("Failed to create save %d: %v", i, err)
+		}
+		hashes = append(hashes, hash)
+	}
+	before, err := repo.DeltaDepths(hashes[len(hashes)-1])
+	if err != nil {
+		t.Fatalf("DeltaDepths failed: %v", err)
+	}
+
+	rewritten, err := repo.RepackDeltas("file.txt")
+	if err != nil {
+		t.Fatalf("RepackDeltas failed: %v", err)
+	}
+	if rewritten == 0 {
+		t.Fatal("Expected delta sets to be rewritten")
+	}
+
+	// Every version of every file is unchanged
+	for i, hash := range hashes {
+		content, err := repo.getFileContentFromSave("file.txt", hash)
+		if err != nil {
+			t.Fatalf("Failed to reconstruct file.txt at save %d: %v", i, err)
+		}
+		if string(content) != versions[i] {
+			t.Errorf("Save %d: expected %q, got %q", i, versions[i], content)
+		}
+		other, err := repo.getFileContentFromSave("other.txt", hash)
+		if err != nil || string(other) != fmt.Sprintf("other %d\n", i) {
+			t.Errorf("Save %d: other.txt changed to %q, %v", i, other, err)
+		}
+	}
+	if issues, err := repo.VerifyIntegrity(); err != nil || len(issues) != 0 {
+		t.Errorf("Expected repacked saves to verify, got %v, %v", issues, err)
+	}
+
+	// No version needs more than one delta, and the latest none
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	for i, save := range saves {
+		if depth := save.DeltaDepths["file.txt"]; depth > 1 {
+			t.Errorf("Save %d: expected file.txt at most one delta deep, got %d", i, depth)
+		}
+	}
+	after, err := repo.DeltaDepths(hashes[len(hashes)-1])
+	if err != nil {
+		t.Fatalf("DeltaDepths failed: %v", err)
+	}
+	for _, file := range after.Files {
+		if file.Path == "file.txt" && file.Depth != 0 {
+			t.Errorf("Expected file.txt stored in full at the latest save, got depth %d (was %+v)", file.Depth, before.Files)
+		}
+	}
+
+	// Repacking again has nothing left to do
+	if rewritten, err := repo.RepackDeltas("file.txt"); err != nil || rewritten != 0 {
+		t.Errorf("Expected a second repack to rewrite nothing, got %d, %v", rewritten, err)
+	}
+	if _, err := repo.RepackDeltas("missing.txt"); err == nil {
+		t.Error("Expected an error for a file in no save")
+	}
+}
+
+func TestRewrittenSavesKeepLineEndings(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"lineEndings": "crlf"}`), 0644)
+
+	versions := []string{"line 0\r\n", "line 0\r\nline 1\r\n", "line 0\r\nline 1\r\nline 2\r\n", "line 3\r\n"}
+	var hashes []string
+	for i, version := range versions {
+		mockFS.AddTestFile("windows.txt", []byte(version))
+		mockFS.AddTestFile("drop.txt", []byte(fmt.Sprintf("drop %d\n", i)))
+		hash, err := repo.SaveState(fmt.Sprintf("Save %d", i))
+		if err != nil {
+			t.Fatalf("Failed to create save %d: %v", i, err)
+		}
+		hashes = append(hashes, hash)
+	}
+	checkOut := func(hash, want string) {
+		t.Helper()
+		if err := repo.Checkout(hash); err != nil {
+			t.Fatalf("Failed to check out %s: %v", hash, err)
+		}
+		if content, _ := mockFS.ReadFile("windows.txt"); string(content) != want {
+			t.Errorf("Expected windows.txt checked out as %q, got %q", want, content)
+		}
+	}
+
+	// Repacked deltas still record the conversion
+	if rewritten, err := repo.RepackDeltas("windows.txt"); err != nil || rewritten == 0 {
+		t.Fatalf("Expected deltas to be repacked, got %d, %v", rewritten, err)
+	}
+	for i, hash := range hashes {
+		checkOut(hash, versions[i])
+	}
+
+	// So do saves made from the content of another save
+	removed, err := repo.RemoveAndSave("drop.txt", "Remove drop.txt")
+	if err != nil {
+		t.Fatalf("Failed to remove and save: %v", err)
+	}
+	if normalized := repo.normalizedInSave(removed); !normalized["windows.txt"] {
+		t.Errorf("Expected windows.txt recorded as normalized after rm --save, got %v", normalized)
+	}
+	squashed, err := repo.Squash(hashes[1], removed)
+	if err != nil {
+		t.Fatalf("Failed to squash: %v", err)
+	}
+	checkOut(hashes[0], versions[0])
+	checkOut(squashed, versions[len(versions)-1])
+}
+
+func TestSquashAcrossRepackBase(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"signingKey": "secret"}`), 0644)
+
+	versions := []string{"line 0\n", "line 0\nline 1\n", "line 0\nline 2\n", "line 0\nline 3\n", "line 4\n"}
+	var hashes []string
+	for i, version := range versions {
+		mockFS.AddTestFile("file.txt", []byte(version))
+		hash, err := repo.SaveState(fmt.Sprintf("Save %d", i))
+		if err != nil {
+			t.Fatalf("Failed to create save %d: %v", i, err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	// Repacking bases the deltas of the middle saves on the first save
+	if rewritten, err := repo.RepackDeltas("file.txt"); err != nil || rewritten == 0 {
+		t.Fatalf("Expected deltas to be repacked, got %d, %v", rewritten, err)
+	}
+	deltaSet, err := repo.loadDeltaSet(hashes[3])
+	if err != nil || deltaSet.Deltas[0].BaseSaveHash != hashes[0] {
+		t.Fatalf("Expected save 3 to be based on save 0 after repacking, got %+v, %v", deltaSet, err)
+	}
+	mockFS.AddTestFile("file.txt", []byte("line 5\n"))
+	newest, err := repo.SaveState("Save 5")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// A squash failing once delta sets were rewritten puts them back
+	failing := NewRepository(&failingWriteFileSystem{FileSystem: mockFS, fail: metadataFile})
+	if _, err := failing.Squash(hashes[0], hashes[1]); err == nil {
+		t.Fatal("Expected the squash to fail when the metadata cannot be written")
+	}
+	if issues, err := repo.VerifyIntegrity(); err != nil || len(issues) != 0 {
+		t.Errorf("Expected the saves to verify after a failed squash, got %v, %v", issues, err)
+	}
+	if deltaSet, err := repo.loadDeltaSet(hashes[3]); err != nil || deltaSet.Deltas[0].BaseSaveHash != hashes[0] {
+		t.Errorf("Expected save 3 to stay based on save 0 after a failed squash, got %+v, %v", deltaSet, err)
+	}
+	if orphans, err := repo.FindOrphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("Expected a failed squash to leave no objects behind, got %v, %v", orphans, err)
+	}
+
+	// Squashing the repack base away leaves every later save readable
+	if _, err := repo.Squash(hashes[0], hashes[1]); err != nil {
+		t.Fatalf("Failed to squash: %v", err)
+	}
+	if issues, err := repo.VerifyIntegrity(); err != nil || len(issues) != 0 {
+		t.Errorf("Expected the saves to verify after squashing, got %v, %v", issues, err)
+	}
+	for i, hash := range hashes[2:] {
+		if content, err := repo.getFileContentFromSave("file.txt", hash); err != nil || string(content) != versions[i+2] {
+			t.Errorf("Save %d: expected %q, got %q, %v", i+2, versions[i+2], content, err)
+		}
+	}
+	if err := repo.Checkout(newest); err != nil {
+		t.Fatalf("Failed to check out the newest save: %v", err)
+	}
+	if content, _ := mockFS.ReadFile("file.txt"); string(content) != "line 5\n" {
+		t.Errorf("Expected the newest version checked out, got %q", content)
+	}
+}
+
+// failingWriteFileSystem fails to write files with the given base name
+type failingWriteFileSystem struct {
+	util.FileSystem
+	fail string
+}
+
+func (fs *failingWriteFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if filepath.Base(name) == fs.fail {
+		return fmt.Errorf("disk full")
+	}
+	return fs.FileSystem.WriteFile(name, data, perm)
+}
+
+// walkRecordingFileSystem records every path visited by Walk
+type walkRecordingFileSystem struct {
+	util.FileSystem
+	visited []string
+}
+
+func (fs *walkRecordingFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
+	return fs.FileSystem.Walk(root, func(path string, info os.FileInfo, err error) error {
+		fs.visited = append(fs.visited, filepath.ToSlash(path))
+		return walkFn(path, info, err)
+	})
+}
+
+func TestSaveSkipsIgnoredDirectories(t *testing.T) {
+	root := t.TempDir()
+	fs := &walkRecordingFileSystem{FileSystem: util.NewOsFileSystem()}
+	repo := NewRepositoryAt(fs, root)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	files := map[string]string{
+		".bitignore":                   "node_modules/\n",
+		"main.go":                      "package main",
+		"node_modules/a/b/c/d/deep.js": "ignored",
+		"node_modules/pkg/index.js":    "ignored",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	hash, err := repo.SaveState("Skip ignored")
+	if err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+
+	for _, path := range fs.visited {
+		rel, _ := filepath.Rel(root, path)
+		rel = filepath.ToSlash(rel)
+		if strings.HasPrefix(rel, "node_modules/") {
+			t.Errorf("Walk descended into ignored directory: %s", rel)
+		}
+	}
+
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if saves[0].Hash != hash || strings.Join(saves[0].Files, ",") != ".bitignore,main.go" {
+		t.Errorf("Unexpected saved files: %v", saves[0].Files)
+	}
+}
+
+// linkFollowingFileSystem walks into symbolic links to directories, as a
+// naive Walk would, and gives up once it has visited too many paths
+type linkFollowingFileSystem struct {
+	util.FileSystem
+	visits int
+}
+
+func (fs *linkFollowingFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
+	if fs.visits++; fs.visits > 1000 {
+		return fmt.Errorf("gave up after %d paths", fs.visits)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	if err := walkFn(root, info, nil); err != nil || !info.IsDir() {
+		if err == filepath.SkipDir {
+			return nil
+		}
+		return err
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return walkFn(root, info, err)
+	}
+	for _, entry := range entries {
+		if err := fs.Walk(filepath.Join(root, entry.Name()), walkFn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestSaveDoesNotFollowDirectoryLinks(t *testing.T) {
+	root := t.TempDir()
+	fs := &linkFollowingFileSystem{FileSystem: util.NewOsFileSystem()}
+	repo := NewRepositoryAt(fs, root)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dir", "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	// A link back to the parent makes a cycle for any walk that follows it
+	if err := os.Symlink("..", filepath.Join(root, "dir", "loop")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	hash, err := repo.SaveState("With a cycle")
+	if err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if saves[0].Hash != hash || strings.Join(saves[0].Files, ",") != "dir/file.txt,dir/loop" {
+		t.Errorf("Unexpected saved files: %v", saves[0].Files)
+	}
+	if !repo.symlinksInSave(hash)["dir/loop"] {
+		t.Error("Expected dir/loop to be saved as a symlink")
+	}
+
+	if _, err := repo.Status(); err != nil {
+		t.Errorf("Status failed: %v", err)
+	}
+}
+
+func TestMoveRecordsRename(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	var large strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&large, "line %d of a large file\n", i)
+	}
+	mockFS.AddTestFile("old.txt", []byte(large.String()))
+	mockFS.AddTestFile("other.txt", []byte("other"))
+	first, err := repo.SaveState("Before rename")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	countBlobs := func() int {
+		count := 0
+		for path := range mockFS.Files {
+			if strings.HasPrefix(path, filepath.ToSlash(filepath.Join(repo.objectsDir, "blobs"))+"/") {
+				count++
+			}
+		}
+		return count
+	}
+	blobsBefore := countBlobs()
+
+	if err := repo.Move("missing.txt", "new.txt"); err == nil {
+		t.Error("Expected error when moving an untracked file")
+	}
+	if err := repo.Move("old.txt", "other.txt"); err == nil {
+		t.Error("Expected error when moving onto an existing file")
+	}
+
+	// Moving twice records a single rename from the saved path
+	if err := repo.Move("old.txt", "tmp.txt"); err != nil {
+		t.Fatalf("Failed to move file: %v", err)
+	}
+	if err := repo.Move("tmp.txt", "dir/new.txt"); err != nil {
+		t.Fatalf("Failed to move file: %v", err)
+	}
+	mockFS.AddTestFile("dir/new.txt", []byte(large.String()+"appended after the rename\n"))
+	if mockFS.Exists("old.txt") {
+		t.Error("old.txt should be moved away")
+	}
+
+	second, err := repo.SaveState("After rename")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	deltaSet, err := repo.loadDeltaSet(second)
+	if err != nil {
+		t.Fatalf("Failed to load delta set: %v", err)
+	}
+	for _, delta := range deltaSet.Deltas {
+		if delta.Path == "dir/new.txt" {
+			if delta.RenamedFrom != "old.txt" || delta.Blob != "" || delta.IsNew {
+				t.Errorf("Expected a rename delta from old.txt, got %+v", delta)
+			}
+		}
+	}
+	if countBlobs() != blobsBefore {
+		t.Errorf("Renamed file was stored in full again")
+	}
+	if mockFS.Exists(repo.bitPath(renamesFile)) {
+		t.Error("Pending renames should be cleared by the save")
+	}
+
+	content, err := repo.getFileContentFromSave("dir/new.txt", second)
+	if err != nil {
+		t.Fatalf("Failed to reconstruct renamed file: %v", err)
+	}
+	if string(content) != large.String()+"appended after the rename\n" {
+		t.Error("Renamed file content mismatch")
+	}
+
+	// The old save still restores the old path
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Failed to checkout first save: %v", err)
+	}
+	if !mockFS.Exists("old.txt") || mockFS.Exists("dir/new.txt") {
+		t.Error("Checkout of the first save should restore old.txt only")
+	}
+}
+
+func TestSaveStateWithReport(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("file1.txt", []byte("This is the content of file 1"))
+	mockFS.AddTestFile("file2.txt", []byte("This is the content of file 2"))
+	mockFS.AddTestFile("same.txt", []byte("Unchanged"))
+	if _, err := repo.SaveState("Initial save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	mockFS.AddTestFile("file1.txt", []byte("This is modified content for file 1"))
+	mockFS.AddTestFile("added.txt", []byte("A new file"))
+	if err := mockFS.Remove(repo.path("file2.txt")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+
+	var reports []FileReport
+	if _, err := repo.SaveStateWithReport("Second save", func(report FileReport) {
+		reports = append(reports, report)
+	}); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	byPath := make(map[string]FileReport)
+	for i, report := range reports {
+		if i > 0 && reports[i-1].Path >= report.Path {
+			t.Errorf("Reports are not sorted by path: %s before %s", reports[i-1].Path, report.Path)
+		}
+		byPath[report.Path] = report
+	}
+
+	added := byPath["added.txt"]
+	if added.Change != "new" || added.Stored != "full" || added.Size != len("A new file") || added.StoredSize != added.Size {
+		t.Errorf("Unexpected report for new file: %+v", added)
+	}
+
+	modified := byPath["file1.txt"]
+	if modified.Change != "modified" || modified.Stored != "delta" || modified.ChainDepth != 1 || modified.StoredSize == 0 {
+		t.Errorf("Unexpected report for modified file: %+v", modified)
+	}
+
+	deleted := byPath["file2.txt"]
+	if deleted.Change != "deleted" || deleted.Stored != "none" {
+		t.Errorf("Unexpected report for deleted file: %+v", deleted)
+	}
+
+	if unchanged := byPath["same.txt"]; unchanged.Change != "unchanged" || unchanged.Stored != "none" {
+		t.Errorf("Unexpected report for unchanged file: %+v", unchanged)
+	}
+}
+
+func TestCreateSaveHashCoversContent(t *testing.T) {
+	timestamp := time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)
+	files := []string{"a.txt", "b.txt"}
+
+	first := createSaveHash("Save", timestamp, "", files, map[string]string{
+		"a.txt": util.CalculateFileHash([]byte("first")),
+		"b.txt": util.CalculateFileHash([]byte("same")),
+	})
+	second := createSaveHash("Save", timestamp, "", files, map[string]string{
+		"a.txt": util.CalculateFileHash([]byte("second")),
+		"b.txt": util.CalculateFileHash([]byte("same")),
+	})
+	if first == second {
+		t.Errorf("Expected saves differing only in content to have distinct hashes, both got %s", first)
+	}
+
+	// Saves are still identified by where they sit in the history
+	if rebased := createSaveHash("Save", timestamp, "abc123", files, map[string]string{
+		"a.txt": util.CalculateFileHash([]byte("first")),
+		"b.txt": util.CalculateFileHash([]byte("same")),
+	}); rebased == first {
+		t.Errorf("Expected saves with different bases to have distinct hashes")
+	}
+
+	// The stored delta set is named after the content-dependent hash
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.AddTestFile("a.txt", []byte("first"))
+	hash, err := repo.SaveState("Save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	deltaSet, err := repo.loadDeltaSet(hash)
+	if err != nil {
+		t.Fatalf("Failed to load delta set of %s: %v", hash, err)
+	}
+	if deltaSet.SaveHash != hash {
+		t.Errorf("Expected delta set for %s, got %s", hash, deltaSet.SaveHash)
+	}
+}
+
+func TestIdenticalTreesProduceIdenticalSaveFiles(t *testing.T) {
+	contents := map[string]string{
+		"b.txt":       "b",
+		"a.txt":       "a",
+		"dir/c.txt":   "c",
+		"dir/a.txt":   "a",
+		"z/nested.go": "package z",
+	}
+	order := []string{"b.txt", "z/nested.go", "a.txt", "dir/c.txt", "dir/a.txt"}
+
+	saveFiles := func(paths []string) []string {
+		mockFS := NewMockFSWithTestFiles()
+		repo := NewRepository(mockFS)
+		if err := repo.InitRepository(); err != nil {
+			t.Fatalf("Failed to initialize repository: %v", err)
+		}
+		for _, path := range paths {
+			mockFS.AddTestFile(path, []byte(contents[path]))
+		}
+		snap, err := repo.getFilesToSave()
+		if err != nil {
+			t.Fatalf("Failed to get files to save: %v", err)
+		}
+		if !sort.StringsAreSorted(snap.files) {
+			t.Errorf("Expected files to save to be sorted, got %v", snap.files)
+		}
+		if _, err := repo.SaveState("Tree"); err != nil {
+			t.Fatalf("Failed to create save: %v", err)
+		}
+		saves, err := repo.ListSaves()
+		if err != nil {
+			t.Fatalf("Failed to list saves: %v", err)
+		}
+		return saves[0].Files
+	}
+
+	reversed := make([]string, len(order))
+	for i, path := range order {
+		reversed[len(order)-1-i] = path
+	}
+
+	first, second := saveFiles(order), saveFiles(reversed)
+	if strings.Join(first, ",") != strings.Join(second, ",") {
+		t.Errorf("Expected identical trees to produce identical files, got %v and %v", first, second)
+	}
+	if !sort.StringsAreSorted(first) {
+		t.Errorf("Expected save files to be sorted, got %v", first)
+	}
+}
+
+func TestFileBecomesDirectory(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("foo", []byte("a file"))
+	mockFS.AddTestFile("other.txt", []byte("other"))
+	asFile, err := repo.SaveState("foo is a file")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	if err := mockFS.Remove("foo"); err != nil {
+		t.Fatalf("Failed to remove foo: %v", err)
+	}
+	mockFS.AddTestFile("foo/bar.txt", []byte("inside a directory"))
+	mockFS.AddTestFile("foo/baz/deep.txt", []byte("deeper"))
+	asDir, err := repo.SaveState("foo is a directory")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if files := strings.Join(saves[1].Files, ","); files != "foo/bar.txt,foo/baz/deep.txt,other.txt" {
+		t.Errorf("Expected foo to be saved as a directory, got %v", files)
+	}
+
+	// The directory is replaced by the file, and the file by the directory
+	for _, step := range []struct {
+		hash     string
+		expected map[string]string
+	}{
+		{asFile, map[string]string{"foo": "a file", "other.txt": "other"}},
+		{asDir, map[string]string{"foo/bar.txt": "inside a directory", "foo/baz/deep.txt": "deeper", "other.txt": "other"}},
+		{asFile, map[string]string{"foo": "a file", "other.txt": "other"}},
+	} {
+		if err := repo.Checkout(step.hash); err != nil {
+			t.Fatalf("Failed to check out %s: %v", step.hash, err)
+		}
+		for file, content := range step.expected {
+			if data, err := mockFS.ReadFile(file); err != nil || string(data) != content {
+				t.Errorf("Expected %s to contain %q after checking out %s, got %q, %v", file, content, step.hash, data, err)
+			}
+		}
+		status, err := repo.Status()
+		if err != nil {
+			t.Fatalf("Failed to get status: %v", err)
+		}
+		if len(status.Added)+len(status.Modified)+len(status.Deleted) != 0 {
+			t.Errorf("Expected a clean working tree after checking out %s, got %+v", step.hash, status)
+		}
+	}
+
+	// A directory still holding an ignored file cannot become a file, and the
+	// failed checkout leaves it alone
+	mockFS.AddFile(".bitignore", []byte("*.log\n"))
+	if err := repo.Checkout(asDir); err != nil {
+		t.Fatalf("Failed to check out %s: %v", asDir, err)
+	}
+	mockFS.AddFile("foo/debug.log", []byte("log"))
+	if err := repo.Checkout(asFile); err == nil || !strings.Contains(err.Error(), "foo/debug.log") {
+		t.Errorf("Expected the ignored file to block the checkout, got %v", err)
+	}
+	if data, err := mockFS.ReadFile("foo/bar.txt"); err != nil || string(data) != "inside a directory" {
+		t.Errorf("Expected foo/bar.txt to be restored, got %q, %v", data, err)
+	}
+
+	// No single save can hold a path as both a file and a directory
+	if err := checkFileDirectoryConflicts(snapshot{files: []string{"foo", "foo/bar.txt"}}); err == nil {
+		t.Error("Expected a path saved as a file and a directory to be refused")
+	}
+	if err := checkFileDirectoryConflicts(snapshot{files: []string{"foo"}, dirs: []string{"foo"}}); err == nil {
+		t.Error("Expected a path saved as a file and an empty directory to be refused")
+	}
+	if err := checkFileDirectoryConflicts(snapshot{files: []string{"foo.txt", "foo/bar.txt"}, dirs: []string{"foo/empty"}}); err != nil {
+		t.Errorf("Expected distinct paths to pass, got %v", err)
+	}
+}
+
+func TestUndo(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("main.go", []byte("package main"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	if _, err := repo.Undo(false); err == nil {
+		t.Error("Expected undoing the only save to be refused")
+	}
+
+	mockFS.AddTestFile("main.go", []byte("package main // changed"))
+	mockFS.AddTestFile("added.txt", []byte("added"))
+	second, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Unsaved changes would be lost
+	mockFS.AddTestFile("added.txt", []byte("unsaved"))
+	if _, err := repo.Undo(false); err == nil || !strings.Contains(err.Error(), "unsaved") {
+		t.Fatalf("Expected unsaved changes to refuse the undo, got %v", err)
+	}
+
+	undone, err := repo.Undo(true)
+	if err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	if undone.Hash != second {
+		t.Errorf("Expected save %s to be undone, got %s", second, undone.Hash)
+	}
+
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if len(saves) != 1 || saves[0].Hash != first {
+		t.Errorf("Expected only the first save to remain, got %v", saves)
+	}
+	if head, _ := repo.Head(); head != first {
+		t.Errorf("Expected HEAD to be the first save, got %s", head)
+	}
+	if content, _ := mockFS.ReadFile("main.go"); string(content) != "package main" {
+		t.Errorf("Expected main.go to match the first save, got %q", content)
+	}
+	if mockFS.Exists("added.txt") {
+		t.Error("Expected the file added by the undone save to be removed")
+	}
+	if clean, err := repo.IsClean(); err != nil || !clean {
+		t.Errorf("Expected the working tree to match the first save, got %v, %v", clean, err)
+	}
+
+	// Objects of the undone save are gone, and those of the first are kept
+	if orphans, err := repo.FindOrphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("Expected no objects left behind, got %v, %v", orphans, err)
+	}
+	if mockFS.Exists(util.DeltaSetPath(second, repo.objectsDir)) {
+		t.Error("Expected the delta set of the undone save to be removed")
+	}
+	if content, err := repo.getFileContentFromSave("main.go", first); err != nil || string(content) != "package main" {
+		t.Errorf("Expected the first save to stay readable, got %q, %v", content, err)
+	}
+}
+
+func TestCheckoutStashesUnsavedChanges(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("main.go", []byte("package main"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	mockFS.AddTestFile("main.go", []byte("package main // second"))
+	mockFS.AddTestFile("added.txt", []byte("only in the second save"))
+	second, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// A clean working tree has nothing to back up
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Failed to check out first save: %v", err)
+	}
+	if err := repo.Checkout(second); err != nil {
+		t.Fatalf("Failed to check out second save: %v", err)
+	}
+	if stashes, err := repo.Stashes(); err != nil || len(stashes) != 0 {
+		t.Fatalf("Expected no stashes for a clean working tree, got %v, %v", stashes, err)
+	}
+
+	// Unsaved changes, including a new file, are stashed before they are replaced
+	mockFS.AddTestFile("main.go", []byte("package main // unsaved"))
+	mockFS.AddTestFile("notes.txt", []byte("untracked notes"))
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Failed to check out first save: %v", err)
+	}
+	if mockFS.Exists("notes.txt") {
+		t.Fatal("Expected checkout to replace the working tree")
+	}
+	stashes, err := repo.Stashes()
+	if err != nil || len(stashes) != 1 {
+		t.Fatalf("Expected one stash, got %v, %v", stashes, err)
+	}
+	if stashes[0].Head != second || stashes[0].Command != "checkout" {
+		t.Errorf("Expected a stash of the checkout from %s, got %+v", second, stashes[0])
+	}
+	if saves, _ := repo.ListSaves(); len(saves) != 2 {
+		t.Errorf("Expected the stash to stay out of the saves, got %d saves", len(saves))
+	}
+	if orphans, err := repo.FindOrphans(); err != nil || len(orphans) != 0 {
+		t.Errorf("Expected the stash objects not to be orphans, got %v, %v", orphans, err)
+	}
+
+	// Popping needs a working tree without unsaved changes
+	mockFS.AddTestFile("main.go", []byte("package main // dirty"))
+	if _, err := repo.PopStash(""); err == nil || !strings.Contains(err.Error(), "unsaved") {
+		t.Errorf("Expected popping onto unsaved changes to be refused, got %v", err)
+	}
+	mockFS.AddTestFile("main.go", []byte("package main"))
+
+	popped, err := repo.PopStash("")
+	if err != nil {
+		t.Fatalf("Failed to pop stash: %v", err)
+	}
+	if popped.Name != stashes[0].Name {
+		t.Errorf("Expected stash %s to be popped, got %s", stashes[0].Name, popped.Name)
+	}
+	for file, want := range map[string]string{"main.go": "package main // unsaved", "notes.txt": "untracked notes", "added.txt": "only in the second save"} {
+		if content, err := mockFS.ReadFile(file); err != nil || string(content) != want {
+			t.Errorf("Expected %s restored as %q, got %q, %v", file, want, content, err)
+		}
+	}
+	if head, _ := repo.Head(); head != second {
+		t.Errorf("Expected the save checked out before the stash, got %s", head)
+	}
+	if stashes, _ := repo.Stashes(); len(stashes) != 0 {
+		t.Errorf("Expected the popped stash to be removed, got %v", stashes)
+	}
+	if _, err := repo.PopStash(""); err == nil {
+		t.Error("Expected popping without stashes to fail")
+	}
+
+	// The stash survives undoing the save whose blobs it shares
+	if _, err := repo.Undo(true); err != nil {
+		t.Fatalf("Undo failed: %v", err)
+	}
+	if _, err := repo.PopStash(""); err != nil {
+		t.Fatalf("Failed to pop the stash taken by undo: %v", err)
+	}
+	if content, err := mockFS.ReadFile("added.txt"); err != nil || string(content) != "only in the second save" {
+		t.Errorf("Expected added.txt restored after undo, got %q, %v", content, err)
+	}
+	if head, _ := repo.Head(); head != first {
+		t.Errorf("Expected HEAD to stay at %s when the stashed save is gone, got %s", first, head)
+	}
+
+	// Only the newest maxStashes stashes are kept, and 0 disables them
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"maxStashes": 2}`), 0644)
+	for i := 0; i < 3; i++ {
+		mockFS.AddTestFile("notes.txt", []byte(fmt.Sprintf("notes %d", i)))
+		if err := repo.Checkout(first); err != nil {
+			t.Fatalf("Failed to check out first save: %v", err)
+		}
+	}
+	if stashes, _ := repo.Stashes(); len(stashes) != 2 {
+		t.Errorf("Expected 2 stashes kept, got %d", len(stashes))
+	}
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"maxStashes": 0}`), 0644)
+	mockFS.AddTestFile("notes.txt", []byte("not stashed"))
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Failed to check out first save: %v", err)
+	}
+	if stashes, _ := repo.Stashes(); len(stashes) != 2 {
+		t.Errorf("Expected no stash with maxStashes 0, got %d", len(stashes))
+	}
+	if _, err := repo.PopStash(""); err != nil {
+		t.Fatalf("Failed to pop stash: %v", err)
+	}
+	if notes, _ := mockFS.ReadFile("notes.txt"); string(notes) != "notes 2" {
+		t.Errorf("Expected the newest stash popped, got %q", notes)
+	}
+}
+
+func TestSaveRecordsAuthorAndHost(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	// Without settings the login name and host name are recorded
+	t.Setenv("USER", "login-name")
+	hostname, _ := os.Hostname()
+	mockFS.AddTestFile("main.go", []byte("package main"))
+	if _, err := repo.SaveState("First save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"author": "Ada", "host": "build-box"}`), 0644)
+	mockFS.AddTestFile("main.go", []byte("package main // changed"))
+	if _, err := repo.SaveState("Second save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if saves[0].Author != "login-name" || saves[0].Host != hostname {
+		t.Errorf("Expected the first save made by login-name@%s, got %s@%s", hostname, saves[0].Author, saves[0].Host)
+	}
+	if saves[1].Author != "Ada" || saves[1].Host != "build-box" {
+		t.Errorf("Expected the configured author and host, got %s@%s", saves[1].Author, saves[1].Host)
+	}
+
+	// Saves made before authors were recorded have none
+	var old Metadata
+	if err := json.Unmarshal([]byte(`{"saves": [{"hash": "abc", "name": "Old", "files": []}]}`), &old); err != nil {
+		t.Fatalf("Failed to decode old metadata: %v", err)
+	}
+	if old.Saves[0].Author != "" || old.Saves[0].Host != "" {
+		t.Errorf("Expected old saves without an author or host, got %+v", old.Saves[0])
+	}
+}
+
+func TestCheckoutIsAtomic(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("a.txt", []byte("a old"))
+	mockFS.AddTestFile("b.txt", []byte("b old"))
+	mockFS.AddTestFile("z.txt", []byte("z old"))
+	hash, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	current := map[string]string{"a.txt": "a new", "b.txt": "b new", "z.txt": "z new", "extra.txt": "extra"}
+	for file, content := range current {
+		mockFS.AddTestFile(file, []byte(content))
+	}
+	if _, err := repo.SaveState("Second save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// The last file restored can no longer be reconstructed
+	deltaSet, err := repo.loadDeltaSet(hash)
+	if err != nil {
+		t.Fatalf("Failed to load delta set: %v", err)
+	}
+	for _, delta := range deltaSet.Deltas {
+		if delta.Path == "z.txt" {
+			if err := mockFS.Remove(util.BlobPath(delta.Blob, repo.objectsDir)); err != nil {
+				t.Fatalf("Failed to remove blob: %v", err)
+			}
+		}
+	}
+
+	if err := repo.Checkout(hash); err == nil || !strings.Contains(err.Error(), "z.txt") {
+		t.Fatalf("Expected the checkout to fail on z.txt, got %v", err)
+	}
+	for file, expected := range current {
+		if content, err := mockFS.ReadFile(file); err != nil || string(content) != expected {
+			t.Errorf("Expected %s to be unchanged, got %q, %v", file, content, err)
+		}
+	}
+	if mockFS.Exists(repo.bitPath(stagingDir)) {
+		t.Error("Expected the staging directory to be removed")
+	}
+	if head, _ := repo.Head(); head == hash {
+		t.Error("Expected HEAD not to move after a failed checkout")
+	}
+}
+
+func TestCheckoutInto(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	saved := map[string]string{"a.txt": "first a", "dir/b.txt": "first b"}
+	for file, content := range saved {
+		mockFS.AddTestFile(file, []byte(content))
+	}
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	mockFS.AddTestFile("a.txt", []byte("second a"))
+	if _, err := repo.SaveState("Second save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	target := filepath.Join(t.TempDir(), "first")
+	mockFS.AddFile(filepath.Join(target, "extra.txt"), []byte("kept"))
+	if err := repo.CheckoutInto(first[:8], target); err != nil {
+		t.Fatalf("CheckoutInto failed: %v", err)
+	}
+	for file, content := range saved {
+		if got, err := mockFS.ReadFile(filepath.Join(target, file)); err != nil || string(got) != content {
+			t.Errorf("Expected %s to contain %q, got %q, %v", file, content, got, err)
+		}
+	}
+	if !mockFS.Exists(filepath.Join(target, "extra.txt")) {
+		t.Error("Expected files already in the target to be kept")
+	}
+
+	// The working tree still holds the second save
+	if content, _ := mockFS.ReadFile("a.txt"); string(content) != "second a" {
+		t.Errorf("Expected the working tree to be untouched, got %q", content)
+	}
+	if head, _ := repo.Head(); head == first {
+		t.Error("Expected HEAD not to move")
+	}
+
+	if err := repo.CheckoutInto(first, "inside"); err == nil {
+		t.Error("Expected a target inside the repository to be refused")
+	}
+
+	// Paths climbing out of the target are refused
+	metadata, _ := repo.loadMetadata()
+	metadata.Saves[0].Files = append(metadata.Saves[0].Files, "../escape.txt")
+	if err := repo.saveMetadata(metadata); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+	escaped := filepath.Join(t.TempDir(), "escaped")
+	if err := repo.CheckoutInto(first, escaped); err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Errorf("Expected a path outside the target to be refused, got %v", err)
+	}
+	if mockFS.Exists(filepath.Join(escaped, "a.txt")) || mockFS.Exists(filepath.Join(escaped, "..", "escape.txt")) {
+		t.Error("Expected nothing to be written")
+	}
+}
+
+// accessRecordingFileSystem records every path whose content is read or written
+type accessRecordingFileSystem struct {
+	util.FileSystem
+	accessed map[string]bool
+}
+
+func (fs *accessRecordingFileSystem) ReadFile(name string) ([]byte, error) {
+	fs.accessed[filepath.ToSlash(name)] = true
+	return fs.FileSystem.ReadFile(name)
+}
+
+func (fs *accessRecordingFileSystem) Open(name string) (util.File, error) {
+	fs.accessed[filepath.ToSlash(name)] = true
+	return fs.FileSystem.Open(name)
+}
+
+func (fs *accessRecordingFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	fs.accessed[filepath.ToSlash(name)] = true
+	return fs.FileSystem.WriteFile(name, data, perm)
+}
+
+func TestCheckoutLeavesIgnoredFilesAlone(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	fs := &accessRecordingFileSystem{FileSystem: mockFS, accessed: make(map[string]bool)}
+	repo := NewRepository(fs)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("main.go", []byte("package main"))
+	mockFS.AddFile(".bitignore", []byte("*.img\n"))
+	hash, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	large := bytes.Repeat([]byte("disk image "), 1<<20)
+	mockFS.AddFile("vm.img", large)
+	mockFS.AddTestFile("main.go", []byte("package main // changed"))
+	if _, err := repo.SaveState("Second save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	for path := range fs.accessed {
+		delete(fs.accessed, path)
+	}
+	if err := repo.Checkout(hash); err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+
+	if fs.accessed["vm.img"] {
+		t.Error("Expected the ignored file not to be read or rewritten by checkout")
+	}
+	if content, err := mockFS.ReadFile("vm.img"); err != nil || !bytes.Equal(content, large) {
+		t.Errorf("Expected the ignored file to be unchanged, got %d bytes, %v", len(content), err)
+	}
+	if content, _ := mockFS.ReadFile("main.go"); string(content) != "package main" {
+		t.Errorf("Expected main.go to be restored, got %q", content)
+	}
+}
+
+func TestCheckoutPaths(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("src/main.go", []byte("package main"))
+	mockFS.AddTestFile("src/util/util.go", []byte("package util"))
+	mockFS.AddTestFile("README.md", []byte("# Project"))
+	hash, err := repo.SaveState("Initial save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	mockFS.AddTestFile("src/main.go", []byte("package main // changed"))
+	mockFS.AddTestFile("src/util/util.go", []byte("package util // changed"))
+	mockFS.AddTestFile("src/extra.go", []byte("package main"))
+	mockFS.AddTestFile("README.md", []byte("# Project (changed)"))
+	mockFS.AddTestFile("notes.txt", []byte("untracked"))
+
+	if err := repo.CheckoutPaths(hash, glob.MustCompile("src/**")); err != nil {
+		t.Fatalf("Failed to checkout paths: %v", err)
+	}
+
+	expected := map[string]string{
+		"src/main.go":      "package main",
+		"src/util/util.go": "package util",
+		"README.md":        "# Project (changed)",
+		"notes.txt":        "untracked",
+	}
+	for file, want := range expected {
+		content, err := mockFS.ReadFile(repo.path(file))
+		if err != nil {
+			t.Errorf("Failed to read %s: %v", file, err)
+			continue
+		}
+		if string(content) != want {
+			t.Errorf("Expected %s to contain %q, got %q", file, want, content)
+		}
+	}
+
+	if mockFS.Exists("src/extra.go") {
+		t.Error("Expected matching file missing from the save to be removed")
+	}
+}
+
+func TestAmendFile(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"signingKey": "secret"}`), 0644)
+
+	mockFS.AddFile(".bitignore", []byte("*.log\n"))
+	mockFS.AddTestFile("main.go", []byte("package main"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// The second save misses a file
+	mockFS.AddTestFile("main.go", []byte("package main // changed"))
+	mockFS.AddTestFile("forgotten.txt", []byte("forgotten"))
+	second, err := repo.SaveStateWithOptions("Second save", SaveOptions{Exclude: []string{"forgotten.txt"}})
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	mockFS.AddTestFile("debug.log", []byte("log"))
+	if _, err := repo.AmendFile("debug.log", false); err == nil || !strings.Contains(err.Error(), "ignored") {
+		t.Errorf("Expected an ignored file to be refused, got %v", err)
+	}
+
+	save, err := repo.AmendFile("forgotten.txt", false)
+	if err != nil {
+		t.Fatalf("AmendFile failed: %v", err)
+	}
+	if save.Hash != second || !containsFile(save.Files, "forgotten.txt") {
+		t.Errorf("Expected forgotten.txt added to save %s, got %s with %v", second, save.Hash, save.Files)
+	}
+
+	// A file the save already has is updated
+	mockFS.AddTestFile("main.go", []byte("package main // amended"))
+	if _, err := repo.AmendFile("main.go", false); err != nil {
+		t.Fatalf("AmendFile failed: %v", err)
+	}
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if len(saves) != 2 {
+		t.Errorf("Expected no new save, got %d saves", len(saves))
+	}
+	if issues, err := repo.VerifyIntegrity(); err != nil || len(issues) != 0 {
+		t.Errorf("Expected the amended save to verify, got %v, %v", issues, err)
+	}
+
+	// Checking out the amended save brings back the added file
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Failed to check out first save: %v", err)
+	}
+	if mockFS.Exists("forgotten.txt") {
+		t.Error("Expected forgotten.txt removed at the first save")
+	}
+	if err := repo.Checkout(second); err != nil {
+		t.Fatalf("Failed to check out amended save: %v", err)
+	}
+	if content, err := mockFS.ReadFile("forgotten.txt"); err != nil || string(content) != "forgotten" {
+		t.Errorf("Expected forgotten.txt restored, got %q, %v", content, err)
+	}
+	if content, _ := mockFS.ReadFile("main.go"); string(content) != "package main // amended" {
+		t.Errorf("Expected the amended main.go, got %q", content)
+	}
+
+	// Only the checked out latest save can be amended
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Failed to check out first save: %v", err)
+	}
+	if _, err := repo.AmendFile("main.go", false); err == nil {
+		t.Error("Expected amending with an older save checked out to be refused")
+	}
+}
+
+func TestCheckoutKeep(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("content"))
+	hash, err := repo.SaveState("Initial save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	mockFS.AddTestFile("scratch/notes.txt", []byte("scratch"))
+	mockFS.AddTestFile("scratch/deep/todo.txt", []byte("todo"))
+	mockFS.AddTestFile("local.env", []byte("SECRET=1"))
+	mockFS.AddTestFile("stray.txt", []byte("stray"))
+
+	opts := CheckoutOptions{Keep: []glob.Glob{glob.MustCompile("scratch/**"), glob.MustCompile("*.env")}}
+	if err := repo.CheckoutWithOptions(hash, opts); err != nil {
+		t.Fatalf("Failed to checkout: %v", err)
+	}
+
+	for _, kept := range []string{"scratch/notes.txt", "scratch/deep/todo.txt", "local.env", "file.txt"} {
+		if !mockFS.Exists(repo.path(kept)) {
+			t.Errorf("Expected %s to survive the checkout", kept)
+		}
+	}
+	if mockFS.Exists(repo.path("stray.txt")) {
+		t.Error("Expected an untracked file not matching --keep to be removed")
+	}
+}
+
+func TestReflog(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	entries, err := repo.Reflog()
+	if err != nil {
+		t.Fatalf("Failed to read empty reflog: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected empty reflog, got %+v", entries)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("first"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Failed to checkout: %v", err)
+	}
+	mockFS.AddTestFile("file.txt", []byte("second"))
+	second, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	entries, err = repo.Reflog()
+	if err != nil {
+		t.Fatalf("Failed to read reflog: %v", err)
+	}
+	expected := []ReflogEntry{
+		{Command: "save", From: "", To: first},
+		{Command: "checkout", From: first, To: first},
+		{Command: "save", From: first, To: second},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d reflog entries, got %d: %+v", len(expected), len(entries), entries)
+	}
+	for i, want := range expected {
+		got := entries[i]
+		if got.Command != want.Command || got.From != want.From || got.To != want.To {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, want, got)
+		}
+		if got.Timestamp.IsZero() {
+			t.Errorf("Entry %d has no timestamp", i)
+		}
+	}
+
+	// An interrupted append must not hide later entries
+	if err := mockFS.AppendFile(repo.bitPath(reflogFile), []byte(`{"command":"sa`), 0644); err != nil {
+		t.Fatalf("Failed to append partial entry: %v", err)
+	}
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Failed to checkout: %v", err)
+	}
+	entries, err = repo.Reflog()
+	if err != nil {
+		t.Fatalf("Failed to read reflog: %v", err)
+	}
+	if len(entries) != 4 || entries[3].From != second || entries[3].To != first {
+		t.Errorf("Expected checkout after interrupted append to be recorded, got %+v", entries)
+	}
+}
+
+func TestHead(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	// A fresh repository has no checked out save
+	head, err := repo.Head()
+	if err != nil {
+		t.Fatalf("Failed to read HEAD of fresh repository: %v", err)
+	}
+	if head != "" {
+		t.Errorf("Expected no HEAD in a fresh repository, got %s", head)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("first"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	mockFS.AddTestFile("file.txt", []byte("second"))
+	mockFS.AddTestFile("extra.txt", []byte("extra"))
+	second, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	if head, err = repo.Head(); err != nil || head != second {
+		t.Errorf("Expected HEAD %s after save, got %s (%v)", second, head, err)
+	}
+
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Failed to checkout: %v", err)
+	}
+	if head, err = repo.Head(); err != nil || head != first {
+		t.Errorf("Expected HEAD %s after checkout, got %s (%v)", first, head, err)
+	}
+
+	// Status compares against the checked out save, not the latest one
+	status, err := repo.Status()
+	if err != nil {
+		t.Fatalf("Failed to get status: %v", err)
+	}
+	if status.Head != first || len(status.Added)+len(status.Modified)+len(status.Deleted) != 0 {
+		t.Errorf("Expected clean status at %s, got %+v", first, status)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("changed"))
+	status, err = repo.Status()
+	if err != nil {
+		t.Fatalf("Failed to get status: %v", err)
+	}
+	if len(status.Modified) != 1 || status.Modified[0] != "file.txt" || len(status.Deleted) != 0 {
+		t.Errorf("Expected only file.txt modified against %s, got %+v", first, status)
+	}
+
+	// Repositories without a HEAD file are at their latest save
+	if err := mockFS.Remove(repo.bitPath(headFile)); err != nil {
+		t.Fatalf("Failed to remove HEAD: %v", err)
+	}
+	if head, err = repo.Head(); err != nil || head != second {
+		t.Errorf("Expected HEAD to default to the latest save %s, got %s (%v)", second, head, err)
+	}
+}
+
+func TestCompareSaves(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("same.txt", []byte("unchanged"))
+	mockFS.AddTestFile("changed.txt", []byte("before"))
+	mockFS.AddTestFile("old.txt", []byte("only in the first save"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	mockFS.AddTestFile("changed.txt", []byte("after"))
+	mockFS.AddTestFile("new.txt", []byte("only in the second save"))
+	if err := mockFS.Remove("old.txt"); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	second, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	changes, err := repo.CompareSaves(first, second)
+	if err != nil {
+		t.Fatalf("CompareSaves failed: %v", err)
+	}
+	if changes.From != first || changes.To != second {
+		t.Errorf("Unexpected saves in changeset: %+v", changes)
+	}
+	if strings.Join(changes.Added, ",") != "new.txt" ||
+		strings.Join(changes.Removed, ",") != "old.txt" ||
+		strings.Join(changes.Modified, ",") != "changed.txt" {
+		t.Errorf("Unexpected changeset: %+v", changes)
+	}
+
+	// Comparing in the other direction swaps added and removed
+	reverse, err := repo.CompareSaves(second, first)
+	if err != nil {
+		t.Fatalf("CompareSaves failed: %v", err)
+	}
+	if strings.Join(reverse.Added, ",") != "old.txt" || strings.Join(reverse.Removed, ",") != "new.txt" {
+		t.Errorf("Unexpected reverse changeset: %+v", reverse)
+	}
+
+	// Saves without any file in common
+	for _, file := range []string{"same.txt", "changed.txt", "new.txt"} {
+		if err := mockFS.Remove(file); err != nil {
+			t.Fatalf("Failed to remove file: %v", err)
+		}
+	}
+	mockFS.AddTestFile("other.txt", []byte("disjoint"))
+	third, err := repo.SaveState("Disjoint save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	disjoint, err := repo.CompareSaves(first, third)
+	if err != nil {
+		t.Fatalf("CompareSaves failed: %v", err)
+	}
+	if strings.Join(disjoint.Added, ",") != "other.txt" ||
+		strings.Join(disjoint.Removed, ",") != "changed.txt,old.txt,same.txt" ||
+		len(disjoint.Modified) != 0 {
+		t.Errorf("Unexpected changeset for disjoint saves: %+v", disjoint)
+	}
+
+	if _, err := repo.CompareSaves(first, "missing"); err == nil {
+		t.Error("Expected error when comparing with an unknown save")
+	}
+}
+
+func TestRepositoryWithSeparateDirectory(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "work")
+	store := filepath.Join(base, "store")
+	fs := util.NewOsFileSystem()
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatalf("Failed to create working tree: %v", err)
+	}
+	if err := NewRepositoryWithDir(fs, root, store).InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	// The working tree only holds a pointer to the repository directory
+	info, err := os.Stat(filepath.Join(root, bitDir))
+	if err != nil || info.IsDir() {
+		t.Fatalf("Expected a %s pointer file in the working tree (%v)", bitDir, err)
+	}
+	if _, err := os.Stat(filepath.Join(store, metadataFile)); err != nil {
+		t.Errorf("Expected metadata in the repository directory: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "file.txt"), []byte("v1"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	// Commands find the repository directory through the pointer
+	repo, err := OpenRepository(fs, root)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %v", err)
+	}
+	if repo.bitDir != store {
+		t.Fatalf("Expected repository directory %s, got %s", store, repo.bitDir)
+	}
+
+	hash, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to save state: %v", err)
+	}
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if len(saves) != 1 || strings.Join(saves[0].Files, ",") != "file.txt" {
+		t.Errorf("Expected only file.txt to be saved, got %+v", saves)
+	}
+	if _, err := os.Stat(util.DeltaSetPath(hash, filepath.Join(store, objectsDir))); err != nil {
+		t.Errorf("Expected objects in the repository directory: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "file.txt"), []byte("v2"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := repo.Checkout(hash); err != nil {
+		t.Fatalf("Failed to checkout: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(root, "file.txt"))
+	if err != nil || string(content) != "v1" {
+		t.Errorf("Expected 'v1' after checkout, got %q (%v)", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, bitDir)); err != nil {
+		t.Errorf("Expected checkout to keep the pointer file: %v", err)
+	}
+
+	if err := NewRepositoryWithDir(fs, root, filepath.Join(base, "other")).InitRepository(); err == nil {
+		t.Error("Expected error when initializing over an existing pointer")
+	}
+}
+
+func TestSize(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("large.txt", []byte(strings.Repeat("large file content\n", 500)))
+	mockFS.AddTestFile("small.txt", []byte("small"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	mockFS.AddTestFile("small.txt", []byte("small, changed"))
+	second, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// An object no save refers to
+	if _, err := util.SaveBlob([]byte("orphaned"), repo.objectsDir, mockFS); err != nil {
+		t.Fatalf("Failed to write blob: %v", err)
+	}
+
+	var written int64
+	objects := 0
+	for path, content := range mockFS.Files {
+		if strings.HasPrefix(path, repo.objectsDir+"/") {
+			written += int64(len(content))
+			objects++
+		}
+	}
+
+	report, err := repo.Size()
+	if err != nil {
+		t.Fatalf("Size failed: %v", err)
+	}
+	if report.TotalBytes != written || report.Objects != objects {
+		t.Errorf("Expected %d bytes in %d objects, got %d bytes in %d objects", written, objects, report.TotalBytes, report.Objects)
+	}
+
+	var attributed int64
+	for _, save := range report.Saves {
+		attributed += save.Bytes
+	}
+	if attributed+report.UnreferencedBytes != report.TotalBytes {
+		t.Errorf("Attributed %d and unreferenced %d bytes do not add up to %d", attributed, report.UnreferencedBytes, report.TotalBytes)
+	}
+	if report.UnreferencedBytes == 0 {
+		t.Error("Expected the orphaned blob to be unreferenced")
+	}
+
+	// The first save stored full copies, the second only a delta
+	if len(report.Saves) != 2 || report.Saves[0].Hash != first || report.Saves[1].Hash != second {
+		t.Fatalf("Expected saves ordered largest first, got %+v", report.Saves)
+	}
+	if report.Saves[1].Bytes != int64(len(mockFS.Files[util.DeltaSetPath(second, repo.objectsDir)])) {
+		t.Errorf("Expected the second save to consist of its delta set, got %d bytes", report.Saves[1].Bytes)
+	}
+}
+
+func TestSaveHashLength(t *testing.T) {
+	full := strings.Repeat("ab", 32)
+	metadata := Metadata{Saves: []Save{{Hash: full[:4]}, {Hash: full[:5]}, {Hash: "ffff"}}}
+
+	// Colliding prefixes are extended until unique
+	if hash := uniqueSaveHash(full, 4, metadata); hash != full[:6] {
+		t.Errorf("Expected the hash to be extended to %s, got %s", full[:6], hash)
+	}
+	if hash := uniqueSaveHash(full, 8, metadata); hash != full[:8] {
+		t.Errorf("Expected an unused prefix to be kept, got %s", hash)
+	}
+
+	// A full hash is a prefix of a longer one, but still resolves to its save
+	resolved, err := resolveHash(Metadata{Saves: []Save{{Hash: full[:5]}, {Hash: full[:6]}, {Hash: full[:4]}}}, full[:4])
+	if err != nil || resolved.Hash != full[:4] {
+		t.Errorf("Expected %s to resolve exactly, got %v, %v", full[:4], resolved, err)
+	}
+
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"hashLength": 4}`), 0644)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		mockFS.AddTestFile("file.txt", []byte(fmt.Sprintf("version %d", i)))
+		hash, err := repo.SaveState(fmt.Sprintf("Save %d", i))
+		if err != nil {
+			t.Fatalf("Failed to create save: %v", err)
+		}
+		if len(hash) < 4 || seen[hash] {
+			t.Fatalf("Expected a unique hash of at least 4 characters, got %s", hash)
+		}
+		seen[hash] = true
+		if content, err := repo.CatFile(hash, "file.txt"); err != nil || string(content) != fmt.Sprintf("version %d", i) {
+			t.Errorf("Expected save %s to be readable, got %q, %v", hash, content, err)
+		}
+	}
+
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"hashLength": 2}`), 0644)
+	mockFS.AddTestFile("file.txt", []byte("refused"))
+	if _, err := repo.SaveState("Too short"); err == nil || !strings.Contains(err.Error(), "hashLength") {
+		t.Errorf("Expected a hash length below the minimum to be refused, got %v", err)
+	}
+}
+
+func TestEnvironmentLocations(t *testing.T) {
+	t.Setenv(util.GlobalIgnoreEnv, filepath.Join(t.TempDir(), "missing"))
+	t.Setenv(IgnoreFileEnv, "settings/ignore")
+	t.Setenv(ConfigEnv, "settings/config.json")
+
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	// The overriding files are read instead of .bitignore and config.json
+	mockFS.AddFile(".bitignore", []byte("*.txt\n"))
+	mockFS.AddFile("settings/ignore", []byte("*.log\nsettings/\n"))
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"hashLength": 20}`), 0644)
+	mockFS.WriteFile("settings/config.json", []byte(`{"hashLength": 6}`), 0644)
+	mockFS.AddTestFile("notes.txt", []byte("notes"))
+	mockFS.AddTestFile("debug.log", []byte("log"))
+
+	snap, err := repo.getFilesToSave()
+	if err != nil {
+		t.Fatalf("Failed to get files to save: %v", err)
+	}
+	expected := []string{".bitignore", "notes.txt"}
+	if strings.Join(snap.files, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected files %v, got %v", expected, snap.files)
+	}
+	hash, err := repo.SaveState("Configured elsewhere")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	if len(hash) != 6 {
+		t.Errorf("Expected a hash of 6 characters from the overriding config, got %s", hash)
+	}
+
+	// Without the variables the repository's own files are used
+	t.Setenv(IgnoreFileEnv, "")
+	t.Setenv(ConfigEnv, "")
+	repo = NewRepository(mockFS)
+	if config, err := repo.loadConfig(); err != nil || config.HashLength != 20 {
+		t.Errorf("Expected hashLength 20 from config.json, got %d, %v", config.HashLength, err)
+	}
+	snap, err = repo.getFilesToSave()
+	if err != nil {
+		t.Fatalf("Failed to get files to save: %v", err)
+	}
+	for _, file := range snap.files {
+		if strings.HasSuffix(file, ".txt") {
+			t.Errorf("Expected .bitignore to exclude %s", file)
+		}
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte(strings.Repeat("content\n", 100)))
+	if _, err := repo.SaveState("First save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	mockFS.AddTestFile("file.txt", []byte(strings.Repeat("changed\n", 100)))
+	if _, err := repo.SaveState("Second save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	orphans, err := repo.FindOrphans()
+	if err != nil {
+		t.Fatalf("FindOrphans failed: %v", err)
+	}
+	if len(orphans) != 0 {
+		t.Errorf("Expected no orphans, got %v", orphans)
+	}
+
+	// Leftovers of a save that never made it into the metadata, and a blob
+	// nothing refers to
+	blobHash, err := util.SaveBlob([]byte("orphaned"), repo.objectsDir, mockFS)
+	if err != nil {
+		t.Fatalf("Failed to write blob: %v", err)
+	}
+	lost := strings.Repeat("ab", 32)
+	mockFS.AddFile(util.DeltaSetPath(lost, repo.objectsDir), []byte("{}"))
+	mockFS.AddFile(util.FileObjectPath("file.txt", lost, repo.objectsDir), []byte("lost"))
+
+	orphans, err = repo.FindOrphans()
+	if err != nil {
+		t.Fatalf("FindOrphans failed: %v", err)
+	}
+	expected := []string{
+		lost + ".file.txt",
+		"blobs/" + blobHash,
+		"delta_" + lost + ".json",
+	}
+	if strings.Join(orphans, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected orphans %v, got %v", expected, orphans)
+	}
+
+	// Reporting deletes nothing
+	for _, orphan := range orphans {
+		if !mockFS.Exists(filepath.Join(repo.objectsDir, orphan)) {
+			t.Errorf("Expected %s to remain on disk", orphan)
+		}
+	}
+}
+
+func TestObjects(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte(strings.Repeat("content\n", 100)))
+	hash, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// A full copy named after the save, as written before blobs
+	if err := util.SaveFullFile([]byte("old"), "dir/old.txt", hash, repo.objectsDir, mockFS); err != nil {
+		t.Fatalf("Failed to write full copy: %v", err)
+	}
+
+	objects, err := repo.Objects()
+	if err != nil {
+		t.Fatalf("Objects failed: %v", err)
+	}
+
+	byType := make(map[string][]ObjectInfo)
+	for _, object := range objects {
+		byType[object.Type] = append(byType[object.Type], object)
+	}
+
+	var blob *ObjectInfo
+	for i, object := range byType["blob"] {
+		if object.Path == "file.txt" {
+			blob = &byType["blob"][i]
+		}
+	}
+	if blob == nil {
+		t.Fatalf("Expected a blob storing file.txt, got %+v", objects)
+	}
+	if blob.Save != hash || blob.Header == nil || blob.Header.ContentHash == "" || blob.Size == 0 {
+		t.Errorf("Expected blob of save %s with a decoded header, got %+v", hash, *blob)
+	}
+
+	if len(byType["delta"]) != 1 || byType["delta"][0].Save != hash || byType["delta"][0].Header != nil {
+		t.Errorf("Expected one delta set of save %s without a header, got %+v", hash, byType["delta"])
+	}
+
+	if len(byType["file"]) != 1 || byType["file"][0].Save != hash || byType["file"][0].Path != "dir/old.txt" || byType["file"][0].Header == nil {
+		t.Errorf("Expected the full copy of dir/old.txt, got %+v", byType["file"])
+	}
+}
+
+func TestVerifyIntegrity(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("unsigned\n"))
+	unsigned, err := repo.SaveState("Unsigned")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"signingKey": "secret"}`), 0644)
+	var hashes []string
+	for i := 0; i < 2; i++ {
+		mockFS.AddTestFile("file.txt", []byte(fmt.Sprintf("signed %d\n", i)))
+		hash, err := repo.SaveState(fmt.Sprintf("Signed %d", i))
+		if err != nil {
+			t.Fatalf("Failed to create save: %v", err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if saves[0].Hash != unsigned || saves[0].Signature != "" || saves[1].Signature == "" || saves[2].Signature == "" {
+		t.Errorf("Expected only the saves made with a key to be signed: %+v", saves)
+	}
+	// Saves made before signing was enabled are not reported
+	if issues, err := repo.VerifyIntegrity(); err != nil || len(issues) != 0 {
+		t.Fatalf("Expected no issues, got %v, %v", issues, err)
+	}
+
+	// Reformatting a delta set leaves its content intact, so only the
+	// signature tells that it was altered
+	deltaPath := util.DeltaSetPath(hashes[1], repo.objectsDir)
+	data, err := mockFS.ReadFile(deltaPath)
+	if err != nil {
+		t.Fatalf("Failed to read delta set: %v", err)
+	}
+	mockFS.WriteFile(deltaPath, append(data, '\n'), 0644)
+
+	issues, err := repo.VerifyIntegrity()
+	if err != nil {
+		t.Fatalf("VerifyIntegrity failed: %v", err)
+	}
+	if len(issues) != 1 || issues[0].Hash != hashes[1] || issues[0].Problem != "signature does not match" {
+		t.Errorf("Expected the signature of %s not to match, got %v", hashes[1], issues)
+	}
+
+	// Without the key, signatures cannot be checked
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{}`), 0644)
+	if issues, err := repo.VerifyIntegrity(); err != nil || len(issues) != 0 {
+		t.Errorf("Expected no issues without a signing key, got %v, %v", issues, err)
+	}
+
+	// Changed content no longer matches the tree hash
+	mockFS.WriteFile(deltaPath, data, 0644)
+	metadata, err := repo.loadMetadata()
+	if err != nil {
+		t.Fatalf("Failed to load metadata: %v", err)
+	}
+	metadata.Saves[2].TreeHash = treeHash([]string{"file.txt"}, map[string]string{"file.txt": util.CalculateFileHash([]byte("forged"))})
+	if err := repo.saveMetadata(metadata); err != nil {
+		t.Fatalf("Failed to save metadata: %v", err)
+	}
+	issues, err = repo.VerifyIntegrity()
+	if err != nil || len(issues) != 1 || issues[0].Problem != "content does not match its tree hash" {
+		t.Errorf("Expected a tree hash mismatch, got %v, %v", issues, err)
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	t.Setenv(util.GlobalIgnoreEnv, filepath.Join(t.TempDir(), "missing"))
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if report := repo.Doctor(); report.Initialized || report.Healthy() {
+		t.Errorf("Expected a missing repository to be reported, got %+v", report)
+	}
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.AddTestFile(".bitignore", []byte("*.log\n# comment\n!keep.log\n"))
+	mockFS.AddTestFile("file.txt", []byte("content\n"))
+	if _, err := repo.SaveState("First save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	report := repo.Doctor()
+	if !report.Healthy() {
+		t.Fatalf("Expected a healthy repository, got %+v", report)
+	}
+	if report.Saves != 1 || report.Verified != 1 || report.Objects == 0 || report.TotalBytes == 0 || len(report.Orphans) != 0 {
+		t.Errorf("Unexpected report for a healthy repository: %+v", report)
+	}
+	if !reflect.DeepEqual(report.IgnorePatterns, []string{"*.log", "!keep.log"}) {
+		t.Errorf("Expected the .bitignore patterns, got %v", report.IgnorePatterns)
+	}
+
+	// Truncate the metadata as an interrupted write would
+	data := mockFS.Files[repo.metadataFile]
+	mockFS.Files[repo.metadataFile] = data[:len(data)/2]
+
+	report = repo.Doctor()
+	if report.Healthy() || report.MetadataError == "" {
+		t.Errorf("Expected corrupt metadata to be reported, got %+v", report)
+	}
+	if len(report.IgnorePatterns) != 2 {
+		t.Errorf("Expected the ignore patterns to be listed regardless, got %v", report.IgnorePatterns)
+	}
+}
+
+func TestUnderscorePaths(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("a_b_c.txt", []byte("first version"))
+	mockFS.AddTestFile("a_b/c.txt", []byte("nested"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	mockFS.AddTestFile("a_b_c.txt", []byte("second version"))
+	second, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+	for path, expected := range map[string]string{"a_b_c.txt": "first version", "a_b/c.txt": "nested"} {
+		if content, _ := mockFS.ReadFile(path); string(content) != expected {
+			t.Errorf("Expected %s to contain %q after checkout, got %q", path, expected, content)
+		}
+	}
+
+	// Full copies, in either naming, are attributed to the save they belong to
+	if err := util.SaveFullFile([]byte("full copy"), "a_b_c.txt", second, repo.objectsDir, mockFS); err != nil {
+		t.Fatalf("Failed to write full copy: %v", err)
+	}
+	if err := mockFS.WriteFile(filepath.Join(repo.objectsDir, first+"_a_b_c.txt"), []byte("legacy copy"), 0644); err != nil {
+		t.Fatalf("Failed to write legacy copy: %v", err)
+	}
+	report, err := repo.Size()
+	if err != nil {
+		t.Fatalf("Size failed: %v", err)
+	}
+	if report.UnreferencedBytes != 0 {
+		t.Errorf("Expected every object to belong to a save, got %d unreferenced bytes", report.UnreferencedBytes)
+	}
+}
+
+func TestRebuildMetadata(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("a.txt", []byte("first version"))
+	mockFS.AddTestFile("b.txt", []byte("unchanged"))
+	if _, err := repo.SaveState("First save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	mockFS.AddTestFile("a.txt", []byte("second version"))
+	if _, err := repo.SaveState("Second save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	mockFS.AddTestFile("c.txt", []byte("new file"))
+	if _, err := repo.SaveState("Third save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Good metadata is never replaced
+	if _, err := repo.RebuildMetadata(); err == nil {
+		t.Fatal("Expected rebuild to refuse intact metadata")
+	}
+
+	original, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+
+	// Truncate the metadata as an interrupted write would
+	data := mockFS.Files[repo.metadataFile]
+	mockFS.Files[repo.metadataFile] = data[:len(data)/2]
+	if _, err := repo.ListSaves(); !errors.Is(err, ErrCorruptMetadata) {
+		t.Fatalf("Expected corrupt metadata error, got %v", err)
+	}
+
+	recovered, err := repo.RebuildMetadata()
+	if err != nil {
+		t.Fatalf("RebuildMetadata failed: %v", err)
+	}
+	if recovered != len(original) {
+		t.Errorf("Expected %d saves recovered, got %d", len(original), recovered)
+	}
+	if !bytes.Equal(mockFS.Files[repo.metadataFile+".corrupt"], data[:len(data)/2]) {
+		t.Error("Expected the corrupt metadata to be kept")
+	}
+
+	rebuilt, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves after rebuild: %v", err)
+	}
+	if len(rebuilt) != len(original) {
+		t.Fatalf("Expected %d saves, got %d", len(original), len(rebuilt))
+	}
+	for i := range original {
+		if rebuilt[i].Hash != original[i].Hash {
+			t.Errorf("Save %d: expected hash %s, got %s", i, original[i].Hash, rebuilt[i].Hash)
+		}
+		if rebuilt[i].BaseSaveHash != original[i].BaseSaveHash {
+			t.Errorf("Save %d: expected base %q, got %q", i, original[i].BaseSaveHash, rebuilt[i].BaseSaveHash)
+		}
+		if strings.Join(rebuilt[i].Files, ",") != strings.Join(original[i].Files, ",") {
+			t.Errorf("Save %d: expected files %v, got %v", i, original[i].Files, rebuilt[i].Files)
+		}
+	}
+
+	// Rebuilt saves restore their content
+	if err := repo.Checkout(original[0].Hash); err != nil {
+		t.Fatalf("Failed to checkout rebuilt save: %v", err)
+	}
+	if content := mockFS.Files["a.txt"]; string(content) != "first version" {
+		t.Errorf("Expected first version after checkout, got %q", content)
+	}
+}
+
+func TestSaveSizeLimits(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.WriteFile(repo.bitPath(configFile), []byte(`{"maxFileSize": 100, "maxSaveSize": 150}`), 0644)
+
+	// Files under the limits are saved
+	mockFS.AddTestFile("small.txt", []byte(strings.Repeat("s", 100)))
+	if _, err := repo.SaveState("Small"); err != nil {
+		t.Fatalf("Expected save under the limits to succeed: %v", err)
+	}
+
+	// A file over the limit is refused, naming the file
+	mockFS.AddTestFile("huge.img", []byte(strings.Repeat("h", 101)))
+	_, err := repo.SaveState("Huge")
+	if err == nil || !strings.Contains(err.Error(), "huge.img") || !strings.Contains(err.Error(), ".bitignore") {
+		t.Fatalf("Expected error naming huge.img, got %v", err)
+	}
+	if saves, _ := repo.ListSaves(); len(saves) != 1 {
+		t.Errorf("Expected the refused save not to be recorded, got %d saves", len(saves))
+	}
+
+	// Ignoring the file lets the save through
+	mockFS.AddTestFile(".bitignore", []byte("*.img\n"))
+	if _, err := repo.SaveState("Ignored"); err != nil {
+		t.Fatalf("Expected save with the file ignored to succeed: %v", err)
+	}
+
+	// The total size is limited too
+	mockFS.AddTestFile("other.txt", []byte(strings.Repeat("o", 60)))
+	if _, err := repo.SaveState("Total"); err == nil || !strings.Contains(err.Error(), "maxSaveSize") {
+		t.Fatalf("Expected total size error, got %v", err)
+	}
+
+	// The limits can be overridden
+	if _, err := repo.SaveStateWithOptions("Allowed", SaveOptions{AllowLarge: true}); err != nil {
+		t.Fatalf("Expected save with AllowLarge to succeed: %v", err)
+	}
+}
+
+func TestGrep(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("main.go", []byte("package main\n\nfunc main() {\n\t// TODO: parse flags\n}\n"))
+	mockFS.AddTestFile("notes.txt", []byte("todo list\r\nnothing here\r\nTODO: write docs\r\n"))
+	mockFS.AddTestFile("image.bin", []byte("TODO\x00\x01\x02"))
+	hash, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Later changes must not affect the search of the save
+	mockFS.AddTestFile("main.go", []byte("package main\n"))
+	if _, err := repo.SaveState("Second save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	matches, err := repo.Grep("TODO", hash)
+	if err != nil {
+		t.Fatalf("Grep failed: %v", err)
+	}
+	expected := []GrepMatch{
+		{Path: "main.go", Line: 4, Text: "\t// TODO: parse flags"},
+		{Path: "notes.txt", Line: 3, Text: "TODO: write docs"},
+	}
+	if fmt.Sprint(matches) != fmt.Sprint(expected) {
+		t.Errorf("Expected matches %v, got %v", expected, matches)
+	}
+
+	// Case-insensitive patterns use the regexp flag
+	matches, err = repo.Grep("(?i)^todo", hash)
+	if err != nil {
+		t.Fatalf("Grep failed: %v", err)
+	}
+	if len(matches) != 2 || matches[0].Line != 1 || matches[1].Line != 3 {
+		t.Errorf("Expected lines 1 and 3 of notes.txt, got %v", matches)
+	}
+
+	// Without a hash the working tree is searched
+	matches, err = repo.Grep("TODO", "")
+	if err != nil {
+		t.Fatalf("Grep failed: %v", err)
+	}
+	if len(matches) != 1 || matches[0].Path != "notes.txt" {
+		t.Errorf("Expected only notes.txt to match in the working tree, got %v", matches)
+	}
+
+	if _, err := repo.Grep("(", hash); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
+
+func TestBranches(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("shared.txt", []byte("common base"))
+	base, err := repo.SaveState("Base")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// The first branch names the existing line of saves main and keeps it current
+	if err := repo.CreateBranch("feature"); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	if err := repo.CreateBranch("feature"); err == nil {
+		t.Error("Expected an error when creating an existing branch")
+	}
+	if err := repo.CreateBranch("abc123"); err == nil {
+		t.Error("Expected an error for a branch name that looks like a hash")
+	}
+	if current, _ := repo.CurrentBranch(); current != "main" {
+		t.Fatalf("Expected main to be current, got %q", current)
+	}
+
+	mockFS.AddTestFile("shared.txt", []byte("main change"))
+	onMain, err := repo.SaveState("On main")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Saves on feature start from the common base, not from the latest save
+	if err := repo.Switch("feature", nil); err != nil {
+		t.Fatalf("Failed to switch branch: %v", err)
+	}
+	if content, _ := mockFS.ReadFile("shared.txt"); string(content) != "common base" {
+		t.Errorf("Expected the branch tip to be checked out, got %q", content)
+	}
+	mockFS.AddTestFile("shared.txt", []byte("feature change"))
+	mockFS.AddTestFile("feature.txt", []byte("feature only"))
+	onFeature, err := repo.SaveState("On feature")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if len(saves) != 3 || saves[2].Hash != onFeature || saves[2].BaseSaveHash != base {
+		t.Fatalf("Expected the feature save to be based on %s, got %+v", base, saves)
+	}
+
+	for branch, expected := range map[string][]string{"main": {base, onMain}, "feature": {base, onFeature}} {
+		branchSaves, err := repo.BranchSaves(branch)
+		if err != nil {
+			t.Fatalf("Failed to list saves of %s: %v", branch, err)
+		}
+		var hashes []string
+		for _, save := range branchSaves {
+			hashes = append(hashes, save.Hash)
+		}
+		if strings.Join(hashes, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expected %s to hold %v, got %v", branch, expected, hashes)
+		}
+	}
+
+	// Each branch restores its own content
+	if err := repo.Switch("main", nil); err != nil {
+		t.Fatalf("Failed to switch branch: %v", err)
+	}
+	if content, _ := mockFS.ReadFile("shared.txt"); string(content) != "main change" {
+		t.Errorf("Expected main's content, got %q", content)
+	}
+	if mockFS.Exists("feature.txt") {
+		t.Error("Expected feature.txt to be removed on main")
+	}
+	content, err := repo.getFileContentFromSave("shared.txt", onFeature)
+	if err != nil || string(content) != "feature change" {
+		t.Errorf("Expected the feature save to stay readable, got %q (%v)", content, err)
+	}
+
+	branches, err := repo.ListBranches()
+	if err != nil {
+		t.Fatalf("Failed to list branches: %v", err)
+	}
+	if len(branches) != 2 || branches[0].Name != "feature" || branches[0].Hash != onFeature ||
+		branches[1].Name != "main" || branches[1].Hash != onMain || !branches[1].Current {
+		t.Errorf("Unexpected branches: %+v", branches)
+	}
+	if err := repo.Switch("missing", nil); err == nil {
+		t.Error("Expected an error when switching to an unknown branch")
+	}
+}
+
+func TestSquashRemoveAndCleanOnBranches(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.AddTestFile("a.txt", []byte("base"))
+	base, err := repo.SaveState("Base")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	if err := repo.CreateBranch("feature"); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+	mockFS.AddTestFile("main.txt", []byte("main"))
+	onMain, err := repo.SaveState("On main")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	mockFS.AddTestFile("a.txt", []byte("main change"))
+	mainTip, err := repo.SaveState("More on main")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	if err := repo.Switch("feature", nil); err != nil {
+		t.Fatalf("Failed to switch branch: %v", err)
+	}
+	mockFS.AddTestFile("feature.txt", []byte("feature"))
+	onFeature, err := repo.SaveState("On feature")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// The feature save is based on a save inside the range, which would go
+	if _, err := repo.Squash(base, onMain); err == nil || !strings.Contains(err.Error(), onFeature) {
+		t.Errorf("Expected a squash leaving the feature save without its parent to be refused, got %v", err)
+	}
+	if _, err := repo.Squash(onMain, mainTip); err != nil {
+		t.Fatalf("Failed to squash the saves of main only: %v", err)
+	}
+	if content, err := repo.getFileContentFromSave("feature.txt", onFeature); err != nil || string(content) != "feature" {
+		t.Errorf("Expected the feature save to stay readable, got %q, %v", content, err)
+	}
+
+	// On main, files are tracked by the tip of main, not by the newest save
+	if err := repo.Switch("main", nil); err != nil {
+		t.Fatalf("Failed to switch branch: %v", err)
+	}
+	if _, err := repo.checkRemovable("feature.txt"); err == nil {
+		t.Error("Expected feature.txt not to be tracked on main")
+	}
+	removed, err := repo.RemoveAndSave("main.txt", "Remove main.txt")
+	if err != nil {
+		t.Fatalf("Failed to remove and save on main: %v", err)
+	}
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if latest := saves[len(saves)-1]; latest.Hash != removed || strings.Join(latest.Files, ",") != "a.txt" {
+		t.Errorf("Expected the removal save to hold main's a.txt only, got %+v", latest)
+	}
+	if content, err := repo.getFileContentFromSave("a.txt", removed); err != nil || string(content) != "main change" {
+		t.Errorf("Expected main's a.txt in the removal save, got %q, %v", content, err)
+	}
+
+	mockFS.AddTestFile("feature.txt", []byte("stray"))
+	if untracked, err := repo.Clean(true); err != nil || strings.Join(untracked, ",") != "feature.txt" {
+		t.Errorf("Expected feature.txt to be untracked on main, got %v, %v", untracked, err)
+	}
+}
+
+// setUpDivergedBranches saves a.txt on a common base, then changes it to
+// mainContent on main and to featureContent on feature, returning the tips
+func setUpDivergedBranches(t *testing.T, mockFS *mockFileSystemWithTestFiles, repo *Repository, mainContent, featureContent string) (string, string) {
+	t.Helper()
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	mockFS.AddTestFile("a.txt", []byte("1\n2\n3\n4\n5\n"))
+	mockFS.AddTestFile("b.txt", []byte("unchanged"))
+	if _, err := repo.SaveState("Base"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	if err := repo.CreateBranch("feature"); err != nil {
+		t.Fatalf("Failed to create branch: %v", err)
+	}
+
+	mockFS.AddTestFile("a.txt", []byte(mainContent))
+	mainTip, err := repo.SaveState("On main")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	if err := repo.Switch("feature", nil); err != nil {
+		t.Fatalf("Failed to switch branch: %v", err)
+	}
+	mockFS.AddTestFile("a.txt", []byte(featureContent))
+	mockFS.AddTestFile("c.txt", []byte("feature file"))
+	featureTip, err := repo.SaveState("On feature")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	if err := repo.Switch("main", nil); err != nil {
+		t.Fatalf("Failed to switch branch: %v", err)
+	}
+	return mainTip, featureTip
+}
+
+func TestMerge(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+	mainTip, featureTip := setUpDivergedBranches(t, mockFS, repo, "one\n2\n3\n4\n5\n", "1\n2\n3\n4\nfive\n")
+
+	result, err := repo.Merge("feature")
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if result.Hash == "" || len(result.Conflicts) != 0 || result.UpToDate {
+		t.Fatalf("Expected a clean merge save, got %+v", result)
+	}
+
+	// Both sides' changes end up in the working tree and in the merge save
+	expected := map[string]string{"a.txt": "one\n2\n3\n4\nfive\n", "b.txt": "unchanged", "c.txt": "feature file"}
+	for file, content := range expected {
+		if working, _ := mockFS.ReadFile(file); string(working) != content {
+			t.Errorf("Expected %s to contain %q, got %q", file, content, working)
+		}
+		if saved, err := repo.getFileContentFromSave(file, result.Hash); err != nil || string(saved) != content {
+			t.Errorf("Expected the merge save to hold %q for %s, got %q (%v)", content, file, saved, err)
+		}
+	}
+
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	merge := saves[len(saves)-1]
+	if merge.Hash != result.Hash || len(merge.MergeParents) != 2 || merge.MergeParents[0] != mainTip || merge.MergeParents[1] != featureTip {
+		t.Errorf("Expected the merge save to record parents %s and %s, got %+v", mainTip, featureTip, merge)
+	}
+	if current, _ := repo.CurrentBranch(); current != "main" {
+		t.Errorf("Expected to stay on main, got %q", current)
+	}
+	if branches, _ := repo.ListBranches(); branches[1].Hash != result.Hash {
+		t.Errorf("Expected main to move to the merge save, got %+v", branches)
+	}
+
+	// The merged save is now part of main's history
+	again, err := repo.Merge(featureTip)
+	if err != nil || !again.UpToDate || again.Hash != "" {
+		t.Errorf("Expected a second merge to be up to date, got %+v (%v)", again, err)
+	}
+}
+
+func TestMergeConflict(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+	mainTip, featureTip := setUpDivergedBranches(t, mockFS, repo, "1\n2\nmain\n4\n5\n", "1\n2\nfeature\n4\n5\n")
+
+	result, err := repo.Merge("feature")
+	if err != nil {
+		t.Fatalf("Merge failed: %v", err)
+	}
+	if result.Hash != "" || len(result.Conflicts) != 1 || result.Conflicts[0] != "a.txt" {
+		t.Fatalf("Expected a conflict in a.txt and no save, got %+v", result)
+	}
+
+	conflicted := "1\n2\n<<<<<<< HEAD\nmain\n=======\nfeature\n>>>>>>> feature\n4\n5\n"
+	if content, _ := mockFS.ReadFile("a.txt"); string(content) != conflicted {
+		t.Errorf("Expected conflict markers in a.txt, got %q", content)
+	}
+	if content, _ := mockFS.ReadFile("c.txt"); string(content) != "feature file" {
+		t.Errorf("Expected files without conflicts to be merged, got %q", content)
+	}
+	if _, err := repo.Merge("feature"); err == nil {
+		t.Error("Expected a second merge to be refused while conflicts are pending")
+	}
+
+	// Saving the resolved tree concludes the merge
+	mockFS.AddTestFile("a.txt", []byte("1\n2\nboth\n4\n5\n"))
+	hash, err := repo.SaveState("Resolve conflict")
+	if err != nil {
+		t.Fatalf("Failed to save resolution: %v", err)
+	}
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	resolved := saves[len(saves)-1]
+	if resolved.Hash != hash || len(resolved.MergeParents) != 2 || resolved.MergeParents[0] != mainTip || resolved.MergeParents[1] != featureTip {
+		t.Errorf("Expected the resolution to record the merge parents, got %+v", resolved)
+	}
+	if pending, _ := repo.readMergeHead(); pending != "" {
+		t.Errorf("Expected the pending merge to be cleared, got %s", pending)
+	}
+}
+
+func TestCheckoutMerge(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("a.txt", []byte("1\n2\n3\n4\n5\n6\n7\n"))
+	mockFS.AddTestFile("b.txt", []byte("one\ntwo\nthree\n"))
+	mockFS.AddTestFile("gone.txt", []byte("deleted later\n"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	mockFS.AddTestFile("a.txt", []byte("1\n2\n3\n4\n5\n6\nseven\n"))
+	mockFS.AddTestFile("b.txt", []byte("one\nTWO\nthree\n"))
+	second, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	if err := repo.Checkout(first); err != nil {
+		t.Fatalf("Failed to check out first save: %v", err)
+	}
+
+	// An edit to other lines applies cleanly, and new and deleted files
+	// stay as they are
+	mockFS.AddTestFile("a.txt", []byte("ONE\n2\n3\n4\n5\n6\n7\n"))
+	mockFS.AddTestFile("notes.txt", []byte("unsaved notes\n"))
+	mockFS.Remove("gone.txt")
+	conflicts, err := repo.CheckoutMerge(second, nil)
+	if err != nil || len(conflicts) != 0 {
+		t.Fatalf("Expected a clean merge, got %v, %v", conflicts, err)
+	}
+	for file, want := range map[string]string{"a.txt": "ONE\n2\n3\n4\n5\n6\nseven\n", "b.txt": "one\nTWO\nthree\n", "notes.txt": "unsaved notes\n"} {
+		if content, _ := mockFS.ReadFile(file); string(content) != want {
+			t.Errorf("Expected %s to be %q, got %q", file, want, content)
+		}
+	}
+	if mockFS.Exists("gone.txt") {
+		t.Error("Expected the deleted file to stay deleted")
+	}
+	if head, _ := repo.Head(); head != second {
+		t.Errorf("Expected %s checked out, got %s", second, head)
+	}
+
+	// An edit to the lines the new save changed conflicts, and the changes
+	// are stashed as they were
+	mockFS.AddTestFile("a.txt", []byte("1\n2\n3\n4\n5\n6\n7\n"))
+	mockFS.Remove("notes.txt")
+	mockFS.AddTestFile("gone.txt", []byte("deleted later\n"))
+	mockFS.AddTestFile("b.txt", []byte("one\nzwei\nthree\n"))
+	conflicts, err = repo.CheckoutMerge(first, nil)
+	if err != nil || !reflect.DeepEqual(conflicts, []string{"b.txt"}) {
+		t.Fatalf("Expected a conflict in b.txt, got %v, %v", conflicts, err)
+	}
+	conflicted := "one\n<<<<<<< " + first + "\ntwo\n=======\nzwei\n>>>>>>> working tree\nthree\n"
+	if content, _ := mockFS.ReadFile("b.txt"); string(content) != conflicted {
+		t.Errorf("Expected conflict markers in b.txt, got %q", content)
+	}
+	stashes, err := repo.Stashes()
+	if err != nil || len(stashes) == 0 {
+		t.Fatalf("Expected the unsaved changes to be stashed, got %v, %v", stashes, err)
+	}
+	if content, err := repo.getFileContentFromSave("b.txt", stashes[0].Save.Hash); err != nil || string(content) != "one\nzwei\nthree\n" {
+		t.Errorf("Expected the stash to keep the edit as it was, got %q, %v", content, err)
+	}
+}
+
+func TestCommandsOutsideRepository(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	mockFS.AddTestFile("file.txt", []byte("content"))
+	repo := NewRepository(mockFS)
+
+	commands := map[string]func() error{
+		"save":       func() error { _, err := repo.SaveState("Save"); return err },
+		"list":       func() error { _, err := repo.ListSaves(); return err },
+		"log":        func() error { _, err := repo.Log(time.Time{}, time.Time{}); return err },
+		"status":     func() error { _, err := repo.Status(); return err },
+		"history":    func() error { _, err := repo.FileHistory("file.txt"); return err },
+		"diff-saves": func() error { _, err := repo.CompareSaves("abc", "def"); return err },
+		"grep":       func() error { _, err := repo.Grep("content", ""); return err },
+		"cat":        func() error { _, err := repo.CatFile("abc", "file.txt"); return err },
+		"checkout":   func() error { return repo.Checkout("abc") },
+		"reflog":     func() error { _, err := repo.Reflog(); return err },
+		"tag":        func() error { return repo.AddTag("abc", "release") },
+		"untag":      func() error { return repo.RemoveTag("release") },
+		"tags":       func() error { _, err := repo.ListTags(); return err },
+		"export":     func() error { return repo.ExportTar("abc", io.Discard) },
+		"size":       func() error { _, err := repo.Size(); return err },
+		"compact":    func() error { _, err := repo.Compact(10); return err },
+		"mv":         func() error { return repo.Move("file.txt", "moved.txt") },
+		"clean":      func() error { _, err := repo.Clean(true); return err },
+	}
+	for name, command := range commands {
+		if err := command(); !errors.Is(err, ErrNotRepository) {
+			t.Errorf("Expected %s outside a repository to fail with ErrNotRepository, got %v", name, err)
+		}
+	}
+	if mockFS.Exists(repo.bitDir) {
+		t.Error("Expected no repository directory to be created")
+	}
+}
+
+func TestOpenRepositoryReportsSearch(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := OpenRepository(util.NewOsFileSystem(), dir)
+	if !errors.Is(err, ErrNotRepository) {
+		t.Fatalf("Expected ErrNotRepository, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "(or any parent up to "+string(filepath.Separator)+")") {
+		t.Errorf("Expected the error to tell how far the search went, got %q", err)
+	}
+}
+
+func TestGlobalIgnore(t *testing.T) {
+	globalIgnore := filepath.Join(t.TempDir(), "ignore")
+	if err := os.WriteFile(globalIgnore, []byte("*.swp\n.DS_Store\n"), 0644); err != nil {
+		t.Fatalf("Failed to write global ignore file: %v", err)
+	}
+	t.Setenv(util.GlobalIgnoreEnv, globalIgnore)
+
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("main.go", []byte("package main"))
+	mockFS.AddTestFile(".main.go.swp", []byte("swap"))
+	mockFS.AddTestFile("docs/.DS_Store", []byte("finder"))
+	mockFS.AddTestFile("keep.swp", []byte("kept on purpose"))
+	// Repository patterns come last, so their negations win
+	mockFS.AddFile(".bitignore", []byte("!keep.swp\n"))
+
+	snap, err := repo.getFilesToSave()
+	if err != nil {
+		t.Fatalf("Failed to get files to save: %v", err)
+	}
+	expected := []string{".bitignore", "keep.swp", "main.go"}
+	if strings.Join(snap.files, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected files %v, got %v", expected, snap.files)
+	}
+
+	// A missing global file is not an error
+	t.Setenv(util.GlobalIgnoreEnv, filepath.Join(t.TempDir(), "missing"))
+	snap, err = repo.getFilesToSave()
+	if err != nil {
+		t.Fatalf("Failed to get files without a global ignore file: %v", err)
+	}
+	if len(snap.files) != 5 {
+		t.Errorf("Expected every file once the global file is gone, got %v", snap.files)
+	}
+}
+
+func TestSaveRefusesCaseCollisions(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("lower"))
+	mockFS.AddTestFile("File.TXT", []byte("upper"))
+	_, err := repo.SaveState("Colliding")
+	if err == nil || !strings.Contains(err.Error(), "File.TXT") || !strings.Contains(err.Error(), "file.txt") {
+		t.Fatalf("Expected the case collision to be reported, got %v", err)
+	}
+	if saves, _ := repo.ListSaves(); len(saves) != 0 {
+		t.Errorf("Expected no save to be made, got %d", len(saves))
+	}
+
+	// Directories differing in case collide as well
+	if err := checkCaseCollisions(snapshot{files: []string{"Docs/a.md", "docs/b.md"}}); err == nil {
+		t.Error("Expected directories differing only in case to collide")
+	}
+	if err := checkCaseCollisions(snapshot{files: []string{"docs/a.md", "docs/b.md", "docs.md"}}); err != nil {
+		t.Errorf("Expected distinct paths to pass, got %v", err)
+	}
+
+	if _, err := repo.SaveStateWithOptions("Allowed", SaveOptions{AllowCaseCollisions: true}); err != nil {
+		t.Errorf("Expected the collision to be saved when allowed, got %v", err)
+	}
+}
+
+func TestSaveIncludeExclude(t *testing.T) {
+	t.Setenv(util.GlobalIgnoreEnv, filepath.Join(t.TempDir(), "missing"))
+
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddFile(".bitignore", []byte("build/\n"))
+	mockFS.AddTestFile("file1.txt", []byte("one"))
+	mockFS.AddTestFile("file2.txt", []byte("two"))
+	mockFS.AddTestFile("build/app.bin", []byte("artifact"))
+	mockFS.AddTestFile("build/app.log", []byte("build log"))
+
+	saved := func(hash string) map[string]bool {
+		t.Helper()
+		metadata, err := repo.loadMetadata()
+		if err != nil {
+			t.Fatalf("Failed to load metadata: %v", err)
+		}
+		files := make(map[string]bool)
+		for _, file := range metadata.Saves[saveIndex(metadata, hash)].Files {
+			files[file] = true
+		}
+		return files
+	}
+
+	// The ignored artifact is force-included for one save, without its log
+	// and without a file excluded despite not being ignored
+	release, err := repo.SaveStateWithOptions("Release", SaveOptions{
+		Include: []string{"build/*.bin"},
+		Exclude: []string{"file2.txt"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to save with overrides: %v", err)
+	}
+	files := saved(release)
+	if !files["build/app.bin"] || files["build/app.log"] || files["file2.txt"] || !files["file1.txt"] {
+		t.Errorf("Expected build/app.bin and not build/app.log or file2.txt in the save, got %v", files)
+	}
+	if content, err := repo.CatFile(release, "build/app.bin"); err != nil || string(content) != "artifact" {
+		t.Errorf("Expected the included artifact to be stored, got %q, %v", content, err)
+	}
+
+	// The overrides are not remembered
+	next, err := repo.SaveState("Next")
+	if err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+	files = saved(next)
+	if files["build/app.bin"] || !files["file2.txt"] {
+		t.Errorf("Expected the next save to follow .bitignore again, got %v", files)
+	}
+	if data, _ := mockFS.ReadFile(".bitignore"); string(data) != "build/\n" {
+		t.Errorf("Expected .bitignore to be left alone, got %q", data)
+	}
+
+	if _, err := repo.SaveStateWithOptions("Bad", SaveOptions{Include: []string{"[unclosed"}}); err == nil {
+		t.Error("Expected an invalid pattern to be rejected")
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	versions := []string{
+		"package main\nfunc main() {\n}\n",
+		"package main\nimport \"fmt\"\nfunc main() {\n}\n",
+		"package main\nimport \"fmt\"\nfunc main() {\n\tfmt.Println(\"hi\")\n}\n",
+	}
+	var hashes []string
+	for i, content := range versions {
+		mockFS.AddTestFile("main.go", []byte(content))
+		mockFS.AddTestFile("other.txt", []byte(fmt.Sprintf("save %d", i)))
+		hash, err := repo.SaveState(fmt.Sprintf("Save %d", i+1))
+		if err != nil {
+			t.Fatalf("Failed to create save: %v", err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	lines, err := repo.Annotate("main.go", "")
+	if err != nil {
+		t.Fatalf("Annotate failed: %v", err)
+	}
+	expected := []struct {
+		hash string
+		line string
+	}{
+		{hashes[0], "package main"},
+		{hashes[1], "import \"fmt\""},
+		{hashes[0], "func main() {"},
+		{hashes[2], "\tfmt.Println(\"hi\")"},
+		{hashes[0], "}"},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %+v", len(expected), lines)
+	}
+	for i, want := range expected {
+		if lines[i].Hash != want.hash || lines[i].Line != want.line || lines[i].Number != i+1 {
+			t.Errorf("Line %d: expected %q from %s, got %+v", i+1, want.line, want.hash, lines[i])
+		}
+	}
+
+	// An earlier save is annotated as it was then
+	lines, err = repo.Annotate("main.go", hashes[1][:8])
+	if err != nil {
+		t.Fatalf("Annotate at an earlier save failed: %v", err)
+	}
+	if len(lines) != 4 || lines[1].Hash != hashes[1] || lines[1].Name != "Save 2" || lines[3].Hash != hashes[0] {
+		t.Errorf("Unexpected annotation at the second save: %+v", lines)
+	}
+
+	if _, err := repo.Annotate("missing.go", ""); err == nil {
+		t.Error("Expected an error for a file not in the save")
+	}
+}
+
+func TestCatFile(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	original := []byte("line one\nline two\r\n\x00binary tail")
+	mockFS.AddTestFile("docs/notes.txt", original)
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	if err := repo.AddTag(first, "v1"); err != nil {
+		t.Fatalf("Failed to tag save: %v", err)
+	}
+	mockFS.AddTestFile("docs/notes.txt", []byte("rewritten"))
+	if _, err := repo.SaveState("Second save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// The earlier content is returned byte for byte, by hash prefix or tag
+	for _, ref := range []string{first, first[:8], "v1"} {
+		content, err := repo.CatFile(ref, "docs/notes.txt")
+		if err != nil {
+			t.Fatalf("CatFile(%s) failed: %v", ref, err)
+		}
+		if !bytes.Equal(content, original) {
+			t.Errorf("CatFile(%s) returned %q, expected %q", ref, content, original)
+		}
+	}
+
+	if _, err := repo.CatFile(first, "missing.txt"); err == nil {
+		t.Error("Expected an error for a file that is not in the save")
+	}
+	if _, err := repo.CatFile("fffffff", "docs/notes.txt"); err == nil {
+		t.Error("Expected an error for an unknown save")
+	}
+}
+
+func TestStorageAttributes(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile(".bitattributes", []byte("*.min.js full\nlog.txt delta\n*.dat binary\n"))
+	mockFS.AddTestFile("app.min.js", []byte("function a(){return 0}"))
+	mockFS.AddTestFile("log.txt", []byte("line 0\n"))
+	mockFS.AddTestFile("plain.txt", []byte("line 0\n"))
+	mockFS.AddTestFile("table.dat", []byte("row 0\n"))
+	if _, err := repo.SaveState("Initial"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Save enough changes for the default policy to store a full copy to
+	// bound the delta chain
+	var hash string
+	for i := 1; i <= maxDeltaChainLength+1; i++ {
+		mockFS.AddTestFile("app.min.js", []byte(fmt.Sprintf("function a(){return %d}", i)))
+		mockFS.AddTestFile("log.txt", append(mockFS.Files["log.txt"], []byte(fmt.Sprintf("line %d\n", i))...))
+		mockFS.AddTestFile("plain.txt", append(mockFS.Files["plain.txt"], []byte(fmt.Sprintf("line %d\n", i))...))
+		mockFS.AddTestFile("table.dat", append(mockFS.Files["table.dat"], []byte(fmt.Sprintf("row %d\n", i))...))
+		var err error
+		hash, err = repo.SaveState(fmt.Sprintf("Save %d", i))
+		if err != nil {
+			t.Fatalf("Failed to create save %d: %v", i, err)
+		}
+
+		deltaSet, err := repo.loadDeltaSet(hash)
+		if err != nil {
+			t.Fatalf("Failed to load delta set: %v", err)
+		}
+		for _, delta := range deltaSet.Deltas {
+			switch delta.Path {
+			case "app.min.js":
+				// Forced to full storage although it would make a small delta
+				if delta.Blob == "" || len(delta.Patches) > 0 {
+					t.Errorf("Save %d: expected app.min.js stored in full only, got %+v", i, delta)
+				}
+			case "log.txt":
+				// Forced to deltas past the chain limit
+				if delta.Blob != "" || len(delta.Patches) == 0 {
+					t.Errorf("Save %d: expected log.txt stored as a delta, got %+v", i, delta)
+				}
+			case "table.dat":
+				if delta.Engine != util.BinaryEngineName {
+					t.Errorf("Save %d: expected table.dat delta made by the binary engine, got %q", i, delta.Engine)
+				}
+			case "plain.txt":
+				if full := delta.Blob != ""; full != (i == maxDeltaChainLength+1) {
+					t.Errorf("Save %d: expected plain.txt in full only at the chain limit, got blob %q", i, delta.Blob)
+				}
+			}
+		}
+	}
+
+	// Every policy restores the same content
+	expected := map[string][]byte{}
+	for _, file := range []string{"app.min.js", "log.txt", "plain.txt", "table.dat"} {
+		expected[file] = append([]byte(nil), mockFS.Files[file]...)
+		mockFS.AddTestFile(file, []byte("scratch"))
+	}
+	if err := repo.Checkout(hash); err != nil {
+		t.Fatalf("Failed to checkout: %v", err)
+	}
+	for file, content := range expected {
+		if !bytes.Equal(mockFS.Files[file], content) {
+			t.Errorf("Expected %s restored to %q, got %q", file, content, mockFS.Files[file])
+		}
+	}
+}
+
+// failingCreateFileSystem fails every Create of a blob once failAfter blobs
+// have been created
+type failingCreateFileSystem struct {
+	util.FileSystem
+	failAfter int
+	created   int
+}
+
+func (fs *failingCreateFileSystem) Create(name string) (util.File, error) {
+	if strings.Contains(filepath.ToSlash(name), "/blobs/") {
+		if fs.failAfter >= 0 && fs.created >= fs.failAfter {
+			return nil, fmt.Errorf("no space left on device")
+		}
+		fs.created++
+	}
+	return fs.FileSystem.Create(name)
+}
+
+func TestSaveRollsBackObjectsOnWriteFailure(t *testing.T) {
+	root := t.TempDir()
+	fs := &failingCreateFileSystem{FileSystem: util.NewOsFileSystem(), failAfter: -1}
+	repo := NewRepositoryAt(fs, root)
+
+	// Store files one at a time so the failing write is deterministic
+	defer func(workers int) { saveWorkers = workers }(saveWorkers)
+	saveWorkers = 1
+	defer func(backoff time.Duration) { objectWriteBackoff = backoff }(objectWriteBackoff)
+	objectWriteBackoff = time.Millisecond
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	writeFile := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	listObjects := func() []string {
+		var objects []string
+		filepath.Walk(repo.objectsDir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				objects = append(objects, path)
+			}
+			return nil
+		})
+		sort.Strings(objects)
+		return objects
+	}
+
+	writeFile("existing.txt", "already stored")
+	if _, err := repo.SaveState("First save"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	before := listObjects()
+
+	// The third new file fails to store
+	for i := 1; i <= 5; i++ {
+		writeFile(fmt.Sprintf("new%d.txt", i), fmt.Sprintf("new content %d", i))
+	}
+	writeFile("shared.txt", "already stored")
+	fs.created, fs.failAfter = 0, 2
+	if _, err := repo.SaveState("Second save"); err == nil {
+		t.Fatal("Expected the save to fail")
+	}
+
+	if after := listObjects(); strings.Join(after, "\n") != strings.Join(before, "\n") {
+		t.Errorf("Expected only the objects of the first save to remain\nbefore: %v\nafter:  %v", before, after)
+	}
+	if saves, err := repo.ListSaves(); err != nil || len(saves) != 1 {
+		t.Errorf("Expected the failed save not to be recorded, got %d saves (%v)", len(saves), err)
+	}
+
+	// The same save succeeds once writes work again
+	fs.failAfter = -1
+	hash, err := repo.SaveState("Second save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	content, err := repo.getFileContentFromSave("new3.txt", hash)
+	if err != nil || string(content) != "new content 3" {
+		t.Errorf("Expected new3.txt to be stored, got %q (%v)", content, err)
+	}
+}
+
+func TestSaveSkipsUnchangedTree(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	mockFS.AddTestFile("file.txt", []byte("content"))
+	first, err := repo.SaveState("First save")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	if _, err := repo.SaveState("Same again"); !errors.Is(err, ErrNothingToSave) {
+		t.Fatalf("Expected ErrNothingToSave, got %v", err)
+	}
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if len(saves) != 1 {
+		t.Fatalf("Expected 1 save, got %d", len(saves))
+	}
+	if _, err := mockFS.Stat(util.DeltaSetPath(first, repo.objectsDir)); err != nil {
+		t.Errorf("Expected the first save to be intact: %v", err)
+	}
+	if head, _ := repo.Head(); head != first {
+		t.Errorf("Expected HEAD to stay at %s, got %s", first, head)
+	}
+
+	// Empty saves can be forced
+	if _, err := repo.SaveStateWithOptions("Forced", SaveOptions{AllowEmpty: true}); err != nil {
+		t.Fatalf("Expected forced empty save to succeed: %v", err)
+	}
+
+	// Any change is saved
+	mockFS.AddTestFile("file.txt", []byte("changed"))
+	if _, err := repo.SaveState("Changed"); err != nil {
+		t.Fatalf("Expected save with changes to succeed: %v", err)
+	}
+	if saves, _ := repo.ListSaves(); len(saves) != 3 {
+		t.Errorf("Expected 3 saves, got %d", len(saves))
+	}
+}
+
+func TestProgress(t *testing.T) {
+	mockFS := NewMockFSWithTestFiles()
+	repo := NewRepository(mockFS)
+
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		mockFS.AddTestFile(fmt.Sprintf("file%02d.txt", i), []byte(fmt.Sprintf("content %d", i)))
+	}
+
+	type update struct {
+		done, total int
+		path        string
+	}
+	var updates []update
+	record := func(done, total int, path string) {
+		updates = append(updates, update{done, total, path})
+	}
+	check := func(operation string, total int) {
+		t.Helper()
+		if len(updates) != total {
+			t.Fatalf("%s: expected %d progress updates, got %d", operation, total, len(updates))
+		}
+		seen := make(map[string]bool)
+		for i, u := range updates {
+			if u.done != i+1 || u.total != total {
+				t.Errorf("%s: update %d is %d/%d, expected %d/%d", operation, i, u.done, u.total, i+1, total)
+			}
+			seen[u.path] = true
+		}
+		if len(seen) != total {
+			t.Errorf("%s: expected every file reported once, got %d distinct paths", operation, len(seen))
+		}
+	}
+
+	hash, err := repo.SaveStateWithOptions("First save", SaveOptions{Progress: record})
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	check("save", 20)
+
+	updates = nil
+	if err := repo.CheckoutWithOptions(hash, CheckoutOptions{Progress: record}); err != nil {
+		t.Fatalf("Failed to checkout: %v", err)
+	}
+	check("checkout", 20)
+
+	// Partial checkouts count only the selected files
+	updates = nil
+	paths := glob.MustCompile("file0*")
+	if err := repo.CheckoutWithOptions(hash, CheckoutOptions{Paths: paths, Progress: record}); err != nil {
+		t.Fatalf("Failed to checkout paths: %v", err)
+	}
+	check("partial checkout", 10)
+}
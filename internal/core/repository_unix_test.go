@@ -0,0 +1,247 @@
+//go:build unix
+
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"bit/internal/util"
+)
+
+func TestCheckoutRestoresExactModes(t *testing.T) {
+	dir := t.TempDir()
+	repo := NewRepositoryAt(util.NewOsFileSystem(), dir)
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+
+	modes := map[string]os.FileMode{"run.sh": 0755, "shared.txt": 0664, "private.txt": 0600}
+	for file, mode := range modes {
+		path := filepath.Join(dir, file)
+		if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", file, err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatalf("Failed to set mode of %s: %v", file, err)
+		}
+	}
+	hash, err := repo.SaveState("Modes")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// A change of mode alone is a change worth saving
+	if err := os.Chmod(filepath.Join(dir, "shared.txt"), 0644); err != nil {
+		t.Fatalf("Failed to change mode: %v", err)
+	}
+	if _, err := repo.SaveState("Mode change"); err != nil {
+		t.Fatalf("Expected a mode change to be saved, got %v", err)
+	}
+
+	// Files are recreated under a umask that would strip group and other bits
+	// and the executable bit alike
+	for file := range modes {
+		if err := os.Remove(filepath.Join(dir, file)); err != nil {
+			t.Fatalf("Failed to remove %s: %v", file, err)
+		}
+	}
+	oldMask := syscall.Umask(0177)
+	defer syscall.Umask(oldMask)
+
+	if err := repo.Checkout(hash); err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+	for file, mode := range modes {
+		info, err := os.Stat(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", file, err)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("Expected %s to be restored with mode %v, got %v", file, mode, info.Mode().Perm())
+		}
+	}
+}
+
+func TestRewrittenSavesKeepModes(t *testing.T) {
+	dir := t.TempDir()
+	repo := NewRepositoryAt(util.NewOsFileSystem(), dir)
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	write := func(file, content string, mode os.FileMode) {
+		t.Helper()
+		path := filepath.Join(dir, file)
+		if err := os.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatalf("Failed to write %s: %v", file, err)
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatalf("Failed to set mode of %s: %v", file, err)
+		}
+	}
+	write("run.sh", "#!/bin/sh\n", 0755)
+	write("notes.txt", "notes\n", 0644)
+	write("drop.txt", "drop\n", 0644)
+	first, err := repo.SaveState("First")
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	write("notes.txt", "more notes\n", 0644)
+	if _, err := repo.SaveState("Second"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	// Saves made from the content of another save keep its modes
+	removed, err := repo.RemoveAndSave("drop.txt", "Remove drop.txt")
+	if err != nil {
+		t.Fatalf("Failed to remove and save: %v", err)
+	}
+	if mode := repo.modesInSave(removed)["run.sh"]; mode != 0755 {
+		t.Errorf("Expected run.sh to keep mode 0755 after rm --save, got %v", mode)
+	}
+	squashed, err := repo.Squash(first, removed)
+	if err != nil {
+		t.Fatalf("Failed to squash: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "run.sh")); err != nil {
+		t.Fatalf("Failed to remove run.sh: %v", err)
+	}
+	if err := repo.Checkout(squashed); err != nil {
+		t.Fatalf("Checkout failed: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "run.sh"))
+	if err != nil {
+		t.Fatalf("Failed to stat run.sh: %v", err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("Expected run.sh checked out with mode 0755 after squash, got %v", info.Mode().Perm())
+	}
+
+	// Modes survive a round trip through a tar archive
+	var archive bytes.Buffer
+	if err := repo.ExportTar(squashed, &archive); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	imported, err := repo.ImportTar("Imported", &archive)
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if modes := repo.modesInSave(imported); modes["run.sh"] != 0755 || modes["notes.txt"] != 0644 {
+		t.Errorf("Expected imported files to keep their modes, got %v", modes)
+	}
+}
+
+func TestSaveHooks(t *testing.T) {
+	dir := t.TempDir()
+	repo := NewRepositoryAt(util.NewOsFileSystem(), dir)
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package  main\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	hooks := filepath.Join(dir, ".bit", "hooks")
+	if err := os.MkdirAll(hooks, 0755); err != nil {
+		t.Fatalf("Failed to create hooks directory: %v", err)
+	}
+	writeHook := func(name, script string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(hooks, name), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+			t.Fatalf("Failed to write %s hook: %v", name, err)
+		}
+	}
+
+	// The pre-save hook runs in the repository root before files are read,
+	// and the post-save hook learns the name and hash of the save
+	out := filepath.Join(t.TempDir(), "post-save.out")
+	t.Setenv("HOOK_OUT", out)
+	writeHook("pre-save", "printf 'package main\\n' > main.go\n")
+	writeHook("post-save", "echo \"$1 $2 $BIT_SAVE_NAME $BIT_SAVE_HASH\" > \"$HOOK_OUT\"\n")
+
+	hash, err := repo.SaveState("Formatted")
+	if err != nil {
+		t.Fatalf("Failed to save with hooks: %v", err)
+	}
+	if content, err := repo.CatFile(hash, "main.go"); err != nil || string(content) != "package main\n" {
+		t.Errorf("Expected the pre-save hook's changes to be saved, got %q, %v", content, err)
+	}
+	if data, err := os.ReadFile(out); err != nil || string(data) != "Formatted "+hash+" Formatted "+hash+"\n" {
+		t.Errorf("Expected the post-save hook to receive the save, got %q, %v", data, err)
+	}
+
+	// A failing pre-save hook aborts the save
+	writeHook("pre-save", "exit 3\n")
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("changed\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := repo.SaveState("Refused"); err == nil || !strings.Contains(err.Error(), "pre-save") {
+		t.Errorf("Expected the pre-save hook to abort the save, got %v", err)
+	}
+	saves, err := repo.ListSaves()
+	if err != nil {
+		t.Fatalf("Failed to list saves: %v", err)
+	}
+	if len(saves) != 1 {
+		t.Errorf("Expected only the first save, got %d", len(saves))
+	}
+
+	// Hooks that are not executable are ignored
+	if err := os.Chmod(filepath.Join(hooks, "pre-save"), 0644); err != nil {
+		t.Fatalf("Failed to change hook mode: %v", err)
+	}
+	if _, err := repo.SaveState("Unhooked"); err != nil {
+		t.Errorf("Expected a non-executable hook to be skipped, got %v", err)
+	}
+}
+
+func TestSaveRereadsFilesChangedWhileMapped(t *testing.T) {
+	originalThreshold := util.MmapThreshold
+	defer func() { util.MmapThreshold = originalThreshold }()
+	util.MmapThreshold = 4
+
+	dir := t.TempDir()
+	repo := NewRepositoryAt(util.NewOsFileSystem(), dir)
+	if err := repo.InitRepository(); err != nil {
+		t.Fatalf("Failed to initialize repository: %v", err)
+	}
+	path := filepath.Join(dir, "large.txt")
+	if err := os.WriteFile(path, []byte("original content\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := repo.SaveState("First"); err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+
+	if err := os.WriteFile(path, []byte("edited content\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	// The file is written again once its mapped content has been stored
+	reports := 0
+	hash, err := repo.SaveStateWithReport("Second", func(report FileReport) {
+		if reports++; reports == 1 {
+			if err := os.WriteFile(path, []byte("content written during the save\n"), 0644); err != nil {
+				t.Errorf("Failed to write file: %v", err)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to create save: %v", err)
+	}
+	if reports != 2 {
+		t.Errorf("Expected the save to be retried once, got %d reports", reports)
+	}
+
+	content, err := repo.CatFile(hash, "large.txt")
+	if err != nil || string(content) != "content written during the save\n" {
+		t.Errorf("Expected the save to record the file as last written, got %q, %v", content, err)
+	}
+	if issues, err := repo.VerifyIntegrity(); err != nil || len(issues) != 0 {
+		t.Errorf("Expected an intact repository, got %v, %v", issues, err)
+	}
+}
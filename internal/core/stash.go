@@ -0,0 +1,221 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// stashDir holds the working tree backups inside the repository directory,
+// one <name>.json file each
+const stashDir = "stash"
+
+// stashTimeFormat names stashes after the time they were taken, so that
+// their names sort oldest first
+const stashTimeFormat = "20060102T150405.000000000"
+
+// Stash is a backup of a working tree with unsaved changes, taken before a
+// checkout replaced it. Its files are stored like a save that is based on no
+// other save, but the save is kept out of the metadata: it is not listed,
+// cannot be checked out and is removed once the stash is popped or too many
+// newer stashes were taken.
+type Stash struct {
+	Name    string `json:"name"`    // When the stash was taken, in UTC
+	Command string `json:"command"` // Command whose checkout replaced the working tree
+	Head    string `json:"head"`    // Save checked out when the stash was taken
+	Save    Save   `json:"save"`
+}
+
+// stashPath returns where the stash with the given name is stored
+func (r *Repository) stashPath(name string) string {
+	return filepath.Join(r.bitDir, stashDir, name+".json")
+}
+
+// stashWorkingTree backs up the working tree before command replaces it,
+// unless it has no unsaved changes or the maxStashes setting disables
+// backups. Only the newest maxStashes stashes are kept. Callers hold the
+// repository lock.
+func (r *Repository) stashWorkingTree(command string) error {
+	config, err := r.loadConfig()
+	if err != nil {
+		return err
+	}
+	if config.MaxStashes == 0 {
+		return nil
+	}
+	if clean, err := r.IsClean(); err != nil || clean {
+		return err
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		return err
+	}
+	snap, err := r.getFilesToSave()
+	if err != nil {
+		return err
+	}
+
+	// Every file is stored in full, so the stash survives any later change
+	// to the saves
+	timestamp := time.Now()
+	op := r.newOperation()
+	save, err := r.writeSave(op, "stash before "+command, timestamp, snap, r.workingTreeSource(snap), nil)
+	if err != nil {
+		op.rollback()
+		return fmt.Errorf("failed to stash the working tree: %w", err)
+	}
+
+	stash := Stash{Name: timestamp.UTC().Format(stashTimeFormat), Command: command, Head: head, Save: save}
+	data, err := json.MarshalIndent(stash, "", "  ")
+	if err != nil {
+		op.rollback()
+		return fmt.Errorf("failed to marshal stash: %w", err)
+	}
+	if err := r.fs.MkdirAll(r.bitPath(stashDir), 0755); err != nil {
+		op.rollback()
+		return fmt.Errorf("failed to create stash directory: %w", err)
+	}
+	if err := r.fs.WriteFile(r.stashPath(stash.Name), data, 0644); err != nil {
+		op.rollback()
+		return fmt.Errorf("failed to write stash: %w", err)
+	}
+
+	stashes, err := r.loadStashes()
+	if err != nil {
+		return err
+	}
+	for _, old := range stashes[min(config.MaxStashes, len(stashes)):] {
+		r.dropStash(old)
+	}
+	return nil
+}
+
+// Stashes returns the working tree backups taken before checkouts, newest
+// first
+func (r *Repository) Stashes() ([]Stash, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return nil, err
+	}
+	return r.loadStashes()
+}
+
+// loadStashes reads every stash, newest first
+func (r *Repository) loadStashes() ([]Stash, error) {
+	entries, err := r.fs.ReadDir(r.bitPath(stashDir))
+	if os.IsNotExist(err) {
+		return []Stash{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list stashes: %w", err)
+	}
+
+	stashes := []Stash{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if entry.IsDir() || !ok {
+			continue
+		}
+		data, err := r.fs.ReadFile(r.stashPath(name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stash %s: %w", name, err)
+		}
+		var stash Stash
+		if err := json.Unmarshal(data, &stash); err != nil {
+			return nil, fmt.Errorf("failed to parse stash %s: %w", name, err)
+		}
+		stashes = append(stashes, stash)
+	}
+
+	sort.Slice(stashes, func(i, j int) bool {
+		return stashes[i].Name > stashes[j].Name
+	})
+	return stashes, nil
+}
+
+// PopStash restores the working tree backed up by the stash with the given
+// name, or by the newest stash when name is empty, checks out the save that
+// was checked out when it was taken and removes the stash. The working tree
+// is replaced, so PopStash refuses to run when it has unsaved changes. The
+// popped stash is returned.
+func (r *Repository) PopStash(name string) (Stash, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return Stash{}, err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return Stash{}, err
+	}
+	defer unlock()
+
+	stashes, err := r.loadStashes()
+	if err != nil {
+		return Stash{}, err
+	}
+	var stash *Stash
+	for i := range stashes {
+		if name == "" || stashes[i].Name == name {
+			stash = &stashes[i]
+			break
+		}
+	}
+	if stash == nil && name == "" {
+		return Stash{}, fmt.Errorf("no stash to pop")
+	} else if stash == nil {
+		return Stash{}, fmt.Errorf("stash %s not found", name)
+	}
+
+	clean, err := r.IsClean()
+	if err != nil {
+		return Stash{}, err
+	}
+	if !clean {
+		return Stash{}, fmt.Errorf("the working tree has unsaved changes; save them before popping a stash")
+	}
+
+	if err := r.restoreSave(stash.Save, CheckoutOptions{}); err != nil {
+		return Stash{}, err
+	}
+	if err := r.saveRenames(nil); err != nil {
+		return Stash{}, err
+	}
+	if err := r.clearMergeHead(); err != nil {
+		return Stash{}, err
+	}
+
+	// The save may have been undone since the stash was taken
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return Stash{}, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	if saveIndex(metadata, stash.Head) >= 0 {
+		if err := r.setHead("stash pop", stash.Head); err != nil {
+			return Stash{}, err
+		}
+	}
+
+	r.dropStash(*stash)
+	return *stash, nil
+}
+
+// dropStash removes a stash and the objects of its save. Blobs may be shared
+// with saves and are left in place.
+func (r *Repository) dropStash(stash Stash) {
+	r.fs.Remove(r.stashPath(stash.Name))
+	r.removeSaveObjects(stash.Save)
+}
+
+// stashSaves returns the saves storing the stashes, for the code that tells
+// which objects are still referred to. Unreadable stashes are left out.
+func (r *Repository) stashSaves() []Save {
+	stashes, _ := r.loadStashes()
+	saves := make([]Save, 0, len(stashes))
+	for _, stash := range stashes {
+		saves = append(saves, stash.Save)
+	}
+	return saves
+}
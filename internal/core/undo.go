@@ -0,0 +1,115 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Undo rewinds the repository by one save: the checked out save, which must
+// be the latest one, is replaced in the working tree by the save it was based
+// on and is then deleted together with the objects no other save refers to.
+// Unsaved changes would be lost, so Undo refuses to run when there are any
+// unless force is set. The deleted save is returned.
+func (r *Repository) Undo(force bool) (Save, error) {
+	if err := r.ensureInitialized(); err != nil {
+		return Save{}, err
+	}
+
+	unlock, err := r.lock()
+	if err != nil {
+		return Save{}, err
+	}
+	defer unlock()
+
+	metadata, err := r.loadMetadata()
+	if err != nil {
+		return Save{}, fmt.Errorf("failed to load metadata: %w", err)
+	}
+	if len(metadata.Saves) == 0 {
+		return Save{}, fmt.Errorf("nothing to undo")
+	}
+	latest := metadata.Saves[len(metadata.Saves)-1]
+
+	// Saves made later could be based on or store deltas against an earlier
+	// save, so only the latest one can be deleted safely
+	head, err := r.Head()
+	if err != nil {
+		return Save{}, err
+	}
+	if head != latest.Hash {
+		return Save{}, fmt.Errorf("can only undo the latest save %s, but %s is checked out", latest.Hash, head)
+	}
+	if latest.BaseSaveHash == "" {
+		return Save{}, fmt.Errorf("cannot undo save %s: there is no earlier save to return to", latest.Hash)
+	}
+	for tag, hash := range metadata.Tags {
+		if hash == latest.Hash {
+			return Save{}, fmt.Errorf("cannot undo save %s: it is tagged %s", latest.Hash, tag)
+		}
+	}
+
+	if !force {
+		clean, err := r.IsClean()
+		if err != nil {
+			return Save{}, err
+		}
+		if !clean {
+			return Save{}, fmt.Errorf("the working tree has unsaved changes; save them or use force to discard them")
+		}
+	}
+
+	if err := r.checkout("undo", latest.BaseSaveHash, CheckoutOptions{}); err != nil {
+		return Save{}, err
+	}
+	if err := r.deleteSave(metadata, latest); err != nil {
+		return Save{}, err
+	}
+	return latest, nil
+}
+
+// deleteSave removes save from metadata, moving branches at it back to the
+// save it was based on, and then removes its delta set and the objects no
+// other save refers to. Callers hold the repository lock and make sure no
+// other save depends on it.
+func (r *Repository) deleteSave(metadata Metadata, save Save) error {
+	// Objects are attributed before the save disappears from the metadata.
+	// Stashes are kept out of the metadata but may share the save's blobs.
+	blobOwners := r.blobOwners(metadata)
+	stashBlobs := r.blobOwners(Metadata{Saves: r.stashSaves()})
+
+	i := saveIndex(metadata, save.Hash)
+	if i < 0 {
+		return fmt.Errorf("save with hash %s not found", save.Hash)
+	}
+	metadata.Saves = append(metadata.Saves[:i:i], metadata.Saves[i+1:]...)
+	for branch, tip := range metadata.Branches {
+		if tip == save.Hash {
+			metadata.Branches[branch] = save.BaseSaveHash
+		}
+	}
+	if err := r.saveMetadata(metadata); err != nil {
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+
+	var owned []string
+	err := r.forEachObject("", func(rel string, info os.FileInfo) error {
+		if blob, ok := strings.CutPrefix(rel, "blobs/"); ok && stashBlobs[blob] != "" {
+			return nil
+		}
+		if objectOwner(rel, blobOwners) == save.Hash {
+			owned = append(owned, rel)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	for _, rel := range owned {
+		if err := r.fs.Remove(filepath.Join(r.objectsDir, filepath.FromSlash(rel))); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove object %s: %w", rel, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// StoragePolicy selects how the content of a file is stored in a save
+type StoragePolicy string
+
+const (
+	// StorageDefault stores deltas, falling back to full content when the
+	// delta chain grows too long
+	StorageDefault StoragePolicy = ""
+	// StorageFull always stores changed content as a full compressed blob
+	StorageFull StoragePolicy = "full"
+	// StorageDelta always stores changes as deltas, however long the chain
+	StorageDelta StoragePolicy = "delta"
+	// StorageBinary stores deltas made by the binary engine
+	StorageBinary StoragePolicy = "binary"
+)
+
+// Attributes maps file patterns to storage policies
+type Attributes struct {
+	rules []attributeRule
+}
+
+type attributeRule struct {
+	pattern glob.Glob
+	policy  StoragePolicy
+}
+
+// LoadAttributes loads the attributes from the given file using the provided filesystem
+func LoadAttributes(attributesFile string, fs FileSystem) (Attributes, error) {
+	file, err := fs.Open(attributesFile)
+	if err != nil {
+		return Attributes{}, err
+	}
+	defer file.Close()
+
+	return ParseAttributes(file)
+}
+
+// ParseAttributes reads attributes from r. Each line holds a pattern and a
+// storage policy separated by whitespace, such as "*.min.js full". Patterns,
+// comments and escapes follow the .bitignore grammar. When several patterns
+// match a file, the last one wins.
+func ParseAttributes(r io.Reader) (Attributes, error) {
+	var attributes Attributes
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := parseIgnoreLine(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		// The policy is the last field, so patterns may contain escaped spaces
+		split := strings.LastIndexAny(line, " \t")
+		if split < 0 {
+			return Attributes{}, fmt.Errorf("line %d: expected a pattern and a storage policy", lineNumber)
+		}
+		pattern := strings.TrimRight(line[:split], " \t")
+		policy := StoragePolicy(line[split+1:])
+
+		switch policy {
+		case StorageFull, StorageDelta, StorageBinary:
+		default:
+			return Attributes{}, fmt.Errorf("line %d: unknown storage policy %q (want full, delta or binary)", lineNumber, policy)
+		}
+
+		compiledPattern, err := compilePattern(pattern)
+		if err != nil {
+			return Attributes{}, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		attributes.rules = append(attributes.rules, attributeRule{pattern: compiledPattern, policy: policy})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return Attributes{}, err
+	}
+
+	return attributes, nil
+}
+
+// StoragePolicy returns the policy of the last pattern matching path, or
+// StorageDefault when none does
+func (a Attributes) StoragePolicy(path string) StoragePolicy {
+	for i := len(a.rules) - 1; i >= 0; i-- {
+		if matchesPattern(a.rules[i].pattern, path) {
+			return a.rules[i].policy
+		}
+	}
+	return StorageDefault
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAttributes(t *testing.T) {
+	content := `
+# Generated files never diff well
+*.min.js      full
+package-lock.json full   # trailing comment
+data/         delta
+data/*.bin    binary
+`
+	attributes, err := ParseAttributes(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("ParseAttributes failed: %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		expected StoragePolicy
+	}{
+		{"app.min.js", StorageFull},
+		{"static/vendor.min.js", StorageFull},
+		{"app.js", StorageDefault},
+		{"package-lock.json", StorageFull},
+		{"data/large.csv", StorageDelta},
+		// The last matching pattern wins
+		{"data/model.bin", StorageBinary},
+		{"other/model.bin", StorageDefault},
+	}
+	for _, test := range tests {
+		if policy := attributes.StoragePolicy(test.path); policy != test.expected {
+			t.Errorf("StoragePolicy(%q) = %q, expected %q", test.path, policy, test.expected)
+		}
+	}
+}
+
+func TestParseAttributesErrors(t *testing.T) {
+	for _, content := range []string{
+		"*.js\n",
+		"*.js compressed\n",
+		"[ full\n",
+	} {
+		if _, err := ParseAttributes(strings.NewReader(content)); err == nil {
+			t.Errorf("Expected an error parsing %q", content)
+		}
+	}
+}
+
+func TestLoadAttributes(t *testing.T) {
+	fs := NewMockFileSystem()
+	fs.AddFile(".bitattributes", []byte("*.min.js full\n"))
+
+	attributes, err := LoadAttributes(".bitattributes", fs)
+	if err != nil {
+		t.Fatalf("LoadAttributes failed: %v", err)
+	}
+	if policy := attributes.StoragePolicy("app.min.js"); policy != StorageFull {
+		t.Errorf("Expected full storage, got %q", policy)
+	}
+
+	if _, err := LoadAttributes("missing", fs); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
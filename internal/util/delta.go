@@ -2,16 +2,21 @@
 package util
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"net/url"
+	"os"
 	"path/filepath"
-
-	"github.com/sergi/go-diff/diffmatchpatch"
+	"strings"
 )
 
 // CompressionConfig holds configuration options for delta compression
@@ -19,21 +24,30 @@ var CompressionConfig = struct {
 	Enabled                bool
 	MinSizeForCompression  int  // Minimum size in bytes before compressing (smaller patches don't benefit as much)
 	CompressNewFileContent bool // Whether to also compress new file content when saved as full files
+	Level                  int  // gzip compression level, from gzip.HuffmanOnly to gzip.BestCompression
 }{
 	Enabled:                true,
 	MinSizeForCompression:  1,    // Always compress regardless of size
 	CompressNewFileContent: true, // Always compress new file content too
+	Level:                  gzip.DefaultCompression,
 }
 
 // DeltaInfo stores information about a file delta
 type DeltaInfo struct {
-	Path         string   `json:"path"`         // File path
-	IsNew        bool     `json:"isNew"`        // Whether this is a new file
-	IsDeleted    bool     `json:"isDeleted"`    // Whether the file was deleted
-	BaseSaveHash string   `json:"baseSaveHash"` // Hash of the save this delta is based on (empty for full file)
-	Patches      []string `json:"patches"`      // JSON representation of the patches
-	ContentHash  string   `json:"contentHash"`  // Hash of the file content (for verification)
-	Compressed   bool     `json:"compressed"`   // Whether the patches are compressed
+	Path         string      `json:"path"`                  // File path
+	IsNew        bool        `json:"isNew"`                 // Whether this is a new file
+	IsDeleted    bool        `json:"isDeleted"`             // Whether the file was deleted
+	BaseSaveHash string      `json:"baseSaveHash"`          // Hash of the save this delta is based on (empty for full file)
+	Patches      []string    `json:"patches"`               // Patch text, base64 encoded for engines other than the text engine
+	ContentHash  string      `json:"contentHash"`           // Hash of the file content (for verification)
+	Compressed   bool        `json:"compressed"`            // Whether the patches are compressed
+	Blob         string      `json:"blob,omitempty"`        // Content hash of the full-file blob stored for this save, if any
+	IsSymlink    bool        `json:"isSymlink,omitempty"`   // Whether the content is the target of a symbolic link
+	Engine       string      `json:"engine,omitempty"`      // Name of the DeltaEngine that made the patches (empty for the text engine)
+	RenamedFrom  string      `json:"renamedFrom,omitempty"` // Path of the file in the base save when the file was renamed
+	Mode         os.FileMode `json:"mode,omitempty"`        // Permission bits of the file, restored exactly on checkout
+	Normalized   bool        `json:"normalized,omitempty"`  // Whether \r\n line endings were stored as \n
+	ModTime      int64       `json:"modTime,omitempty"`     // Modification time of the file in nanoseconds since the Unix epoch, restored on checkout
 }
 
 // DeltaSet represents a collection of deltas for a single save
@@ -42,8 +56,17 @@ type DeltaSet struct {
 	Deltas   []DeltaInfo `json:"deltas"`   // List of deltas
 }
 
-// CalculateDelta computes the delta between two versions of a file
+// CalculateDelta computes the delta between two versions of a file. A nil
+// version stands for a missing file, so nil oldContent makes a new file and nil
+// newContent a deleted one, while an empty but non-nil slice is a file with no
+// bytes; use EmptyIfNil on content read from a file that exists.
 func CalculateDelta(oldContent, newContent []byte, path string, baseSaveHash string) DeltaInfo {
+	return CalculateDeltaWithEngine(oldContent, newContent, path, baseSaveHash, DeltaEngineConfig.Engine)
+}
+
+// CalculateDeltaWithEngine is like CalculateDelta but makes the patches with the
+// named engine instead of the configured one
+func CalculateDeltaWithEngine(oldContent, newContent []byte, path string, baseSaveHash string, engineName string) DeltaInfo {
 	// If old content is nil, this is a new file
 	if oldContent == nil {
 		return DeltaInfo{
@@ -52,7 +75,7 @@ func CalculateDelta(oldContent, newContent []byte, path string, baseSaveHash str
 			IsDeleted:    false,
 			BaseSaveHash: "",
 			Patches:      nil,
-			ContentHash:  calculateFileHash(newContent),
+			ContentHash:  CalculateFileHash(newContent),
 			Compressed:   true, // Set to true by default
 		}
 	}
@@ -65,20 +88,27 @@ func CalculateDelta(oldContent, newContent []byte, path string, baseSaveHash str
 			IsDeleted:    true,
 			BaseSaveHash: baseSaveHash,
 			Patches:      nil,
-			ContentHash:  calculateFileHash(oldContent),
+			ContentHash:  CalculateFileHash(oldContent),
 			Compressed:   true, // Set to true by default
 		}
 	}
 
-	// Calculate patches
-	dmp := diffmatchpatch.New()
-	patches := dmp.PatchMake(string(oldContent), string(newContent))
-	patchesText := dmp.PatchToText(patches)
-
-	// Split patch text by newlines to store as array
-	patchesArray := []string{patchesText}
-	if len(patchesText) == 0 {
-		patchesArray = nil // No changes, file is identical
+	// Calculate patches with the configured engine, falling back to the
+	// binary engine, which handles any content, so that a delta is always produced
+	var patchesArray []string
+	usedEngine := ""
+	if !bytes.Equal(oldContent, newContent) {
+		engine, err := GetDeltaEngine(engineName)
+		if err != nil {
+			engine = BinaryDeltaEngine{}
+		}
+		patch, err := engine.Make(oldContent, newContent)
+		if err != nil {
+			engine = BinaryDeltaEngine{}
+			patch, _ = engine.Make(oldContent, newContent)
+		}
+		usedEngine = engine.Name()
+		patchesArray = []string{encodePatch(usedEngine, patch)}
 	}
 
 	return DeltaInfo{
@@ -87,38 +117,82 @@ func CalculateDelta(oldContent, newContent []byte, path string, baseSaveHash str
 		IsDeleted:    false,
 		BaseSaveHash: baseSaveHash,
 		Patches:      patchesArray,
-		ContentHash:  calculateFileHash(newContent),
+		ContentHash:  CalculateFileHash(newContent),
 		Compressed:   true, // Set to true by default
+		Engine:       usedEngine,
 	}
 }
 
-// ApplyDelta applies a delta to reconstruct a file
-func ApplyDelta(delta DeltaInfo, baseContentProvider func(path, saveHash string) ([]byte, error)) ([]byte, error) {
-	// Handle new file
-	if delta.IsNew {
-		// For new files, we need to get the full content from the save
-		return baseContentProvider(delta.Path, delta.BaseSaveHash)
+// encodePatch converts a patch into its stored text form. Text engine patches
+// are stored as is, all others are base64 encoded.
+func encodePatch(engineName string, patch []byte) string {
+	if engineName == "" || engineName == TextEngineName {
+		return string(patch)
 	}
+	return base64.StdEncoding.EncodeToString(patch)
+}
 
-	// Handle deleted file
+// decodePatch reverses encodePatch
+func decodePatch(engineName, text string) ([]byte, error) {
+	if engineName == "" || engineName == TextEngineName {
+		return []byte(text), nil
+	}
+	return base64.StdEncoding.DecodeString(text)
+}
+
+// EmptyIfNil returns content as the content of a file that exists: an empty
+// file yields an empty, non-nil slice, which CalculateDelta does not mistake
+// for a missing file
+func EmptyIfNil(content []byte) []byte {
+	if content == nil {
+		return []byte{}
+	}
+	return content
+}
+
+// ApplyDelta applies a delta to reconstruct a file. The content of a file that
+// exists is never nil, even when empty; a deleted file yields nil.
+func ApplyDelta(delta DeltaInfo, baseContentProvider func(path, saveHash string) ([]byte, error)) ([]byte, error) {
 	if delta.IsDeleted {
 		return nil, nil
 	}
+	content, err := applyDelta(delta, baseContentProvider)
+	if err != nil {
+		return nil, err
+	}
+	return EmptyIfNil(content), nil
+}
+
+// DeltaBase returns the path and save of the content ApplyDelta passes delta
+// to: its own path at the base save, or the previous path of a renamed file.
+// Deleted files have no base.
+func DeltaBase(delta DeltaInfo) (path, saveHash string) {
+	if delta.RenamedFrom != "" && !delta.IsNew {
+		return delta.RenamedFrom, delta.BaseSaveHash
+	}
+	return delta.Path, delta.BaseSaveHash
+}
+
+// applyDelta reconstructs the content of a file that was not deleted
+func applyDelta(delta DeltaInfo, baseContentProvider func(path, saveHash string) ([]byte, error)) ([]byte, error) {
+	basePath, baseSaveHash := DeltaBase(delta)
 
-	// Handle no changes
-	if delta.Patches == nil || len(delta.Patches) == 0 {
-		// File exists but has no changes, get base version
-		return baseContentProvider(delta.Path, delta.BaseSaveHash)
+	// Handle new files and no changes
+	if delta.IsNew || delta.Patches == nil || len(delta.Patches) == 0 {
+		// The content is that of the base version
+		return baseContentProvider(basePath, baseSaveHash)
 	}
 
 	// Get base content
-	baseContent, err := baseContentProvider(delta.Path, delta.BaseSaveHash)
+	baseContent, err := baseContentProvider(basePath, baseSaveHash)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get base content: %w", err)
 	}
 
-	// Apply patches
-	dmp := diffmatchpatch.New()
+	engine, err := GetDeltaEngine(delta.Engine)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply delta to %s: %w", delta.Path, err)
+	}
 
 	// Handle compressed patches
 	patchText := delta.Patches[0]
@@ -130,20 +204,22 @@ func ApplyDelta(delta DeltaInfo, baseContentProvider func(path, saveHash string)
 		}
 	}
 
-	patches, err := dmp.PatchFromText(patchText)
+	patch, err := decodePatch(delta.Engine, patchText)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse patches: %w", err)
+		return nil, fmt.Errorf("failed to decode patches: %w", err)
 	}
 
-	newContent, _ := dmp.PatchApply(patches, string(baseContent))
-	resultContent := []byte(newContent)
+	newContent, err := engine.Apply(baseContent, patch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply delta to %s: %w", delta.Path, err)
+	}
 
 	// Verify content hash
-	if calculateFileHash(resultContent) != delta.ContentHash {
+	if CalculateFileHash(newContent) != delta.ContentHash {
 		return nil, fmt.Errorf("content hash mismatch after applying delta")
 	}
 
-	return resultContent, nil
+	return newContent, nil
 }
 
 // SaveDeltaSet stores a set of deltas to disk using the provided filesystem
@@ -155,23 +231,15 @@ func SaveDeltaSet(deltaSet DeltaSet, objectsDir string, fs FileSystem) error {
 	}
 
 	for i, delta := range deltaSet.Deltas {
-		compressedDelta := delta
-
-		// Compress the delta patches if they exist and the delta is marked for compression
-		if delta.Compressed && delta.Patches != nil && len(delta.Patches) > 0 {
-			// Compress the patch data
-			compressed, err := compressString(delta.Patches[0])
-			if err != nil {
-				return fmt.Errorf("failed to compress delta for %s: %w", delta.Path, err)
-			}
-			compressedDelta.Patches = []string{compressed}
+		compressedDelta, err := CompressDelta(delta)
+		if err != nil {
+			return err
 		}
-
 		compressedDeltaSet.Deltas[i] = compressedDelta
 	}
 
 	// Create delta file path
-	deltaPath := filepath.Join(objectsDir, "delta_"+deltaSet.SaveHash+".json")
+	deltaPath := DeltaSetPath(deltaSet.SaveHash, objectsDir)
 
 	// Marshal to JSON
 	data, err := json.MarshalIndent(compressedDeltaSet, "", "  ")
@@ -187,12 +255,28 @@ func SaveDeltaSet(deltaSet DeltaSet, objectsDir string, fs FileSystem) error {
 	return nil
 }
 
+// CompressDelta returns delta with its patches compressed as stored in a delta
+// set, if it is marked for compression. Deltas loaded with LoadDeltaSet are
+// already compressed.
+func CompressDelta(delta DeltaInfo) (DeltaInfo, error) {
+	// Compress the delta patches if they exist and the delta is marked for compression
+	if delta.Compressed && delta.Patches != nil && len(delta.Patches) > 0 {
+		// Compress the patch data
+		compressed, err := compressString(delta.Patches[0])
+		if err != nil {
+			return delta, fmt.Errorf("failed to compress delta for %s: %w", delta.Path, err)
+		}
+		delta.Patches = []string{compressed}
+	}
+	return delta, nil
+}
+
 // LoadDeltaSet loads a set of deltas from disk using the provided filesystem
 func LoadDeltaSet(saveHash, objectsDir string, fs FileSystem) (DeltaSet, error) {
 	var deltaSet DeltaSet
 
 	// Create delta file path
-	deltaPath := filepath.Join(objectsDir, "delta_"+saveHash+".json")
+	deltaPath := DeltaSetPath(saveHash, objectsDir)
 
 	// Read file
 	data, err := fs.ReadFile(deltaPath)
@@ -208,10 +292,18 @@ func LoadDeltaSet(saveHash, objectsDir string, fs FileSystem) (DeltaSet, error)
 	return deltaSet, nil
 }
 
+// DeltaSetPath returns the location of the delta set for the given save
+func DeltaSetPath(saveHash, objectsDir string) string {
+	return filepath.Join(objectsDir, "delta_"+saveHash+".json")
+}
+
 // compressString compresses a string using gzip
 func compressString(s string) (string, error) {
 	var b bytes.Buffer
-	gz := gzip.NewWriter(&b)
+	gz, err := newGzipWriter(&b)
+	if err != nil {
+		return "", err
+	}
 	if _, err := gz.Write([]byte(s)); err != nil {
 		return "", fmt.Errorf("failed to write to gzip writer: %w", err)
 	}
@@ -221,6 +313,15 @@ func compressString(s string) (string, error) {
 	return hex.EncodeToString(b.Bytes()), nil
 }
 
+// newGzipWriter creates a gzip writer using the configured compression level
+func newGzipWriter(w io.Writer) (*gzip.Writer, error) {
+	gz, err := gzip.NewWriterLevel(w, CompressionConfig.Level)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compression level %d: %w", CompressionConfig.Level, err)
+	}
+	return gz, nil
+}
+
 // decompressString decompresses a hex-encoded gzipped string
 func decompressString(s string) (string, error) {
 	data, err := hex.DecodeString(s)
@@ -234,7 +335,8 @@ func decompressString(s string) (string, error) {
 	}
 	defer gz.Close()
 
-	var b bytes.Buffer
+	// Decompress straight into the string rather than through an extra buffer
+	var b strings.Builder
 	if _, err := io.Copy(&b, gz); err != nil {
 		return "", fmt.Errorf("failed to read from gzip reader: %w", err)
 	}
@@ -242,8 +344,8 @@ func decompressString(s string) (string, error) {
 	return b.String(), nil
 }
 
-// calculateFileHash computes a SHA-256 hash of file content
-func calculateFileHash(content []byte) string {
+// CalculateFileHash computes a SHA-256 hash of file content
+func CalculateFileHash(content []byte) string {
 	h := sha256.New()
 	h.Write(content)
 	return hex.EncodeToString(h.Sum(nil))
@@ -263,49 +365,180 @@ func CopyToFile(content []byte, targetPath string, fs FileSystem) error {
 
 // SaveFullFile saves a full copy of the file (for first version) using the provided filesystem
 func SaveFullFile(content []byte, path, saveHash, objectsDir string, fs FileSystem) error {
-	fullPath := filepath.Join(objectsDir, saveHash+"_"+path)
+	return writeObjectFile(content, FileObjectPath(path, saveHash, objectsDir), fs)
+}
 
-	// Always compress the content for storage
-	// Create metadata indicating compression
-	metadata := struct {
-		Compressed  bool   `json:"compressed"`
-		ContentHash string `json:"contentHash"`
-	}{
-		Compressed:  true,
-		ContentHash: calculateFileHash(content),
+// FileObjectPath returns the location of the full copy of path stored for a
+// save: the save hash, a dot and the percent-encoded path, so that the name
+// parses back unambiguously with ParseFileObjectName
+func FileObjectPath(path, saveHash, objectsDir string) string {
+	return filepath.Join(objectsDir, saveHash+"."+url.PathEscape(filepath.ToSlash(path)))
+}
+
+// FileObjectPaths returns every location the full copy of path may have for a
+// save: FileObjectPath, then the <saveHash>_<path> name used before paths were
+// encoded
+func FileObjectPaths(path, saveHash, objectsDir string) []string {
+	return []string{
+		FileObjectPath(path, saveHash, objectsDir),
+		filepath.Join(objectsDir, saveHash+"_"+path),
 	}
+}
 
-	// Compress the content
-	var b bytes.Buffer
-	gz := gzip.NewWriter(&b)
-	if _, err := gz.Write(content); err != nil {
-		return fmt.Errorf("failed to compress file content: %w", err)
+// ParseFileObjectName splits the name of a full-copy object, relative to the
+// objects directory and slash-separated, into its save hash and file path.
+// Save hashes are hexadecimal, so they end at the first other character: a
+// dot for encoded names or an underscore for the older raw names.
+func ParseFileObjectName(name string) (saveHash, path string, ok bool) {
+	end := strings.IndexFunc(name, func(r rune) bool {
+		return !('0' <= r && r <= '9' || 'a' <= r && r <= 'f')
+	})
+	if end <= 0 {
+		return "", "", false
+	}
+
+	saveHash, rest := name[:end], name[end+1:]
+	switch name[end] {
+	case '.':
+		path, err := url.PathUnescape(rest)
+		if err != nil || strings.Contains(rest, "/") {
+			return "", "", false
+		}
+		return saveHash, path, true
+	case '_':
+		return saveHash, rest, true
 	}
-	if err := gz.Close(); err != nil {
-		return fmt.Errorf("failed to close gzip writer: %w", err)
+	return "", "", false
+}
+
+// SaveBlob stores content in the content-addressed blob store and returns its
+// content hash. Content that is already stored is not written again.
+func SaveBlob(content []byte, objectsDir string, fs FileSystem) (string, error) {
+	contentHash := CalculateFileHash(content)
+	blobPath := BlobPath(contentHash, objectsDir)
+
+	if fs.Exists(blobPath) {
+		return contentHash, nil
+	}
+
+	if err := writeObjectFile(content, blobPath, fs); err != nil {
+		return "", err
+	}
+
+	return contentHash, nil
+}
+
+// GetBlobContent retrieves the content stored in the blob store under contentHash
+func GetBlobContent(contentHash, objectsDir string, fs FileSystem) ([]byte, error) {
+	reader, err := GetBlobContentReader(contentHash, objectsDir, fs)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// GetBlobContentReader streams the content stored in the blob store under
+// contentHash. The caller must close the returned reader.
+func GetBlobContentReader(contentHash, objectsDir string, fs FileSystem) (io.ReadCloser, error) {
+	return openObject(BlobPath(contentHash, objectsDir), fs)
+}
+
+// BlobPath returns the location of the blob with the given content hash
+func BlobPath(contentHash, objectsDir string) string {
+	return filepath.Join(objectsDir, "blobs", contentHash)
+}
+
+// writeObjectFile stores content as a compressed object at targetPath,
+// creating directories as needed
+func writeObjectFile(content []byte, targetPath string, fs FileSystem) error {
+	targetDir := filepath.Dir(targetPath)
+	if err := fs.MkdirAll(targetDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", targetDir, err)
+	}
+
+	file, err := fs.Create(targetPath)
+	if err != nil {
+		return fmt.Errorf("failed to create object %s: %w", targetPath, err)
+	}
+
+	// Remove partial objects so they are never mistaken for stored content
+	if err := writeObject(file, content); err != nil {
+		file.Close()
+		fs.Remove(targetPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		fs.Remove(targetPath)
+		return fmt.Errorf("failed to close object %s: %w", targetPath, err)
+	}
+
+	return nil
+}
+
+// objectMagic starts every object written by writeObject, followed by a
+// format version byte. Objects without it predate the versioned format.
+var objectMagic = []byte("BIT1")
+
+// objectFormatVersion is the version of the object format written by writeObject
+const objectFormatVersion byte = 1
+
+// objectMetadata is the JSON header stored in front of object content
+type objectMetadata struct {
+	Compressed  bool   `json:"compressed"`
+	ContentHash string `json:"contentHash"`
+}
+
+// writeObject streams content to w prefixed with its metadata header,
+// without buffering the compressed output in memory. Content is compressed
+// unless CompressionConfig disables compression of file content or the
+// content is smaller than MinSizeForCompression, in which case it is stored
+// as is.
+func writeObject(w io.Writer, content []byte) error {
+	metadata := objectMetadata{
+		Compressed: CompressionConfig.Enabled && CompressionConfig.CompressNewFileContent &&
+			len(content) >= CompressionConfig.MinSizeForCompression,
+		ContentHash: CalculateFileHash(content),
 	}
 
-	// Create combined content with metadata and compressed data
 	metadataBytes, err := json.Marshal(metadata)
 	if err != nil {
 		return fmt.Errorf("failed to marshal compression metadata: %w", err)
 	}
 
-	// Format: [metadata length (4 bytes)][metadata json][compressed content]
+	// Format: [magic][version (1 byte)][metadata length (4 bytes)][metadata json][content, compressed if marked so]
 	metadataLen := len(metadataBytes)
-	combinedContent := make([]byte, 4+metadataLen+b.Len())
+	header := make([]byte, 0, len(objectMagic)+5+metadataLen)
+	header = append(header, objectMagic...)
+	header = append(header, objectFormatVersion)
+	header = binary.BigEndian.AppendUint32(header, uint32(metadataLen))
+	header = append(header, metadataBytes...)
 
-	// Store metadata length
-	combinedContent[0] = byte(metadataLen >> 24)
-	combinedContent[1] = byte(metadataLen >> 16)
-	combinedContent[2] = byte(metadataLen >> 8)
-	combinedContent[3] = byte(metadataLen)
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write object header: %w", err)
+	}
 
-	// Copy metadata and compressed content
-	copy(combinedContent[4:], metadataBytes)
-	copy(combinedContent[4+metadataLen:], b.Bytes())
+	if !metadata.Compressed {
+		if _, err := w.Write(content); err != nil {
+			return fmt.Errorf("failed to write file content: %w", err)
+		}
+		return nil
+	}
 
-	return CopyToFile(combinedContent, fullPath, fs)
+	// Compress the content straight into the output
+	gz, err := newGzipWriter(w)
+	if err != nil {
+		return err
+	}
+	if _, err := gz.Write(content); err != nil {
+		return fmt.Errorf("failed to compress file content: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to close gzip writer: %w", err)
+	}
+
+	return nil
 }
 
 // GetFileContent retrieves file content either from working dir or saved object using the provided filesystem
@@ -315,55 +548,227 @@ func GetFileContent(path, saveHash, objectsDir string, fs FileSystem) ([]byte, e
 		return fs.ReadFile(path)
 	}
 
-	// Read from objects directory
-	filePath := filepath.Join(objectsDir, saveHash+"_"+path)
-	content, err := fs.ReadFile(filePath)
+	reader, err := GetFileContentReader(path, saveHash, objectsDir, fs)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// GetFileContentReader is like GetFileContent but streams the content instead of
+// buffering it, so large files can be copied without holding them in memory.
+// The content hash is verified when the reader reaches EOF, and a mismatch is
+// returned as the final read error. The caller must close the returned reader.
+func GetFileContentReader(path, saveHash, objectsDir string, fs FileSystem) (io.ReadCloser, error) {
+	if saveHash == "" {
+		// Read from working directory
+		return fs.Open(path)
+	}
+
+	// Read from objects directory, under the current or the older name
+	var reader io.ReadCloser
+	var err error
+	for _, objectPath := range FileObjectPaths(path, saveHash, objectsDir) {
+		if reader, err = openObject(objectPath, fs); !os.IsNotExist(err) {
+			break
+		}
+	}
+	return reader, err
+}
+
+// openObject opens the object file at path and streams its decoded content
+func openObject(path string, fs FileSystem) (io.ReadCloser, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := newObjectReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &objectReadCloser{Reader: reader, closers: []io.Closer{reader, file}}, nil
+}
+
+// objectReadCloser reads from a decoded object and closes the decoder along
+// with the underlying file
+type objectReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (o *objectReadCloser) Close() error {
+	var firstErr error
+	for _, c := range o.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// decodeObject reverses writeObject for an object held in memory
+func decodeObject(content []byte) ([]byte, error) {
+	reader, err := newObjectReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
+
+// newObjectReader parses the header written by writeObject and returns a reader
+// for the content that follows. Objects written before the format was versioned
+// are recognised heuristically, and content without a valid metadata header is
+// returned as is.
+func newObjectReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+
+	header, ok, err := readObjectHeader(br)
 	if err != nil {
 		return nil, err
 	}
+	if !ok {
+		// Not compressed or invalid metadata, return as is
+		return io.NopCloser(br), nil
+	}
+
+	return newPayloadReader(objectMetadata{Compressed: header.Compressed, ContentHash: header.ContentHash}, br)
+}
+
+// ObjectHeader is the decoded header stored in front of an object's content
+type ObjectHeader struct {
+	Version     int    `json:"version"`     // Format version, 0 for objects written before the format was versioned
+	Compressed  bool   `json:"compressed"`  // Whether the content is gzip-compressed
+	ContentHash string `json:"contentHash"` // Hash of the decoded content
+}
+
+// ReadObjectHeader decodes the header of the object at path without reading
+// its content. ok is false when the object has no header and is stored as is.
+func ReadObjectHeader(path string, fs FileSystem) (header ObjectHeader, ok bool, err error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return ObjectHeader{}, false, err
+	}
+	defer file.Close()
+
+	return readObjectHeader(bufio.NewReader(file))
+}
+
+// readObjectHeader consumes the header written by writeObject from br. Headers
+// without the magic signature are only recognised when they mark compressed
+// content, leaving br untouched otherwise.
+func readObjectHeader(br *bufio.Reader) (ObjectHeader, bool, error) {
+	if magic, _ := br.Peek(len(objectMagic)); !bytes.Equal(magic, objectMagic) {
+		return readLegacyObjectHeader(br)
+	}
+
+	header := make([]byte, len(objectMagic)+5)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return ObjectHeader{}, false, fmt.Errorf("truncated object header")
+	}
+	header = header[len(objectMagic):]
+	if version := header[0]; version != objectFormatVersion {
+		return ObjectHeader{}, false, fmt.Errorf("unsupported object format version %d", version)
+	}
+
+	metadataLen := int64(binary.BigEndian.Uint32(header[1:5]))
+	var metadataBytes bytes.Buffer
+	if n, _ := io.CopyN(&metadataBytes, br, metadataLen); n < metadataLen {
+		return ObjectHeader{}, false, fmt.Errorf("truncated object metadata")
+	}
+
+	var metadata objectMetadata
+	if err := json.Unmarshal(metadataBytes.Bytes(), &metadata); err != nil {
+		return ObjectHeader{}, false, fmt.Errorf("failed to parse object metadata: %w", err)
+	}
 
+	return ObjectHeader{
+		Version:     int(objectFormatVersion),
+		Compressed:  metadata.Compressed,
+		ContentHash: metadata.ContentHash,
+	}, true, nil
+}
+
+// readLegacyObjectHeader consumes the header of objects written without the
+// magic signature, which is only a metadata length and JSON. The header is
+// guessed from the leading bytes, so raw content that resembles one can be
+// misread.
+func readLegacyObjectHeader(br *bufio.Reader) (ObjectHeader, bool, error) {
 	// Check if content is compressed (has metadata header)
-	if len(content) > 8 { // Minimum size for metadata length + minimal JSON
-		// Try to parse metadata length
-		metadataLen := (int(content[0]) << 24) | (int(content[1]) << 16) | (int(content[2]) << 8) | int(content[3])
-
-		// Validate metadata length
-		if metadataLen > 0 && metadataLen < 1000 && 4+metadataLen < len(content) {
-			// Extract and parse metadata
-			metadata := struct {
-				Compressed  bool   `json:"compressed"`
-				ContentHash string `json:"contentHash"`
-			}{}
-
-			err := json.Unmarshal(content[4:4+metadataLen], &metadata)
-			if err == nil && metadata.Compressed {
-				// Content is compressed, decompress it
-				compressedData := content[4+metadataLen:]
-				gz, err := gzip.NewReader(bytes.NewReader(compressedData))
-				if err != nil {
-					return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	if lenBytes, err := br.Peek(4); err == nil {
+		metadataLen := int(binary.BigEndian.Uint32(lenBytes))
+
+		// Validate metadata length, requiring content after the header
+		if metadataLen > 0 && metadataLen < 1000 {
+			if peeked, err := br.Peek(4 + metadataLen + 1); err == nil {
+				var metadata objectMetadata
+				err := json.Unmarshal(peeked[4:4+metadataLen], &metadata)
+				if err == nil && metadata.Compressed {
+					if _, err := br.Discard(4 + metadataLen); err != nil {
+						return ObjectHeader{}, false, err
+					}
+					return ObjectHeader{Compressed: true, ContentHash: metadata.ContentHash}, true, nil
 				}
-				defer gz.Close()
+			}
+		}
+	}
 
-				var b bytes.Buffer
-				if _, err := io.Copy(&b, gz); err != nil {
-					return nil, fmt.Errorf("failed to decompress content: %w", err)
-				}
+	return ObjectHeader{}, false, nil
+}
 
-				decompressedContent := b.Bytes()
+// newPayloadReader decompresses the content following an object header if
+// needed and verifies it against the hash recorded in the header
+func newPayloadReader(metadata objectMetadata, payload io.Reader) (io.ReadCloser, error) {
+	if !metadata.Compressed {
+		return newVerifyingReader(payload, nil, metadata.ContentHash), nil
+	}
 
-				// Verify content hash
-				if calculateFileHash(decompressedContent) != metadata.ContentHash {
-					return nil, fmt.Errorf("content hash mismatch after decompression")
-				}
+	gz, err := gzip.NewReader(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	return newVerifyingReader(gz, gz, metadata.ContentHash), nil
+}
 
-				return decompressedContent, nil
-			}
+// verifyingReader hashes the content as it is read through it, so that it is
+// verified in the same pass that decompresses it, and fails at EOF if it does
+// not match the expected hash
+type verifyingReader struct {
+	r        io.Reader
+	closer   io.Closer
+	hash     hash.Hash
+	expected string
+}
+
+// newVerifyingReader returns a verifyingReader over r, closing closer if set
+func newVerifyingReader(r io.Reader, closer io.Closer, expected string) *verifyingReader {
+	h := sha256.New()
+	return &verifyingReader{r: io.TeeReader(r, h), closer: closer, hash: h, expected: expected}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if err == io.EOF {
+		if hex.EncodeToString(v.hash.Sum(nil)) != v.expected {
+			return n, fmt.Errorf("content hash mismatch after decompression")
 		}
+	} else if err != nil {
+		return n, fmt.Errorf("failed to decompress content: %w", err)
 	}
+	return n, err
+}
 
-	// Not compressed or invalid metadata, return as is
-	return content, nil
+func (v *verifyingReader) Close() error {
+	if v.closer == nil {
+		return nil
+	}
+	return v.closer.Close()
 }
 
 // CalculateCompressionStats calculates and returns compression statistics for diagnostic purposes
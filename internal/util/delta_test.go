@@ -2,7 +2,11 @@ package util
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"encoding/json"
+	"io"
+	"math/rand"
 	"path/filepath"
 	"strings"
 	"testing"
@@ -29,7 +33,7 @@ func TestCalculateDelta(t *testing.T) {
 				IsDeleted:    false,
 				BaseSaveHash: "",
 				Patches:      nil,
-				ContentHash:  calculateFileHash([]byte("New file content")),
+				ContentHash:  CalculateFileHash([]byte("New file content")),
 				Compressed:   true,
 			},
 		},
@@ -45,7 +49,7 @@ func TestCalculateDelta(t *testing.T) {
 				IsDeleted:    true,
 				BaseSaveHash: "abc123",
 				Patches:      nil,
-				ContentHash:  calculateFileHash([]byte("Original content")),
+				ContentHash:  CalculateFileHash([]byte("Original content")),
 				Compressed:   true,
 			},
 		},
@@ -76,7 +80,7 @@ func TestCalculateDelta(t *testing.T) {
 				IsDeleted:    false,
 				BaseSaveHash: "abc123",
 				Patches:      nil,
-				ContentHash:  calculateFileHash([]byte("Same content")),
+				ContentHash:  CalculateFileHash([]byte("Same content")),
 				Compressed:   true,
 			},
 		},
@@ -152,7 +156,7 @@ func TestApplyDelta(t *testing.T) {
 				IsDeleted:    false,
 				BaseSaveHash: "base123",
 				Patches:      []string{compressedPatch},
-				ContentHash:  calculateFileHash([]byte("Original Modified content")),
+				ContentHash:  CalculateFileHash([]byte("Original Modified content")),
 				Compressed:   true,
 			},
 			expectedResult: []byte("Original Modified content"),
@@ -166,7 +170,7 @@ func TestApplyDelta(t *testing.T) {
 				IsDeleted:    false,
 				BaseSaveHash: "",
 				Patches:      nil,
-				ContentHash:  calculateFileHash([]byte("New file content")),
+				ContentHash:  CalculateFileHash([]byte("New file content")),
 				Compressed:   true,
 			},
 			expectedResult: []byte("New file content"),
@@ -180,7 +184,7 @@ func TestApplyDelta(t *testing.T) {
 				IsDeleted:    true,
 				BaseSaveHash: "base123",
 				Patches:      nil,
-				ContentHash:  calculateFileHash([]byte("Original content")),
+				ContentHash:  CalculateFileHash([]byte("Original content")),
 				Compressed:   true,
 			},
 			expectedResult: nil,
@@ -194,7 +198,7 @@ func TestApplyDelta(t *testing.T) {
 				IsDeleted:    false,
 				BaseSaveHash: "base123",
 				Patches:      nil,
-				ContentHash:  calculateFileHash([]byte("Original content")),
+				ContentHash:  CalculateFileHash([]byte("Original content")),
 				Compressed:   true,
 			},
 			expectedResult: []byte("Original content"),
@@ -235,6 +239,115 @@ func TestApplyDelta(t *testing.T) {
 	}
 }
 
+func TestPayloadReaderVerifiesHash(t *testing.T) {
+	content := bytes.Repeat([]byte("streamed content "), 1000)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(content)
+	gz.Close()
+
+	for _, compress := range []bool{false, true} {
+		payload := content
+		if compress {
+			payload = compressed.Bytes()
+		}
+
+		for _, expected := range []string{CalculateFileHash(content), CalculateFileHash([]byte("other"))} {
+			metadata := objectMetadata{Compressed: compress, ContentHash: expected}
+			reader, err := newPayloadReader(metadata, bytes.NewReader(payload))
+			if err != nil {
+				t.Fatalf("newPayloadReader failed: %v", err)
+			}
+			read, err := io.ReadAll(reader)
+			reader.Close()
+
+			if expected == CalculateFileHash(content) {
+				if err != nil || !bytes.Equal(read, content) {
+					t.Errorf("Expected matching content to pass (compressed %v), got %v", compress, err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), "content hash mismatch") {
+				t.Errorf("Expected hash mismatch error (compressed %v), got %v", compress, err)
+			}
+		}
+	}
+}
+
+func TestApplyDeltaMismatchedBase(t *testing.T) {
+	oldContent := []byte("The quick brown fox jumps over the lazy dog")
+	newContent := []byte("The quick brown fox leaps over the lazy cat")
+	delta := CalculateDelta(oldContent, newContent, "file.txt", "base123")
+	delta.Compressed = false // Patches are only compressed when saved by the repository
+
+	// A base that shares nothing with the original cannot be patched
+	wrongBase := func(path, saveHash string) ([]byte, error) {
+		return []byte("0123456789 completely unrelated base content 9876543210"), nil
+	}
+
+	_, err := ApplyDelta(delta, wrongBase)
+	if err == nil {
+		t.Fatal("Expected error when applying delta to a mismatched base")
+	}
+	if !strings.Contains(err.Error(), "failed to apply patch 1") || !strings.Contains(err.Error(), "file.txt") {
+		t.Errorf("Expected error naming the patch and file, got: %v", err)
+	}
+	if strings.Contains(err.Error(), "content hash mismatch") {
+		t.Errorf("Expected patch failure to be reported before the hash check, got: %v", err)
+	}
+}
+
+func TestEmptyContentDelta(t *testing.T) {
+	for _, engine := range []string{TextEngineName, BinaryEngineName} {
+		t.Run(engine, func(t *testing.T) {
+			tests := []struct {
+				name     string
+				old, new []byte
+			}{
+				{"emptied", []byte("content"), []byte{}},
+				{"filled", []byte{}, []byte("content")},
+				{"still empty", []byte{}, []byte{}},
+				{"whitespace removed", []byte(" \n\t\n"), []byte{}},
+				{"whitespace only", []byte{}, []byte("  \n")},
+			}
+			for _, tt := range tests {
+				delta := CalculateDeltaWithEngine(tt.old, tt.new, "file.txt", "base123", engine)
+				if delta.IsNew || delta.IsDeleted {
+					t.Errorf("%s: expected a modification, got new=%v deleted=%v", tt.name, delta.IsNew, delta.IsDeleted)
+					continue
+				}
+				delta.Compressed = false
+
+				// An empty base read back as nil is still an empty file
+				base := func(path, saveHash string) ([]byte, error) {
+					if len(tt.old) == 0 {
+						return nil, nil
+					}
+					return tt.old, nil
+				}
+				content, err := ApplyDelta(delta, base)
+				if err != nil {
+					t.Errorf("%s: ApplyDelta failed: %v", tt.name, err)
+					continue
+				}
+				if content == nil || !bytes.Equal(content, tt.new) {
+					t.Errorf("%s: expected %q, got %q (nil: %v)", tt.name, tt.new, content, content == nil)
+				}
+			}
+		})
+	}
+
+	// Only nil stands for a missing file
+	if delta := CalculateDelta(nil, []byte{}, "file.txt", ""); !delta.IsNew {
+		t.Error("Expected nil old content to make a new file")
+	}
+	if delta := CalculateDelta([]byte{}, nil, "file.txt", "base123"); !delta.IsDeleted {
+		t.Error("Expected nil new content to make a deleted file")
+	}
+	deleted := DeltaInfo{Path: "file.txt", IsDeleted: true}
+	if content, err := ApplyDelta(deleted, nil); err != nil || content != nil {
+		t.Errorf("Expected a deleted file to have nil content, got %q, %v", content, err)
+	}
+}
+
 func TestSaveAndLoadDeltaSet(t *testing.T) {
 	// Set up mock filesystem
 	mockFS := NewMockFileSystem()
@@ -327,7 +440,7 @@ func TestSaveFullFile(t *testing.T) {
 	}
 
 	// Verify file was saved
-	expectedPath := filepath.Join(objectsDir, saveHash+"_"+path)
+	expectedPath := FileObjectPath(path, saveHash, objectsDir)
 	if !mockFS.Exists(expectedPath) {
 		t.Errorf("Expected file %s to exist", expectedPath)
 	}
@@ -343,6 +456,52 @@ func TestSaveFullFile(t *testing.T) {
 	}
 }
 
+func TestFileObjectNames(t *testing.T) {
+	mockFS := NewMockFileSystem()
+	objectsDir := ".bit/objects"
+	saveHash := "0123abcd"
+
+	// Underscores, dots, percent signs, spaces and unicode in paths survive
+	// the round trip
+	for _, path := range []string{"a_b_c.txt", "dir/sub_dir/file_1.txt", "100%_done.txt", ".hidden", "my file (1).txt", "#notes.txt", "naïve café ☕.txt", "dir with space/🎉.md"} {
+		if err := SaveFullFile([]byte(path), path, saveHash, objectsDir, mockFS); err != nil {
+			t.Fatalf("Failed to save %s: %v", path, err)
+		}
+		objectPath := FileObjectPath(path, saveHash, objectsDir)
+		if filepath.Dir(objectPath) != objectsDir {
+			t.Errorf("Expected %s to be stored directly in the objects directory, got %s", path, objectPath)
+		}
+
+		gotHash, gotPath, ok := ParseFileObjectName(filepath.Base(objectPath))
+		if !ok || gotHash != saveHash || gotPath != path {
+			t.Errorf("Parsed %s as (%q, %q, %v), expected (%q, %q)", objectPath, gotHash, gotPath, ok, saveHash, path)
+		}
+
+		content, err := GetFileContent(path, saveHash, objectsDir, mockFS)
+		if err != nil || string(content) != path {
+			t.Errorf("Failed to read %s back: %q (%v)", path, content, err)
+		}
+	}
+
+	// Objects written under the older <saveHash>_<path> names are still read and parsed
+	if err := writeObjectFile([]byte("legacy"), filepath.Join(objectsDir, saveHash+"_a_b.txt"), mockFS); err != nil {
+		t.Fatalf("Failed to write legacy object: %v", err)
+	}
+	if content, err := GetFileContent("a_b.txt", saveHash, objectsDir, mockFS); err != nil || string(content) != "legacy" {
+		t.Errorf("Failed to read legacy object: %q (%v)", content, err)
+	}
+	if gotHash, gotPath, ok := ParseFileObjectName(saveHash + "_a_b.txt"); !ok || gotHash != saveHash || gotPath != "a_b.txt" {
+		t.Errorf("Parsed legacy name as (%q, %q, %v)", gotHash, gotPath, ok)
+	}
+
+	// Names of other objects are not taken for full copies
+	for _, name := range []string{"delta_" + saveHash + ".json", "blobs/" + saveHash, "_a.txt", saveHash, saveHash + ".a%2"} {
+		if _, _, ok := ParseFileObjectName(name); ok {
+			t.Errorf("Expected %q not to parse as a full-copy object", name)
+		}
+	}
+}
+
 func TestGetFileContent(t *testing.T) {
 	// Set up mock filesystem
 	mockFS := NewMockFileSystem()
@@ -389,6 +548,83 @@ func TestGetFileContent(t *testing.T) {
 	}
 }
 
+func TestGetFileContentReader(t *testing.T) {
+	mockFS := NewMockFileSystem()
+	objectsDir := ".bit/objects"
+	saveHash := "save123"
+
+	// Large enough to span many gzip blocks and bufio reads
+	rng := rand.New(rand.NewSource(1))
+	large := make([]byte, 4<<20)
+	rng.Read(large)
+
+	files := map[string][]byte{
+		"empty.txt": {},
+		"small.txt": []byte("Saved content"),
+		"large.bin": large,
+	}
+	for path, content := range files {
+		if err := SaveFullFile(content, path, saveHash, objectsDir, mockFS); err != nil {
+			t.Fatalf("Failed to save %s: %v", path, err)
+		}
+	}
+
+	for path, content := range files {
+		buffered, err := GetFileContent(path, saveHash, objectsDir, mockFS)
+		if err != nil {
+			t.Fatalf("GetFileContent failed for %s: %v", path, err)
+		}
+
+		reader, err := GetFileContentReader(path, saveHash, objectsDir, mockFS)
+		if err != nil {
+			t.Fatalf("GetFileContentReader failed for %s: %v", path, err)
+		}
+		streamed, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Reading stream for %s failed: %v", path, err)
+		}
+		if err := reader.Close(); err != nil {
+			t.Errorf("Closing stream for %s failed: %v", path, err)
+		}
+
+		if !bytes.Equal(streamed, buffered) || !bytes.Equal(streamed, content) {
+			t.Errorf("Streamed content of %s differs from buffered content", path)
+		}
+	}
+
+	// Corrupted content is reported once the stream is fully read
+	objectPath := FileObjectPath("small.txt", saveHash, objectsDir)
+	var corrupted bytes.Buffer
+	if err := writeObject(&corrupted, []byte("Other content")); err != nil {
+		t.Fatalf("writeObject failed: %v", err)
+	}
+	raw := corrupted.Bytes()
+	original := mockFS.Files[objectPath]
+	metadataEnd := len(objectMagic) + 5 + int(binary.BigEndian.Uint32(original[len(objectMagic)+1:]))
+	newMetadataEnd := len(objectMagic) + 5 + int(binary.BigEndian.Uint32(raw[len(objectMagic)+1:]))
+	mockFS.Files[objectPath] = append(append([]byte{}, original[:metadataEnd]...), raw[newMetadataEnd:]...)
+
+	reader, err := GetFileContentReader("small.txt", saveHash, objectsDir, mockFS)
+	if err != nil {
+		t.Fatalf("GetFileContentReader failed: %v", err)
+	}
+	defer reader.Close()
+	if _, err := io.ReadAll(reader); err == nil || !strings.Contains(err.Error(), "hash mismatch") {
+		t.Errorf("Expected hash mismatch error, got %v", err)
+	}
+
+	// Working directory files are streamed as is
+	mockFS.AddFile("working.txt", []byte("Working content"))
+	reader, err = GetFileContentReader("working.txt", "", objectsDir, mockFS)
+	if err != nil {
+		t.Fatalf("GetFileContentReader failed for working file: %v", err)
+	}
+	defer reader.Close()
+	if content, err := io.ReadAll(reader); err != nil || string(content) != "Working content" {
+		t.Errorf("Expected working content, got %q (%v)", content, err)
+	}
+}
+
 func TestCompressDecompressString(t *testing.T) {
 	// Test strings of different sizes
 	testCases := []string{
@@ -591,22 +827,20 @@ func TestFullFileCompression(t *testing.T) {
 			}
 
 			// Check if the file was compressed (it should always be now)
-			rawContent, err := fs.ReadFile(filepath.Join(objectsDir, saveHash+"_"+path))
+			rawContent, err := fs.ReadFile(FileObjectPath(path, saveHash, objectsDir))
 			if err != nil {
 				t.Fatalf("Failed to read raw file: %v", err)
 			}
 
 			// Verify it has our compression header format
 			isCompressed := false
-			if len(rawContent) > 8 {
-				// Try to parse metadata length
-				metadataLen := (int(rawContent[0]) << 24) | (int(rawContent[1]) << 16) | (int(rawContent[2]) << 8) | int(rawContent[3])
-				if metadataLen > 0 && metadataLen < 1000 && 4+metadataLen < len(rawContent) {
+			if bytes.HasPrefix(rawContent, objectMagic) && len(rawContent) > len(objectMagic)+5 {
+				header := rawContent[len(objectMagic):]
+				metadataLen := int(binary.BigEndian.Uint32(header[1:5]))
+				if header[0] == objectFormatVersion && 5+metadataLen < len(header) {
 					// Extract metadata
-					metadata := struct {
-						Compressed bool `json:"compressed"`
-					}{}
-					if json.Unmarshal(rawContent[4:4+metadataLen], &metadata) == nil {
+					var metadata objectMetadata
+					if json.Unmarshal(header[5:5+metadataLen], &metadata) == nil {
 						isCompressed = metadata.Compressed
 					}
 				}
@@ -631,3 +865,230 @@ func TestFullFileCompression(t *testing.T) {
 		})
 	}
 }
+
+func TestSaveBlob(t *testing.T) {
+	fs := NewMockFileSystem()
+	objectsDir := ".bit/objects"
+	content := []byte("blob content that should only be stored once")
+
+	hash1, err := SaveBlob(content, objectsDir, fs)
+	if err != nil {
+		t.Fatalf("SaveBlob failed: %v", err)
+	}
+	if hash1 != CalculateFileHash(content) {
+		t.Errorf("Expected blob to be addressed by its content hash")
+	}
+
+	written := fs.Files[BlobPath(hash1, objectsDir)]
+
+	// Storing the same content again reuses the existing blob
+	hash2, err := SaveBlob(content, objectsDir, fs)
+	if err != nil {
+		t.Fatalf("SaveBlob failed: %v", err)
+	}
+	if hash1 != hash2 {
+		t.Errorf("Expected identical content to produce the same blob, got %s and %s", hash1, hash2)
+	}
+	if !bytes.Equal(written, fs.Files[BlobPath(hash2, objectsDir)]) {
+		t.Errorf("Expected existing blob to be left untouched")
+	}
+
+	retrieved, err := GetBlobContent(hash1, objectsDir, fs)
+	if err != nil {
+		t.Fatalf("GetBlobContent failed: %v", err)
+	}
+	if !bytes.Equal(retrieved, content) {
+		t.Errorf("Retrieved blob mismatch: expected %q, got %q", content, retrieved)
+	}
+
+	if _, err := GetBlobContent("missing", objectsDir, fs); err == nil {
+		t.Error("Expected error for a missing blob")
+	}
+}
+
+func BenchmarkSaveFullFileLarge(b *testing.B) {
+	// 50MB of moderately compressible content
+	rng := rand.New(rand.NewSource(1))
+	content := make([]byte, 50<<20)
+	for i := range content {
+		content[i] = 'a' + byte(rng.Intn(16))
+	}
+
+	fs := NewOsFileSystem()
+	objectsDir := filepath.Join(b.TempDir(), "objects")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := SaveFullFile(content, "large.bin", "save123", objectsDir, fs); err != nil {
+			b.Fatalf("Failed to save full file: %v", err)
+		}
+	}
+}
+
+func TestCompressionLevel(t *testing.T) {
+	originalLevel := CompressionConfig.Level
+	defer func() { CompressionConfig.Level = originalLevel }()
+
+	content := []byte(strings.Repeat("compressible content ", 500))
+	objectsDir := ".bit/objects"
+
+	sizes := make(map[int]int)
+	for _, level := range []int{gzip.NoCompression, gzip.BestSpeed, gzip.BestCompression} {
+		CompressionConfig.Level = level
+		mockFS := NewMockFileSystem()
+
+		if err := SaveFullFile(content, "file.txt", "save123", objectsDir, mockFS); err != nil {
+			t.Fatalf("Failed to save with level %d: %v", level, err)
+		}
+
+		// Objects written at any level read back the same way
+		retrieved, err := GetFileContent("file.txt", "save123", objectsDir, mockFS)
+		if err != nil {
+			t.Fatalf("Failed to read object saved with level %d: %v", level, err)
+		}
+		if !bytes.Equal(retrieved, content) {
+			t.Errorf("Content mismatch for level %d", level)
+		}
+
+		stored, _ := mockFS.ReadFile(FileObjectPath("file.txt", "save123", objectsDir))
+		sizes[level] = len(stored)
+	}
+
+	if sizes[gzip.BestCompression] >= sizes[gzip.NoCompression] {
+		t.Errorf("Expected best compression (%d bytes) to be smaller than no compression (%d bytes)",
+			sizes[gzip.BestCompression], sizes[gzip.NoCompression])
+	}
+
+	// Invalid levels are reported instead of silently ignored
+	CompressionConfig.Level = 42
+	mockFS := NewMockFileSystem()
+	if err := SaveFullFile(content, "file.txt", "save456", objectsDir, mockFS); err == nil {
+		t.Error("Expected error for invalid compression level")
+	}
+	if mockFS.Exists(filepath.Join(objectsDir, "save456_file.txt")) {
+		t.Error("Expected partial object to be removed")
+	}
+}
+
+func TestObjectFormatMagic(t *testing.T) {
+	fs := NewMockFileSystem()
+	objectsDir := ".bit/objects"
+
+	// Content that the unversioned format would take for a metadata header
+	fakeMetadata := []byte(`{"compressed":true,"contentHash":"0"}`)
+	crafted := binary.BigEndian.AppendUint32(nil, uint32(len(fakeMetadata)))
+	crafted = append(crafted, fakeMetadata...)
+	crafted = append(crafted, []byte("not gzip data")...)
+
+	hash, err := SaveBlob(crafted, objectsDir, fs)
+	if err != nil {
+		t.Fatalf("SaveBlob failed: %v", err)
+	}
+	raw := fs.Files[BlobPath(hash, objectsDir)]
+	if !bytes.HasPrefix(raw, objectMagic) || raw[len(objectMagic)] != objectFormatVersion {
+		t.Fatalf("Expected object to start with the magic signature and version, got %q", raw[:8])
+	}
+
+	content, err := GetBlobContent(hash, objectsDir, fs)
+	if err != nil {
+		t.Fatalf("GetBlobContent failed: %v", err)
+	}
+	if !bytes.Equal(content, crafted) {
+		t.Errorf("Crafted content did not round-trip: got %q", content)
+	}
+
+	// Raw content that resembles an uncompressed legacy header is kept as is
+	rawHeader := []byte(`{"compressed":false}`)
+	legacyRaw := binary.BigEndian.AppendUint32(nil, uint32(len(rawHeader)))
+	legacyRaw = append(legacyRaw, rawHeader...)
+	legacyRaw = append(legacyRaw, []byte("payload")...)
+	if decoded, err := decodeObject(legacyRaw); err != nil || !bytes.Equal(decoded, legacyRaw) {
+		t.Errorf("Expected raw content to be returned as is, got %q (%v)", decoded, err)
+	}
+
+	// Objects written before the format was versioned still decode
+	original := []byte("legacy object content")
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(original)
+	gz.Close()
+	metadata, _ := json.Marshal(objectMetadata{Compressed: true, ContentHash: CalculateFileHash(original)})
+	legacy := binary.BigEndian.AppendUint32(nil, uint32(len(metadata)))
+	legacy = append(legacy, metadata...)
+	legacy = append(legacy, compressed.Bytes()...)
+	if decoded, err := decodeObject(legacy); err != nil || !bytes.Equal(decoded, original) {
+		t.Errorf("Failed to decode legacy object: got %q (%v)", decoded, err)
+	}
+
+	// Versioned objects are never mistaken for raw content
+	future := append(append([]byte(nil), raw...), 0)
+	future[len(objectMagic)] = objectFormatVersion + 1
+	if _, err := decodeObject(future); err == nil {
+		t.Error("Expected error for an unsupported object format version")
+	}
+	if _, err := decodeObject(raw[:len(objectMagic)+3]); err == nil {
+		t.Error("Expected error for a truncated object header")
+	}
+}
+
+func TestObjectCompressionConfig(t *testing.T) {
+	original := CompressionConfig
+	defer func() { CompressionConfig = original }()
+
+	content := []byte(strings.Repeat("compressible content ", 100))
+	objectsDir := ".bit/objects"
+
+	// storedPayload returns the metadata and payload of the stored object
+	storedPayload := func(fs *MockFileSystem, path string) (objectMetadata, []byte) {
+		t.Helper()
+		raw := fs.Files[path]
+		if !bytes.HasPrefix(raw, objectMagic) {
+			t.Fatalf("Expected a versioned object at %s", path)
+		}
+		raw = raw[len(objectMagic)+1:]
+		metadataLen := binary.BigEndian.Uint32(raw)
+		var metadata objectMetadata
+		if err := json.Unmarshal(raw[4:4+metadataLen], &metadata); err != nil {
+			t.Fatalf("Failed to parse object metadata: %v", err)
+		}
+		return metadata, raw[4+metadataLen:]
+	}
+
+	tests := []struct {
+		name       string
+		enabled    bool
+		minSize    int
+		content    []byte
+		compressed bool
+	}{
+		{"enabled", true, 1, content, true},
+		{"disabled", false, 1, content, false},
+		{"below the minimum size", true, 64, []byte("tiny"), false},
+		{"at the minimum size", true, len(content), content, true},
+	}
+	for _, test := range tests {
+		CompressionConfig.Enabled = test.enabled
+		CompressionConfig.MinSizeForCompression = test.minSize
+		fs := NewMockFileSystem()
+
+		if err := SaveFullFile(test.content, "file.txt", "save123", objectsDir, fs); err != nil {
+			t.Fatalf("%s: failed to save full file: %v", test.name, err)
+		}
+		metadata, payload := storedPayload(fs, FileObjectPath("file.txt", "save123", objectsDir))
+		if metadata.Compressed != test.compressed {
+			t.Errorf("%s: expected compressed %v, got %v", test.name, test.compressed, metadata.Compressed)
+		}
+		if isGzip := bytes.HasPrefix(payload, []byte{0x1f, 0x8b}); isGzip != test.compressed {
+			t.Errorf("%s: expected gzip payload %v, got %v", test.name, test.compressed, isGzip)
+		}
+		if !test.compressed && !bytes.Equal(payload, test.content) {
+			t.Errorf("%s: expected the content to be stored as is, got %q", test.name, payload)
+		}
+
+		retrieved, err := GetFileContent("file.txt", "save123", objectsDir, fs)
+		if err != nil || !bytes.Equal(retrieved, test.content) {
+			t.Errorf("%s: failed to read the object back: %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// DeltaEngine computes and applies patches between two versions of a file
+type DeltaEngine interface {
+	// Name identifies the engine in stored deltas
+	Name() string
+	// Make returns a patch that turns old into new
+	Make(old, new []byte) ([]byte, error)
+	// Apply reconstructs the new content from base and a patch made by Make
+	Apply(base, patch []byte) ([]byte, error)
+}
+
+// Names of the built-in delta engines
+const (
+	TextEngineName   = "dmp"
+	BinaryEngineName = "binary"
+)
+
+// DeltaEngineConfig selects the engine used for new deltas. Existing deltas are
+// always applied with the engine recorded in them.
+var DeltaEngineConfig = struct {
+	Engine string // Name of a registered DeltaEngine
+}{
+	Engine: TextEngineName,
+}
+
+var (
+	deltaEnginesMutex sync.RWMutex
+	deltaEngines      = map[string]DeltaEngine{
+		TextEngineName:   TextDeltaEngine{},
+		BinaryEngineName: BinaryDeltaEngine{},
+	}
+)
+
+// RegisterDeltaEngine makes an engine available under its name
+func RegisterDeltaEngine(engine DeltaEngine) {
+	deltaEnginesMutex.Lock()
+	defer deltaEnginesMutex.Unlock()
+	deltaEngines[engine.Name()] = engine
+}
+
+// GetDeltaEngine returns the engine registered under name. Deltas written
+// before engines were recorded have no name and use the text engine.
+func GetDeltaEngine(name string) (DeltaEngine, error) {
+	if name == "" {
+		name = TextEngineName
+	}
+
+	deltaEnginesMutex.RLock()
+	defer deltaEnginesMutex.RUnlock()
+	engine, ok := deltaEngines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown delta engine %q", name)
+	}
+	return engine, nil
+}
+
+// TextDeltaEngine produces character-oriented diffmatchpatch patches. Its
+// patches are plain text.
+type TextDeltaEngine struct{}
+
+// Name returns the identifier of the text engine
+func (TextDeltaEngine) Name() string { return TextEngineName }
+
+// Make computes a diffmatchpatch patch from old to new. Content that is not
+// valid text can make diffmatchpatch panic, which is reported as an error.
+func (TextDeltaEngine) Make(old, new []byte) (patch []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			patch, err = nil, fmt.Errorf("failed to diff content as text: %v", r)
+		}
+	}()
+
+	dmp := diffmatchpatch.New()
+	patches := dmp.PatchMake(string(old), string(new))
+	return []byte(dmp.PatchToText(patches)), nil
+}
+
+// Apply applies a diffmatchpatch patch, failing if any hunk does not apply
+func (TextDeltaEngine) Apply(base, patch []byte) ([]byte, error) {
+	dmp := diffmatchpatch.New()
+	patches, err := dmp.PatchFromText(string(patch))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse patches: %w", err)
+	}
+
+	newContent, applied := dmp.PatchApply(patches, string(base))
+	for i, ok := range applied {
+		if !ok {
+			return nil, fmt.Errorf("failed to apply patch %d of %d: base content does not match", i+1, len(applied))
+		}
+	}
+	return []byte(newContent), nil
+}
+
+// binaryBlockSize is the length of the blocks the binary engine matches
+const binaryBlockSize = 32
+
+// Operations of the binary patch format
+const (
+	binaryOpCopy   byte = 'C' // Copy a range of the base: offset, length
+	binaryOpInsert byte = 'I' // Insert literal bytes: length, data
+)
+
+// BinaryDeltaEngine produces byte-oriented copy/insert patches in the spirit
+// of bsdiff and xdelta. It works on arbitrary content and handles large
+// insertions and moved blocks better than the text engine.
+//
+// Patch format: uvarint target length, then a sequence of operations, each a
+// one-byte opcode followed by uvarint arguments.
+type BinaryDeltaEngine struct{}
+
+// Name returns the identifier of the binary engine
+func (BinaryDeltaEngine) Name() string { return BinaryEngineName }
+
+// Make computes a copy/insert patch from old to new by matching blocks of old
+// found anywhere in new
+func (BinaryDeltaEngine) Make(old, new []byte) ([]byte, error) {
+	var patch bytes.Buffer
+	writeUvarint(&patch, uint64(len(new)))
+
+	// Index the blocks of the old content by rolling hash
+	index := make(map[uint32]int)
+	for off := 0; off+binaryBlockSize <= len(old); off += binaryBlockSize {
+		h := blockHash(old[off : off+binaryBlockSize])
+		if _, ok := index[h]; !ok {
+			index[h] = off
+		}
+	}
+
+	literalStart := 0
+	flushLiteral := func(end int) {
+		if end > literalStart {
+			patch.WriteByte(binaryOpInsert)
+			writeUvarint(&patch, uint64(end-literalStart))
+			patch.Write(new[literalStart:end])
+		}
+	}
+
+	pow := rollingPow()
+	i := 0
+	var h uint32
+	if len(index) > 0 && len(new) >= binaryBlockSize {
+		h = blockHash(new[:binaryBlockSize])
+	}
+	for len(index) > 0 && i+binaryBlockSize <= len(new) {
+		if off, ok := index[h]; ok && bytes.Equal(old[off:off+binaryBlockSize], new[i:i+binaryBlockSize]) {
+			// Extend the match forwards, then backwards into pending literals
+			n := binaryBlockSize
+			for off+n < len(old) && i+n < len(new) && old[off+n] == new[i+n] {
+				n++
+			}
+			for i > literalStart && off > 0 && old[off-1] == new[i-1] {
+				i--
+				off--
+				n++
+			}
+
+			flushLiteral(i)
+			patch.WriteByte(binaryOpCopy)
+			writeUvarint(&patch, uint64(off))
+			writeUvarint(&patch, uint64(n))
+
+			i += n
+			literalStart = i
+			if i+binaryBlockSize <= len(new) {
+				h = blockHash(new[i : i+binaryBlockSize])
+			}
+			continue
+		}
+
+		if i+binaryBlockSize < len(new) {
+			h = (h-uint32(new[i])*pow)*rollingBase + uint32(new[i+binaryBlockSize])
+		}
+		i++
+	}
+	flushLiteral(len(new))
+
+	return patch.Bytes(), nil
+}
+
+// Apply replays a copy/insert patch on top of base
+func (BinaryDeltaEngine) Apply(base, patch []byte) ([]byte, error) {
+	r := bytes.NewReader(patch)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read patch header: %w", err)
+	}
+
+	result := make([]byte, 0, size)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+
+		switch op {
+		case binaryOpCopy:
+			off, err1 := binary.ReadUvarint(r)
+			n, err2 := binary.ReadUvarint(r)
+			if err := errors.Join(err1, err2); err != nil {
+				return nil, fmt.Errorf("failed to read copy operation: %w", err)
+			}
+			if off+n > uint64(len(base)) {
+				return nil, fmt.Errorf("copy of %d bytes at offset %d exceeds base of %d bytes", n, off, len(base))
+			}
+			result = append(result, base[off:off+n]...)
+		case binaryOpInsert:
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read insert operation: %w", err)
+			}
+			if n > uint64(r.Len()) {
+				return nil, fmt.Errorf("insert of %d bytes exceeds patch data", n)
+			}
+			data := make([]byte, n)
+			r.Read(data)
+			result = append(result, data...)
+		default:
+			return nil, fmt.Errorf("unknown patch operation %q", op)
+		}
+	}
+
+	if uint64(len(result)) != size {
+		return nil, fmt.Errorf("patch produced %d bytes, expected %d", len(result), size)
+	}
+	return result, nil
+}
+
+// rollingBase is the multiplier of the polynomial rolling hash
+const rollingBase = 257
+
+// rollingPow returns rollingBase raised to binaryBlockSize-1, the weight of
+// the byte leaving the window
+func rollingPow() uint32 {
+	pow := uint32(1)
+	for i := 0; i < binaryBlockSize-1; i++ {
+		pow *= rollingBase
+	}
+	return pow
+}
+
+// blockHash computes the rolling hash of a block from scratch
+func blockHash(block []byte) uint32 {
+	var h uint32
+	for _, b := range block {
+		h = h*rollingBase + uint32(b)
+	}
+	return h
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
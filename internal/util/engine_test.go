@@ -0,0 +1,146 @@
+package util
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDeltaEnginesReconstructSameContent(t *testing.T) {
+	text := strings.Repeat("The quick brown fox jumps over the lazy dog.\n", 50)
+
+	tests := []struct {
+		name     string
+		old, new []byte
+	}{
+		{"Text edit", []byte(text), []byte(strings.Replace(text, "lazy", "sleepy", 3))},
+		{"Text rearrangement", []byte(text[1000:] + text[:1000]), []byte(text)},
+		{"Empty base", []byte{}, []byte("all new content")},
+		{"Emptied file", []byte("content that disappears"), []byte{}},
+		{"Short content", []byte("abc"), []byte("abd")},
+	}
+
+	engines := []DeltaEngine{TextDeltaEngine{}, BinaryDeltaEngine{}}
+	for _, tc := range tests {
+		for _, engine := range engines {
+			t.Run(tc.name+"/"+engine.Name(), func(t *testing.T) {
+				patch, err := engine.Make(tc.old, tc.new)
+				if err != nil {
+					t.Fatalf("Make failed: %v", err)
+				}
+				result, err := engine.Apply(tc.old, patch)
+				if err != nil {
+					t.Fatalf("Apply failed: %v", err)
+				}
+				if !bytes.Equal(result, tc.new) {
+					t.Errorf("Reconstructed content does not match")
+				}
+			})
+		}
+	}
+}
+
+func TestBinaryContentFallsBackToBinaryEngine(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	old := make([]byte, 4096)
+	rng.Read(old)
+
+	// Random bytes with a block moved and bytes inserted in the middle
+	new := append([]byte{}, old[2048:3072]...)
+	new = append(new, old[:2048]...)
+	new = append(new, []byte("inserted bytes")...)
+	new = append(new, old[3072:]...)
+
+	// The text engine reports invalid text instead of panicking
+	if _, err := (TextDeltaEngine{}).Make(old, new); err == nil {
+		t.Skip("diffmatchpatch handled the binary content")
+	}
+
+	delta := CalculateDelta(old, new, "file.bin", "base123")
+	if delta.Engine != BinaryEngineName {
+		t.Errorf("Expected fallback to the binary engine, got %q", delta.Engine)
+	}
+	delta.Compressed = false // Patches are only compressed when saved by the repository
+	result, err := ApplyDelta(delta, func(path, saveHash string) ([]byte, error) {
+		return old, nil
+	})
+	if err != nil {
+		t.Fatalf("ApplyDelta failed: %v", err)
+	}
+	if !bytes.Equal(result, new) {
+		t.Error("Reconstructed content does not match")
+	}
+}
+
+func TestBinaryEngineReusesBaseBlocks(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	old := make([]byte, 64*1024)
+	rng.Read(old)
+	new := append(append([]byte{}, old[:32*1024]...), append([]byte("edit"), old[32*1024:]...)...)
+
+	patch, err := BinaryDeltaEngine{}.Make(old, new)
+	if err != nil {
+		t.Fatalf("Make failed: %v", err)
+	}
+	if len(patch) > 64 {
+		t.Errorf("Expected a small patch for a small insertion, got %d bytes", len(patch))
+	}
+}
+
+func TestBinaryEngineRejectsMismatchedBase(t *testing.T) {
+	old := bytes.Repeat([]byte("0123456789abcdef"), 8)
+	patch, err := BinaryDeltaEngine{}.Make(old, append(old, 'x'))
+	if err != nil {
+		t.Fatalf("Make failed: %v", err)
+	}
+	if _, err := (BinaryDeltaEngine{}).Apply(old[:16], patch); err == nil {
+		t.Error("Expected error when applying to a shorter base")
+	}
+}
+
+func TestDeltaRecordsEngine(t *testing.T) {
+	originalEngine := DeltaEngineConfig.Engine
+	defer func() { DeltaEngineConfig.Engine = originalEngine }()
+
+	old := []byte(strings.Repeat("line of content\n", 20))
+	new := append([]byte("header\n"), old...)
+
+	for _, name := range []string{TextEngineName, BinaryEngineName} {
+		DeltaEngineConfig.Engine = name
+		delta := CalculateDelta(old, new, "file.txt", "base123")
+		if delta.Engine != name {
+			t.Errorf("Expected engine %q to be recorded, got %q", name, delta.Engine)
+		}
+
+		// Store and reload the delta set so patches go through compression
+		mockFS := NewMockFileSystem()
+		if err := SaveDeltaSet(DeltaSet{SaveHash: "save123", Deltas: []DeltaInfo{delta}}, ".bit/objects", mockFS); err != nil {
+			t.Fatalf("Failed to save delta set: %v", err)
+		}
+		loaded, err := LoadDeltaSet("save123", ".bit/objects", mockFS)
+		if err != nil {
+			t.Fatalf("Failed to load delta set: %v", err)
+		}
+
+		// Replaying does not depend on the currently configured engine
+		DeltaEngineConfig.Engine = TextEngineName
+		result, err := ApplyDelta(loaded.Deltas[0], func(path, saveHash string) ([]byte, error) {
+			return old, nil
+		})
+		if err != nil {
+			t.Fatalf("ApplyDelta with %s engine failed: %v", name, err)
+		}
+		if !bytes.Equal(result, new) {
+			t.Errorf("Content mismatch with %s engine", name)
+		}
+	}
+
+	// Unknown engines are reported
+	_, err := ApplyDelta(DeltaInfo{Path: "file.txt", Patches: []string{"x"}, Engine: "missing"}, func(path, saveHash string) ([]byte, error) {
+		return old, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "unknown delta engine") {
+		t.Errorf("Expected unknown engine error, got: %v", err)
+	}
+}
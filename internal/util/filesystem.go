@@ -1,26 +1,63 @@
 package util
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// ErrLocked is returned by Lock when the lock is already held
+var ErrLocked = errors.New("lock is held by another process")
+
+// StaleLockTimeout is the age after which a lock file without a process id is
+// assumed to be left behind by a crashed process and is broken
+var StaleLockTimeout = 10 * time.Minute
+
 // FileSystem interface abstracts filesystem operations for testing
 type FileSystem interface {
 	// Basic file operations
 	ReadFile(filename string) ([]byte, error)
+	// WriteFile replaces the content of a file, creating it if needed
 	WriteFile(filename string, data []byte, perm os.FileMode) error
+	AppendFile(filename string, data []byte, perm os.FileMode) error
 	Open(name string) (File, error)
+	// Create opens a file for writing, truncating it if it exists. Written
+	// content is visible to ReadFile and Open as soon as Write returns.
 	Create(name string) (File, error)
 	Remove(name string) error
 	RemoveAll(path string) error
+	Rename(oldpath, newpath string) error
 	MkdirAll(path string, perm os.FileMode) error
 	Stat(name string) (os.FileInfo, error)
+	// Lstat is like Stat, but describes a symbolic link itself rather than
+	// the file it points to
+	Lstat(name string) (os.FileInfo, error)
+	// Chmod sets the permission bits of a file exactly, regardless of umask
+	Chmod(name string, mode os.FileMode) error
+	// Chtimes sets the access and modification times of a file. A zero time
+	// leaves that time unchanged.
+	Chtimes(name string, atime, mtime time.Time) error
+
+	// Symbolic links
+	Readlink(name string) (string, error)
+	Symlink(oldname, newname string) error
+
+	// Advisory locking between processes. Lock fails with ErrLocked
+	// while another holder has the lock.
+	Lock(name string) error
+	Unlock(name string) error
 
 	// Walk directory with callback function
 	Walk(root string, walkFn filepath.WalkFunc) error
 
+	// ReadDir lists the immediate children of a directory, sorted by name
+	ReadDir(path string) ([]os.DirEntry, error)
+
 	// Check if file exists
 	Exists(path string) bool
 }
@@ -51,6 +88,24 @@ func (fs *OsFileSystem) WriteFile(filename string, data []byte, perm os.FileMode
 	return os.WriteFile(filename, data, perm)
 }
 
+// AppendFile appends data to the named file, creating it if needed, and syncs
+// it to disk before returning
+func (fs *OsFileSystem) AppendFile(filename string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 // Open opens the named file for reading
 func (fs *OsFileSystem) Open(name string) (File, error) {
 	return os.Open(name)
@@ -61,11 +116,92 @@ func (fs *OsFileSystem) Create(name string) (File, error) {
 	return os.Create(name)
 }
 
+// Lock atomically creates the named lock file, recording the current process
+// id. A lock recording a process that is no longer running is broken and
+// acquired again, as is a lock without a process id that is older than
+// StaleLockTimeout. Locks of running processes are never broken, however long
+// they are held.
+func (fs *OsFileSystem) Lock(name string) error {
+	err := createLockFile(name)
+	if os.IsExist(err) && lockIsStale(name) {
+		err = breakLock(name)
+	}
+	if os.IsExist(err) {
+		return ErrLocked
+	}
+	return err
+}
+
+// createLockFile creates the named file if it does not exist and writes the
+// current process id to it
+func createLockFile(name string) error {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(file, "%d\n", os.Getpid()); err != nil {
+		file.Close()
+		os.Remove(name)
+		return err
+	}
+	return file.Close()
+}
+
+// lockIsStale reports whether the named lock file was left behind by a
+// process that is no longer running
+func lockIsStale(name string) bool {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return false
+	}
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid > 0 {
+		return !processAlive(pid)
+	}
+
+	// The holder may not have written its process id yet, or crashed before
+	// doing so
+	info, err := os.Stat(name)
+	return err == nil && time.Since(info.ModTime()) > StaleLockTimeout
+}
+
+// breakLock replaces the stale named lock with one held by the current
+// process. Only the process that creates the guard file name+".break" may do
+// so, and it checks again that the lock is stale while holding the guard, as
+// another process may have broken and taken it in the meantime.
+func breakLock(name string) error {
+	guard := name + ".break"
+	if err := createLockFile(guard); err != nil {
+		if os.IsExist(err) && lockIsStale(guard) {
+			os.Remove(guard)
+		}
+		return err
+	}
+	defer os.Remove(guard)
+
+	if !lockIsStale(name) {
+		return os.ErrExist
+	}
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return createLockFile(name)
+}
+
+// Unlock releases a lock acquired with Lock
+func (fs *OsFileSystem) Unlock(name string) error {
+	return os.Remove(name)
+}
+
 // Remove removes the named file or directory
 func (fs *OsFileSystem) Remove(name string) error {
 	return os.Remove(name)
 }
 
+// Rename moves oldpath to newpath, replacing newpath if it exists
+func (fs *OsFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
 // RemoveAll removes path and any children it contains
 func (fs *OsFileSystem) RemoveAll(path string) error {
 	return os.RemoveAll(path)
@@ -81,13 +217,110 @@ func (fs *OsFileSystem) Stat(name string) (os.FileInfo, error) {
 	return os.Stat(name)
 }
 
+// Lstat returns file info without following a symbolic link
+func (fs *OsFileSystem) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+// Chmod sets the permission bits of the named file
+func (fs *OsFileSystem) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+// Chtimes sets the access and modification times of the named file
+func (fs *OsFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// Readlink returns the destination of the named symbolic link
+func (fs *OsFileSystem) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+// Symlink creates newname as a symbolic link to oldname
+func (fs *OsFileSystem) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
 // Walk walks the file tree rooted at root
 func (fs *OsFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
 	return filepath.Walk(root, walkFn)
 }
 
+// ReadDir lists the entries of the named directory, sorted by name
+func (fs *OsFileSystem) ReadDir(path string) ([]os.DirEntry, error) {
+	return os.ReadDir(path)
+}
+
 // Exists checks if a file or directory exists
 func (fs *OsFileSystem) Exists(path string) bool {
 	_, err := os.Stat(path)
 	return !os.IsNotExist(err)
 }
+
+// MmapThreshold is the size in bytes from which ReadFileMapped maps a file
+// into memory instead of reading it. 0 disables mapping.
+var MmapThreshold int64 = 16 << 20
+
+// ReadFileMapped returns the content of the named file like fs.ReadFile, but
+// maps files of at least MmapThreshold bytes into memory when fs is the OS
+// filesystem, so that hashing and compressing them needs no heap copy. The
+// returned release function must be called once the content is no longer
+// used, which must not be touched afterwards. Other filesystems, smaller files
+// and failed mappings fall back to ReadFile, whose release does nothing.
+//
+// Mapped content reflects later writes to the file, and truncating the file
+// while it is mapped makes reading past its new end crash, so it must only be
+// used while the file is not expected to change, and callers must check that
+// the file kept its size and modification time before relying on the content.
+func ReadFileMapped(fs FileSystem, name string) ([]byte, func() error, error) {
+	noRelease := func() error { return nil }
+	if _, ok := fs.(*OsFileSystem); !ok || MmapThreshold <= 0 {
+		content, err := fs.ReadFile(name)
+		return content, noRelease, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, noRelease, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, noRelease, err
+	}
+	if info.Size() >= MmapThreshold && info.Mode().IsRegular() {
+		if data, err := mmapFile(f, int(info.Size())); err == nil {
+			return data, func() error { return munmap(data) }, nil
+		}
+	}
+
+	content, err := fs.ReadFile(name)
+	return content, noRelease, err
+}
+
+// ErrNotRepository is returned when neither a directory nor any of its parents holds a repository
+var ErrNotRepository = errors.New("not a bit repository")
+
+// FindRepositoryRoot walks up from startDir looking for a directory containing .bit,
+// either the repository directory itself or a file pointing to it, and returns
+// the first one found
+func FindRepositoryRoot(startDir string, fs FileSystem) (string, error) {
+	dir, err := filepath.Abs(startDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", startDir, err)
+	}
+
+	for {
+		if _, err := fs.Stat(filepath.Join(dir, ".bit")); err == nil {
+			return dir, nil
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("%w (or any parent up to %s)", ErrNotRepository, dir)
+		}
+		dir = parent
+	}
+}
@@ -1,9 +1,15 @@
 package util
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestOsFileSystem(t *testing.T) {
@@ -191,3 +197,218 @@ func TestOsFileSystem(t *testing.T) {
 	// This is a basic test of Walk - we're just ensuring it runs without errors
 	// A more comprehensive test would check the exact paths visited
 }
+
+func TestFindRepositoryRoot(t *testing.T) {
+	fs := NewMockFileSystem()
+	fs.AddDirectory("/work/project/.bit")
+	fs.AddDirectory("/work/project/src/nested")
+
+	// Found from the root itself
+	root, err := FindRepositoryRoot("/work/project", fs)
+	if err != nil {
+		t.Fatalf("FindRepositoryRoot failed: %v", err)
+	}
+	if root != "/work/project" {
+		t.Errorf("Expected root /work/project, got %s", root)
+	}
+
+	// Found from a nested directory
+	root, err = FindRepositoryRoot("/work/project/src/nested", fs)
+	if err != nil {
+		t.Fatalf("FindRepositoryRoot failed: %v", err)
+	}
+	if root != "/work/project" {
+		t.Errorf("Expected root /work/project, got %s", root)
+	}
+
+	// Not found outside the repository
+	if _, err := FindRepositoryRoot("/work/other", fs); err == nil {
+		t.Error("Expected error when no repository exists in any parent")
+	}
+}
+
+func TestOsFileSystemSymlinks(t *testing.T) {
+	tmpDir := t.TempDir()
+	fs := NewOsFileSystem()
+
+	target := filepath.Join(tmpDir, "target.txt")
+	link := filepath.Join(tmpDir, "link.txt")
+	if err := fs.WriteFile(target, []byte("target"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	if err := fs.Symlink("target.txt", link); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	destination, err := fs.Readlink(link)
+	if err != nil {
+		t.Fatalf("Readlink failed: %v", err)
+	}
+	if destination != "target.txt" {
+		t.Errorf("Readlink mismatch: expected %q, got %q", "target.txt", destination)
+	}
+
+	if _, err := fs.Readlink(target); err == nil {
+		t.Errorf("Readlink on a regular file should fail")
+	}
+}
+
+func TestOsFileSystemLock(t *testing.T) {
+	fs := NewOsFileSystem()
+	lock := filepath.Join(t.TempDir(), "lock")
+
+	// Only one of many concurrent callers acquires the lock
+	var acquired int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := fs.Lock(lock)
+			if err == nil {
+				atomic.AddInt32(&acquired, 1)
+			} else if !errors.Is(err, ErrLocked) {
+				t.Errorf("Unexpected lock error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired != 1 {
+		t.Fatalf("Expected exactly one holder, got %d", acquired)
+	}
+
+	if err := fs.Unlock(lock); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if err := fs.Lock(lock); err != nil {
+		t.Fatalf("Lock after unlock failed: %v", err)
+	}
+
+	// Locks of running processes are kept however old they are
+	old := time.Now().Add(-2 * StaleLockTimeout)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if err := fs.Lock(lock); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected old lock of a running process to be kept, got: %v", err)
+	}
+
+	// Locks of processes that are no longer running are broken
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	if err := exited.Run(); err != nil {
+		t.Fatalf("Running child process failed: %v", err)
+	}
+	if err := os.WriteFile(lock, []byte(fmt.Sprintf("%d\n", exited.Process.Pid)), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := fs.Lock(lock); err != nil {
+		t.Errorf("Expected lock of exited process to be broken, got: %v", err)
+	}
+	if data, _ := os.ReadFile(lock); string(data) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Errorf("Expected broken lock to be taken over, got %q", data)
+	}
+	if _, err := os.Stat(lock + ".break"); !os.IsNotExist(err) {
+		t.Errorf("Expected guard file to be removed, got: %v", err)
+	}
+
+	// Locks without a process id are broken only once they are old
+	if err := os.WriteFile(lock, nil, 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if err := fs.Lock(lock); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected new empty lock to be kept, got: %v", err)
+	}
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatalf("Chtimes failed: %v", err)
+	}
+	if err := fs.Lock(lock); err != nil {
+		t.Errorf("Expected old empty lock to be broken, got: %v", err)
+	}
+}
+
+func TestOsFileSystemAppendFile(t *testing.T) {
+	fs := NewOsFileSystem()
+	path := filepath.Join(t.TempDir(), "log")
+
+	for _, line := range []string{"first\n", "second\n"} {
+		if err := fs.AppendFile(path, []byte(line), 0644); err != nil {
+			t.Fatalf("AppendFile failed: %v", err)
+		}
+	}
+
+	content, err := fs.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if string(content) != "first\nsecond\n" {
+		t.Errorf("Unexpected content: %q", content)
+	}
+}
+
+func TestReadFileMapped(t *testing.T) {
+	originalThreshold := MmapThreshold
+	defer func() { MmapThreshold = originalThreshold }()
+	MmapThreshold = 4
+
+	path := filepath.Join(t.TempDir(), "large.txt")
+	content := []byte("large enough to be mapped")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	data, release, err := ReadFileMapped(NewOsFileSystem(), path)
+	if err != nil {
+		t.Fatalf("ReadFileMapped failed: %v", err)
+	}
+	if string(data) != string(content) {
+		t.Errorf("Expected %q, got %q", content, data)
+	}
+	if err := release(); err != nil {
+		t.Errorf("Release failed: %v", err)
+	}
+
+	// Other filesystems are read as usual
+	mockFS := NewMockFileSystem()
+	mockFS.AddFile("large.txt", content)
+	data, release, err = ReadFileMapped(mockFS, "large.txt")
+	if err != nil || string(data) != string(content) {
+		t.Errorf("Expected %q from the mock filesystem, got %q, %v", content, data, err)
+	}
+	release()
+
+	if _, _, err := ReadFileMapped(NewOsFileSystem(), filepath.Join(t.TempDir(), "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected a not-exist error, got %v", err)
+	}
+}
+
+func BenchmarkReadFileMapped(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "large.bin")
+	if err := os.WriteFile(path, make([]byte, 64<<20), 0644); err != nil {
+		b.Fatalf("Failed to write file: %v", err)
+	}
+	fs := NewOsFileSystem()
+
+	b.Run("ReadFile", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			content, err := fs.ReadFile(path)
+			if err != nil {
+				b.Fatalf("ReadFile failed: %v", err)
+			}
+			CalculateFileHash(content)
+		}
+	})
+
+	b.Run("Mapped", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			content, release, err := ReadFileMapped(fs, path)
+			if err != nil {
+				b.Fatalf("ReadFileMapped failed: %v", err)
+			}
+			CalculateFileHash(content)
+			release()
+		}
+	})
+}
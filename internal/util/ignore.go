@@ -2,6 +2,8 @@ package util
 
 import (
 	"bufio"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,43 +13,134 @@ import (
 
 // GetIgnorePatterns loads ignore patterns from .bitignore file
 func GetIgnorePatterns(ignoreFile string) ([]glob.Glob, error) {
-	file, err := os.Open(ignoreFile)
+	return LoadIgnorePatterns(ignoreFile, NewOsFileSystem())
+}
+
+// GlobalIgnoreEnv names the environment variable overriding the location of
+// the global ignore file
+const GlobalIgnoreEnv = "BIT_GLOBAL_IGNORE"
+
+// GlobalIgnorePath returns the location of the user's global ignore file:
+// $BIT_GLOBAL_IGNORE when set, otherwise bit/ignore in $XDG_CONFIG_HOME or
+// ~/.config
+func GlobalIgnorePath() (string, error) {
+	if path := os.Getenv(GlobalIgnoreEnv); path != "" {
+		return path, nil
+	}
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		configDir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configDir, "bit", "ignore"), nil
+}
+
+// LoadGlobalIgnore loads the patterns of the user's global ignore file, which
+// apply to every repository on the machine. A missing file yields no patterns.
+func LoadGlobalIgnore() ([]glob.Glob, error) {
+	path, err := GlobalIgnorePath()
 	if err != nil {
-		return nil, err
+		// Without a home directory there is no global file to read
+		return nil, nil
 	}
-	defer file.Close()
 
-	var patterns []glob.Glob
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		// Skip empty lines and comments
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
+	patterns, err := GetIgnorePatterns(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to load global ignore file %s: %w", path, err)
+	}
+	return patterns, nil
+}
 
-		// Convert the pattern to a glob pattern
-		pattern := line
+// LoadIgnorePatterns loads ignore patterns from the given file using the provided filesystem
+func LoadIgnorePatterns(ignoreFile string, fs FileSystem) ([]glob.Glob, error) {
+	file, err := fs.Open(ignoreFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
 
-		// Handle directory patterns (ending with /)
-		if strings.HasSuffix(pattern, "/") {
-			pattern = pattern + "**"
-		}
+	return ParseIgnorePatterns(file)
+}
 
-		// Handle file patterns
-		if !strings.Contains(pattern, "/") {
-			// *.log should match both test.log and subfolder/test.log
-			pattern = "**/" + pattern
-		}
+// ParseIgnorePatterns compiles the ignore patterns read from r.
+//
+// Each line holds one pattern, with this grammar:
+//   - leading whitespace is ignored, and blank lines are skipped
+//   - a "#" at the start of a line, or preceded by whitespace, starts a
+//     comment running to the end of the line; "#" inside a word such as
+//     "a#b" is part of the pattern
+//   - trailing whitespace is dropped unless escaped with a backslash, so
+//     "name\ " matches "name " with the trailing space
+//   - "\#" and "\!" stand for a literal "#" and "!", so files whose names
+//     start with those characters can be ignored
+//   - a pattern starting with "!" re-includes paths ignored by an earlier
+//     pattern; the last matching pattern decides. As everything inside an
+//     ignored directory is skipped, files inside it cannot be re-included.
+//   - a pattern ending in "/" matches everything inside that directory
+//   - a pattern starting with "/" is anchored to the repository root, so
+//     "/build" matches "build" but not "src/build"; any other pattern
+//     matches at any depth
+//
+// Any other backslash is passed on to the glob, where it escapes the next
+// character.
+func ParseIgnorePatterns(r io.Reader) ([]glob.Glob, error) {
+	lines, err := ReadIgnorePatterns(r)
+	if err != nil {
+		return nil, err
+	}
 
-		// Compile the pattern
-		compiledPattern, err := glob.Compile(pattern)
+	patterns := make([]glob.Glob, 0, len(lines))
+	for _, line := range lines {
+		compiledPattern, err := compilePattern(line.Pattern)
 		if err != nil {
 			return nil, err
 		}
+		if line.Negated {
+			compiledPattern = negatedPattern{compiledPattern}
+		}
 		patterns = append(patterns, compiledPattern)
 	}
 
+	return patterns, nil
+}
+
+// IgnorePattern is one pattern of an ignore file, as left once comments,
+// escapes and unescaped trailing whitespace are removed
+type IgnorePattern struct {
+	Pattern string `json:"pattern"`
+	Negated bool   `json:"negated,omitempty"` // Whether the pattern re-includes paths
+}
+
+// String returns the pattern with a leading "!" if it is negated
+func (p IgnorePattern) String() string {
+	if p.Negated {
+		return "!" + p.Pattern
+	}
+	return p.Pattern
+}
+
+// ReadIgnorePatterns reads the patterns of an ignore file from r without
+// compiling them, following the grammar of ParseIgnorePatterns
+func ReadIgnorePatterns(r io.Reader) ([]IgnorePattern, error) {
+	var patterns []IgnorePattern
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// An unescaped leading "!" negates the pattern
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		negated := strings.HasPrefix(line, "!")
+		line = parseIgnoreLine(strings.TrimPrefix(line, "!"))
+		// Skip empty lines and comments
+		if line == "" {
+			continue
+		}
+		patterns = append(patterns, IgnorePattern{Pattern: line, Negated: negated})
+	}
+
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
@@ -55,16 +148,90 @@ func GetIgnorePatterns(ignoreFile string) ([]glob.Glob, error) {
 	return patterns, nil
 }
 
-// IsIgnored checks if a file path matches any of the ignore patterns
-func IsIgnored(path string, patterns []glob.Glob) bool {
+// CompilePatterns compiles patterns written as in .bitignore, one per entry,
+// for use with IsIgnored
+func CompilePatterns(patterns []string) ([]glob.Glob, error) {
+	compiled := make([]glob.Glob, 0, len(patterns))
+	for _, pattern := range patterns {
+		compiledPattern, err := compilePattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		compiled = append(compiled, compiledPattern)
+	}
+	return compiled, nil
+}
+
+// negatedPattern marks a "!" pattern, which re-includes the paths it matches
+type negatedPattern struct {
+	glob.Glob
+}
+
+// compilePattern converts a .bitignore style pattern into a glob matching
+// repository-relative paths
+func compilePattern(pattern string) (glob.Glob, error) {
+	// Handle directory patterns (ending with /)
+	if strings.HasSuffix(pattern, "/") {
+		pattern = pattern + "**"
+	}
+
+	// A leading slash anchors the pattern to the root, anything else matches
+	// at any depth: *.log matches both test.log and subfolder/test.log
+	if anchored := strings.TrimPrefix(pattern, "/"); anchored != pattern {
+		pattern = anchored
+	} else if !strings.HasPrefix(pattern, "**/") {
+		pattern = "**/" + pattern
+	}
+
+	return glob.Compile(pattern)
+}
+
+// matchesPattern reports whether pattern matches path, which may also be
+// written with a leading ./
+func matchesPattern(pattern glob.Glob, path string) bool {
 	// Normalize path to use forward slashes
 	normalizedPath := filepath.ToSlash(path)
+	return pattern.Match(normalizedPath) || pattern.Match("./"+normalizedPath)
+}
 
-	// Also try with a leading ./ as some patterns might be specified that way
-	altPath := "./" + normalizedPath
+// parseIgnoreLine strips comments, escapes and unescaped trailing whitespace
+// from a .bitignore line, returning the pattern or "" when there is none
+func parseIgnoreLine(line string) string {
+	line = strings.TrimLeft(strings.TrimSuffix(line, "\r"), " \t")
 
-	for _, pattern := range patterns {
-		if pattern.Match(normalizedPath) || pattern.Match(altPath) {
+	var pattern strings.Builder
+	// Length of the pattern up to its last character that is not unescaped
+	// whitespace
+	keep := 0
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && strings.IndexByte("#! \t", line[i+1]) >= 0 {
+			i++
+			pattern.WriteByte(line[i])
+			keep = pattern.Len()
+			continue
+		}
+		if c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			break
+		}
+		pattern.WriteByte(c)
+		if c != ' ' && c != '\t' {
+			keep = pattern.Len()
+		}
+	}
+
+	return pattern.String()[:keep]
+}
+
+// IsIgnored checks if a file path is ignored by the patterns: the last
+// pattern matching it must not be a "!" negation
+func IsIgnored(path string, patterns []glob.Glob) bool {
+	for i := len(patterns) - 1; i >= 0; i-- {
+		if negated, ok := patterns[i].(negatedPattern); ok {
+			if matchesPattern(negated.Glob, path) {
+				return false
+			}
+		} else if matchesPattern(patterns[i], path) {
 			return true
 		}
 	}
@@ -72,6 +239,12 @@ func IsIgnored(path string, patterns []glob.Glob) bool {
 	return false
 }
 
+// IsIgnoredDir checks if a directory is matched by a directory pattern such
+// as "build/", meaning everything inside it is ignored and walks can skip it
+func IsIgnoredDir(path string, patterns []glob.Glob) bool {
+	return IsIgnored(strings.TrimSuffix(filepath.ToSlash(path), "/")+"/", patterns)
+}
+
 // IsBitDirectory checks if a path is inside the .bit directory
 func IsBitDirectory(path string) bool {
 	return path == ".bit" || strings.HasPrefix(path, ".bit/")
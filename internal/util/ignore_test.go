@@ -3,6 +3,7 @@ package util
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/gobwas/glob"
@@ -53,6 +54,45 @@ src/*.test.js
 	}
 }
 
+func TestParseIgnorePatternsEscapes(t *testing.T) {
+	content := "\\#notacomment\n" +
+		"\\!literal\n" +
+		"*.tmp # temporary files\n" +
+		"a#b\n" +
+		"trailing\\ \n" +
+		"spaces   \n"
+
+	patterns, err := ParseIgnorePatterns(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("ParseIgnorePatterns failed: %v", err)
+	}
+	if len(patterns) != 6 {
+		t.Fatalf("Expected 6 patterns, got %d", len(patterns))
+	}
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"#notacomment", true},
+		{"dir/#notacomment", true},
+		{"notacomment", false},
+		{"!literal", true},
+		{"literal", false},
+		{"cache.tmp", true},
+		{"a#b", true},
+		{"trailing ", true},
+		{"trailing", false},
+		{"spaces", true},
+		{"spaces   ", false},
+	}
+	for _, test := range tests {
+		if result := IsIgnored(test.path, patterns); result != test.expected {
+			t.Errorf("IsIgnored(%q) = %v, expected %v", test.path, result, test.expected)
+		}
+	}
+}
+
 func TestIsIgnored(t *testing.T) {
 	// Create test patterns that match the actual implementation behavior
 	// The implementation in ignore.go adds "**" to directory patterns and "**/" to file patterns without a slash
@@ -125,3 +165,59 @@ func TestIsBitDirectory(t *testing.T) {
 		})
 	}
 }
+
+func TestIsIgnoredDir(t *testing.T) {
+	patterns, err := ParseIgnorePatterns(strings.NewReader("node_modules/\nbuild/\n*.log\n"))
+	if err != nil {
+		t.Fatalf("ParseIgnorePatterns failed: %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"node_modules", true},
+		{"node_modules/", true},
+		{"src", false},
+		{"build", true},
+		{"logs.log", false}, // File patterns don't hide whole directories
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			if result := IsIgnoredDir(tc.path, patterns); result != tc.expected {
+				t.Errorf("IsIgnoredDir(%q) = %v, want %v", tc.path, result, tc.expected)
+			}
+		})
+	}
+}
+
+func TestAnchoredPatterns(t *testing.T) {
+	patterns, err := ParseIgnorePatterns(strings.NewReader("/build/**\nout/**\n/dist/\n/TODO\n"))
+	if err != nil {
+		t.Fatalf("ParseIgnorePatterns failed: %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{"build/app.bin", true},
+		{"src/build/app.bin", false}, // /build/** only matches at the root
+		{"out/app.bin", true},
+		{"src/out/app.bin", true}, // out/** matches anywhere
+		{"dist/bundle.js", true},
+		{"web/dist/bundle.js", false},
+		{"TODO", true},
+		{"docs/TODO", false},
+	}
+	for _, tc := range tests {
+		if result := IsIgnored(tc.path, patterns); result != tc.expected {
+			t.Errorf("IsIgnored(%q) = %v, want %v", tc.path, result, tc.expected)
+		}
+	}
+
+	if !IsIgnoredDir("dist", patterns) || IsIgnoredDir("web/dist", patterns) {
+		t.Error("Expected /dist/ to hide only the root dist directory")
+	}
+}
@@ -0,0 +1,215 @@
+package util
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// lineHunk replaces the base lines [start, end) with lines
+type lineHunk struct {
+	start, end int
+	lines      []string
+}
+
+// MergeText merges the changes made from base to ours and from base to theirs
+// line by line. Changes to different lines are combined. Where both sides
+// changed the same lines differently, both versions are written between
+// conflict markers labelled with oursLabel and theirsLabel, and conflict is
+// reported.
+func MergeText(base, ours, theirs, oursLabel, theirsLabel string) (merged string, conflict bool) {
+	baseLines := SplitLines(base)
+	oursHunks := diffLineHunks(base, ours)
+	theirsHunks := diffLineHunks(base, theirs)
+
+	var out strings.Builder
+	pos, i, j := 0, 0, 0
+	for i < len(oursHunks) || j < len(theirsHunks) {
+		// Start a region at the earliest remaining hunk and grow it while
+		// hunks of either side touch it
+		var start, end int
+		if j >= len(theirsHunks) || i < len(oursHunks) && oursHunks[i].start <= theirsHunks[j].start {
+			start, end = oursHunks[i].start, oursHunks[i].end
+		} else {
+			start, end = theirsHunks[j].start, theirsHunks[j].end
+		}
+		firstOurs, firstTheirs := i, j
+		for grown := true; grown; {
+			grown = false
+			if i < len(oursHunks) && touchesRegion(oursHunks[i], start, end) {
+				end = max(end, oursHunks[i].end)
+				i++
+				grown = true
+			}
+			if j < len(theirsHunks) && touchesRegion(theirsHunks[j], start, end) {
+				end = max(end, theirsHunks[j].end)
+				j++
+				grown = true
+			}
+		}
+
+		out.WriteString(strings.Join(baseLines[pos:start], ""))
+		pos = end
+
+		oursText := applyLineHunks(baseLines, start, end, oursHunks[firstOurs:i])
+		theirsText := applyLineHunks(baseLines, start, end, theirsHunks[firstTheirs:j])
+		switch {
+		case i == firstOurs || oursText == theirsText:
+			out.WriteString(theirsText)
+		case j == firstTheirs:
+			out.WriteString(oursText)
+		default:
+			conflict = true
+			out.WriteString("<<<<<<< " + oursLabel + "\n")
+			out.WriteString(withTrailingNewline(oursText))
+			out.WriteString("=======\n")
+			out.WriteString(withTrailingNewline(theirsText))
+			out.WriteString(">>>>>>> " + theirsLabel + "\n")
+		}
+	}
+	out.WriteString(strings.Join(baseLines[pos:], ""))
+
+	return out.String(), conflict
+}
+
+// lineDiff is a run of lines kept, deleted or inserted between two texts
+type lineDiff struct {
+	op    diffmatchpatch.Operation
+	lines []string
+}
+
+// diffLines compares a and b line by line. Each distinct line is encoded as
+// one rune, so that the character diff of the encoded texts is a diff of whole
+// lines; the lines of each run are then taken back from a and b by count.
+func diffLines(a, b string) []lineDiff {
+	aLines, bLines := SplitLines(a), SplitLines(b)
+	codes := make(map[string]rune)
+	encode := func(lines []string) []rune {
+		runes := make([]rune, len(lines))
+		for i, line := range lines {
+			code, ok := codes[line]
+			if !ok {
+				// Skip the surrogate range, which holds no valid runes
+				code = rune(len(codes) + 1)
+				if code >= 0xD800 {
+					code += 0x800
+				}
+				codes[line] = code
+			}
+			runes[i] = code
+		}
+		return runes
+	}
+	aRunes, bRunes := encode(aLines), encode(bLines)
+
+	var diffs []lineDiff
+	aPos, bPos := 0, 0
+	for _, diff := range diffmatchpatch.New().DiffMainRunes(aRunes, bRunes, false) {
+		n := utf8.RuneCountInString(diff.Text)
+		switch diff.Type {
+		case diffmatchpatch.DiffEqual:
+			diffs = append(diffs, lineDiff{op: diff.Type, lines: aLines[aPos : aPos+n]})
+			aPos += n
+			bPos += n
+		case diffmatchpatch.DiffDelete:
+			diffs = append(diffs, lineDiff{op: diff.Type, lines: aLines[aPos : aPos+n]})
+			aPos += n
+		case diffmatchpatch.DiffInsert:
+			diffs = append(diffs, lineDiff{op: diff.Type, lines: bLines[bPos : bPos+n]})
+			bPos += n
+		}
+	}
+	return diffs
+}
+
+// diffLineHunks returns the line hunks turning base into other, in order
+func diffLineHunks(base, other string) []lineHunk {
+	var hunks []lineHunk
+	pos := 0
+	// Deletions and insertions between two equal runs form one hunk
+	open := false
+	for _, diff := range diffLines(base, other) {
+		lines := diff.lines
+		if diff.op == diffmatchpatch.DiffEqual {
+			pos += len(lines)
+			open = false
+			continue
+		}
+
+		if !open {
+			hunks = append(hunks, lineHunk{start: pos, end: pos})
+			open = true
+		}
+		current := &hunks[len(hunks)-1]
+		if diff.op == diffmatchpatch.DiffDelete {
+			pos += len(lines)
+			current.end = pos
+		} else {
+			current.lines = append(current.lines, lines...)
+		}
+	}
+	return hunks
+}
+
+// MatchLines pairs the lines of newer with the lines of older they were kept
+// from. The result holds, for each line of newer, the index of the same line
+// in older, or -1 for lines added or changed since older.
+func MatchLines(older, newer string) []int {
+	matches := make([]int, 0, len(SplitLines(newer)))
+	olderPos := 0
+	for _, diff := range diffLines(older, newer) {
+		lines := len(diff.lines)
+		switch diff.op {
+		case diffmatchpatch.DiffEqual:
+			for i := 0; i < lines; i++ {
+				matches = append(matches, olderPos+i)
+			}
+			olderPos += lines
+		case diffmatchpatch.DiffDelete:
+			olderPos += lines
+		case diffmatchpatch.DiffInsert:
+			for i := 0; i < lines; i++ {
+				matches = append(matches, -1)
+			}
+		}
+	}
+	return matches
+}
+
+// touchesRegion reports whether hunk, which starts at or after start, changes
+// lines of the region [start, end) or inserts lines at its start
+func touchesRegion(hunk lineHunk, start, end int) bool {
+	return hunk.start < end || hunk.start == start
+}
+
+// applyLineHunks returns the base lines [start, end) with hunks applied
+func applyLineHunks(baseLines []string, start, end int, hunks []lineHunk) string {
+	var out strings.Builder
+	pos := start
+	for _, hunk := range hunks {
+		out.WriteString(strings.Join(baseLines[pos:hunk.start], ""))
+		out.WriteString(strings.Join(hunk.lines, ""))
+		pos = hunk.end
+	}
+	out.WriteString(strings.Join(baseLines[pos:end], ""))
+	return out.String()
+}
+
+// SplitLines splits text into lines, each keeping its trailing newline
+func SplitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// withTrailingNewline ends non-empty text with a newline so that a conflict
+// marker after it starts on its own line
+func withTrailingNewline(text string) string {
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		return text + "\n"
+	}
+	return text
+}
@@ -0,0 +1,95 @@
+package util
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMergeText(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\nfive\n"
+
+	tests := []struct {
+		name     string
+		ours     string
+		theirs   string
+		expected string
+		conflict bool
+	}{
+		{
+			name:     "changes to different lines",
+			ours:     "ONE\ntwo\nthree\nfour\nfive\n",
+			theirs:   "one\ntwo\nthree\nfour\nFIVE\n",
+			expected: "ONE\ntwo\nthree\nfour\nFIVE\n",
+		},
+		{
+			name:     "insertion and deletion",
+			ours:     "one\ntwo\ntwo and a half\nthree\nfour\nfive\n",
+			theirs:   "one\ntwo\nthree\nfive\n",
+			expected: "one\ntwo\ntwo and a half\nthree\nfive\n",
+		},
+		{
+			name:     "same change on both sides",
+			ours:     "one\n2\nthree\nfour\nfive\n",
+			theirs:   "one\n2\nthree\nfour\nfive\n",
+			expected: "one\n2\nthree\nfour\nfive\n",
+		},
+		{
+			name:     "only one side changed",
+			ours:     base,
+			theirs:   "one\ntwo\n3\nfour\nfive\n",
+			expected: "one\ntwo\n3\nfour\nfive\n",
+		},
+		{
+			name:     "conflicting change",
+			ours:     "one\ntwo\nours\nfour\nfive\n",
+			theirs:   "one\ntwo\ntheirs\nfour\nFIVE\n",
+			expected: "one\ntwo\n<<<<<<< HEAD\nours\n=======\ntheirs\n>>>>>>> other\nfour\nFIVE\n",
+			conflict: true,
+		},
+		{
+			name:     "conflicting insertions at the same place",
+			ours:     "one\ntwo\nthree\nfour\nfive\nsix\n",
+			theirs:   "one\ntwo\nthree\nfour\nfive\n6",
+			expected: "one\ntwo\nthree\nfour\nfive\n<<<<<<< HEAD\nsix\n=======\n6\n>>>>>>> other\n",
+			conflict: true,
+		},
+	}
+
+	for _, test := range tests {
+		merged, conflict := MergeText(base, test.ours, test.theirs, "HEAD", "other")
+		if merged != test.expected || conflict != test.conflict {
+			t.Errorf("%s: got %q (conflict %v), expected %q (conflict %v)", test.name, merged, conflict, test.expected, test.conflict)
+		}
+	}
+
+	// Merging into empty content works when there is no common base
+	if merged, conflict := MergeText("", "", "new\n", "HEAD", "other"); merged != "new\n" || conflict {
+		t.Errorf("Expected additions to an empty base to merge cleanly, got %q (conflict %v)", merged, conflict)
+	}
+}
+
+func TestMatchLines(t *testing.T) {
+	older := "a\nb\nc\n"
+	newer := "a\nB\nc\nd\n"
+	expected := []int{0, -1, 2, -1}
+
+	matches := MatchLines(older, newer)
+	if len(matches) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, matches)
+	}
+	for i := range expected {
+		if matches[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, matches)
+			break
+		}
+	}
+
+	// Texts with more distinct lines than single digits pair up line by line
+	older = "a\nb\nc\nd\ne\nf\ng\nh\ni\nj"
+	newer = "a\nB\nc\nd\ne\nf\ng\nh\ni\nJ\n"
+	expected = []int{0, -1, 2, 3, 4, 5, 6, 7, 8, -1}
+	matches = MatchLines(older, newer)
+	if fmt.Sprint(matches) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, matches)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package util
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile is not supported on this platform, so ReadFileMapped always reads
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("memory mapping is not supported on this platform")
+}
+
+// munmap is never called without a mapping from mmapFile
+func munmap(data []byte) error {
+	return nil
+}
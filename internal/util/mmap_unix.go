@@ -0,0 +1,19 @@
+//go:build unix
+
+package util
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the first size bytes of f into memory read-only. The mapping
+// stays valid after f is closed.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmap releases a mapping made by mmapFile
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
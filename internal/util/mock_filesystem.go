@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	iofs "io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -34,6 +36,8 @@ type MockFile struct {
 	Name   string
 	Closed bool
 	mutex  sync.Mutex
+
+	persist func(content []byte) // Writes content through to the filesystem
 }
 
 func NewMockFile(name string, content []byte) *MockFile {
@@ -77,7 +81,11 @@ func (m *MockFile) Write(p []byte) (n int, err error) {
 	if m.Closed {
 		return 0, errors.New("file closed")
 	}
-	return m.Buffer.Write(p)
+	n, err = m.Buffer.Write(p)
+	if m.persist != nil {
+		m.persist(append([]byte(nil), m.Buffer.Bytes()...))
+	}
+	return n, err
 }
 
 func (m *MockFile) Close() error {
@@ -87,6 +95,9 @@ func (m *MockFile) Close() error {
 		return errors.New("file already closed")
 	}
 	m.Closed = true
+	if m.persist != nil {
+		m.persist(append([]byte(nil), m.Buffer.Bytes()...))
+	}
 	return nil
 }
 
@@ -105,6 +116,8 @@ type MockFileSystem struct {
 	Files     map[string][]byte
 	FileInfos map[string]os.FileInfo
 	Dirs      map[string]bool
+	Links     map[string]string // Symbolic link path -> target
+	Locks     map[string]bool   // Currently held locks
 	mutex     sync.RWMutex
 }
 
@@ -113,6 +126,8 @@ func NewMockFileSystem() *MockFileSystem {
 		Files:     make(map[string][]byte),
 		FileInfos: make(map[string]os.FileInfo),
 		Dirs:      make(map[string]bool),
+		Links:     make(map[string]string),
+		Locks:     make(map[string]bool),
 	}
 }
 
@@ -180,6 +195,15 @@ func (fs *MockFileSystem) WriteFile(filename string, data []byte, perm os.FileMo
 	return nil
 }
 
+func (fs *MockFileSystem) AppendFile(filename string, data []byte, perm os.FileMode) error {
+	fs.mutex.RLock()
+	content := append([]byte(nil), fs.Files[filepath.ToSlash(filename)]...)
+	fs.mutex.RUnlock()
+
+	fs.AddFile(filename, append(content, data...))
+	return nil
+}
+
 func (fs *MockFileSystem) Open(name string) (File, error) {
 	fs.mutex.RLock()
 	defer fs.mutex.RUnlock()
@@ -191,6 +215,9 @@ func (fs *MockFileSystem) Open(name string) (File, error) {
 	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
 }
 
+// Create truncates or creates a file like OsFileSystem.Create. Writes go
+// through to the filesystem as they are made, so the content can be read back
+// before the file is closed.
 func (fs *MockFileSystem) Create(name string) (File, error) {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
@@ -207,7 +234,11 @@ func (fs *MockFileSystem) Create(name string) (File, error) {
 		FileIsDir:   false,
 	}
 
-	return NewMockFile(name, []byte{}), nil
+	file := NewMockFile(name, []byte{})
+	file.persist = func(content []byte) {
+		fs.AddFile(normalizedPath, content)
+	}
+	return file, nil
 }
 
 func (fs *MockFileSystem) Remove(name string) error {
@@ -220,6 +251,11 @@ func (fs *MockFileSystem) Remove(name string) error {
 		delete(fs.FileInfos, normalizedPath)
 		return nil
 	}
+	if _, ok := fs.Links[normalizedPath]; ok {
+		delete(fs.Links, normalizedPath)
+		delete(fs.FileInfos, normalizedPath)
+		return nil
+	}
 	if _, ok := fs.Dirs[normalizedPath]; ok {
 		// Check if directory is empty
 		for path := range fs.Files {
@@ -234,6 +270,47 @@ func (fs *MockFileSystem) Remove(name string) error {
 	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
 }
 
+func (fs *MockFileSystem) Rename(oldpath, newpath string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	oldPath := filepath.ToSlash(oldpath)
+	newPath := filepath.ToSlash(newpath)
+	info, ok := fs.FileInfos[oldPath]
+	if !ok || fs.Dirs[oldPath] {
+		// Only files and links can be renamed in the mock
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+
+	if content, ok := fs.Files[oldPath]; ok {
+		delete(fs.Files, oldPath)
+		fs.Files[newPath] = content
+	}
+	if target, ok := fs.Links[oldPath]; ok {
+		delete(fs.Links, oldPath)
+		fs.Links[newPath] = target
+	}
+	delete(fs.FileInfos, oldPath)
+
+	if renamed, ok := info.(MockFileInfo); ok {
+		renamed.FileName = filepath.Base(newPath)
+		info = renamed
+	}
+	fs.FileInfos[newPath] = info
+
+	// Create parent directories of the new path
+	for dir := filepath.Dir(newPath); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		fs.Dirs[dir] = true
+		fs.FileInfos[dir] = MockFileInfo{
+			FileName:    filepath.Base(dir),
+			FileMode:    0755,
+			FileModTime: time.Now(),
+			FileIsDir:   true,
+		}
+	}
+	return nil
+}
+
 func (fs *MockFileSystem) RemoveAll(path string) error {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
@@ -248,6 +325,14 @@ func (fs *MockFileSystem) RemoveAll(path string) error {
 		}
 	}
 
+	// Remove all symbolic links with this prefix
+	for linkPath := range fs.Links {
+		if linkPath == normalizedPath || strings.HasPrefix(linkPath, normalizedPath+"/") {
+			delete(fs.Links, linkPath)
+			delete(fs.FileInfos, linkPath)
+		}
+	}
+
 	// Remove all directories with this prefix
 	for dirPath := range fs.Dirs {
 		if dirPath == normalizedPath || strings.HasPrefix(dirPath, normalizedPath+"/") {
@@ -275,6 +360,107 @@ func (fs *MockFileSystem) Stat(name string) (os.FileInfo, error) {
 	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
 }
 
+// Lstat returns file info without following a symbolic link. Links are never
+// followed by the mock, so this is the same as Stat.
+func (fs *MockFileSystem) Lstat(name string) (os.FileInfo, error) {
+	info, err := fs.Stat(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+	}
+	return info, nil
+}
+
+// Chmod records mode in the FileMode of the file's MockFileInfo
+func (fs *MockFileSystem) Chmod(name string, mode os.FileMode) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	normalizedPath := filepath.ToSlash(name)
+	info, ok := fs.FileInfos[normalizedPath].(MockFileInfo)
+	if !ok {
+		return &os.PathError{Op: "chmod", Path: name, Err: os.ErrNotExist}
+	}
+	info.FileMode = info.FileMode&^os.ModePerm | mode.Perm()
+	fs.FileInfos[normalizedPath] = info
+	return nil
+}
+
+// Chtimes records mtime in the FileModTime of the file's MockFileInfo. Access
+// times are not tracked.
+func (fs *MockFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	normalizedPath := filepath.ToSlash(name)
+	info, ok := fs.FileInfos[normalizedPath].(MockFileInfo)
+	if !ok {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+	if !mtime.IsZero() {
+		info.FileModTime = mtime
+	}
+	fs.FileInfos[normalizedPath] = info
+	return nil
+}
+
+func (fs *MockFileSystem) Readlink(name string) (string, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	normalizedPath := filepath.ToSlash(name)
+	if target, ok := fs.Links[normalizedPath]; ok {
+		return target, nil
+	}
+	if _, ok := fs.FileInfos[normalizedPath]; ok {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: errors.New("invalid argument")}
+	}
+	return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MockFileSystem) Symlink(oldname, newname string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	normalizedPath := filepath.ToSlash(newname)
+	if _, ok := fs.FileInfos[normalizedPath]; ok {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+
+	fs.Links[normalizedPath] = oldname
+	fs.FileInfos[normalizedPath] = MockFileInfo{
+		FileName:    filepath.Base(normalizedPath),
+		FileSize:    int64(len(oldname)),
+		FileMode:    os.ModeSymlink | 0777,
+		FileModTime: time.Now(),
+		FileIsDir:   false,
+	}
+	return nil
+}
+
+func (fs *MockFileSystem) Lock(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	normalizedPath := filepath.ToSlash(name)
+	if fs.Locks[normalizedPath] {
+		return ErrLocked
+	}
+	fs.Locks[normalizedPath] = true
+	return nil
+}
+
+func (fs *MockFileSystem) Unlock(name string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	normalizedPath := filepath.ToSlash(name)
+	if !fs.Locks[normalizedPath] {
+		return &os.PathError{Op: "unlock", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fs.Locks, normalizedPath)
+	return nil
+}
+
 func (fs *MockFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
 	fs.mutex.RLock()
 
@@ -290,11 +476,17 @@ func (fs *MockFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
 
 	fs.mutex.RUnlock()
 
-	// Sort paths for deterministic order (important for testing)
-	// This simplified version doesn't sort but you should in a real implementation
-	// sort.Strings(paths)
+	// Sort paths for deterministic order (important for testing); parents
+	// sort before their children
+	sort.Strings(paths)
 
+	var skipped []string
 	for _, path := range paths {
+		// Children of skipped directories are never visited
+		if isUnderAny(path, skipped) {
+			continue
+		}
+
 		fs.mutex.RLock()
 		info := fs.FileInfos[path]
 		fs.mutex.RUnlock()
@@ -302,6 +494,7 @@ func (fs *MockFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
 		err := walkFn(path, info, nil)
 		if err != nil {
 			if err == filepath.SkipDir && info.IsDir() {
+				skipped = append(skipped, path)
 				continue
 			}
 			return err
@@ -311,6 +504,42 @@ func (fs *MockFileSystem) Walk(root string, walkFn filepath.WalkFunc) error {
 	return nil
 }
 
+// ReadDir lists the files, directories and links directly inside path
+func (fs *MockFileSystem) ReadDir(path string) ([]os.DirEntry, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	normalizedPath := filepath.ToSlash(filepath.Clean(path))
+	if info, ok := fs.FileInfos[normalizedPath]; ok && !info.IsDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: path, Err: errors.New("not a directory")}
+	}
+
+	var entries []os.DirEntry
+	for child, info := range fs.FileInfos {
+		if child != normalizedPath && filepath.ToSlash(filepath.Dir(child)) == normalizedPath {
+			entries = append(entries, iofs.FileInfoToDirEntry(info))
+		}
+	}
+	if len(entries) == 0 && !fs.Dirs[normalizedPath] && normalizedPath != "." {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// isUnderAny reports whether path is inside one of the given directories
+func isUnderAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 func (fs *MockFileSystem) Exists(path string) bool {
 	fs.mutex.RLock()
 	defer fs.mutex.RUnlock()
@@ -318,6 +547,7 @@ func (fs *MockFileSystem) Exists(path string) bool {
 	normalizedPath := filepath.ToSlash(path)
 	_, fileExists := fs.Files[normalizedPath]
 	_, dirExists := fs.Dirs[normalizedPath]
+	_, linkExists := fs.Links[normalizedPath]
 
-	return fileExists || dirExists
+	return fileExists || dirExists || linkExists
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -148,10 +149,6 @@ func TestMockFileSystem(t *testing.T) {
 		t.Fatalf("Close failed: %v", err)
 	}
 
-	// For MockFile, the buffer content is updated when Write is called,
-	// but we need to explicitly update the Files map to reflect changes
-	fs.AddFile(newFile, newContent)
-
 	readContent, err := fs.ReadFile(newFile)
 	if err != nil {
 		t.Fatalf("ReadFile failed for updated file: %v", err)
@@ -260,3 +257,166 @@ func TestMockFileSystem(t *testing.T) {
 		t.Errorf("Seek on closed file should fail")
 	}
 }
+
+func TestMockFileSystemSymlinks(t *testing.T) {
+	fs := NewMockFileSystem()
+	fs.AddFile("target.txt", []byte("target"))
+
+	if err := fs.Symlink("target.txt", "link.txt"); err != nil {
+		t.Fatalf("Symlink failed: %v", err)
+	}
+
+	// Creating a link over an existing path fails like os.Symlink
+	if err := fs.Symlink("target.txt", "link.txt"); err == nil {
+		t.Errorf("Symlink over an existing path should fail")
+	}
+
+	target, err := fs.Readlink("link.txt")
+	if err != nil {
+		t.Fatalf("Readlink failed: %v", err)
+	}
+	if target != "target.txt" {
+		t.Errorf("Readlink mismatch: expected %q, got %q", "target.txt", target)
+	}
+
+	info, err := fs.Stat("link.txt")
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Expected link to report ModeSymlink, got %v", info.Mode())
+	}
+
+	// Readlink on a regular file fails
+	if _, err := fs.Readlink("target.txt"); err == nil {
+		t.Errorf("Readlink on a regular file should fail")
+	}
+
+	if err := fs.Remove("link.txt"); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	if fs.Exists("link.txt") {
+		t.Errorf("Link still exists after Remove")
+	}
+	if !fs.Exists("target.txt") {
+		t.Errorf("Removing a link should not remove its target")
+	}
+}
+
+func TestMockFileSystemCreate(t *testing.T) {
+	// The mock must behave like the real filesystem
+	dir := t.TempDir()
+	filesystems := map[string]struct {
+		fs   FileSystem
+		path string
+	}{
+		"mock": {NewMockFileSystem(), "created.txt"},
+		"os":   {NewOsFileSystem(), filepath.Join(dir, "created.txt")},
+	}
+
+	for name, tt := range filesystems {
+		t.Run(name, func(t *testing.T) {
+			if err := tt.fs.WriteFile(tt.path, []byte("old and longer content"), 0644); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+
+			// Create truncates an existing file
+			file, err := tt.fs.Create(tt.path)
+			if err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+			if content, err := tt.fs.ReadFile(tt.path); err != nil || len(content) != 0 {
+				t.Errorf("Expected Create to truncate, got %q, %v", content, err)
+			}
+
+			// Writes can be read back before the file is closed
+			if _, err := file.Write([]byte("new ")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if content, err := tt.fs.ReadFile(tt.path); err != nil || string(content) != "new " {
+				t.Errorf("Expected the write to be visible, got %q, %v", content, err)
+			}
+			if _, err := file.Write([]byte("content")); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if err := file.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			if content, err := tt.fs.ReadFile(tt.path); err != nil || string(content) != "new content" {
+				t.Errorf("Expected %q after closing, got %q, %v", "new content", content, err)
+			}
+			if info, err := tt.fs.Stat(tt.path); err != nil || info.Size() != int64(len("new content")) {
+				t.Errorf("Expected Stat to report the written size, got %v, %v", info, err)
+			}
+		})
+	}
+}
+
+func TestMockFileSystemWalkSkipDir(t *testing.T) {
+	fs := NewMockFileSystem()
+	fs.AddFile("root/keep.txt", []byte("keep"))
+	fs.AddFile("root/skip/deep/file.txt", []byte("skipped"))
+
+	var visited []string
+	err := fs.Walk("root", func(path string, info os.FileInfo, err error) error {
+		if path == "root/skip" {
+			return filepath.SkipDir
+		}
+		visited = append(visited, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %v", err)
+	}
+
+	for _, path := range visited {
+		if strings.HasPrefix(path, "root/skip/") {
+			t.Errorf("Walk visited %s inside a skipped directory", path)
+		}
+	}
+	if len(visited) != 2 {
+		t.Errorf("Expected root and keep.txt to be visited, got %v", visited)
+	}
+}
+
+func TestMockFileSystemReadDir(t *testing.T) {
+	fs := NewMockFileSystem()
+	fs.AddFile("root/b.txt", []byte("b"))
+	fs.AddFile("root/a.txt", []byte("a"))
+	fs.AddFile("root/sub/deep/file.txt", []byte("deep"))
+	fs.AddFile("rootless.txt", []byte("sibling with a common prefix"))
+	fs.Symlink("a.txt", "root/link")
+	fs.MkdirAll("root/empty", 0755)
+
+	entries, err := fs.ReadDir("root")
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != "a.txt,b.txt,empty,link,sub" {
+		t.Errorf("Expected only the immediate children in order, got %v", names)
+	}
+	for _, entry := range entries {
+		if isDir := entry.Name() == "sub" || entry.Name() == "empty"; entry.IsDir() != isDir {
+			t.Errorf("Expected IsDir of %s to be %v", entry.Name(), isDir)
+		}
+	}
+	if info, err := entries[0].Info(); err != nil || info.Size() != 1 {
+		t.Errorf("Expected a.txt info with size 1, got %v (%v)", info, err)
+	}
+
+	if entries, err := fs.ReadDir("root/empty"); err != nil || len(entries) != 0 {
+		t.Errorf("Expected an empty directory, got %v (%v)", entries, err)
+	}
+	if _, err := fs.ReadDir("missing"); !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error, got %v", err)
+	}
+	if _, err := fs.ReadDir("root/a.txt"); err == nil {
+		t.Error("Expected an error reading a file as a directory")
+	}
+}
@@ -0,0 +1,203 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// DefaultContextLines is the number of unchanged lines shown around changes,
+// as in git and diff -u
+const DefaultContextLines = 3
+
+// patchLine is one line of a unified diff: kept (' '), removed ('-') or added ('+')
+type patchLine struct {
+	op   byte
+	text string
+}
+
+// UnifiedDiff returns the changes from oldContent to newContent as a unified
+// diff with context unchanged lines around each change, readable by git apply
+// and patch. Paths are written as a/path and b/path; an empty oldPath or
+// newPath marks a file that is created or deleted. Identical contents give "".
+func UnifiedDiff(oldPath, newPath, oldContent, newContent string, context int) string {
+	if oldContent == newContent && oldPath != "" && newPath != "" {
+		return ""
+	}
+	context = max(context, 0)
+
+	lines := diffPatchLines(oldContent, newContent)
+
+	var out strings.Builder
+	oldName, newName := writeGitHeader(&out, oldPath, newPath)
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	for _, hunk := range patchHunks(lines, context) {
+		writeHunk(&out, lines, hunk[0], hunk[1])
+	}
+	return out.String()
+}
+
+// BinaryDiff returns the patch noting that a binary file changed, without
+// its content
+func BinaryDiff(oldPath, newPath string) string {
+	var out strings.Builder
+	oldName, newName := writeGitHeader(&out, oldPath, newPath)
+	fmt.Fprintf(&out, "Binary files %s and %s differ\n", oldName, newName)
+	return out.String()
+}
+
+// CountLineChanges returns the number of lines added and removed by the
+// changes from oldContent to newContent, as counted by diff --stat
+func CountLineChanges(oldContent, newContent string) (insertions, deletions int) {
+	for _, diff := range diffLines(oldContent, newContent) {
+		switch diff.op {
+		case diffmatchpatch.DiffInsert:
+			insertions += len(diff.lines)
+		case diffmatchpatch.DiffDelete:
+			deletions += len(diff.lines)
+		}
+	}
+	return insertions, deletions
+}
+
+// writeGitHeader writes the diff --git line of a file's patch, followed by
+// the mode of a created or deleted file, and returns the names the file has
+// on either side: a/path and b/path, or /dev/null where it does not exist
+func writeGitHeader(out *strings.Builder, oldPath, newPath string) (oldName, newName string) {
+	path := newPath
+	if path == "" {
+		path = oldPath
+	}
+
+	oldName, newName = quotePatchName("a/"+path), quotePatchName("b/"+path)
+	fmt.Fprintf(out, "diff --git %s %s\n", oldName, newName)
+	switch {
+	case oldPath == "":
+		out.WriteString("new file mode 100644\n")
+		oldName = "/dev/null"
+	case newPath == "":
+		out.WriteString("deleted file mode 100644\n")
+		newName = "/dev/null"
+	}
+	return oldName, newName
+}
+
+// quotePatchName quotes a file name of a patch the way git does when it
+// contains a double quote, a backslash or a control character, which would
+// otherwise end or corrupt the name: in double quotes, with C escapes. Other
+// names, including those with spaces or non-ASCII characters, are written
+// as is, which git apply and patch read back unchanged.
+func quotePatchName(name string) string {
+	if !strings.ContainsFunc(name, func(r rune) bool { return r == '"' || r == '\\' || r < ' ' || r == 0x7f }) {
+		return name
+	}
+
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '"', '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case '\a':
+			quoted.WriteString(`\a`)
+		case '\b':
+			quoted.WriteString(`\b`)
+		case '\t':
+			quoted.WriteString(`\t`)
+		case '\n':
+			quoted.WriteString(`\n`)
+		case '\v':
+			quoted.WriteString(`\v`)
+		case '\f':
+			quoted.WriteString(`\f`)
+		case '\r':
+			quoted.WriteString(`\r`)
+		default:
+			if c < ' ' || c == 0x7f {
+				fmt.Fprintf(&quoted, "\\%03o", c)
+			} else {
+				quoted.WriteByte(c)
+			}
+		}
+	}
+	quoted.WriteByte('"')
+	return quoted.String()
+}
+
+// diffPatchLines returns every line of oldContent and newContent in order,
+// marked as kept, removed or added
+func diffPatchLines(oldContent, newContent string) []patchLine {
+	var lines []patchLine
+	for _, diff := range diffLines(oldContent, newContent) {
+		op := byte(' ')
+		switch diff.op {
+		case diffmatchpatch.DiffDelete:
+			op = '-'
+		case diffmatchpatch.DiffInsert:
+			op = '+'
+		}
+		for _, line := range diff.lines {
+			lines = append(lines, patchLine{op: op, text: line})
+		}
+	}
+	return lines
+}
+
+// patchHunks returns the [start, end) ranges of lines forming hunks: every
+// change with up to context lines around it, merging hunks that would touch
+func patchHunks(lines []patchLine, context int) [][2]int {
+	var hunks [][2]int
+	for i, line := range lines {
+		if line.op == ' ' {
+			continue
+		}
+		start, end := max(0, i-context), min(len(lines), i+context+1)
+		if n := len(hunks); n > 0 && start <= hunks[n-1][1] {
+			hunks[n-1][1] = end
+		} else {
+			hunks = append(hunks, [2]int{start, end})
+		}
+	}
+	return hunks
+}
+
+// writeHunk writes the lines [start, end) as a hunk with its @@ header
+func writeHunk(out *strings.Builder, lines []patchLine, start, end int) {
+	oldLine, newLine := 0, 0
+	for _, line := range lines[:start] {
+		if line.op != '+' {
+			oldLine++
+		}
+		if line.op != '-' {
+			newLine++
+		}
+	}
+	oldCount, newCount := 0, 0
+	for _, line := range lines[start:end] {
+		if line.op != '+' {
+			oldCount++
+		}
+		if line.op != '-' {
+			newCount++
+		}
+	}
+
+	// Ranges are 1-based, except that an empty range names the line before it
+	if oldCount > 0 {
+		oldLine++
+	}
+	if newCount > 0 {
+		newLine++
+	}
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", oldLine, oldCount, newLine, newCount)
+
+	for _, line := range lines[start:end] {
+		out.WriteByte(line.op)
+		out.WriteString(line.text)
+		if !strings.HasSuffix(line.text, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
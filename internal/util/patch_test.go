@@ -0,0 +1,143 @@
+package util
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// applyUnifiedDiff applies the hunks of a single-file unified diff to content
+func applyUnifiedDiff(t *testing.T, content, patch string) string {
+	t.Helper()
+
+	lines := SplitLines(content)
+	var out []string
+	pos := 0
+	patchLines := SplitLines(patch)
+	for i := 0; i < len(patchLines); i++ {
+		line := patchLines[i]
+		if !strings.HasPrefix(line, "@@ ") {
+			continue
+		}
+		var oldStart, oldCount, newStart, newCount int
+		if _, err := fmt.Sscanf(line, "@@ -%d,%d +%d,%d @@", &oldStart, &oldCount, &newStart, &newCount); err != nil {
+			t.Fatalf("Bad hunk header %q: %v", line, err)
+		}
+		if oldCount == 0 {
+			oldStart++
+		}
+		out = append(out, lines[pos:oldStart-1]...)
+		pos = oldStart - 1
+
+		for i+1 < len(patchLines) && !strings.HasPrefix(patchLines[i+1], "@@ ") {
+			i++
+			hunkLine := patchLines[i]
+			text := hunkLine[1:]
+			if i+1 < len(patchLines) && strings.HasPrefix(patchLines[i+1], "\\") {
+				text = strings.TrimSuffix(text, "\n")
+				i++
+			}
+			switch hunkLine[0] {
+			case ' ':
+				if lines[pos] != text {
+					t.Fatalf("Context %q does not match %q", text, lines[pos])
+				}
+				out = append(out, text)
+				pos++
+			case '-':
+				if lines[pos] != text {
+					t.Fatalf("Removed line %q does not match %q", text, lines[pos])
+				}
+				pos++
+			case '+':
+				out = append(out, text)
+			}
+		}
+	}
+	out = append(out, lines[pos:]...)
+	return strings.Join(out, "")
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	var base strings.Builder
+	for i := 1; i <= 30; i++ {
+		fmt.Fprintf(&base, "line %d\n", i)
+	}
+	changed := strings.Replace(base.String(), "line 2\n", "line two\n", 1)
+	changed = strings.Replace(changed, "line 15\n", "", 1)
+	changed = strings.Replace(changed, "line 28\n", "line 28\ninserted\n", 1)
+
+	tests := []struct {
+		name     string
+		old, new string
+	}{
+		{"changes far apart", base.String(), changed},
+		{"no trailing newline", "a\nb\nc", "a\nB\nc"},
+		{"newline added at end", "a\nb", "a\nb\n"},
+		{"everything replaced", "old\n", "new\n"},
+	}
+
+	for _, test := range tests {
+		for _, context := range []int{0, 1, DefaultContextLines} {
+			patch := UnifiedDiff("file.txt", "file.txt", test.old, test.new, context)
+			if !strings.HasPrefix(patch, "diff --git a/file.txt b/file.txt\n--- a/file.txt\n+++ b/file.txt\n@@ ") {
+				t.Errorf("%s: unexpected header in %q", test.name, patch)
+			}
+			if applied := applyUnifiedDiff(t, test.old, patch); applied != test.new {
+				t.Errorf("%s (context %d): applying the patch gave %q, expected %q\n%s", test.name, context, applied, test.new, patch)
+			}
+		}
+	}
+
+	// Changes more than twice the context apart get hunks of their own
+	if hunks := strings.Count(UnifiedDiff("file.txt", "file.txt", base.String(), changed, 3), "\n@@ "); hunks != 3 {
+		t.Errorf("Expected 3 hunks, got %d", hunks)
+	}
+
+	expected := "diff --git a/new.txt b/new.txt\nnew file mode 100644\n--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1,2 @@\n+one\n+two\n"
+	if patch := UnifiedDiff("", "new.txt", "", "one\ntwo\n", 3); patch != expected {
+		t.Errorf("Unexpected patch for a new file:\n%s", patch)
+	}
+	if patch := UnifiedDiff("gone.txt", "", "bye\n", "", 3); !strings.Contains(patch, "--- a/gone.txt\n+++ /dev/null\n@@ -1,1 +0,0 @@\n-bye\n") {
+		t.Errorf("Unexpected patch for a deleted file:\n%s", patch)
+	}
+	if patch := UnifiedDiff("same.txt", "same.txt", "same\n", "same\n", 3); patch != "" {
+		t.Errorf("Expected no patch for identical content, got %q", patch)
+	}
+
+	// Names git would misread are quoted like git quotes them; others are kept
+	names := map[string]string{
+		"my file (1).txt":  "a/my file (1).txt",
+		"naïve café ☕.txt": "a/naïve café ☕.txt",
+		"tab\tname.txt":    `"a/tab\tname.txt"`,
+		`say "hi".txt`:     `"a/say \"hi\".txt"`,
+		`back\slash.txt`:   `"a/back\\slash.txt"`,
+		"bell\a\x01.txt":   `"a/bell\a\001.txt"`,
+	}
+	for path, want := range names {
+		patch := UnifiedDiff(path, path, "a\n", "b\n", 3)
+		if !strings.HasPrefix(patch, "diff --git "+want+" ") || !strings.Contains(patch, "\n--- "+want+"\n") {
+			t.Errorf("Expected %q written as %s, got %q", path, want, patch)
+		}
+	}
+}
+
+func TestCountLineChanges(t *testing.T) {
+	tests := []struct {
+		old, new              string
+		insertions, deletions int
+	}{
+		{"a\nb\nc\n", "a\nb\nc\n", 0, 0},
+		{"a\nb\nc\n", "a\nB\nc\nd\n", 2, 1},
+		{"", "one\ntwo", 2, 0},
+		{"gone\n", "", 0, 1},
+		// Only the last line changes when a newline is added at the end
+		{"a\nb", "a\nb\n", 1, 1},
+	}
+	for _, test := range tests {
+		insertions, deletions := CountLineChanges(test.old, test.new)
+		if insertions != test.insertions || deletions != test.deletions {
+			t.Errorf("CountLineChanges(%q, %q) = %d, %d, want %d, %d", test.old, test.new, insertions, deletions, test.insertions, test.deletions)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package util
+
+import "os"
+
+// processAlive reports whether a process with the given id is running. Where
+// finding a process does not check that it exists, every process is assumed
+// to be running.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package util
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processAlive reports whether a process with the given id is running. A
+// process owned by another user is running even though it cannot be signalled.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
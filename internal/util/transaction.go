@@ -0,0 +1,184 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Transaction stages writes and removals of files so that they are applied
+// together by Commit, or not at all. Content is written to files in a staging
+// directory as it is staged, so large trees are never held in memory, and
+// moved into place by renames when the transaction commits.
+type Transaction struct {
+	fs      FileSystem
+	dir     string
+	changes []stagedChange
+}
+
+// stagedChange is a file to replace with the staged file, or to remove when
+// staged is empty
+type stagedChange struct {
+	path   string
+	staged string
+}
+
+// NewTransaction starts a transaction staging its files in dir, which is
+// created and must not be used for anything else. dir should be on the same
+// filesystem as the files changed so that moving them into place is a rename.
+func NewTransaction(fs FileSystem, dir string) (*Transaction, error) {
+	if err := fs.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to clear staging directory: %w", err)
+	}
+	if err := fs.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	return &Transaction{fs: fs, dir: dir}, nil
+}
+
+// stagingPath returns a new path in the staging directory
+func (t *Transaction) stagingPath() string {
+	return filepath.Join(t.dir, strconv.Itoa(len(t.changes)))
+}
+
+// Write stages content to be written to path with the given permission bits,
+// applied exactly regardless of umask. A zero mode writes the file as
+// WriteFile does.
+func (t *Transaction) Write(path string, content []byte, mode os.FileMode) error {
+	staged := t.stagingPath()
+	if err := t.fs.WriteFile(staged, content, 0644); err != nil {
+		return fmt.Errorf("failed to stage %s: %w", path, err)
+	}
+	if mode != 0 {
+		if err := t.fs.Chmod(staged, mode); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %w", path, err)
+		}
+	}
+	t.changes = append(t.changes, stagedChange{path: path, staged: staged})
+	return nil
+}
+
+// Symlink stages a symbolic link to target to be created at path
+func (t *Transaction) Symlink(target, path string) error {
+	staged := t.stagingPath()
+	if err := t.fs.Symlink(target, staged); err != nil {
+		return fmt.Errorf("failed to stage %s: %w", path, err)
+	}
+	t.changes = append(t.changes, stagedChange{path: path, staged: staged})
+	return nil
+}
+
+// Remove stages the removal of path. Paths that do not exist when the
+// transaction commits are skipped.
+func (t *Transaction) Remove(path string) {
+	t.changes = append(t.changes, stagedChange{path: path})
+}
+
+// Commit applies the staged changes in the order they were staged. Files
+// about to be replaced or removed are first moved aside, so that when any
+// change fails every change already made is undone and the original files are
+// put back before the error is returned. A directory where a file is written
+// is removed first if it holds nothing but empty directories, as it does once
+// the files inside it have been removed by earlier changes, and is recreated
+// on failure. Directories created for new files are left in place. The
+// staging directory is removed either way.
+func (t *Transaction) Commit() (err error) {
+	defer t.Abort()
+
+	// applied lists, in order, the changes made so far with where the file
+	// they replaced was moved to, if there was one, or the directories they
+	// replaced
+	type appliedChange struct {
+		stagedChange
+		backup string
+		dirs   []string
+	}
+	var applied []appliedChange
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(applied) - 1; i >= 0; i-- {
+			change := applied[i]
+			if change.staged != "" {
+				t.fs.Remove(change.path)
+			}
+			if change.backup != "" {
+				t.fs.Rename(change.backup, change.path)
+			}
+			for _, dir := range change.dirs {
+				t.fs.MkdirAll(dir, 0755)
+			}
+		}
+	}()
+
+	for i, change := range t.changes {
+		done := appliedChange{stagedChange: change}
+		if t.isDir(change.path) {
+			if done.dirs, err = t.removeEmptyDir(change.path); err != nil {
+				return err
+			}
+		} else if t.exists(change.path) {
+			done.backup = filepath.Join(t.dir, strconv.Itoa(i)+".orig")
+			if err := t.fs.Rename(change.path, done.backup); err != nil {
+				return fmt.Errorf("failed to move %s aside: %w", change.path, err)
+			}
+		}
+		applied = append(applied, done)
+		if change.staged == "" {
+			continue
+		}
+
+		if err := t.fs.MkdirAll(filepath.Dir(change.path), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", change.path, err)
+		}
+		if err := t.fs.Rename(change.staged, change.path); err != nil {
+			// The file was never put in place, so there is nothing to remove
+			applied[len(applied)-1].staged = ""
+			return fmt.Errorf("failed to write %s: %w", change.path, err)
+		}
+	}
+	return nil
+}
+
+// Abort discards the staged changes without applying them
+func (t *Transaction) Abort() error {
+	t.changes = nil
+	return t.fs.RemoveAll(t.dir)
+}
+
+// removeEmptyDir removes the directory at path and returns every directory
+// removed, provided that nothing but directories is found inside it
+func (t *Transaction) removeEmptyDir(path string) ([]string, error) {
+	var dirs []string
+	err := t.fs.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("cannot replace directory %s with a file: it contains %s", path, p)
+		}
+		dirs = append(dirs, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := t.fs.RemoveAll(path); err != nil {
+		return nil, fmt.Errorf("failed to remove directory %s: %w", path, err)
+	}
+	return dirs, nil
+}
+
+// isDir reports whether path is a directory, not following symbolic links
+func (t *Transaction) isDir(path string) bool {
+	info, err := t.fs.Lstat(path)
+	return err == nil && info.IsDir()
+}
+
+// exists reports whether path exists, including dangling symbolic links
+func (t *Transaction) exists(path string) bool {
+	_, err := t.fs.Lstat(path)
+	return err == nil
+}
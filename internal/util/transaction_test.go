@@ -0,0 +1,85 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestTransaction(t *testing.T) {
+	fs := NewMockFileSystem()
+	fs.AddFile("kept.txt", []byte("old"))
+	fs.AddFile("removed.txt", []byte("removed"))
+
+	tx, err := NewTransaction(fs, ".bit/staging")
+	if err != nil {
+		t.Fatalf("Failed to start transaction: %v", err)
+	}
+	if err := tx.Write("kept.txt", []byte("new"), 0600); err != nil {
+		t.Fatalf("Failed to stage write: %v", err)
+	}
+	if err := tx.Write("dir/added.txt", []byte("added"), 0); err != nil {
+		t.Fatalf("Failed to stage write: %v", err)
+	}
+	if err := tx.Symlink("kept.txt", "link"); err != nil {
+		t.Fatalf("Failed to stage symlink: %v", err)
+	}
+	tx.Remove("removed.txt")
+
+	// Nothing changes until the transaction commits
+	if content, _ := fs.ReadFile("kept.txt"); string(content) != "old" || fs.Exists("dir/added.txt") {
+		t.Fatal("Expected staged changes not to be applied before commit")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	if content, _ := fs.ReadFile("kept.txt"); string(content) != "new" {
+		t.Errorf("Expected kept.txt to be replaced, got %q", content)
+	}
+	if info, err := fs.Stat("kept.txt"); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected kept.txt to get mode 0600, got %v, %v", info, err)
+	}
+	if content, _ := fs.ReadFile("dir/added.txt"); string(content) != "added" {
+		t.Errorf("Expected dir/added.txt to be written, got %q", content)
+	}
+	if target, err := fs.Readlink("link"); err != nil || target != "kept.txt" {
+		t.Errorf("Expected link to point to kept.txt, got %q, %v", target, err)
+	}
+	if fs.Exists("removed.txt") || fs.Exists(".bit/staging") {
+		t.Error("Expected removed.txt and the staging directory to be gone")
+	}
+}
+
+func TestTransactionRollsBack(t *testing.T) {
+	fs := NewMockFileSystem()
+	fs.AddFile("a.txt", []byte("a"))
+	fs.AddFile("b.txt", []byte("b"))
+	fs.AddFile("dir/file.txt", []byte("inside"))
+
+	tx, err := NewTransaction(fs, ".bit/staging")
+	if err != nil {
+		t.Fatalf("Failed to start transaction: %v", err)
+	}
+	if err := tx.Write("a.txt", []byte("changed"), 0); err != nil {
+		t.Fatalf("Failed to stage write: %v", err)
+	}
+	tx.Remove("b.txt")
+	if err := tx.Write("new.txt", []byte("new"), 0); err != nil {
+		t.Fatalf("Failed to stage write: %v", err)
+	}
+	// The mock cannot move a directory aside, so the last change fails
+	if err := tx.Write("dir", []byte("not a directory"), 0); err != nil {
+		t.Fatalf("Failed to stage write: %v", err)
+	}
+
+	if err := tx.Commit(); err == nil {
+		t.Fatal("Expected the commit to fail")
+	}
+	for path, expected := range map[string]string{"a.txt": "a", "b.txt": "b", "dir/file.txt": "inside"} {
+		if content, err := fs.ReadFile(path); err != nil || string(content) != expected {
+			t.Errorf("Expected %s to be restored to %q, got %q, %v", path, expected, content, err)
+		}
+	}
+	if fs.Exists("new.txt") || fs.Exists(".bit/staging") {
+		t.Error("Expected new.txt and the staging directory to be removed")
+	}
+}